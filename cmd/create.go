@@ -19,6 +19,7 @@ import (
 	"os"
 
 	"github.com/PextraCloud/pxitool/internal/createpxi"
+	"github.com/PextraCloud/pxitool/internal/rootfs"
 	"github.com/PextraCloud/pxitool/internal/utils"
 	"github.com/PextraCloud/pxitool/pkg/log"
 	"github.com/PextraCloud/pxitool/pkg/pxi/constants/compressiontype"
@@ -33,6 +34,17 @@ var forceOverwrite bool
 var encryptionTypeString string
 var excluded []string
 var rootfsPath string
+var parentSnapshots map[string]string
+var keepSnapshots bool
+var rootfsBtrfs bool
+var tmpDir string
+var streamImages bool
+var keepChains bool
+var volumeFormats map[string]string
+var qmpSocket string
+var guestAgentSocket string
+var createIDMap []string
+var createParallel bool
 
 func init() {
 	rootCmd.AddCommand(createCmd)
@@ -41,7 +53,7 @@ func init() {
 	createCmd.MarkFlagRequired("config")
 	createCmd.MarkFlagFilename("config", "json")
 
-	createCmd.Flags().StringVarP(&outputFileName, "output", "o", "", "Output file name for the Pextra Image (.pxi). Defaults to <name>.pxi from the config file")
+	createCmd.Flags().StringVarP(&outputFileName, "output", "o", "", "Output file name for the Pextra Image (.pxi), or '-' to write it to stdout, such as for piping it over ssh. Defaults to <name>.pxi from the config file. Volumes written to stdout are first captured to --tmpdir one at a time, as their length is stored before their data.")
 	createCmd.MarkFlagFilename("output", "pxi")
 
 	createCmd.Flags().BoolVarP(&forceOverwrite, "force", "f", false, "Force overwrite of existing .pxi files without prompt")
@@ -52,6 +64,23 @@ func init() {
 
 	createCmd.Flags().StringVarP(&rootfsPath, "rootfs", "r", "", "Path to the root filesystem for LXC instances (required). This option is ignored for other instance types.")
 	createCmd.MarkFlagDirname("rootfs")
+	createCmd.Flags().StringArrayVar(&createIDMap, "idmap", nil, "An LXC-style ID mapping of an unprivileged container, such as 'u 0 100000 65536'. Can be specified multiple times, and needs both user and group mappings. The rootfs is stored with container IDs, so it can be restored with any ID map.")
+	createCmd.Flags().BoolVar(&rootfsBtrfs, "rootfs-btrfs", false, "Capture the LXC root filesystem with 'btrfs send' instead of tar. The rootfs path must be a btrfs subvolume.")
+
+	createCmd.Flags().StringToStringVar(&parentSnapshots, "parent-snapshot", nil, "A map of volume IDs to an existing snapshot to back up incrementally from. Format: 'vol-xxx=snap1,vol-yyy=snap2,...'. Only supported for RBD and btrfs volumes. Use 'rootfs' for a btrfs LXC rootfs.")
+	createCmd.Flags().StringVar(&tmpDir, "tmpdir", "", "Directory for temporary files, such as converted disk images, and volumes that are captured before being written to an encrypted image or to stdout. Must have enough free space for the largest of these volumes. Defaults to the system temporary directory.")
+	createCmd.MarkFlagDirname("tmpdir")
+	createCmd.Flags().BoolVar(&streamImages, "stream", false, "Stream disk image volumes through qemu-nbd as sparse raw data, instead of converting them to qcow2 in the temporary directory. Needs no scratch space.")
+
+	createCmd.Flags().StringToStringVar(&volumeFormats, "format", nil, "A map of disk image volume IDs to the format they are stored in. Format: 'vol-xxx=vmdk,vol-yyy=vhdx,...'. Supported: raw, qcow2 (default), vmdk, vhd, vhdx.")
+	createCmd.Flags().BoolVar(&keepChains, "keep-chains", false, "Store qcow2 volumes as is, keeping their backing chain, internal snapshots and compression. Each backing image is stored as a separate volume. The instance should be stopped while its images are copied.")
+
+	createCmd.Flags().StringVar(&qmpSocket, "qmp-socket", "", "QMP socket of the running VM. Disk images are then backed up live: writes go to a temporary external snapshot during the backup, which is committed back afterwards.")
+	createCmd.Flags().StringVar(&guestAgentSocket, "guest-agent-socket", "", "QEMU guest agent socket of the running VM. Guest filesystems are frozen while the live snapshot is taken, for application-consistent backups. Requires --qmp-socket.")
+
+	createCmd.Flags().BoolVar(&createParallel, "parallel", false, "Capture all volumes at once instead of one after another. Each volume is spooled in the temporary directory, which must have enough free space for all of them, before it is written to the image.")
+
+	createCmd.Flags().BoolVar(&keepSnapshots, "keep-snapshots", false, "Keep the snapshots taken for the backup, so they can be used with --parent-snapshot by a later incremental backup.")
 }
 
 var createCmd = &cobra.Command{
@@ -76,12 +105,21 @@ data.`,
 			os.Exit(1)
 		}
 
-		file, err := utils.GetOutputFileHandle(outputFileName, forceOverwrite)
-		if err != nil {
-			log.Error("Error opening output file: %v\n", err)
+		if guestAgentSocket != "" && qmpSocket == "" {
+			log.Error("--guest-agent-socket requires --qmp-socket.\n")
 			os.Exit(1)
 		}
-		defer file.Close()
+
+		output := os.Stdout
+		if outputFileName != "-" {
+			file, err := utils.GetOutputFileHandle(outputFileName, forceOverwrite)
+			if err != nil {
+				log.Error("Error opening output file: %v\n", err)
+				os.Exit(1)
+			}
+			defer file.Close()
+			output = file
+		}
 
 		var encryptionType encryptiontype.EncryptionType
 		switch encryptionTypeString {
@@ -94,9 +132,36 @@ data.`,
 			os.Exit(1)
 		}
 
-		err = createpxi.Create(file, json, rootfsPath, compressiontype.None, encryptionType, excluded)
+		formats, err := parseVolumeFormats(volumeFormats)
+		if err != nil {
+			log.Error("%v\n", err)
+			os.Exit(1)
+		}
+
+		idMap, err := rootfs.ParseIDMap(createIDMap)
+		if err != nil {
+			log.Error("%v\n", err)
+			os.Exit(1)
+		}
+
+		options := createpxi.Options{
+			ParentSnapshots:  parentSnapshots,
+			KeepSnapshots:    keepSnapshots,
+			RootfsBtrfs:      rootfsBtrfs,
+			TmpDir:           tmpDir,
+			StreamImages:     streamImages,
+			Formats:          formats,
+			KeepChains:       keepChains,
+			QMPSocket:        qmpSocket,
+			GuestAgentSocket: guestAgentSocket,
+			IDMap:            idMap,
+			Parallel:         createParallel,
+		}
+		err = createpxi.Create(output, json, rootfsPath, compressiontype.None, encryptionType, excluded, options)
 		if err != nil {
-			os.Remove(outputFileName)
+			if outputFileName != "-" {
+				os.Remove(outputFileName)
+			}
 			log.Error("Error creating Pextra Image: %v\n", err)
 			os.Exit(1)
 		}
@@ -0,0 +1,72 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"os"
+	"strings"
+
+	"github.com/PextraCloud/pxitool/internal/extractpxi"
+	"github.com/PextraCloud/pxitool/pkg/log"
+	"github.com/spf13/cobra"
+)
+
+var extractOutputDir string
+var extractToStdout bool
+
+func init() {
+	rootCmd.AddCommand(extractCmd)
+
+	extractCmd.Flags().StringVarP(&extractOutputDir, "output", "o", "", "Directory to extract the matching files to. It is created if needed, and existing files are replaced.")
+	extractCmd.MarkFlagDirname("output")
+	extractCmd.Flags().BoolVar(&extractToStdout, "stdout", false, "Write the contents of a single regular file to stdout. Takes one path, without glob patterns.")
+	extractCmd.MarkFlagsMutuallyExclusive("output", "stdout")
+	extractCmd.MarkFlagsOneRequired("output", "stdout")
+}
+
+var extractCmd = &cobra.Command{
+	Use:   "extract [file] [pattern...]",
+	Args:  cobra.MinimumNArgs(2),
+	Short: "Extract files from the rootfs of an LXC Pextra Image",
+	Long: `Extract the files matching glob patterns, such as
+'etc/hostname' or 'etc/nginx/*.conf', from the rootfs
+of an LXC Pextra Image. Directories that match are
+extracted with their contents. Only the rootfs is
+read; other volumes are skipped.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		inputFileName := args[0]
+		patterns := args[1:]
+
+		if extractToStdout {
+			if len(patterns) != 1 || strings.ContainsAny(patterns[0], `*?[\`) {
+				log.Error("--stdout takes exactly one path, without glob patterns.")
+				os.Exit(1)
+			}
+			if err := extractpxi.WriteFile(inputFileName, patterns[0], os.Stdout); err != nil {
+				log.Error("Error extracting file: %v", err)
+				os.Exit(1)
+			}
+			return
+		}
+
+		count, err := extractpxi.Extract(inputFileName, patterns, extractOutputDir)
+		if err != nil {
+			log.Error("Error extracting files: %v", err)
+			os.Exit(1)
+		}
+		log.Info("Extracted %d entries to %s", count, extractOutputDir)
+	},
+}
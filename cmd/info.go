@@ -42,7 +42,8 @@ var infoCmd = &cobra.Command{
 	Long: `This command displays information about a
 Pextra Image (.pxi) file. It checks the file structure,
 verifies the integrity of the chunks, and outputs
-information about the image`,
+information about the image. The file can be '-'
+to read the image from stdin.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		inputFileName := args[0]
 		result, err := readpxi.GetInfo(inputFileName, skipEncryptedChunks)
@@ -62,6 +63,9 @@ information about the image`,
 			log.Info("PXI File: %s", result.Path)
 			log.Info("Version=%s, InstanceType=%s, Compression=%s, Encryption=%s", result.PXIVersion, result.InstanceType, result.CompressionType, result.EncryptionType)
 			log.Info("%d volumes in config, of which %d are present in the PXI file", len(result.Config.Volumes), len(result.Volumes))
+			if result.Config != nil && result.Config.SnapshotTime != "" {
+				log.Info("Volumes captured from snapshots taken together at %s", result.Config.SnapshotTime)
+			}
 			if result.Config != nil {
 				log.Info("Config: can be viewed by passing the '--json' flag")
 			} else {
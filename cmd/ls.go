@@ -0,0 +1,71 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"os"
+
+	"github.com/PextraCloud/pxitool/internal/lspxi"
+	"github.com/PextraCloud/pxitool/pkg/log"
+	"github.com/spf13/cobra"
+)
+
+var lsPartition int
+var lsRecursive bool
+
+func init() {
+	rootCmd.AddCommand(lsCmd)
+
+	lsCmd.Flags().IntVarP(&lsPartition, "partition", "p", 0, "Partition of a disk volume to list, numbered from 1. Without it, the partition table is listed, or the filesystem of an unpartitioned disk.")
+	lsCmd.Flags().BoolVarP(&lsRecursive, "recursive", "R", false, "List the contents of subdirectories")
+}
+
+var lsCmd = &cobra.Command{
+	Use:   "ls [file] [volume] [path]",
+	Args:  cobra.RangeArgs(1, 3),
+	Short: "List the volumes of a Pextra Image, or the files inside one",
+	Long: `Without a volume, list the volumes stored in a
+Pextra Image. With a volume, list the files at path
+(the root by default) inside it: the entries of an LXC
+rootfs archive, or the files of an ext2/3/4 filesystem
+on a raw or qcow2 disk volume. Nothing is restored or
+mounted, and only the parts of the image that are
+needed are read.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		inputFileName := args[0]
+		if len(args) == 1 {
+			if err := lspxi.ListVolumes(inputFileName, os.Stdout); err != nil {
+				log.Error("Error listing volumes: %v", err)
+				os.Exit(1)
+			}
+			return
+		}
+
+		name := "."
+		if len(args) == 3 {
+			name = args[2]
+		}
+		if lsPartition < 0 {
+			log.Error("--partition must be a partition number, starting at 1.")
+			os.Exit(1)
+		}
+		opts := lspxi.Options{Partition: lsPartition, Recursive: lsRecursive}
+		if err := lspxi.List(inputFileName, args[1], name, opts, os.Stdout); err != nil {
+			log.Error("Error listing files: %v", err)
+			os.Exit(1)
+		}
+	},
+}
@@ -16,39 +16,97 @@ limitations under the License.
 package cmd
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/PextraCloud/pxitool/internal/readpxi"
 	"github.com/PextraCloud/pxitool/internal/restorepxi"
+	"github.com/PextraCloud/pxitool/internal/rootfs"
 	"github.com/PextraCloud/pxitool/pkg/log"
 	"github.com/spf13/cobra"
 )
 
 var restorePaths map[string]string
 var restoreOutputFile string
+var restoreFormats map[string]string
+var restoreTmpDir string
+var restoreIDMap []string
+var restorePoolsFile string
+var restorePoolMap map[string]string
+var restoreDryRun bool
+var restorePlanJSON bool
+var restoreJobs int
+var restoreResume bool
+var restoreVolume string
+var restoreKeepReceived bool
 
 func init() {
 	rootCmd.AddCommand(restoreCmd)
 
-	restoreCmd.Flags().StringToStringVarP(&restorePaths, "paths", "p", nil, "A map of volume IDs to restore paths. Format: 'vol-xxx=path1,vol-yyy=path2,...'. Use 'rootfs' for the LXC rootfs volume ID.")
-	restoreCmd.MarkFlagRequired("paths")
+	restoreCmd.Flags().StringToStringVarP(&restorePaths, "paths", "p", nil, "A map of volume IDs to restore paths. Format: 'vol-xxx=path1,vol-yyy=path2,...'. Use 'rootfs' for the LXC rootfs volume ID. RBD volumes given a path of the form 'rbd:[pool/]image' are imported into that RBD image, and any other path is restored as a file.")
 
-	restoreCmd.Flags().StringVarP(&restoreOutputFile, "config-output", "o", "", "Path to the output file where the configuration will be saved after restoration. This file will contain the restored configuration of the PXI file.")
+	restoreCmd.Flags().StringVar(&restorePoolsFile, "pools", "", "Path to a JSON file describing the local storage pools, such as '{\"local\": {\"backend\": \"directory\", \"path\": \"/var/lib/pools/local\"}}'. Every volume without a restore path in --paths is restored to its storage pool, under the name of its original path, and the config output records the new pools and paths. RBD pools take an RBD pool name as their path. Volumes restored to lvm, iscsi and block pools must already exist as block devices.")
+	restoreCmd.MarkFlagFilename("pools", "json")
+	restoreCmd.Flags().StringToStringVar(&restorePoolMap, "pool-map", nil, "A map of the storage pool IDs in the image to local pool IDs in --pools. Format: 'old-pool=new-pool,...'. Pools that are not mapped are restored to the local pool with the same ID.")
+	restoreCmd.Flags().StringVar(&restoreVolume, "volume", "", "Write only the data of this volume to the --config-output path instead, or to stdout if it is '-', for piping it into another tool. Disk images are written as raw disk data, with vmdk, vhd and vhdx images converted in --tmpdir first; qcow2 images with a backing file are refused. The rootfs and other volumes are written as stored, such as a tar archive. Use 'rootfs' for the LXC rootfs volume ID.")
+	restoreCmd.MarkFlagsOneRequired("paths", "pools", "volume")
+
+	restoreCmd.Flags().StringToStringVar(&restoreFormats, "format", nil, "A map of volume IDs to the disk image format they are restored in. Format: 'vol-xxx=raw,vol-yyy=vmdk,...'. Supported: raw, qcow2, vmdk, vhd, vhdx. Defaults to the stored format. Block devices only take raw images, which are converted onto the device after checking its capacity.")
+
+	restoreCmd.Flags().StringVar(&restoreTmpDir, "tmpdir", "", "Directory for staging volumes that are converted to another format or written as raw with --volume, and for a copy of an image read from stdin. Defaults to the system temporary directory.")
+	restoreCmd.MarkFlagDirname("tmpdir")
+
+	restoreCmd.Flags().StringArrayVar(&restoreIDMap, "idmap", nil, "An LXC-style ID mapping of the unprivileged container the rootfs is restored for, such as 'u 0 100000 65536'. Can be specified multiple times, and needs both user and group mappings. Owners, POSIX ACLs and file capabilities are shifted to the host IDs.")
+
+	restoreCmd.Flags().IntVar(&restoreJobs, "jobs", 4, "Number of volumes to restore at once. Each volume is read from the PXI file independently, and the first volume to fail stops the others.")
+
+	restoreCmd.Flags().BoolVar(&restoreResume, "resume", false, "Make the restore resumable, or resume an interrupted one with the same arguments. Raw and sparse volumes restored to files or block devices are written block by block, with their progress recorded in a journal next to the config output; the data they already have is checked against the journal, and writing continues after it. Other volumes are restored again. Without it, an interrupted restore is rolled back.")
+
+	restoreCmd.Flags().BoolVar(&restoreKeepReceived, "keep-received", false, "Keep the read-only snapshot that each btrfs volume is received as, next to its restored subvolume. It is kept anyway for volumes captured from a snapshot that was kept for incremental backups, as the parent that later incremental images of the volume are received onto.")
+
+	restoreCmd.Flags().BoolVar(&restoreDryRun, "dry-run", false, "Resolve and check every restore path, and print a plan of what would be written or overwritten, without writing anything. Exits with an error if the restore would fail.")
+	restoreCmd.Flags().BoolVarP(&restorePlanJSON, "json", "j", false, "Print the --dry-run plan in JSON format")
+
+	restoreCmd.Flags().StringVarP(&restoreOutputFile, "config-output", "o", "", "Path to the output file where the configuration will be saved after restoration. This file will contain the restored configuration of the PXI file. With --volume, the path the volume data is written to, '-' for stdout.")
 	restoreCmd.MarkFlagRequired("config-output")
 	restoreCmd.MarkFlagFilename("config-output", "json")
+
+	for _, flag := range []string{"paths", "pools", "format", "idmap", "dry-run", "resume", "keep-received"} {
+		restoreCmd.MarkFlagsMutuallyExclusive("volume", flag)
+	}
 }
 
 var restoreCmd = &cobra.Command{
 	Use:   "restore [file]",
 	Args:  cobra.ExactArgs(1),
 	Short: "Restore a Pextra Image",
-	Long:  `Restore a Pextra Image (PXI) file to specified paths for each volume, and save the configuration to an output file.`,
+	Long: `Restore a Pextra Image (PXI) file to specified paths for each volume, and save the configuration to an output file.
+With --pools, every volume is restored to the local storage pool its recorded pool maps to.
+With --volume, a single volume is written to a file or to stdout, such as:
+  pxitool restore vm.pxi --volume vol-1 -o - | ssh host dd of=/dev/sdb bs=4M
+The file can be '-' to read the image from stdin. A single volume is
+streamed from it; otherwise, the image is first copied to --tmpdir. The key
+of an encrypted image on stdin must be given in PXI_ENCRYPTION_KEY.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if restoreOutputFile == "" {
 			log.Error("Config output file must be specified using --config-output flag.")
 			os.Exit(1)
 		}
 
+		if restoreVolume != "" {
+			if err := writeSingleVolume(args[0]); err != nil {
+				log.Error("Error writing volume '%s': %v", restoreVolume, err)
+				os.Exit(1)
+			}
+			return
+		}
+
 		// Validate restorePaths
 		for volumeId, restorePath := range restorePaths {
 			if restorePath == "" {
@@ -61,18 +119,127 @@ var restoreCmd = &cobra.Command{
 			}
 		}
 
+		var pools *restorepxi.PoolMap
+		if restorePoolsFile != "" {
+			localPools, err := restorepxi.LoadPools(restorePoolsFile)
+			if err != nil {
+				log.Error("%v", err)
+				os.Exit(1)
+			}
+			pools = &restorepxi.PoolMap{Pools: localPools, Mapping: restorePoolMap}
+		} else if len(restorePoolMap) > 0 {
+			log.Error("--pool-map needs the local pools to be described with --pools.")
+			os.Exit(1)
+		}
+
+		formats, err := parseVolumeFormats(restoreFormats)
+		if err != nil {
+			log.Error("%v", err)
+			os.Exit(1)
+		}
+
+		idMap, err := rootfs.ParseIDMap(restoreIDMap)
+		if err != nil {
+			log.Error("%v", err)
+			os.Exit(1)
+		}
+
+		if restoreJobs < 1 {
+			log.Error("--jobs must be at least 1.")
+			os.Exit(1)
+		}
+
+		// Volumes are read from the file as they are restored, rather than
+		// loaded into memory
 		inputFileName := args[0]
-		result, err := readpxi.ReadChunks(inputFileName)
+		result, volumes, err := readpxi.IndexChunks(inputFileName, restoreTmpDir)
 		if err != nil {
 			log.Error("Error reading PXI file: %v", err)
 			os.Exit(1)
 		}
+		defer volumes.Close()
+
+		opts := restorepxi.Options{Formats: formats, TmpDir: restoreTmpDir, IDMap: idMap, Pools: pools, Jobs: restoreJobs, Resume: restoreResume, KeepReceived: restoreKeepReceived, Disks: volumes}
+		if restoreDryRun {
+			planRestore(result, opts)
+			return
+		}
+
+		// Staged volumes are cleaned up when interrupted
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
 
 		log.Info("Restoring PXI file: %s", inputFileName)
-		if err := restorepxi.Restore(result, restorePaths, restoreOutputFile); err != nil {
+		if err := restorepxi.Restore(ctx, result, restorePaths, restoreOutputFile, opts); err != nil {
 			log.Error("Error restoring PXI file: %v", err)
 			os.Exit(1)
 		}
 		log.Info("PXI file restored successfully to specified paths.")
 	},
 }
+
+// Prints what restoring would do, exiting with an error if it would fail.
+func planRestore(chunks *readpxi.PXIChunks, opts restorepxi.Options) {
+	plan, err := restorepxi.PlanRestore(chunks, restorePaths, restoreOutputFile, opts)
+	if err != nil {
+		log.Error("Error planning restore: %v", err)
+		os.Exit(1)
+	}
+
+	if restorePlanJSON {
+		jsonData, err := json.MarshalIndent(plan, "", "    ")
+		if err != nil {
+			log.Error("Error serializing restore plan to JSON: %v", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(jsonData))
+	} else if err := plan.Write(os.Stdout); err != nil {
+		log.Error("Error writing restore plan: %v", err)
+		os.Exit(1)
+	}
+
+	if plan.ProblemsFound {
+		log.Error("Restore would fail, nothing was written.")
+		os.Exit(1)
+	}
+	log.Info("Dry run finished, nothing was written.")
+}
+
+// Writes the data of a single volume to the config output path, or to
+// stdout. Logging goes to stderr, so stdout only carries the volume. An
+// output file is removed if the volume could not be written in full.
+func writeSingleVolume(inputFileName string) (err error) {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var w io.Writer = os.Stdout
+	if restoreOutputFile != "-" {
+		file, openErr := os.OpenFile(restoreOutputFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+		if openErr != nil {
+			return fmt.Errorf("failed to open output file: %w", openErr)
+		}
+		defer func() {
+			if closeErr := file.Close(); err == nil && closeErr != nil {
+				err = fmt.Errorf("failed to close output file: %w", closeErr)
+			}
+			if err != nil {
+				if removeErr := os.Remove(restoreOutputFile); removeErr != nil {
+					log.Warn("Failed to remove partial output file '%s': %v", restoreOutputFile, removeErr)
+				}
+			}
+		}()
+		w = file
+	}
+
+	// Large writes, as pipes to tools such as dd and ssh are read in blocks
+	bw := bufio.NewWriterSize(w, 1024*1024)
+	written, err := restorepxi.WriteVolume(ctx, inputFileName, restoreVolume, restoreTmpDir, bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		return err
+	}
+	log.Info("Wrote %d bytes of volume '%s'", written, restoreVolume)
+	return nil
+}
@@ -0,0 +1,45 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteSingleVolume_RemovesPartialFile(t *testing.T) {
+	dir := t.TempDir()
+	inputFileName := filepath.Join(dir, "input.pxi")
+	if err := os.WriteFile(inputFileName, []byte("not a PXI file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := [...]string{restoreOutputFile, restoreVolume, restoreTmpDir}
+	t.Cleanup(func() {
+		restoreOutputFile, restoreVolume, restoreTmpDir = previous[0], previous[1], previous[2]
+	})
+	restoreOutputFile = filepath.Join(dir, "vol-1.img")
+	restoreVolume = "vol-1"
+	restoreTmpDir = dir
+
+	if err := writeSingleVolume(inputFileName); err == nil {
+		t.Fatal("Expected an error for an invalid PXI file, got nil")
+	}
+	if _, err := os.Stat(restoreOutputFile); !os.IsNotExist(err) {
+		t.Errorf("Expected the partial output file to be removed, got %v", err)
+	}
+}
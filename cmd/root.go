@@ -16,9 +16,11 @@ limitations under the License.
 package cmd
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/PextraCloud/pxitool/pkg/log"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumeformat"
 	"github.com/spf13/cobra"
 )
 
@@ -49,3 +51,16 @@ func Execute() {
 		os.Exit(1)
 	}
 }
+
+// Parses a map of volume IDs to volume format names.
+func parseVolumeFormats(formats map[string]string) (map[string]volumeformat.VolumeFormat, error) {
+	parsed := make(map[string]volumeformat.VolumeFormat, len(formats))
+	for volumeID, name := range formats {
+		var format volumeformat.VolumeFormat
+		if err := format.UnmarshalText([]byte(name)); err != nil {
+			return nil, fmt.Errorf("invalid format for volume '%s': %w", volumeID, err)
+		}
+		parsed[volumeID] = format
+	}
+	return parsed, nil
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/PextraCloud/pxitool/internal/servepxi"
+	"github.com/PextraCloud/pxitool/pkg/log"
+	"github.com/spf13/cobra"
+)
+
+var serveNBDVolume string
+var serveNBDSocket string
+
+func init() {
+	rootCmd.AddCommand(serveNBDCmd)
+
+	serveNBDCmd.Flags().StringVar(&serveNBDVolume, "volume", "", "ID of the volume to serve")
+	serveNBDCmd.MarkFlagRequired("volume")
+	serveNBDCmd.Flags().StringVar(&serveNBDSocket, "socket", "", "Path of the unix socket to listen on")
+	serveNBDCmd.MarkFlagRequired("socket")
+}
+
+var serveNBDCmd = &cobra.Command{
+	Use:   "serve-nbd [file]",
+	Args:  cobra.ExactArgs(1),
+	Short: "Serve a volume of a Pextra Image read-only over NBD",
+	Long: `Serve the disk of a raw, sparse or qcow2 volume
+read-only over the NBD protocol on a unix socket,
+until interrupted. The volume is read from the image
+as it is requested, so qemu or nbd-client can attach
+it immediately. qcow2 volumes with a backing file are
+refused, as the backing file is not read. For example:
+
+  qemu-img convert nbd+unix:///vol-1?socket=/tmp/nbd.sock out.img
+  nbd-client -unix /tmp/nbd.sock -N vol-1 /dev/nbd0`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+
+		if err := servepxi.ServeNBD(ctx, args[0], serveNBDVolume, serveNBDSocket); err != nil {
+			log.Error("Error serving volume: %v", err)
+			os.Exit(1)
+		}
+	},
+}
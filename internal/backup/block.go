@@ -0,0 +1,65 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package backup
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/PextraCloud/pxitool/internal/sparse"
+	"github.com/PextraCloud/pxitool/internal/utils"
+	"github.com/PextraCloud/pxitool/pkg/log"
+)
+
+const (
+	blockDeviceReadSize = 4 * 1024 * 1024 // Multiple of any logical block size
+)
+
+// Backs up a block device (or a disk image file) as a sparse stream, so
+// zeroed regions do not take up space in the image.
+func BackupBlockDevice(devicePath string, writeStream io.Writer) error {
+	device, err := os.Open(devicePath)
+	if err != nil {
+		return fmt.Errorf("failed to open block device: %w", err)
+	}
+	defer device.Close()
+
+	size, err := utils.GetFileOrDeviceSize(device)
+	if err != nil {
+		return fmt.Errorf("failed to get size of block device: %w", err)
+	}
+	log.Debug("Backing up %s (%d bytes)", devicePath, size)
+
+	sparseWriter, err := sparse.NewWriter(writeStream, size)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, blockDeviceReadSize)
+	var offset int64
+	for offset < size {
+		n, err := io.ReadFull(device, buf[:min(int64(len(buf)), size-offset)])
+		if err != nil {
+			return fmt.Errorf("failed to read block device at offset %d: %w", offset, err)
+		}
+		if _, err := sparseWriter.Write(buf[:n]); err != nil {
+			return err
+		}
+		offset += int64(n)
+	}
+	return sparseWriter.Close()
+}
@@ -0,0 +1,128 @@
+//go:build integration && linux
+
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package backup
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/PextraCloud/pxitool/internal/sparse"
+)
+
+// sparseTarget is a sparse.Target backed by a byte slice.
+type sparseTarget []byte
+
+func (s sparseTarget) WriteAt(p []byte, off int64) (int, error) {
+	return copy(s[off:], p), nil
+}
+
+func (s sparseTarget) Zero(offset, length int64) error {
+	clear(s[offset : offset+length])
+	return nil
+}
+
+// verifySparseBackup decodes a sparse stream and compares it to the expected data.
+func verifySparseBackup(t *testing.T, buf *bytes.Buffer, expected []byte) {
+	t.Helper()
+	reader, err := sparse.NewReader(buf)
+	if err != nil {
+		t.Fatalf("Failed to read sparse stream: %v", err)
+	}
+	if reader.Size() != int64(len(expected)) {
+		t.Fatalf("Expected volume size %d, got %d", len(expected), reader.Size())
+	}
+	restored := make(sparseTarget, reader.Size())
+	if _, err := sparse.Copy(restored, reader); err != nil {
+		t.Fatalf("Failed to decode sparse stream: %v", err)
+	}
+	if !bytes.Equal(restored, expected) {
+		t.Error("Backup data does not match original data")
+	}
+}
+
+func TestBackupBlockDevice(t *testing.T) {
+	// BEGIN setup mostly empty disk image
+	testData := make([]byte, 32*1024*1024)
+	copy(testData, "pxitool block test data")
+	copy(testData[20*1024*1024+3:], "more block test data")
+
+	imageFile, err := os.CreateTemp("", "pxitool-test-block-")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	defer os.Remove(imageFile.Name())
+	if _, err := imageFile.Write(testData); err != nil {
+		t.Fatalf("Failed to write test data: %v", err)
+	}
+	imageFile.Close()
+	// END setup mostly empty disk image
+
+	// BEGIN test backup of a regular file
+	var buf bytes.Buffer
+	if err := BackupBlockDevice(imageFile.Name(), &buf); err != nil {
+		t.Fatalf("BackupBlockDevice failed: %v", err)
+	}
+	if buf.Len() > 1024*1024 {
+		t.Errorf("Expected zeroed regions to be skipped, but backup is %d bytes", buf.Len())
+	}
+	verifySparseBackup(t, &buf, testData)
+	// END test backup of a regular file
+
+	// BEGIN test backup of a loop device
+	if os.Getuid() != 0 || !commandExists("losetup") {
+		t.Skip("Skipping loop device backup: must be run as root with losetup")
+	}
+	output, err := exec.Command("losetup", "-f", "--show", imageFile.Name()).Output()
+	if err != nil {
+		t.Fatalf("Failed to set up loop device: %v", err)
+	}
+	loopDevice := strings.TrimSpace(string(output))
+	t.Cleanup(func() {
+		exec.Command("losetup", "-d", loopDevice).Run()
+	})
+
+	buf.Reset()
+	if err := BackupBlockDevice(loopDevice, &buf); err != nil {
+		t.Fatalf("BackupBlockDevice failed for %s: %v", loopDevice, err)
+	}
+	verifySparseBackup(t, &buf, testData)
+	// END test backup of a loop device
+}
+
+func TestBackupBlockDevice_FailureCases(t *testing.T) {
+	var buf bytes.Buffer
+
+	t.Run("non-existent device", func(t *testing.T) {
+		err := BackupBlockDevice("/dev/nonexistent_pxitool_device", &buf)
+		if err == nil {
+			t.Error("Expected an error for a non-existent device, but got nil")
+		}
+		if err != nil && !strings.Contains(err.Error(), "failed to open block device") {
+			t.Errorf("Expected error to be about opening the device, but got: %v", err)
+		}
+	})
+	t.Run("character device", func(t *testing.T) {
+		err := BackupBlockDevice("/dev/null", &buf)
+		if err == nil {
+			t.Error("Expected an error for a character device, but got nil")
+		}
+	})
+}
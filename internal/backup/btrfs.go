@@ -0,0 +1,80 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package backup
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/PextraCloud/pxitool/pkg/log"
+)
+
+// Snapshots are created next to the subvolume, as <subvolume>@<snapshot>.
+func btrfsSnapshotPath(volumePath, snapshot string) string {
+	volumePath = filepath.Clean(volumePath)
+	return filepath.Join(filepath.Dir(volumePath), fmt.Sprintf("%s@%s", filepath.Base(volumePath), snapshot))
+}
+
+// Creates a read-only snapshot, as required by btrfs send.
+func createBtrfsSnapshot(volumePath, snapshotPath string) error {
+	createCmd := exec.Command("btrfs", "subvolume", "snapshot", "-r", volumePath, snapshotPath)
+	if err := createCmd.Run(); err != nil {
+		return fmt.Errorf("failed to create btrfs snapshot of %s: %w", volumePath, err)
+	}
+	return nil
+}
+
+func deleteBtrfsSnapshot(snapshotPath string) {
+	deleteCmd := exec.Command("btrfs", "subvolume", "delete", snapshotPath)
+	if err := deleteCmd.Run(); err != nil {
+		log.Warn("Failed to delete btrfs snapshot %s: %v", snapshotPath, err)
+	}
+}
+
+// Backs up a full copy of a btrfs subvolume.
+func BackupBtrfsVolume(volumePath string, writeStream io.Writer) error {
+	return BackupBtrfsVolumeWithOptions(volumePath, Options{}, writeStream)
+}
+
+// Backs up a btrfs subvolume from a read-only snapshot taken for the backup.
+// If a parent snapshot is given, only the changes since that snapshot are sent.
+func BackupBtrfsVolumeWithOptions(volumePath string, opts Options, writeStream io.Writer) error {
+	snapshotPath := btrfsSnapshotPath(volumePath, opts.snapshotName())
+
+	if !opts.SnapshotPrepared {
+		if err := createBtrfsSnapshot(volumePath, snapshotPath); err != nil {
+			return err
+		}
+		// Delete snapshot after sending, unless it is needed for later incrementals
+		if !opts.KeepSnapshot {
+			defer deleteBtrfsSnapshot(snapshotPath)
+		}
+	}
+
+	args := []string{"send", "-q"}
+	if opts.ParentSnapshot != "" {
+		parentPath := btrfsSnapshotPath(volumePath, opts.ParentSnapshot)
+		log.Debug("Sending changes of %s since snapshot %s", snapshotPath, parentPath)
+		args = append(args, "-p", parentPath)
+	}
+	args = append(args, snapshotPath)
+
+	cmd := exec.Command("btrfs", args...)
+	cmd.Stdout = writeStream
+	return cmd.Run()
+}
@@ -0,0 +1,194 @@
+//go:build integration && linux
+
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package backup
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setupBtrfs mounts a temporary btrfs filesystem and returns its mount point.
+func setupBtrfs(t *testing.T) string {
+	t.Helper()
+	if os.Getuid() != 0 {
+		t.Skip("Skipping btrfs test: must be run as root")
+	}
+	requiredCmds := []string{"mkfs.btrfs", "btrfs", "mount", "umount"}
+	for _, cmd := range requiredCmds {
+		if !commandExists(cmd) {
+			t.Skipf("Skipping btrfs test: command '%s' not found", cmd)
+		}
+	}
+
+	backingFile, err := os.CreateTemp("", "btrfs-test-backing-")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	backingFileName := backingFile.Name()
+	t.Cleanup(func() { os.Remove(backingFileName) })
+
+	if err := backingFile.Truncate(256 * 1024 * 1024); err != nil { // 256MB
+		t.Fatalf("Failed to truncate backing file: %v", err)
+	}
+	backingFile.Close()
+
+	mountPoint := t.TempDir()
+	runCommand(t, "mkfs.btrfs", "-f", backingFileName)
+	runCommand(t, "mount", "-o", "loop", backingFileName, mountPoint)
+	t.Cleanup(func() {
+		// Ignore errors during cleanup
+		exec.Command("umount", mountPoint).Run()
+	})
+	return mountPoint
+}
+
+// receiveBtrfs applies a send stream below dir using btrfs receive.
+func receiveBtrfs(t *testing.T, dir string, stream *bytes.Buffer) {
+	t.Helper()
+	cmd := exec.Command("btrfs", "receive", dir)
+	cmd.Stdin = stream
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("btrfs receive failed: %v\nOutput:\n%s", err, string(output))
+	}
+}
+
+func TestBackupBtrfsVolume(t *testing.T) {
+	mountPoint := setupBtrfs(t)
+
+	// BEGIN setup subvolume
+	subvolume := filepath.Join(mountPoint, "rootfs")
+	runCommand(t, "btrfs", "subvolume", "create", subvolume)
+
+	testData := []byte("pxitool btrfs test data")
+	if err := os.WriteFile(filepath.Join(subvolume, "testfile"), testData, 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	// END setup subvolume
+
+	// BEGIN test full backup
+	var buf bytes.Buffer
+	err := BackupBtrfsVolumeWithOptions(subvolume, Options{Snapshot: "full", KeepSnapshot: true}, &buf)
+	if err != nil {
+		t.Fatalf("BackupBtrfsVolumeWithOptions failed: %v", err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte("btrfs-stream")) {
+		t.Fatalf("Expected a btrfs send stream, got prefix %q", buf.Bytes()[:min(buf.Len(), 12)])
+	}
+
+	receiveDir := filepath.Join(mountPoint, "received")
+	if err := os.Mkdir(receiveDir, 0755); err != nil {
+		t.Fatalf("Failed to create receive dir: %v", err)
+	}
+	receiveBtrfs(t, receiveDir, &buf)
+
+	restoredData, err := os.ReadFile(filepath.Join(receiveDir, "rootfs@full", "testfile"))
+	if err != nil {
+		t.Fatalf("Failed to read restored file: %v", err)
+	}
+	if !bytes.Equal(restoredData, testData) {
+		t.Errorf("Restored data does not match original data.\nOriginal: %q\nRestored: %q", testData, restoredData)
+	}
+	// END test full backup
+
+	// BEGIN test incremental backup
+	incrementalData := []byte("pxitool btrfs incremental data")
+	if err := os.WriteFile(filepath.Join(subvolume, "incremental"), incrementalData, 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	buf.Reset()
+	err = BackupBtrfsVolumeWithOptions(subvolume, Options{Snapshot: "incr", ParentSnapshot: "full"}, &buf)
+	if err != nil {
+		t.Fatalf("Incremental BackupBtrfsVolumeWithOptions failed: %v", err)
+	}
+	if _, err := os.Stat(btrfsSnapshotPath(subvolume, "incr")); !os.IsNotExist(err) {
+		t.Errorf("Expected snapshot 'incr' to be deleted, got: %v", err)
+	}
+	receiveBtrfs(t, receiveDir, &buf)
+
+	restoredData, err = os.ReadFile(filepath.Join(receiveDir, "rootfs@incr", "incremental"))
+	if err != nil {
+		t.Fatalf("Failed to read restored file: %v", err)
+	}
+	if !bytes.Equal(restoredData, incrementalData) {
+		t.Errorf("Restored data does not match original data.\nOriginal: %q\nRestored: %q", incrementalData, restoredData)
+	}
+	// END test incremental backup
+}
+
+func TestBtrfsSnapshotPath(t *testing.T) {
+	testCases := []struct {
+		name     string
+		path     string
+		snapshot string
+		expected string
+	}{
+		{
+			name:     "subvolume path",
+			path:     "/var/lib/lxc/ct1/rootfs",
+			snapshot: "pxitool_20250101000000",
+			expected: "/var/lib/lxc/ct1/rootfs@pxitool_20250101000000",
+		},
+		{
+			name:     "trailing slash",
+			path:     "/mnt/pool/vol/",
+			snapshot: "snap",
+			expected: "/mnt/pool/vol@snap",
+		},
+		{
+			name:     "relative path",
+			path:     "vol",
+			snapshot: "snap",
+			expected: "vol@snap",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := btrfsSnapshotPath(tc.path, tc.snapshot)
+			if result != tc.expected {
+				t.Errorf("expected snapshot path %q, but got %q", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestBackupBtrfsVolume_FailureCases(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Skipping btrfs test: must be run as root")
+	}
+	if !commandExists("btrfs") {
+		t.Skip("Skipping btrfs test: command 'btrfs' not found")
+	}
+
+	var buf bytes.Buffer
+
+	t.Run("non-existent subvolume", func(t *testing.T) {
+		err := BackupBtrfsVolume("/path/to/non/existent/subvolume", &buf)
+		if err == nil {
+			t.Error("Expected an error for a non-existent subvolume, but got nil")
+		}
+		if err != nil && !strings.Contains(err.Error(), "failed to create btrfs snapshot") {
+			t.Errorf("Expected error to be about snapshot creation, but got: %v", err)
+		}
+	})
+}
@@ -0,0 +1,265 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/PextraCloud/pxitool/internal/qmp"
+	"github.com/PextraCloud/pxitool/pkg/log"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumetype"
+)
+
+// SnapshotGroup holds the snapshots of all volumes of an instance, taken
+// together before any of them is read, so that data spread over several
+// volumes is consistent across them. Snapshots are taken in two phases:
+// PrepareSnapshots takes them, then the volumes are backed up from them,
+// and Release removes the snapshots that are not kept.
+type SnapshotGroup struct {
+	Snapshot string    // Name of the snapshots
+	Time     time.Time // When the snapshots were taken
+	Complete bool      // Whether every volume was snapshotted, none is read as is
+
+	release []func() error // Run in reverse order by Release
+}
+
+// Takes the snapshots of every volume that supports them, as close
+// together as each backend allows:
+//
+//   - ZFS datasets are snapshotted with a single, atomic "zfs snapshot".
+//   - Disk images of a running VM are redirected to overlays in a single
+//     QMP transaction.
+//   - LVM, RBD and btrfs volumes are snapshotted one right after the other,
+//     as RBD group snapshots cannot be exported by name. Unless the guest
+//     is frozen, a warning is logged when there are several of them, as
+//     writes between their snapshots are not consistent across them.
+//
+// If a guest agent socket is given, guest filesystems stay frozen until
+// every snapshot is taken. The Options of the volumes that were
+// snapshotted are updated to read from their snapshot. If any snapshot
+// fails, those already taken are removed.
+func PrepareSnapshots(volumes []*VolumeBackupPayload) (_ *SnapshotGroup, err error) {
+	group := &SnapshotGroup{Snapshot: NewSnapshotName()}
+	for _, volume := range volumes {
+		if volume.Options.Snapshot != "" {
+			group.Snapshot = volume.Options.Snapshot
+			break
+		}
+	}
+	defer func() {
+		if err != nil {
+			group.Release()
+		}
+	}()
+
+	agentSocket := ""
+	for _, volume := range volumes {
+		socket := volume.Options.GuestAgentSocket
+		if socket == "" {
+			continue
+		}
+		if agentSocket != "" && socket != agentSocket {
+			return nil, fmt.Errorf("volumes give different guest agent sockets %s and %s, only one guest can be frozen", agentSocket, socket)
+		}
+		agentSocket = socket
+	}
+
+	var agent *qmp.Client
+	if agentSocket != "" {
+		if agent, err = qmp.DialGuestAgent(agentSocket); err != nil {
+			return nil, err
+		}
+		defer agent.Close()
+
+		frozen, err := agent.FSFreeze()
+		if err != nil {
+			// A failed freeze may leave some filesystems frozen
+			if _, thawErr := agent.FSThaw(); thawErr != nil {
+				err = errors.Join(err, fmt.Errorf("failed to thaw guest filesystems: %w", thawErr))
+			}
+			return nil, fmt.Errorf("failed to freeze guest filesystems: %w", err)
+		}
+		log.Debug("Froze %d guest filesystems", frozen)
+	}
+
+	group.Time = time.Now()
+	count, snapshotErr := group.snapshot(volumes, agent != nil)
+
+	// Thaw as soon as possible, even if a snapshot failed
+	if agent != nil {
+		if _, err := agent.FSThaw(); err != nil {
+			return nil, errors.Join(snapshotErr, fmt.Errorf("failed to thaw guest filesystems: %w", err))
+		}
+	}
+	if snapshotErr != nil {
+		return nil, snapshotErr
+	}
+	group.Complete = count == len(volumes)
+	log.Info("Took snapshot %s of %d of %d volumes", group.Snapshot, count, len(volumes))
+	return group, nil
+}
+
+// Takes the snapshot of each volume, adding how to remove it to the group.
+// It returns how many volumes were snapshotted.
+func (g *SnapshotGroup) snapshot(volumes []*VolumeBackupPayload, frozen bool) (int, error) {
+	var zfsSnapshots []string
+	var sequential []string
+	liveOverlays := make(map[string]string)
+	liveSocket := ""
+	for _, volume := range volumes {
+		volume.Options.Snapshot = g.Snapshot
+		switch volume.Type {
+		case volumetype.ZFS:
+			zfsSnapshots = append(zfsSnapshots, fmt.Sprintf("%s@%s", pathToZFSDataset(volume.Path), g.Snapshot))
+		case volumetype.Directory, volumetype.NetFS:
+			if volume.Options.QMPSocket != "" {
+				liveSocket = volume.Options.QMPSocket
+				liveOverlays[volume.Path] = liveOverlayPath(volume.Path, g.Snapshot)
+			}
+		case volumetype.LVM, volumetype.RBD, volumetype.Btrfs:
+			sequential = append(sequential, volume.Path)
+		}
+	}
+	if len(sequential) > 1 && !frozen {
+		log.Warn("Volumes %s are snapshotted one after the other, without a guest agent to freeze the guest; writes between their snapshots may be inconsistent across them", strings.Join(sequential, ", "))
+	}
+
+	// Live overlays and ZFS snapshots are each taken atomically, the
+	// others right after
+	if len(liveOverlays) > 0 {
+		if err := g.snapshotLive(liveSocket, liveOverlays); err != nil {
+			return 0, err
+		}
+	}
+	if len(zfsSnapshots) > 0 {
+		if err := createZFSSnapshots(zfsSnapshots...); err != nil {
+			return 0, err
+		}
+		for _, snapshotName := range zfsSnapshots {
+			g.onRelease(func() error {
+				destroyZFSSnapshot(snapshotName)
+				return nil
+			})
+		}
+	}
+
+	count := 0
+	for _, volume := range volumes {
+		opts := volume.Options
+		switch volume.Type {
+		case volumetype.ZFS:
+		case volumetype.Directory, volumetype.NetFS:
+			if opts.QMPSocket == "" {
+				continue
+			}
+		case volumetype.LVM:
+			vgName, lvName := pathToLVMVolume(volume.Path)
+			snapshotName := lvmSnapshotName(lvName, g.Snapshot)
+			if err := createLVMSnapshot(vgName, lvName, snapshotName); err != nil {
+				return count, err
+			}
+			g.onRelease(func() error {
+				removeLVMSnapshot(vgName, snapshotName)
+				return nil
+			})
+		case volumetype.RBD:
+			snapshotSpec := fmt.Sprintf("%s@%s", volume.Path, g.Snapshot)
+			if err := createRBDSnapshot(snapshotSpec); err != nil {
+				return count, err
+			}
+			if !opts.KeepSnapshot {
+				g.onRelease(func() error {
+					removeRBDSnapshot(snapshotSpec)
+					return nil
+				})
+			}
+		case volumetype.Btrfs:
+			snapshotPath := btrfsSnapshotPath(volume.Path, g.Snapshot)
+			if err := createBtrfsSnapshot(volume.Path, snapshotPath); err != nil {
+				return count, err
+			}
+			if !opts.KeepSnapshot {
+				g.onRelease(func() error {
+					deleteBtrfsSnapshot(snapshotPath)
+					return nil
+				})
+			}
+		default:
+			// Read as is
+			continue
+		}
+		volume.Options.SnapshotPrepared = true
+		count++
+		log.Debug("Took snapshot %s of %s", g.Snapshot, volume.Path)
+	}
+	return count, nil
+}
+
+// Redirects the writes of the VM to every image into an overlay at once.
+func (g *SnapshotGroup) snapshotLive(socketPath string, overlays map[string]string) error {
+	client, err := qmp.Dial(socketPath)
+	if err != nil {
+		return err
+	}
+
+	var nodeOverlays []qmp.Overlay
+	for i, filePath := range slices.Sorted(maps.Keys(overlays)) {
+		node, err := client.FindBlockNode(filePath)
+		if err != nil {
+			client.Close()
+			return err
+		}
+		nodeOverlays = append(nodeOverlays, qmp.Overlay{Node: node, File: overlays[filePath], SnapshotNode: liveOverlayNodeName(g.Time, i)})
+	}
+
+	log.Debug("Redirecting writes to %d images of the VM into overlays", len(nodeOverlays))
+	if err := client.BlockdevSnapshotSyncGroup(nodeOverlays); err != nil {
+		client.Close()
+		return fmt.Errorf("failed to create live snapshots: %w", err)
+	}
+
+	// The overlays are the active layers now, so they are merged back
+	// together, once every volume has been read
+	g.onRelease(func() error {
+		defer client.Close()
+		var errs []error
+		for _, overlay := range nodeOverlays {
+			errs = append(errs, commitLiveOverlay(client, overlay))
+		}
+		return errors.Join(errs...)
+	})
+	return nil
+}
+
+func (g *SnapshotGroup) onRelease(f func() error) {
+	g.release = append(g.release, f)
+}
+
+// Removes the snapshots that are not kept, and merges live overlays back
+// into their images. It must be called once the volumes have been read.
+func (g *SnapshotGroup) Release() error {
+	var errs []error
+	for i := len(g.release) - 1; i >= 0; i-- {
+		errs = append(errs, g.release[i]())
+	}
+	g.release = nil
+	return errors.Join(errs...)
+}
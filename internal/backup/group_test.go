@@ -0,0 +1,168 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package backup
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/PextraCloud/pxitool/internal/qmp"
+	"github.com/PextraCloud/pxitool/internal/qmp/qmptest"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumetype"
+)
+
+func TestPrepareSnapshots_Live(t *testing.T) {
+	images := []string{"/var/lib/images/os.qcow2", "/var/lib/images/data.qcow2"}
+	var events []string
+	var actions []any
+	vm := qmptest.NewServer(t, func(command string, arguments map[string]any) (any, error) {
+		events = append(events, command)
+		switch command {
+		case "query-block":
+			var blocks []map[string]any
+			for i, image := range images {
+				blocks = append(blocks, map[string]any{"device": "", "inserted": map[string]any{"file": image, "node-name": []string{"disk0", "disk1"}[i]}})
+			}
+			return blocks, nil
+		case "query-jobs":
+			return []map[string]any{{"id": liveCommitJobID, "type": "commit", "status": "concluded"}}, nil
+		case "transaction":
+			actions = arguments["actions"].([]any)
+		case "block-commit":
+			// Each overlay is committed into the node it was created on
+			for _, action := range actions {
+				data := action.(map[string]any)["data"].(map[string]any)
+				if arguments["device"] == data["snapshot-node-name"] && arguments["base-node"] == data["node-name"] {
+					return map[string]any{}, nil
+				}
+			}
+			return nil, &qmp.Error{Class: "GenericError", Desc: "Need a root block node"}
+		}
+		return map[string]any{}, nil
+	})
+	agent := newFakeGuestAgent(t, &events)
+
+	opts := Options{Snapshot: "pxitool_test", QMPSocket: vm.SocketPath, GuestAgentSocket: agent.SocketPath}
+	volumes := []*VolumeBackupPayload{
+		{Path: images[0], Type: volumetype.Directory, Options: opts},
+		{Path: images[1], Type: volumetype.Directory, Options: opts},
+		{Path: "/dev/sdb", Type: volumetype.Block, Options: opts},
+	}
+	group, err := PrepareSnapshots(volumes)
+	if err != nil {
+		t.Fatalf("PrepareSnapshots failed: %v", err)
+	}
+	if group.Snapshot != "pxitool_test" || group.Time.IsZero() {
+		t.Errorf("Unexpected group %+v", group)
+	}
+	if group.Complete {
+		t.Errorf("Expected the group to be incomplete, as the block device is read as is")
+	}
+
+	// Both overlays are created in one transaction while the guest is frozen
+	want := "guest-fsfreeze-freeze,query-block,query-block,transaction,guest-fsfreeze-thaw"
+	if got := strings.Join(events, ","); got != want {
+		t.Errorf("Unexpected sequence:\n got: %s\nwant: %s", got, want)
+	}
+	if len(actions) != 2 {
+		t.Errorf("Expected 2 actions in the transaction, got %v", actions)
+	}
+	if !volumes[0].Options.SnapshotPrepared || !volumes[1].Options.SnapshotPrepared || volumes[2].Options.SnapshotPrepared {
+		t.Errorf("Expected only the disk images to read from a snapshot")
+	}
+
+	events = nil
+	if err := group.Release(); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	if got := strings.Count(strings.Join(events, ","), "block-commit"); got != 2 {
+		t.Errorf("Expected both overlays to be committed, got %v", events)
+	}
+}
+
+func TestPrepareSnapshots_Complete(t *testing.T) {
+	var events []string
+	vm := newFakeVM(t, &events)
+
+	volumes := []*VolumeBackupPayload{{Path: liveTestImage, Type: volumetype.Directory, Options: Options{QMPSocket: vm.SocketPath}}}
+	group, err := PrepareSnapshots(volumes)
+	if err != nil {
+		t.Fatalf("PrepareSnapshots failed: %v", err)
+	}
+	defer group.Release()
+	if !group.Complete {
+		t.Errorf("Expected the group to be complete, as every volume was snapshotted")
+	}
+}
+
+func TestPrepareSnapshots_Failure(t *testing.T) {
+	var events []string
+	vm := newFakeVM(t, &events)
+	agent := newFakeGuestAgent(t, &events)
+
+	// The second image is not open in the VM
+	opts := Options{QMPSocket: vm.SocketPath, GuestAgentSocket: agent.SocketPath}
+	volumes := []*VolumeBackupPayload{
+		{Path: liveTestImage, Type: volumetype.Directory, Options: opts},
+		{Path: "/var/lib/images/other.qcow2", Type: volumetype.Directory, Options: opts},
+	}
+	if _, err := PrepareSnapshots(volumes); err == nil {
+		t.Fatal("Expected PrepareSnapshots to fail")
+	}
+
+	got := strings.Join(events, ",")
+	if strings.Contains(got, "transaction") || !strings.HasSuffix(got, "guest-fsfreeze-thaw") {
+		t.Errorf("Expected the guest to be thawed without snapshots, got %s", got)
+	}
+}
+
+func TestPrepareSnapshots_FreezeFailure(t *testing.T) {
+	var events []string
+	vm := newFakeVM(t, &events)
+	agent := qmptest.NewGuestAgentServer(t, func(command string, arguments map[string]any) (any, error) {
+		events = append(events, command)
+		if command == "guest-fsfreeze-freeze" {
+			return nil, &qmp.Error{Class: "GenericError", Desc: "failed to freeze /data"}
+		}
+		return 0, nil
+	})
+
+	opts := Options{QMPSocket: vm.SocketPath, GuestAgentSocket: agent.SocketPath}
+	if _, err := PrepareSnapshots([]*VolumeBackupPayload{{Path: liveTestImage, Type: volumetype.Directory, Options: opts}}); err == nil {
+		t.Fatal("Expected PrepareSnapshots to fail")
+	}
+	// Filesystems frozen before the failure are thawed
+	if got := strings.Join(events, ","); got != "guest-fsfreeze-freeze,guest-fsfreeze-thaw" {
+		t.Errorf("Expected the guest to be thawed without snapshots, got %s", got)
+	}
+}
+
+func TestPrepareSnapshots_AgentSockets(t *testing.T) {
+	var events []string
+	vm := newFakeVM(t, &events)
+	agents := []*qmptest.Server{newFakeGuestAgent(t, &events), newFakeGuestAgent(t, &events)}
+
+	volumes := []*VolumeBackupPayload{
+		{Path: liveTestImage, Type: volumetype.Directory, Options: Options{QMPSocket: vm.SocketPath, GuestAgentSocket: agents[0].SocketPath}},
+		{Path: "/dev/sdb", Type: volumetype.Block, Options: Options{GuestAgentSocket: agents[1].SocketPath}},
+	}
+	if _, err := PrepareSnapshots(volumes); err == nil || !strings.Contains(err.Error(), "different guest agent sockets") {
+		t.Fatalf("Expected an error for different guest agent sockets, got %v", err)
+	}
+	if len(events) != 0 {
+		t.Errorf("Expected nothing to be frozen or snapshotted, got %v", events)
+	}
+}
@@ -18,10 +18,8 @@ package backup
 import (
 	"fmt"
 	"io"
-	"os"
 	"os/exec"
 	"strings"
-	"time"
 
 	"github.com/PextraCloud/pxitool/pkg/log"
 )
@@ -44,27 +42,43 @@ func pathToLVMVolume(volumePath string) (string, string) { // vgname, lvname
 	return vgName, lvName
 }
 
-func BackupLVMVolume(volumePath string, writeStream io.Writer) error {
-	vgName, lvName := pathToLVMVolume(volumePath)
+// Snapshots are created in the volume group of their LV, as <lv>-<snapshot>.
+func lvmSnapshotName(lvName, snapshot string) string {
+	return fmt.Sprintf("%s-%s", lvName, snapshot)
+}
 
-	// Create snapshot
-	timestamp := time.Now().Format("20060102150405")
-	snapshotName := fmt.Sprintf("%s-pxitool-%s", lvName, timestamp)
+func createLVMSnapshot(vgName, lvName, snapshotName string) error {
 	createCmd := exec.Command("lvcreate", "--snapshot", "--name", snapshotName, "--size", "64M", fmt.Sprintf("/dev/%s/%s", vgName, lvName))
-
 	if err := createCmd.Run(); err != nil {
-		return fmt.Errorf("failed to create LVM snapshot: %w", err)
+		return fmt.Errorf("failed to create LVM snapshot of %s/%s: %w", vgName, lvName, err)
 	}
-	// Destroy snapshot after sending
-	defer func() {
-		deleteCmd := exec.Command("lvremove", "-f", fmt.Sprintf("/dev/%s/%s", vgName, snapshotName))
-		if err := deleteCmd.Run(); err != nil {
-			log.Warn("Failed to destroy LVM snapshot %s: %v", snapshotName, err)
+	return nil
+}
+
+func removeLVMSnapshot(vgName, snapshotName string) {
+	deleteCmd := exec.Command("lvremove", "-f", fmt.Sprintf("/dev/%s/%s", vgName, snapshotName))
+	if err := deleteCmd.Run(); err != nil {
+		log.Warn("Failed to destroy LVM snapshot %s: %v", snapshotName, err)
+	}
+}
+
+func BackupLVMVolume(volumePath string, writeStream io.Writer) error {
+	return BackupLVMVolumeWithOptions(volumePath, Options{}, writeStream)
+}
+
+// Backs up a logical volume from a temporary snapshot taken for the backup.
+func BackupLVMVolumeWithOptions(volumePath string, opts Options, writeStream io.Writer) error {
+	vgName, lvName := pathToLVMVolume(volumePath)
+	snapshotName := lvmSnapshotName(lvName, opts.snapshotName())
+
+	if !opts.SnapshotPrepared {
+		if err := createLVMSnapshot(vgName, lvName, snapshotName); err != nil {
+			return err
 		}
-	}()
+		// Destroy snapshot after sending
+		defer removeLVMSnapshot(vgName, snapshotName)
+	}
 
-	cmd := exec.Command("dd", fmt.Sprintf("if=/dev/%s/%s", vgName, snapshotName), "bs=8M", "status=none")
-	cmd.Stderr = io.MultiWriter(writeStream, io.Discard, io.Writer(os.Stderr)) // Do not specify "of=" so it writes to stdout
-	cmd.Stdout = writeStream
-	return cmd.Run()
+	// Thin LVs read unallocated ranges as zeroes, which are left out
+	return BackupBlockDevice(fmt.Sprintf("/dev/%s/%s", vgName, snapshotName), writeStream)
 }
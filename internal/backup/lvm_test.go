@@ -20,11 +20,12 @@ package backup
 import (
 	"bytes"
 	"fmt"
-	"io"
 	"os"
 	"os/exec"
 	"strings"
 	"testing"
+
+	"github.com/PextraCloud/pxitool/internal/sparse"
 )
 
 func TestBackupLVMVolume(t *testing.T) {
@@ -93,11 +94,19 @@ func TestBackupLVMVolume(t *testing.T) {
 		t.Error("BackupLVMVolume produced an empty backup")
 	}
 
-	backupData := make([]byte, len(testData))
-	_, err = buf.Read(backupData)
-	if err != nil && err != io.EOF {
-		t.Fatalf("Failed to read from backup buffer: %v", err)
+	// LVM volumes are stored as sparse streams
+	sparseReader, err := sparse.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("Failed to read sparse stream: %v", err)
+	}
+	var expanded bytes.Buffer
+	if _, err := sparse.Expand(&expanded, sparseReader); err != nil {
+		t.Fatalf("Failed to expand sparse stream: %v", err)
+	}
+	if expanded.Len() != 128*1024*1024 {
+		t.Errorf("Expected a 128 MiB volume, got %d bytes", expanded.Len())
 	}
+	backupData := expanded.Bytes()[:len(testData)]
 
 	if !bytes.Equal(testData, backupData) {
 		t.Errorf("Backup data does not match original data.\nOriginal: %q\nBackup:   %q", testData, backupData)
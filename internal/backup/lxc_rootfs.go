@@ -17,12 +17,18 @@ package backup
 
 import (
 	"io"
-	"os/exec"
+
+	"github.com/PextraCloud/pxitool/internal/rootfs"
 )
 
+// Backs up an LXC rootfs directory as a PAX tar archive, keeping numeric
+// owners, extended attributes, device nodes, hard links and holes.
 func BackupLXCRootfs(filePath string, writeStream io.Writer) error {
-	cmd := exec.Command("tar", "--numeric-owner", "-C", filePath, "-cf", "-", ".")
+	return BackupLXCRootfsWithOptions(filePath, Options{}, writeStream)
+}
 
-	cmd.Stdout = writeStream
-	return cmd.Run()
+// Backs up an LXC rootfs directory, mapping the owners of an unprivileged
+// container's files back to container IDs with opts.IDMap.
+func BackupLXCRootfsWithOptions(filePath string, opts Options, writeStream io.Writer) error {
+	return rootfs.Archive(filePath, writeStream, opts.IDMap)
 }
@@ -92,8 +92,8 @@ func TestBackupLXCRootfs_FailureCases(t *testing.T) {
 		if err == nil {
 			t.Error("Expected an error for a non-existent directory, but got nil")
 		}
-		if err != nil && !strings.Contains(err.Error(), "exit status") {
-			t.Errorf("Expected error to be about command exit status, but got: %v", err)
+		if err != nil && !strings.Contains(err.Error(), "failed to stat rootfs") {
+			t.Errorf("Expected error to be about the missing rootfs, but got: %v", err)
 		}
 	})
 }
@@ -18,41 +18,105 @@ package backup
 import (
 	"fmt"
 	"io"
+	"time"
 
+	"github.com/PextraCloud/pxitool/internal/rootfs"
 	"github.com/PextraCloud/pxitool/internal/utils"
 	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumeformat"
 	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumetype"
 )
 
+// A volume to back up, with the options it is captured with.
 type VolumeBackupPayload struct {
-	Path string
-	Type volumetype.VolumeType
+	Path    string
+	Type    volumetype.VolumeType
+	Options Options
+}
+
+// Options controls how a volume is captured. Backends that do not
+// support snapshots or incremental streams ignore these fields.
+type Options struct {
+	Snapshot         string                     // Name of the snapshot taken for the backup, generated if empty
+	ParentSnapshot   string                     // Existing snapshot to send an incremental stream from
+	KeepSnapshot     bool                       // Keep the snapshot so it can be the parent of a later incremental backup
+	TmpDir           string                     // Directory for scratch files, the system default if empty
+	StreamImages     bool                       // Stream disk image files through qemu-nbd instead of converting them in TmpDir
+	KeepImage        bool                       // Store a disk image file as is, as part of a backing chain
+	QMPSocket        string                     // QMP socket of the VM using a disk image file, for live backups
+	GuestAgentSocket string                     // Guest agent socket of the VM, to freeze its filesystems during live backups
+	Format           *volumeformat.VolumeFormat // Format to convert disk image files to, qcow2 if nil
+	IDMap            rootfs.IDMap               // Maps the host IDs of an unprivileged LXC rootfs back to container IDs
+	SnapshotPrepared bool                       // The snapshot named Snapshot was taken by a SnapshotGroup, which also removes it
+}
+
+// Returns a snapshot name unique to the current second.
+func NewSnapshotName() string {
+	return "pxitool_" + time.Now().Format("20060102150405")
+}
+
+func (o Options) snapshotName() string {
+	if o.Snapshot != "" {
+		return o.Snapshot
+	}
+	return NewSnapshotName()
+}
+
+// Reports whether volumes of the given type can be backed up incrementally
+// from a parent snapshot, and keep their backup snapshot on request.
+func SupportsIncremental(volumeType volumetype.VolumeType) bool {
+	switch volumeType {
+	case volumetype.RBD, volumetype.Btrfs:
+		return true
+	default:
+		return false
+	}
 }
 
 // Backs up a volume based on its type
-func BackupVolume(volumePath string, volumeType volumetype.VolumeType, writeStream io.Writer) (int64, *volumeformat.VolumeFormat, error) {
+func BackupVolume(volumePath string, volumeType volumetype.VolumeType, writeStream io.Writer, opts Options) (int64, *volumeformat.VolumeFormat, error) {
 	countingWriter := utils.NewCountingWriter(writeStream)
 	switch volumeType {
 	case volumetype.Directory, volumetype.NetFS:
-		err := BackupQEMUVolume(volumePath, countingWriter)
+		var err error
+		if opts.QMPSocket != "" && !opts.SnapshotPrepared {
+			err = BackupQEMULiveVolume(volumePath, opts, countingWriter)
+		} else if opts.KeepImage {
+			err = BackupQEMUImageFile(volumePath, countingWriter)
+		} else {
+			err = BackupQEMUVolumeWithOptions(volumePath, opts, countingWriter)
+		}
 		format := getVolumeFormat(countingWriter.First4())
 		return countingWriter.Count(), &format, err
 	case volumetype.LVM:
-		err := BackupLVMVolume(volumePath, countingWriter)
+		err := BackupLVMVolumeWithOptions(volumePath, opts, countingWriter)
 		format := getVolumeFormat(countingWriter.First4())
 		return countingWriter.Count(), &format, err
 	case volumetype.ZFS:
-		err := BackupZFSVolume(volumePath, countingWriter)
+		err := BackupZFSVolumeWithOptions(volumePath, opts, countingWriter)
 		format := getVolumeFormat(countingWriter.First4())
 		return countingWriter.Count(), &format, err
 	case volumetype.RBD:
-		err := BackupRBDVolume(volumePath, countingWriter)
+		err := BackupRBDVolumeWithOptions(volumePath, opts, countingWriter)
+		format := getVolumeFormat(countingWriter.First4())
+		return countingWriter.Count(), &format, err
+	case volumetype.Btrfs:
+		err := BackupBtrfsVolumeWithOptions(volumePath, opts, countingWriter)
+		format := getVolumeFormat(countingWriter.First4())
+		return countingWriter.Count(), &format, err
+	case volumetype.Block:
+		err := BackupBlockDevice(volumePath, countingWriter)
 		format := getVolumeFormat(countingWriter.First4())
 		return countingWriter.Count(), &format, err
 	case volumetype.ISCSI:
-		return 0, nil, fmt.Errorf("iSCSI volumes should not be backed up directly; use the underlying block device")
+		// The LUN must already be mapped on this host
+		if !utils.IsBlockDevice(volumePath) {
+			return 0, nil, fmt.Errorf("iSCSI volume path %s is not a block device; use the block device of the mapped LUN", volumePath)
+		}
+		err := BackupBlockDevice(volumePath, countingWriter)
+		format := getVolumeFormat(countingWriter.First4())
+		return countingWriter.Count(), &format, err
 	case volumetype.LXC_:
-		err := BackupLXCRootfs(volumePath, countingWriter)
+		err := BackupLXCRootfsWithOptions(volumePath, opts, countingWriter)
 		format := getVolumeFormat(countingWriter.First4()) // Will be Raw for LXC
 		return countingWriter.Count(), &format, err
 	default:
@@ -56,6 +56,16 @@ func TestBackupVolume_Failures(t *testing.T) {
 			volumeType: volumetype.LXC_,
 			volumePath: "/path/to/non/existent/rootfs",
 		},
+		{
+			name:       "btrfs type with non-existent subvolume",
+			volumeType: volumetype.Btrfs,
+			volumePath: "/path/to/non/existent/subvolume",
+		},
+		{
+			name:       "Block type with non-existent device",
+			volumeType: volumetype.Block,
+			volumePath: "/dev/nonexistent_pxitool_device",
+		},
 		{
 			name:       "ISCSI type should always fail",
 			volumeType: volumetype.ISCSI,
@@ -83,6 +93,10 @@ func TestBackupVolume_Failures(t *testing.T) {
 				if !commandExists("rbd") {
 					t.Skip("Skipping test: rbd not found")
 				}
+			case volumetype.Btrfs:
+				if !commandExists("btrfs") {
+					t.Skip("Skipping test: btrfs not found")
+				}
 			case volumetype.LXC_:
 				if !commandExists("tar") {
 					t.Skip("Skipping test: tar not found")
@@ -90,7 +104,7 @@ func TestBackupVolume_Failures(t *testing.T) {
 			}
 
 			var buf bytes.Buffer
-			_, _, err := BackupVolume(tc.volumePath, tc.volumeType, &buf)
+			_, _, err := BackupVolume(tc.volumePath, tc.volumeType, &buf, Options{})
 			if err == nil {
 				t.Fatalf("Expected an error for volume type %s, but got nil", tc.volumeType)
 			}
@@ -0,0 +1,84 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumeformat"
+)
+
+// An image in a qcow2 backing chain.
+type ChainImage struct {
+	Path   string
+	Format string // Image format, as reported by qemu-img
+}
+
+// Returns the backing chain of a disk image file, starting with the image
+// itself and ending with the base image.
+func GetQEMUBackingChain(filePath string) ([]ChainImage, error) {
+	cmd := exec.Command("qemu-img", "info", "--backing-chain", "--output=json", "--force-share", filePath)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("qemu-img info failed for %s: %w", filePath, err)
+	}
+
+	var images []struct {
+		Filename string `json:"filename"`
+		Format   string `json:"format"`
+	}
+	if err := json.Unmarshal(output, &images); err != nil {
+		return nil, fmt.Errorf("failed to parse qemu-img info output: %w", err)
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("qemu-img info returned no images for %s", filePath)
+	}
+
+	chain := make([]ChainImage, len(images))
+	for i, image := range images {
+		chain[i] = ChainImage{Path: image.Filename, Format: image.Format}
+	}
+	return chain, nil
+}
+
+// Backs up a single image of a backing chain without converting it, so
+// its backing file reference, internal snapshots and compression are kept.
+// Images that are not qcow2 can only be the base of a chain, and are
+// stored as sparse streams.
+func BackupQEMUImageFile(filePath string, writeStream io.Writer) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open source file: %w", err)
+	}
+	defer file.Close()
+
+	var first4 [4]byte
+	if _, err := io.ReadFull(file, first4[:]); err != nil || getVolumeFormat(first4) != volumeformat.QCOW2 {
+		return BackupBlockDevice(filePath, writeStream)
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek source file: %w", err)
+	}
+	if _, err := io.Copy(writeStream, file); err != nil {
+		return fmt.Errorf("failed to copy qcow2 data: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+//go:build integration
+
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package backup
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetQEMUBackingChain(t *testing.T) {
+	if !commandExists("qemu-img") {
+		t.Skip("Skipping QEMU test: command 'qemu-img' not found")
+	}
+
+	dir := t.TempDir()
+	basePath := filepath.Join(dir, "base.raw")
+	overlayPath := filepath.Join(dir, "overlay.qcow2")
+	runCommand(t, "qemu-img", "create", "-f", "raw", basePath, "10M")
+	runCommand(t, "qemu-img", "create", "-f", "qcow2", "-b", basePath, "-F", "raw", overlayPath)
+
+	chain, err := GetQEMUBackingChain(overlayPath)
+	if err != nil {
+		t.Fatalf("GetQEMUBackingChain failed: %v", err)
+	}
+	if len(chain) != 2 {
+		t.Fatalf("Expected a chain of 2 images, got %d", len(chain))
+	}
+	if chain[0].Format != "qcow2" || chain[1].Format != "raw" {
+		t.Errorf("Unexpected chain formats: %+v", chain)
+	}
+	if filepath.Base(chain[1].Path) != "base.raw" {
+		t.Errorf("Expected base image base.raw, got %s", chain[1].Path)
+	}
+}
+
+func TestBackupQEMUImageFile(t *testing.T) {
+	if !commandExists("qemu-img") {
+		t.Skip("Skipping QEMU test: command 'qemu-img' not found")
+	}
+
+	dir := t.TempDir()
+	basePath := filepath.Join(dir, "base.raw")
+	overlayPath := filepath.Join(dir, "overlay.qcow2")
+	runCommand(t, "qemu-img", "create", "-f", "raw", basePath, "10M")
+	runCommand(t, "qemu-img", "create", "-f", "qcow2", "-b", basePath, "-F", "raw", overlayPath)
+
+	t.Run("qcow2 overlay is kept as is", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := BackupQEMUImageFile(overlayPath, &buf); err != nil {
+			t.Fatalf("BackupQEMUImageFile failed: %v", err)
+		}
+		if !bytes.HasPrefix(buf.Bytes(), QCOW2Signature) {
+			t.Error("Expected a qcow2 image")
+		}
+		if !bytes.Contains(buf.Bytes(), []byte(basePath)) {
+			t.Error("Expected the backing file reference to be kept")
+		}
+	})
+
+	t.Run("raw base is stored sparse", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := BackupQEMUImageFile(basePath, &buf); err != nil {
+			t.Fatalf("BackupQEMUImageFile failed: %v", err)
+		}
+		var first4 [4]byte
+		copy(first4[:], buf.Bytes())
+		if format := getVolumeFormat(first4); format.String() != "sparse raw" {
+			t.Errorf("Expected a sparse raw stream, got %s", format)
+		}
+	})
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/PextraCloud/pxitool/internal/qmp"
+	"github.com/PextraCloud/pxitool/pkg/log"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumetype"
+)
+
+const liveCommitJobID = "pxitool-commit"
+
+// Overlays are created next to the image, as <image>.<snapshot>.qcow2.
+func liveOverlayPath(filePath, snapshot string) string {
+	return fmt.Sprintf("%s.%s.qcow2", filePath, snapshot)
+}
+
+// Returns the node name of the i-th overlay of a group of live snapshots
+// taken at the given time. QEMU limits node names to 31 characters.
+func liveOverlayNodeName(taken time.Time, i int) string {
+	return fmt.Sprintf("pxitool-%d-%d", taken.Unix(), i)
+}
+
+// Merges an overlay back into the node it was created on, which keeps the
+// rest of its backing chain as is, and removes it.
+func commitLiveOverlay(client *qmp.Client, overlay qmp.Overlay) error {
+	log.Debug("Committing %s back into node %s", overlay.File, overlay.Node)
+	if err := client.BlockCommit(overlay.SnapshotNode, overlay.Node, liveCommitJobID); err != nil {
+		return fmt.Errorf("failed to commit live snapshot, the VM still writes to %s: %w", overlay.File, err)
+	}
+	if err := os.Remove(overlay.File); err != nil && !os.IsNotExist(err) {
+		log.Error("Failed to remove live snapshot %s: %v", overlay.File, err)
+	}
+	return nil
+}
+
+// Backs up a disk image file of a running VM. The VM's writes are
+// redirected to a temporary external snapshot while the image is backed
+// up, then merged back into the image.
+func BackupQEMULiveVolume(filePath string, opts Options, writeStream io.Writer) error {
+	return withLiveSnapshot(filePath, opts, func() error {
+		if opts.KeepImage {
+			return BackupQEMUImageFile(filePath, writeStream)
+		}
+		return BackupQEMUVolumeWithOptions(filePath, opts, writeStream)
+	})
+}
+
+// Runs backupFunc while the image file is a stable point-in-time copy.
+// The overlay is created by a SnapshotGroup of the image alone, so guest
+// filesystems are frozen once, if a guest agent socket is given, while
+// the snapshot is taken in a single transaction.
+func withLiveSnapshot(filePath string, opts Options, backupFunc func() error) error {
+	volume := &VolumeBackupPayload{Path: filePath, Type: volumetype.Directory, Options: opts}
+	group, err := PrepareSnapshots([]*VolumeBackupPayload{volume})
+	if err != nil {
+		return err
+	}
+
+	backupErr := backupFunc()
+
+	// The overlay is the active layer now, so it is merged back even if the backup failed
+	return errors.Join(backupErr, group.Release())
+}
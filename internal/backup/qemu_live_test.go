@@ -0,0 +1,115 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package backup
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/PextraCloud/pxitool/internal/qmp"
+	"github.com/PextraCloud/pxitool/internal/qmp/qmptest"
+)
+
+const liveTestImage = "/var/lib/images/vm.qcow2"
+
+func newFakeVM(t *testing.T, events *[]string) *qmptest.Server {
+	overlayNode := ""
+	return qmptest.NewServer(t, func(command string, arguments map[string]any) (any, error) {
+		*events = append(*events, command)
+		switch command {
+		case "query-block":
+			return []map[string]any{{"device": "", "inserted": map[string]any{"file": liveTestImage, "node-name": "disk0", "image": map[string]any{"filename": liveTestImage}}}}, nil
+		case "query-jobs":
+			return []map[string]any{{"id": liveCommitJobID, "type": "commit", "status": "concluded"}}, nil
+		case "transaction":
+			for _, action := range arguments["actions"].([]any) {
+				data := action.(map[string]any)["data"].(map[string]any)
+				if data["node-name"] != "disk0" || !strings.HasPrefix(data["snapshot-file"].(string), liveTestImage+".") || data["snapshot-node-name"] == nil {
+					return nil, &qmp.Error{Class: "GenericError", Desc: "unexpected arguments"}
+				}
+				overlayNode = data["snapshot-node-name"].(string)
+			}
+		case "block-commit":
+			// Only the overlay is the root node, and it is committed into
+			// the image, not the bottom of its chain
+			if arguments["device"] != overlayNode || arguments["base-node"] != "disk0" {
+				return nil, &qmp.Error{Class: "GenericError", Desc: "Need a root block node"}
+			}
+		}
+		return map[string]any{}, nil
+	})
+}
+
+func newFakeGuestAgent(t *testing.T, events *[]string) *qmptest.Server {
+	return qmptest.NewGuestAgentServer(t, func(command string, arguments map[string]any) (any, error) {
+		*events = append(*events, command)
+		return 1, nil
+	})
+}
+
+func TestWithLiveSnapshot(t *testing.T) {
+	var events []string
+	vm := newFakeVM(t, &events)
+	agent := newFakeGuestAgent(t, &events)
+
+	opts := Options{QMPSocket: vm.SocketPath, GuestAgentSocket: agent.SocketPath}
+	err := withLiveSnapshot(liveTestImage, opts, func() error {
+		events = append(events, "backup")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("withLiveSnapshot failed: %v", err)
+	}
+
+	// Frozen once, for a single transaction
+	want := "guest-fsfreeze-freeze,query-block,transaction,guest-fsfreeze-thaw,backup,block-commit,query-jobs,job-dismiss"
+	if got := strings.Join(events, ","); got != want {
+		t.Errorf("Unexpected sequence:\n got: %s\nwant: %s", got, want)
+	}
+}
+
+func TestWithLiveSnapshot_BackupFailure(t *testing.T) {
+	var events []string
+	vm := newFakeVM(t, &events)
+
+	backupErr := errors.New("disk full")
+	err := withLiveSnapshot(liveTestImage, Options{QMPSocket: vm.SocketPath}, func() error {
+		return backupErr
+	})
+	if !errors.Is(err, backupErr) {
+		t.Errorf("Expected the backup error, got %v", err)
+	}
+
+	// The overlay must still be committed back into the image
+	if !strings.Contains(strings.Join(events, ","), "block-commit") {
+		t.Errorf("Expected the live snapshot to be committed, got %v", events)
+	}
+}
+
+func TestWithLiveSnapshot_ImageNotOpen(t *testing.T) {
+	var events []string
+	vm := newFakeVM(t, &events)
+
+	called := false
+	err := withLiveSnapshot("/var/lib/images/other.qcow2", Options{QMPSocket: vm.SocketPath}, func() error {
+		called = true
+		return nil
+	})
+	if err == nil || called {
+		t.Errorf("Expected an error without running the backup, got %v", err)
+	}
+}
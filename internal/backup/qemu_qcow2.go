@@ -16,56 +16,200 @@ limitations under the License.
 package backup
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/PextraCloud/pxitool/internal/nbd"
+	"github.com/PextraCloud/pxitool/internal/sparse"
+	"github.com/PextraCloud/pxitool/internal/utils"
+	"github.com/PextraCloud/pxitool/pkg/log"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumeformat"
+)
+
+const (
+	nbdStartTimeout = 30 * time.Second
+	nbdReadSize     = 4 * 1024 * 1024
 )
 
+// Backs up a disk image file as a compact qcow2 image.
 func BackupQEMUVolume(filePath string, writeStream io.Writer) error {
-	// A temp file is needed: https://lists.gnu.org/archive/html/qemu-discuss/2020-01/msg00028.html
-	// Step 1: Take a copy of the file
-	copyFile, err := os.CreateTemp("", "pxitool-qemu-img-copy-*.qcow2")
+	return BackupQEMUVolumeWithOptions(filePath, Options{}, writeStream)
+}
+
+// Backs up a disk image file. By default, it is converted to a compact
+// qcow2 image in opts.TmpDir, which is then streamed. With
+// opts.StreamImages, the image is instead read through qemu-nbd and
+// streamed as sparse raw data, without using any scratch space.
+func BackupQEMUVolumeWithOptions(filePath string, opts Options, writeStream io.Writer) error {
+	// The source format is given to qemu, which would probe fixed VHDs as raw
+	sourceFormat, err := getImageFormat(filePath)
 	if err != nil {
-		return fmt.Errorf("failed to create temp copy: %w", err)
+		return err
+	}
+	sourceDriver, err := utils.QEMUImgDriver(sourceFormat)
+	if err != nil {
+		return fmt.Errorf("%s is not a disk image: %w", filePath, err)
+	}
+
+	if opts.StreamImages {
+		return streamQEMUVolume(filePath, sourceDriver, writeStream)
+	}
+	format := volumeformat.QCOW2
+	if opts.Format != nil {
+		format = *opts.Format
 	}
-	defer os.Remove(copyFile.Name())
-	defer copyFile.Close()
+	return stageQEMUVolume(filePath, sourceDriver, opts.TmpDir, format, writeStream)
+}
 
-	srcFile, err := os.Open(filePath)
+// Checks that tmpDir has enough free space for the converted image.
+// qemu-img can only measure raw and qcow2 output, which is a close
+// estimate for the other sparse formats.
+func checkConvertSpace(filePath string, sourceDriver string, tmpDir string, format volumeformat.VolumeFormat) error {
+	measureDriver := "qcow2"
+	if format == volumeformat.Raw {
+		measureDriver = "raw"
+	}
+	cmd := exec.Command("qemu-img", "measure", "--output=json", "--force-share", "-f", sourceDriver, "-O", measureDriver, filePath)
+	output, err := cmd.Output()
 	if err != nil {
-		return fmt.Errorf("failed to open source file: %w", err)
+		return fmt.Errorf("qemu-img measure failed: %w", err)
+	}
+	var measurement struct {
+		Required uint64 `json:"required"`
+	}
+	if err := json.Unmarshal(output, &measurement); err != nil {
+		return fmt.Errorf("failed to parse qemu-img measure output: %w", err)
 	}
-	defer srcFile.Close()
 
-	if _, err := io.Copy(copyFile, srcFile); err != nil {
-		return fmt.Errorf("failed to copy source file: %w", err)
+	free, err := utils.GetFreeSpace(tmpDir)
+	if err != nil {
+		return err
+	}
+	if measurement.Required > free {
+		return fmt.Errorf("not enough space in %s to convert %s: %d bytes needed, %d bytes available", tmpDir, filePath, measurement.Required, free)
 	}
 
-	if err := copyFile.Sync(); err != nil {
-		return fmt.Errorf("failed to sync copied file: %w", err)
+	log.Debug("Converting %s needs %d bytes in %s, %d bytes available", filePath, measurement.Required, tmpDir, free)
+	return nil
+}
+
+func stageQEMUVolume(filePath string, sourceDriver string, tmpDir string, format volumeformat.VolumeFormat, writeStream io.Writer) error {
+	driver, err := utils.QEMUImgDriver(format)
+	if err != nil {
+		return err
+	}
+	if tmpDir == "" {
+		tmpDir = os.TempDir()
+	}
+	if err := checkConvertSpace(filePath, sourceDriver, tmpDir, format); err != nil {
+		return err
 	}
 
-	// Step 2: Perform convert to remove sparseness
-	convertedFile, err := os.CreateTemp("", "pxitool-qemu-img-conv-*.qcow2")
+	// A temp file is needed: https://lists.gnu.org/archive/html/qemu-discuss/2020-01/msg00028.html
+	convertedFile, err := os.CreateTemp(tmpDir, "pxitool-qemu-img-conv-*."+driver)
 	if err != nil {
 		return fmt.Errorf("failed to create temp converted file: %w", err)
 	}
 	defer os.Remove(convertedFile.Name())
 	defer convertedFile.Close()
 
-	cmd := exec.Command("qemu-img", "convert", "-O", "qcow2", "--force-share", copyFile.Name(), convertedFile.Name())
+	// Convert directly from the source to remove sparseness, sharing it with a running VM
+	args := append([]string{"convert", "-f", sourceDriver, "-O", driver}, utils.QEMUImgCreateOptions(format)...)
+	cmd := exec.Command("qemu-img", append(args, "--force-share", filePath, convertedFile.Name())...)
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("qemu-img convert failed: %w", err)
 	}
 
-	// Step 3: io.Copy the new file and then delete it
+	// Raw images are stored without their zeroed ranges
+	if format == volumeformat.Raw {
+		return BackupBlockDevice(convertedFile.Name(), writeStream)
+	}
+
 	if _, err := convertedFile.Seek(0, io.SeekStart); err != nil {
 		return fmt.Errorf("failed to seek converted file: %w", err)
 	}
 	if _, err := io.Copy(writeStream, convertedFile); err != nil {
-		return fmt.Errorf("failed to copy converted qcow2 data: %w", err)
+		return fmt.Errorf("failed to copy converted %s data: %w", format, err)
 	}
 
 	return nil
 }
+
+func streamQEMUVolume(filePath string, driver string, writeStream io.Writer) error {
+	socketDir, err := os.MkdirTemp("", "pxitool-nbd-")
+	if err != nil {
+		return fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	defer os.RemoveAll(socketDir)
+	socketPath := filepath.Join(socketDir, "nbd.sock")
+
+	cmd := exec.Command("qemu-nbd", "--read-only", "--force-share", "--format", driver, "--socket", socketPath, filePath)
+	var errBuf bytes.Buffer
+	cmd.Stderr = &errBuf
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start qemu-nbd: %w", err)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	defer func() {
+		cmd.Process.Kill()
+		<-exited
+	}()
+
+	client, err := dialQEMUNBD(socketPath, exited)
+	if err != nil {
+		log.Error("qemu-nbd stderr: %s", errBuf.String())
+		return err
+	}
+	defer client.Close()
+
+	size := client.Size()
+	log.Debug("Streaming %s (%s, %d bytes) from qemu-nbd", filePath, driver, size)
+	sparseWriter, err := sparse.NewWriter(writeStream, size)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, nbdReadSize)
+	for offset := int64(0); offset < size; {
+		n, err := client.ReadAt(buf[:min(int64(len(buf)), size-offset)], offset)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read %s at offset %d: %w", filePath, offset, err)
+		}
+		if _, err := sparseWriter.Write(buf[:n]); err != nil {
+			return err
+		}
+		offset += int64(n)
+	}
+	return sparseWriter.Close()
+}
+
+// Waits for qemu-nbd to listen on its socket.
+func dialQEMUNBD(socketPath string, exited chan error) (*nbd.Client, error) {
+	deadline := time.Now().Add(nbdStartTimeout)
+	for {
+		select {
+		case err := <-exited:
+			exited <- err // Keep the result for the caller
+			return nil, fmt.Errorf("qemu-nbd exited unexpectedly: %v", err)
+		default:
+		}
+
+		client, err := nbd.Dial(socketPath, "")
+		if err == nil {
+			return client, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for qemu-nbd: %w", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
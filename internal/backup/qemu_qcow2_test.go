@@ -19,9 +19,15 @@ package backup
 
 import (
 	"bytes"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+
+	"github.com/PextraCloud/pxitool/internal/sparse"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumeformat"
 )
 
 func TestBackupQEMUVolume(t *testing.T) {
@@ -89,3 +95,147 @@ func TestBackupQEMUVolume_FailureCases(t *testing.T) {
 		}
 	})
 }
+
+func TestBackupQEMUVolume_TmpDir(t *testing.T) {
+	if !commandExists("qemu-img") {
+		t.Skip("Skipping QEMU test: command 'qemu-img' not found")
+	}
+
+	sourceFileName := filepath.Join(t.TempDir(), "source.qcow2")
+	runCommand(t, "qemu-img", "create", "-f", "qcow2", sourceFileName, "10M")
+
+	tmpDir := t.TempDir()
+	var buf bytes.Buffer
+	if err := BackupQEMUVolumeWithOptions(sourceFileName, Options{TmpDir: tmpDir}, &buf); err != nil {
+		t.Fatalf("BackupQEMUVolumeWithOptions failed: %v", err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), QCOW2Signature) {
+		t.Error("Expected a qcow2 image")
+	}
+
+	// The converted image must be cleaned up
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatalf("Failed to read temp dir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Expected temp dir to be empty, found %d entries", len(entries))
+	}
+}
+
+func TestBackupQEMUVolume_Stream(t *testing.T) {
+	if !commandExists("qemu-img") || !commandExists("qemu-nbd") {
+		t.Skip("Skipping QEMU stream test: commands 'qemu-img' or 'qemu-nbd' not found")
+	}
+
+	dir := t.TempDir()
+	rawFileName := filepath.Join(dir, "source.raw")
+	data := make([]byte, 10*1024*1024)
+	copy(data[1024*1024:], "hello pxitool")
+	if err := os.WriteFile(rawFileName, data, 0644); err != nil {
+		t.Fatalf("Failed to write source file: %v", err)
+	}
+	sourceFileName := filepath.Join(dir, "source.qcow2")
+	runCommand(t, "qemu-img", "convert", "-O", "qcow2", rawFileName, sourceFileName)
+
+	var buf bytes.Buffer
+	if err := BackupQEMUVolumeWithOptions(sourceFileName, Options{StreamImages: true}, &buf); err != nil {
+		t.Fatalf("BackupQEMUVolumeWithOptions failed: %v", err)
+	}
+	// Mostly zeroes, so the stream must be much smaller than the image
+	if buf.Len() >= len(data)/2 {
+		t.Errorf("Expected a sparse stream, got %d bytes", buf.Len())
+	}
+
+	if got := readSparseStream(t, &buf); !bytes.Equal(got, data) {
+		t.Error("Streamed data does not match the source image")
+	}
+}
+
+// Decodes a sparse stream into the data of the whole volume.
+func readSparseStream(t *testing.T, r io.Reader) []byte {
+	t.Helper()
+	reader, err := sparse.NewReader(r)
+	if err != nil {
+		t.Fatalf("Failed to read sparse stream: %v", err)
+	}
+	data := make([]byte, reader.Size())
+	for {
+		extent, err := reader.Next()
+		if err == io.EOF {
+			return data
+		}
+		if err != nil {
+			t.Fatalf("Failed to read extent: %v", err)
+		}
+		if _, err := io.ReadFull(reader, data[extent.Offset:extent.Offset+extent.Length]); err != nil {
+			t.Fatalf("Failed to read extent data: %v", err)
+		}
+	}
+}
+
+func TestBackupQEMUVolume_VHD(t *testing.T) {
+	if !commandExists("qemu-img") || !commandExists("qemu-nbd") {
+		t.Skip("Skipping VHD test: commands 'qemu-img' or 'qemu-nbd' not found")
+	}
+
+	dir := t.TempDir()
+	rawFileName := filepath.Join(dir, "source.raw")
+	data := make([]byte, 8*1024*1024)
+	copy(data, "start of disk")
+	copy(data[5*1024*1024:], "hello pxitool")
+	if err := os.WriteFile(rawFileName, data, 0644); err != nil {
+		t.Fatalf("Failed to write source file: %v", err)
+	}
+
+	raw := volumeformat.Raw
+	// Fixed VHDs only have a footer, dynamic ones also have a copy of it at the start
+	for _, subformat := range []string{"fixed", "dynamic"} {
+		sourceFileName := filepath.Join(dir, subformat+".vhd")
+		runCommand(t, "qemu-img", "convert", "-O", "vpc", "-o", "subformat="+subformat+",force_size=on", rawFileName, sourceFileName)
+		if format, err := getImageFormat(sourceFileName); err != nil || format != volumeformat.VHD {
+			t.Fatalf("Expected %s image to be detected as VHD, got %s (%v)", subformat, format, err)
+		}
+
+		for _, opts := range []Options{{StreamImages: true}, {Format: &raw}} {
+			t.Run(fmt.Sprintf("%s stream=%v", subformat, opts.StreamImages), func(t *testing.T) {
+				var buf bytes.Buffer
+				if err := BackupQEMUVolumeWithOptions(sourceFileName, opts, &buf); err != nil {
+					t.Fatalf("BackupQEMUVolumeWithOptions failed: %v", err)
+				}
+				if got := readSparseStream(t, &buf); !bytes.Equal(got, data) {
+					t.Errorf("Backed up data of %d bytes does not match the %d bytes of the source image", len(got), len(data))
+				}
+			})
+		}
+	}
+}
+
+func TestBackupQEMUVolume_Format(t *testing.T) {
+	if !commandExists("qemu-img") {
+		t.Skip("Skipping QEMU test: command 'qemu-img' not found")
+	}
+
+	sourceFileName := filepath.Join(t.TempDir(), "source.qcow2")
+	runCommand(t, "qemu-img", "create", "-f", "qcow2", sourceFileName, "10M")
+
+	for _, format := range []volumeformat.VolumeFormat{volumeformat.Raw, volumeformat.VMDK, volumeformat.VHD, volumeformat.VHDX} {
+		t.Run(format.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := BackupQEMUVolumeWithOptions(sourceFileName, Options{Format: &format}, &buf); err != nil {
+				t.Fatalf("BackupQEMUVolumeWithOptions failed: %v", err)
+			}
+
+			// Raw images are stored as sparse streams
+			expected := format
+			if format == volumeformat.Raw {
+				expected = volumeformat.SparseRaw
+			}
+			var first4 [4]byte
+			copy(first4[:], buf.Bytes())
+			if got := getVolumeFormat(first4); got != expected {
+				t.Errorf("Expected a %s image, got %s", expected, got)
+			}
+		})
+	}
+}
@@ -16,13 +16,82 @@ limitations under the License.
 package backup
 
 import (
+	"encoding/json"
+	"fmt"
 	"io"
 	"os/exec"
+
+	"github.com/PextraCloud/pxitool/internal/sparse"
+	"github.com/PextraCloud/pxitool/pkg/log"
 )
 
+// Backs up a full, point-in-time copy of an RBD image.
 func BackupRBDVolume(volumePath string, writeStream io.Writer) error {
-	cmd := exec.Command("rbd", "export", volumePath, "-")
+	return BackupRBDVolumeWithOptions(volumePath, Options{}, writeStream)
+}
+
+// Backs up an RBD image from a snapshot taken for the backup. If a parent
+// snapshot is given, only the changes since that snapshot are written, as
+// an "rbd export-diff" stream.
+func BackupRBDVolumeWithOptions(volumePath string, opts Options, writeStream io.Writer) error {
+	snapshotSpec := fmt.Sprintf("%s@%s", volumePath, opts.snapshotName())
+
+	if !opts.SnapshotPrepared {
+		if err := createRBDSnapshot(snapshotSpec); err != nil {
+			return err
+		}
+		// Remove snapshot after exporting, unless it is needed for later incrementals
+		if !opts.KeepSnapshot {
+			defer removeRBDSnapshot(snapshotSpec)
+		}
+	}
+
+	if opts.ParentSnapshot != "" {
+		log.Debug("Exporting changes of %s since snapshot %s", snapshotSpec, opts.ParentSnapshot)
+		cmd := exec.Command("rbd", "export-diff", "--no-progress", "--from-snap", opts.ParentSnapshot, snapshotSpec, "-")
+		cmd.Stdout = writeStream
+		return cmd.Run()
+	}
+	return exportRBDSparse(snapshotSpec, writeStream)
+}
+
+func createRBDSnapshot(snapshotSpec string) error {
+	createCmd := exec.Command("rbd", "snap", "create", "--no-progress", snapshotSpec)
+	if err := createCmd.Run(); err != nil {
+		return fmt.Errorf("failed to create RBD snapshot %s: %w", snapshotSpec, err)
+	}
+	return nil
+}
+
+func removeRBDSnapshot(snapshotSpec string) {
+	deleteCmd := exec.Command("rbd", "snap", "rm", "--no-progress", snapshotSpec)
+	if err := deleteCmd.Run(); err != nil {
+		log.Warn("Failed to remove RBD snapshot %s: %v", snapshotSpec, err)
+	}
+}
+
+// Exports an RBD image as a sparse stream, so unallocated and zeroed
+// ranges of thin images are left out.
+func exportRBDSparse(spec string, writeStream io.Writer) error {
+	output, err := exec.Command("rbd", "info", "--format", "json", spec).Output()
+	if err != nil {
+		return fmt.Errorf("failed to get RBD image info: %w", err)
+	}
+	var info struct {
+		Size int64 `json:"size"`
+	}
+	if err := json.Unmarshal(output, &info); err != nil {
+		return fmt.Errorf("failed to parse RBD image info: %w", err)
+	}
 
-	cmd.Stdout = writeStream
-	return cmd.Run()
+	sparseWriter, err := sparse.NewWriter(writeStream, info.Size)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("rbd", "export", "--no-progress", spec, "-")
+	cmd.Stdout = sparseWriter
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	return sparseWriter.Close()
 }
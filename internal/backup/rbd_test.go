@@ -24,6 +24,8 @@ import (
 	"os/exec"
 	"strings"
 	"testing"
+
+	"github.com/PextraCloud/pxitool/internal/sparse"
 )
 
 // checkCephReady skips the test if a Ceph environment is not detected.
@@ -91,7 +93,12 @@ func TestBackupRBDVolume(t *testing.T) {
 		t.Fatalf("Failed to create temp backup file: %v", err)
 	}
 	defer os.Remove(backupFile.Name())
-	if _, err := backupFile.Write(buf.Bytes()); err != nil {
+	// Full exports are sparse streams
+	sparseReader, err := sparse.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("Failed to read sparse stream: %v", err)
+	}
+	if _, err := sparse.Expand(backupFile, sparseReader); err != nil {
 		t.Fatalf("Failed to write backup data: %v", err)
 	}
 	backupFile.Close()
@@ -133,3 +140,54 @@ func TestBackupRBDVolume_FailureCases(t *testing.T) {
 		}
 	})
 }
+
+func TestBackupRBDVolume_Incremental(t *testing.T) {
+	checkCephReady(t)
+
+	poolName := "rbd"
+	imageName := "pxitool_test_incr_image"
+	rbdSpec := fmt.Sprintf("%s/%s", poolName, imageName)
+
+	// BEGIN setup RBD image with a parent snapshot
+	runCommand(t, "rbd", "create", rbdSpec, "--size", "128M")
+	t.Cleanup(func() {
+		// Ignore errors during cleanup
+		exec.Command("rbd", "snap", "purge", rbdSpec).Run()
+		exec.Command("rbd", "rm", rbdSpec).Run()
+	})
+	runCommand(t, "rbd", "snap", "create", rbdSpec+"@base")
+
+	testData := []byte("pxitool RBD incremental data")
+	tmpFile, err := os.CreateTemp("", "pxitool_testdata")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(testData); err != nil {
+		t.Fatalf("Failed to write test data: %v", err)
+	}
+	tmpFile.Close()
+	runCommand(t, "rbd", "write", rbdSpec, "--offset", "4096", "--infile", tmpFile.Name())
+	// END setup RBD image with a parent snapshot
+
+	// BEGIN test backup
+	var buf bytes.Buffer
+	err = BackupRBDVolumeWithOptions(rbdSpec, Options{Snapshot: "incr", ParentSnapshot: "base", KeepSnapshot: true}, &buf)
+	// END test backup
+
+	// BEGIN verify backup
+	if err != nil {
+		t.Fatalf("BackupRBDVolumeWithOptions failed: %v", err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte("rbd diff v1\n")) {
+		t.Errorf("Expected an rbd export-diff stream, got prefix %q", buf.Bytes()[:min(buf.Len(), 12)])
+	}
+	output, err := exec.Command("rbd", "snap", "ls", rbdSpec).Output()
+	if err != nil {
+		t.Fatalf("Failed to list snapshots: %v", err)
+	}
+	if !strings.Contains(string(output), "incr") {
+		t.Errorf("Expected snapshot 'incr' to be kept, snapshots:\n%s", output)
+	}
+	// END verify backup
+}
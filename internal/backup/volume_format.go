@@ -17,13 +17,46 @@ package backup
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 
+	"github.com/PextraCloud/pxitool/internal/sparse"
 	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumeformat"
 )
 
 var (
-	QCOW2Signature = []byte{0x51, 0x46, 0x49, 0xfb} // QCOW2 signature ("magic number")
-	VMDKSignature  = []byte{0x4b, 0x44, 0x4d, 0x56} // VMware VMDK signature ("magic number")
+	QCOW2Signature   = []byte{0x51, 0x46, 0x49, 0xfb} // QCOW2 signature ("magic number")
+	VMDKSignature    = []byte{0x4b, 0x44, 0x4d, 0x56} // VMware VMDK signature ("magic number")
+	RBDDiffSignature = []byte{0x72, 0x62, 0x64, 0x20} // Start of the "rbd diff v1\n" export-diff header
+	BtrfsSignature   = []byte{0x62, 0x74, 0x72, 0x66} // Start of the "btrfs-stream" send stream header
+	VHDSignature     = []byte{0x63, 0x6f, 0x6e, 0x65} // Start of the "conectix" footer copy of dynamic VHDs
+	VHDXSignature    = []byte{0x76, 0x68, 0x64, 0x78} // VHDX file type identifier ("vhdx")
+
+	VHDFooterSignature = []byte("conectix") // Cookie of the footer at the end of every VHD
+)
+
+// Signatures at the start of disk image files. Unlike the signatures of
+// the streams in SVOL chunks, these never match the data of raw images
+// that happens to start with a stream header.
+var imageSignatures = []struct {
+	signature []byte
+	format    volumeformat.VolumeFormat
+}{
+	{QCOW2Signature, volumeformat.QCOW2},
+	{VMDKSignature, volumeformat.VMDK},
+	{[]byte("vhdxfile"), volumeformat.VHDX},
+	{VHDFooterSignature, volumeformat.VHD}, // Footer copy of dynamic VHDs
+}
+
+const (
+	// Size of the VHD footer. Images made by old versions of Virtual PC
+	// have a 511-byte footer instead.
+	vhdFooterSize = 512
+	vhdFixedDisk  = 2 // Disk type of fixed VHDs
 )
 
 func getVolumeFormat(data [4]byte) volumeformat.VolumeFormat {
@@ -32,8 +65,77 @@ func getVolumeFormat(data [4]byte) volumeformat.VolumeFormat {
 		return volumeformat.QCOW2
 	case bytes.Equal(data[:], VMDKSignature):
 		return volumeformat.VMDK
+	case bytes.Equal(data[:], RBDDiffSignature):
+		return volumeformat.RBDDiff
+	case bytes.Equal(data[:], BtrfsSignature):
+		return volumeformat.BtrfsStream
+	case bytes.Equal(data[:], VHDSignature):
+		return volumeformat.VHD
+	case bytes.Equal(data[:], VHDXSignature):
+		return volumeformat.VHDX
+	case bytes.Equal(data[:], sparse.Signature):
+		return volumeformat.SparseRaw
 	default:
 		// Default to Raw if no known signature matches
 		return volumeformat.Raw
 	}
 }
+
+// Detects the format of a disk image file. Fixed VHDs have no header, only
+// a footer at the end of the file. The end of a raw image is guest data, so
+// only files named as VHDs are checked for a footer, and it must be valid.
+func getImageFormat(filePath string) (volumeformat.VolumeFormat, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open source file: %w", err)
+	}
+	defer file.Close()
+
+	header := make([]byte, len(VHDFooterSignature))
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return 0, fmt.Errorf("failed to read source file: %w", err)
+	}
+	for _, image := range imageSignatures {
+		if bytes.HasPrefix(header[:n], image.signature) {
+			return image.format, nil
+		}
+	}
+	if !strings.EqualFold(filepath.Ext(filePath), ".vhd") {
+		return volumeformat.Raw, nil
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat source file: %w", err)
+	}
+	if info.Size() < vhdFooterSize {
+		return volumeformat.Raw, nil
+	}
+	footer := make([]byte, vhdFooterSize)
+	if _, err := file.ReadAt(footer, info.Size()-vhdFooterSize); err != nil {
+		return 0, fmt.Errorf("failed to read source file footer: %w", err)
+	}
+	if isFixedVHDFooter(footer, info.Size()-vhdFooterSize) || isFixedVHDFooter(footer[1:], info.Size()-vhdFooterSize+1) {
+		return volumeformat.VHD, nil
+	}
+	return volumeformat.Raw, nil
+}
+
+// Checks that footer is the footer of a fixed VHD whose disk is dataSize
+// bytes long, with a valid checksum.
+func isFixedVHDFooter(footer []byte, dataSize int64) bool {
+	if !bytes.HasPrefix(footer, VHDFooterSignature) {
+		return false
+	}
+	if binary.BigEndian.Uint64(footer[48:56]) != uint64(dataSize) || binary.BigEndian.Uint32(footer[60:64]) != vhdFixedDisk {
+		return false
+	}
+	var sum uint32
+	for i, b := range footer {
+		if i < 64 || i >= 68 {
+			sum += uint32(b)
+		}
+	}
+	return binary.BigEndian.Uint32(footer[64:68]) == ^sum
+}
@@ -16,10 +16,14 @@ limitations under the License.
 package backup
 
 import (
+	"encoding/binary"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
 	"testing"
 
+	"github.com/PextraCloud/pxitool/internal/sparse"
 	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumeformat"
 )
 
@@ -79,6 +83,49 @@ func TestGetVolumeFormat(t *testing.T) {
 			t.Errorf("expected volume format %q, but got %q", volumeformat.VMDK, result)
 		}
 	})
+	t.Run("VHD signature", func(t *testing.T) {
+		signature, ok := createAndReadSignature(t, "vpc")
+		if !ok {
+			return
+		}
+		result := getVolumeFormat(signature)
+		if result != volumeformat.VHD {
+			t.Errorf("expected volume format %q, but got %q", volumeformat.VHD, result)
+		}
+	})
+	t.Run("VHDX signature", func(t *testing.T) {
+		signature, ok := createAndReadSignature(t, "vhdx")
+		if !ok {
+			return
+		}
+		result := getVolumeFormat(signature)
+		if result != volumeformat.VHDX {
+			t.Errorf("expected volume format %q, but got %q", volumeformat.VHDX, result)
+		}
+	})
+	t.Run("RBD diff signature", func(t *testing.T) {
+		var input [4]byte
+		copy(input[:], "rbd diff v1\n")
+		result := getVolumeFormat(input)
+		if result != volumeformat.RBDDiff {
+			t.Errorf("expected volume format %q, but got %q", volumeformat.RBDDiff, result)
+		}
+	})
+	t.Run("btrfs stream signature", func(t *testing.T) {
+		var input [4]byte
+		copy(input[:], "btrfs-stream\x00")
+		result := getVolumeFormat(input)
+		if result != volumeformat.BtrfsStream {
+			t.Errorf("expected volume format %q, but got %q", volumeformat.BtrfsStream, result)
+		}
+	})
+	t.Run("Sparse raw signature", func(t *testing.T) {
+		input := [4]byte{0x50, 0x58, 0x53, 0x50}
+		result := getVolumeFormat(input)
+		if result != volumeformat.SparseRaw {
+			t.Errorf("expected volume format %q, but got %q", volumeformat.SparseRaw, result)
+		}
+	})
 	t.Run("Unknown signature (zeros)", func(t *testing.T) {
 		input := [4]byte{0x00, 0x00, 0x00, 0x00}
 		expected := volumeformat.Raw
@@ -96,3 +143,65 @@ func TestGetVolumeFormat(t *testing.T) {
 		}
 	})
 }
+
+// Returns the footer of a fixed VHD whose disk is dataSize bytes long.
+func fixedVHDFooter(dataSize int) []byte {
+	footer := make([]byte, vhdFooterSize)
+	copy(footer, VHDFooterSignature)
+	binary.BigEndian.PutUint64(footer[48:], uint64(dataSize))
+	binary.BigEndian.PutUint32(footer[60:], vhdFixedDisk)
+	var sum uint32
+	for _, b := range footer {
+		sum += uint32(b)
+	}
+	binary.BigEndian.PutUint32(footer[64:], ^sum)
+	return footer
+}
+
+func TestGetImageFormat(t *testing.T) {
+	dir := t.TempDir()
+	data := make([]byte, 64*1024)
+	footer := fixedVHDFooter(len(data))
+	badFooter := slices.Clone(footer)
+	badFooter[64]++
+	startingWith := func(header string) []byte {
+		contents := slices.Clone(data)
+		copy(contents, header)
+		return contents
+	}
+
+	tests := []struct {
+		name     string
+		contents []byte
+		expected volumeformat.VolumeFormat
+	}{
+		{"raw.img", data, volumeformat.Raw},
+		{"fixed.vhd", append(slices.Clone(data), footer...), volumeformat.VHD},
+		{"fixed-511.VHD", append(slices.Clone(data), footer[:511]...), volumeformat.VHD},
+		{"footer.img", append(slices.Clone(data), footer...), volumeformat.Raw},
+		{"bad-checksum.vhd", append(slices.Clone(data), badFooter...), volumeformat.Raw},
+		{"wrong-size.vhd", append(slices.Clone(data[1:]), footer...), volumeformat.Raw},
+		{"tiny.vhd", []byte("tiny"), volumeformat.Raw},
+		{"qcow2.img", append(slices.Clone(QCOW2Signature), footer...), volumeformat.QCOW2},
+		{"dynamic.img", startingWith("conectix"), volumeformat.VHD},
+		{"vhdx.img", startingWith("vhdxfile"), volumeformat.VHDX},
+		{"rbd-diff.img", startingWith("rbd diff v1\n"), volumeformat.Raw},
+		{"btrfs-stream.img", startingWith("btrfs-stream"), volumeformat.Raw},
+		{"sparse.img", startingWith(string(sparse.Signature)), volumeformat.Raw},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			if err := os.WriteFile(path, tt.contents, 0644); err != nil {
+				t.Fatalf("Failed to write image: %v", err)
+			}
+			format, err := getImageFormat(path)
+			if err != nil {
+				t.Fatalf("getImageFormat failed: %v", err)
+			}
+			if format != tt.expected {
+				t.Errorf("expected volume format %q, but got %q", tt.expected, format)
+			}
+		})
+	}
+}
@@ -19,7 +19,6 @@ import (
 	"fmt"
 	"io"
 	"os/exec"
-	"time"
 
 	"github.com/PextraCloud/pxitool/pkg/log"
 )
@@ -34,24 +33,38 @@ func pathToZFSDataset(volumePath string) string {
 	return datasetName
 }
 
-func BackupZFSVolume(volumePath string, writeStream io.Writer) error {
-	dataset := pathToZFSDataset(volumePath)
-
-	timestamp := time.Now().Format("20060102150405")
-	snapshotName := fmt.Sprintf("%s@pxitool_%s", dataset, timestamp)
-
-	// Create snapshot
-	createCmd := exec.Command("zfs", "snapshot", snapshotName)
+// Creates snapshots, given as dataset@name, atomically: snapshots of
+// datasets in the same pool are taken at the same moment.
+func createZFSSnapshots(snapshotNames ...string) error {
+	createCmd := exec.Command("zfs", append([]string{"snapshot"}, snapshotNames...)...)
 	if err := createCmd.Run(); err != nil {
 		return fmt.Errorf("failed to create snapshot: %w", err)
 	}
-	// Destroy snapshot after sending
-	defer func() {
-		deleteCmd := exec.Command("zfs", "destroy", snapshotName)
-		if err := deleteCmd.Run(); err != nil {
-			log.Warn("Failed to destroy ZFS snapshot %s: %v", snapshotName, err)
+	return nil
+}
+
+func destroyZFSSnapshot(snapshotName string) {
+	deleteCmd := exec.Command("zfs", "destroy", snapshotName)
+	if err := deleteCmd.Run(); err != nil {
+		log.Warn("Failed to destroy ZFS snapshot %s: %v", snapshotName, err)
+	}
+}
+
+func BackupZFSVolume(volumePath string, writeStream io.Writer) error {
+	return BackupZFSVolumeWithOptions(volumePath, Options{}, writeStream)
+}
+
+// Backs up a zvol or dataset from a temporary snapshot taken for the backup.
+func BackupZFSVolumeWithOptions(volumePath string, opts Options, writeStream io.Writer) error {
+	snapshotName := fmt.Sprintf("%s@%s", pathToZFSDataset(volumePath), opts.snapshotName())
+
+	if !opts.SnapshotPrepared {
+		if err := createZFSSnapshots(snapshotName); err != nil {
+			return err
 		}
-	}()
+		// Destroy snapshot after sending
+		defer destroyZFSSnapshot(snapshotName)
+	}
 
 	cmd := exec.Command("zfs", "send", snapshotName)
 	cmd.Stdout = writeStream
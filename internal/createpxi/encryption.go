@@ -17,13 +17,13 @@ package createpxi
 
 import (
 	"fmt"
-	"os"
+	"io"
 
 	"github.com/PextraCloud/pxitool/internal/encryption"
 	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/encr"
 )
 
-func getEncryptedWriter(file *os.File) (*encryption.EncryptedWriter, error) {
+func getEncryptedWriter(file io.Writer) (*encryption.EncryptedWriter, error) {
 	key, salt, err := encryption.CreateEncryptionKey()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create encryption key: %v", err)
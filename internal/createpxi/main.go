@@ -19,6 +19,9 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"slices"
+	"time"
 
 	"github.com/PextraCloud/pxitool/internal/backup"
 	"github.com/PextraCloud/pxitool/internal/encryption"
@@ -37,7 +40,188 @@ import (
 	"github.com/PextraCloud/pxitool/pkg/pxi/signature"
 )
 
-func Create(file *os.File, config *conf.InstanceConfigGeneric, rootfsPath string, compressionType compressiontype.CompressionType, encryptionType encryptiontype.EncryptionType, excludedVolumes []string) error {
+type chainRole int
+
+const (
+	notInChain   chainRole = iota
+	chainTop               // Active layer of a kept backing chain
+	chainBacking           // Backing image, which a running VM never writes to
+)
+
+// Adds the backing images of qcow2 volumes as volumes of their own, and
+// records the chain in the volume config. Backing images are not part of
+// config.Volumes, so they are only listed in the chain of their volume.
+// An image shared by several chains, such as a common base image, is
+// stored once, under the ID given by the first volume that uses it.
+func addBackingChains(volumes []*conf.InstanceVolume) ([]*conf.InstanceVolume, map[string]chainRole, error) {
+	roles := make(map[string]chainRole)
+	expanded := make([]*conf.InstanceVolume, 0, len(volumes))
+	stored := make(map[string]os.FileInfo) // Backing image files by volume ID
+	for _, volume := range volumes {
+		expanded = append(expanded, volume)
+		if volume.Type != volumetype.Directory && volume.Type != volumetype.NetFS {
+			continue
+		}
+
+		chain, err := backup.GetQEMUBackingChain(volume.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if chain[0].Format != "qcow2" {
+			log.Debug("Volume %s is a %s image, converting it", volume.ID, chain[0].Format)
+			continue
+		}
+		roles[volume.ID] = chainTop
+
+		volume.BackingChain = nil
+		for i, image := range chain[1:] {
+			info, err := os.Stat(image.Path)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to stat backing image %s: %v", image.Path, err)
+			}
+			backingID := findStoredImage(stored, info)
+			if backingID != "" {
+				log.Debug("Volume %s shares backing image %s (%s)", volume.ID, image.Path, backingID)
+			} else {
+				backingID = fmt.Sprintf("%s-backing-%d", volume.ID, i+1)
+				if slices.ContainsFunc(volumes, func(v *conf.InstanceVolume) bool { return v.ID == backingID }) {
+					return nil, nil, fmt.Errorf("volume ID %s is already used, cannot store backing image %s", backingID, image.Path)
+				}
+				log.Debug("Volume %s has backing image %s (%s)", volume.ID, image.Path, image.Format)
+
+				expanded = append(expanded, &conf.InstanceVolume{
+					ID:            backingID,
+					Type:          volume.Type,
+					StoragePoolID: volume.StoragePoolID,
+					Path:          image.Path,
+				})
+				roles[backingID] = chainBacking
+				stored[backingID] = info
+			}
+
+			volume.BackingChain = append(volume.BackingChain, conf.BackingImage{
+				ID:     backingID,
+				File:   filepath.Base(image.Path),
+				Format: image.Format,
+			})
+		}
+	}
+	return expanded, roles, nil
+}
+
+// Returns the volume ID of a stored backing image that is the same file,
+// even if reached through another path, or "" if there is none.
+func findStoredImage(stored map[string]os.FileInfo, info os.FileInfo) string {
+	for backingID, storedInfo := range stored {
+		if os.SameFile(storedInfo, info) {
+			return backingID
+		}
+	}
+	return ""
+}
+
+// Checks that a volume can be converted to the target format when stored.
+func checkTargetFormat(volume *conf.InstanceVolume, format volumeformat.VolumeFormat, role chainRole, opts Options) error {
+	if volume.Type != volumetype.Directory && volume.Type != volumetype.NetFS {
+		return fmt.Errorf("volume %s is a %s volume, only disk image files can be stored in another format", volume.ID, volume.Type)
+	}
+	if opts.StreamImages {
+		return fmt.Errorf("volume %s cannot be converted to %s when streaming disk images", volume.ID, format)
+	}
+	if role != notInChain {
+		return fmt.Errorf("volume %s cannot be converted to %s when keeping its backing chain", volume.ID, format)
+	}
+	switch format {
+	case volumeformat.Raw, volumeformat.QCOW2, volumeformat.VMDK, volumeformat.VHD, volumeformat.VHDX:
+		return nil
+	default:
+		return fmt.Errorf("volume %s cannot be stored as %s, supported formats: raw, qcow2, vmdk, vhd, vhdx", volume.ID, format)
+	}
+}
+
+// Resolves the backup options of each volume and records snapshot
+// relationships in the volume config, so they are stored in the image.
+func getBackupOptions(volumes []*conf.InstanceVolume, roles map[string]chainRole, opts Options) (map[string]backup.Options, error) {
+	for volumeID := range opts.ParentSnapshots {
+		if !slices.ContainsFunc(volumes, func(v *conf.InstanceVolume) bool { return v.ID == volumeID }) {
+			return nil, fmt.Errorf("parent snapshot given for volume %s, which is not in the config or is excluded", volumeID)
+		}
+	}
+	for volumeID := range opts.Formats {
+		if !slices.ContainsFunc(volumes, func(v *conf.InstanceVolume) bool { return v.ID == volumeID }) {
+			return nil, fmt.Errorf("format given for volume %s, which is not in the config or is excluded", volumeID)
+		}
+	}
+
+	snapshot := backup.NewSnapshotName()
+	backupOptions := make(map[string]backup.Options, len(volumes))
+	for _, volume := range volumes {
+		parent := opts.ParentSnapshots[volume.ID]
+		incremental := backup.SupportsIncremental(volume.Type)
+		if parent != "" && !incremental {
+			return nil, fmt.Errorf("incremental backups are not supported for %s volume %s", volume.Type, volume.ID)
+		}
+
+		var format *volumeformat.VolumeFormat
+		if f, found := opts.Formats[volume.ID]; found {
+			if err := checkTargetFormat(volume, f, roles[volume.ID], opts); err != nil {
+				return nil, err
+			}
+			format = &f
+		}
+
+		backupOpts := backup.Options{
+			Snapshot:       snapshot,
+			ParentSnapshot: parent,
+			KeepSnapshot:   opts.KeepSnapshots,
+			TmpDir:         opts.TmpDir,
+			StreamImages:   opts.StreamImages,
+			KeepImage:      roles[volume.ID] != notInChain,
+			Format:         format,
+			IDMap:          opts.IDMap,
+		}
+		// Only the images a running VM writes to need a live snapshot
+		if roles[volume.ID] != chainBacking {
+			backupOpts.QMPSocket = opts.QMPSocket
+			backupOpts.GuestAgentSocket = opts.GuestAgentSocket
+		}
+		backupOptions[volume.ID] = backupOpts
+
+		volume.ParentSnapshot = parent
+		if opts.KeepSnapshots && incremental {
+			volume.Snapshot = snapshot
+		}
+	}
+	return backupOptions, nil
+}
+
+// Takes the snapshots of all volumes together, and updates their backup
+// options to read from them.
+func snapshotVolumes(volumes []*conf.InstanceVolume, backupOptions map[string]backup.Options) (*backup.SnapshotGroup, error) {
+	payloads := make([]*backup.VolumeBackupPayload, len(volumes))
+	for i, volume := range volumes {
+		payloads[i] = &backup.VolumeBackupPayload{Path: volume.Path, Type: volume.Type, Options: backupOptions[volume.ID]}
+	}
+	group, err := backup.PrepareSnapshots(payloads)
+	if err != nil {
+		return nil, fmt.Errorf("failed to snapshot volumes: %v", err)
+	}
+	for i, volume := range volumes {
+		backupOptions[volume.ID] = payloads[i].Options
+	}
+	return group, nil
+}
+
+// Returns the snapshot time recorded in the config, which is only set when
+// every volume was captured from the snapshots of the group.
+func snapshotTime(group *backup.SnapshotGroup) string {
+	if !group.Complete {
+		return ""
+	}
+	return group.Time.UTC().Format(time.RFC3339)
+}
+
+func Create(file io.Writer, config *conf.InstanceConfigGeneric, rootfsPath string, compressionType compressiontype.CompressionType, encryptionType encryptiontype.EncryptionType, excludedVolumes []string, opts Options) error {
 	var writer io.Writer = file
 	var err error
 
@@ -61,6 +245,47 @@ func Create(file *os.File, config *conf.InstanceConfigGeneric, rootfsPath string
 		writer = encryptedWriter
 	}
 
+	// Select volumes, excluding specified ones
+	volumes := utils.GetVolumesFromConfig(config, excludedVolumes)
+	log.Debug("Backing up %d volumes, excluding %d volumes: %v", len(config.Volumes), len(excludedVolumes), excludedVolumes)
+
+	if config.Type == instancetype.LXC {
+		// Include rootfs path for LXC instances
+		rootfsType := volumetype.LXC_
+		if opts.RootfsBtrfs {
+			if opts.IDMap != nil {
+				return fmt.Errorf("an ID map cannot be applied to a btrfs rootfs")
+			}
+			rootfsType = volumetype.Btrfs
+		}
+		volumes = append(volumes, &conf.InstanceVolume{
+			ID:   "rootfs",
+			Type: rootfsType,
+			Path: rootfsPath,
+		})
+	}
+
+	var roles map[string]chainRole
+	if opts.KeepChains {
+		if volumes, roles, err = addBackingChains(volumes); err != nil {
+			return err
+		}
+	}
+
+	backupOptions, err := getBackupOptions(volumes, roles, opts)
+	if err != nil {
+		return err
+	}
+
+	// Snapshot every volume before any is read, and record when if none
+	// is read as is
+	group, err := snapshotVolumes(volumes, backupOptions)
+	if err != nil {
+		return err
+	}
+	defer group.Release()
+	config.SnapshotTime = snapshotTime(group)
+
 	// Write CONF chunk
 	var confChunk *conf.CONF
 	if confChunk, err = conf.New(config); err != nil {
@@ -70,30 +295,75 @@ func Create(file *os.File, config *conf.InstanceConfigGeneric, rootfsPath string
 		return fmt.Errorf("failed to write CONF chunk: %v", err)
 	}
 
-	// Write volumes, excluding specified ones
-	volumes := utils.GetVolumePathsFromConfig(config, excludedVolumes)
-	log.Debug("Backing up %d volumes, excluding %d volumes: %v", len(config.Volumes), len(excludedVolumes), excludedVolumes)
+	// Write volumes. Their lengths are patched into their SVOL chunks where
+	// the output can be seeked, and are otherwise found by spooling them.
+	// Encrypted SVOL chunks are always spooled: they cannot be patched, as
+	// the block holding the header would be sealed twice with one nonce.
+	seeker, seekable := seekableWriter(writer)
+	switch {
+	case opts.Parallel:
+		err = writeVolumesParallel(writer, volumes, backupOptions, opts.TmpDir)
+	case seekable:
+		err = writeVolumes(seeker, volumes, backupOptions)
+	default:
+		err = writeVolumesSpooled(writer, volumes, backupOptions, opts.TmpDir)
+	}
+	if err != nil {
+		return err
+	}
 
-	if config.Type == instancetype.LXC {
-		// Include rootfs path for LXC instances
-		volumes = append(volumes, rootfsPath)
-		config.Volumes = append(config.Volumes, conf.InstanceVolume{
-			ID:   "rootfs",
-			Type: volumetype.LXC_,
-		})
+	if err = group.Release(); err != nil {
+		return fmt.Errorf("failed to release snapshots: %v", err)
+	}
+
+	// Write IEND chunk
+	iendChunk := iend.New()
+	if err = writeChunk(writer, &iendChunk.Chunk); err != nil {
+		return fmt.Errorf("failed to write IEND chunk: %v", err)
+	}
+
+	// Flush buffers if using encrypted/compressed writer
+	if encryptedWriter != nil {
+		log.Debug("Flushing encrypted writer buffers...")
+		if err := encryptedWriter.Close(); err != nil {
+			return fmt.Errorf("failed to close encrypted writer: %v", err)
+		}
+	}
+	if closer, ok := writer.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			return fmt.Errorf("failed to close writer: %v", err)
+		}
+	}
+	return nil
+}
+
+// Returns w if it can be seeked back to patch a chunk, which encrypted
+// streams, pipes and sockets cannot.
+func seekableWriter(w io.Writer) (io.WriteSeeker, bool) {
+	seeker, ok := w.(io.WriteSeeker)
+	if !ok {
+		return nil, false
 	}
+	if _, err := seeker.Seek(0, io.SeekCurrent); err != nil {
+		return nil, false
+	}
+	return seeker, true
+}
+
+// Captures the volumes one at a time, straight into the image, patching
+// the length of each SVOL chunk once its data has been written.
+func writeVolumes(writer io.WriteSeeker, volumes []*conf.InstanceVolume, backupOptions map[string]backup.Options) error {
+	var err error
+	for i, volume := range volumes {
+		volumePath := volume.Path
 
-	for i, volumePath := range volumes {
-		// Save before position seek
 		// Save current file position to later update SVOL chunk length
 		var startPos int64
-		if seeker, ok := writer.(io.Seeker); ok {
-			if startPos, err = seeker.Seek(0, io.SeekCurrent); err != nil {
-				return fmt.Errorf("failed to get current file position: %v", err)
-			}
+		if startPos, err = writer.Seek(0, io.SeekCurrent); err != nil {
+			return fmt.Errorf("failed to get current file position: %v", err)
 		}
 
-		svolChunk := svol.New(config.Volumes[i].Type, config.Volumes[i].ID)
+		svolChunk := svol.New(volume.Type, volume.ID)
 		if err = writeChunk(writer, &svolChunk.Chunk); err != nil {
 			return fmt.Errorf("failed to write SVOL chunk for volume %s: %v", volumePath, err)
 		}
@@ -101,7 +371,7 @@ func Create(file *os.File, config *conf.InstanceConfigGeneric, rootfsPath string
 		log.Debug("Backing up volume %d/%d: %s", i+1, len(volumes), volumePath)
 		var bytesWritten int64
 		var volumeFormat *volumeformat.VolumeFormat
-		if bytesWritten, volumeFormat, err = backup.BackupVolume(volumePath, config.Volumes[i].Type, writer); err != nil {
+		if bytesWritten, volumeFormat, err = backup.BackupVolume(volumePath, volume.Type, writer, backupOptions[volume.ID]); err != nil {
 			return fmt.Errorf("failed to backup volume %s: %v", volumePath, err)
 		}
 		if volumeFormat == nil {
@@ -113,36 +383,15 @@ func Create(file *os.File, config *conf.InstanceConfigGeneric, rootfsPath string
 		svol.IncrementLength(svolChunk, uint64(bytesWritten))
 		svol.SetVolumeFormat(svolChunk, *volumeFormat)
 
-		// Change the length of the SVOL chunk in the writer (todo)
-		if seeker, ok := writer.(io.Seeker); ok {
-			if _, err = seeker.Seek(startPos, io.SeekStart); err != nil {
-				return fmt.Errorf("failed to seek back to SVOL chunk start position: %v", err)
-			}
-			if err = writeChunk(writer, &svolChunk.Chunk); err != nil {
-				return fmt.Errorf("failed to update SVOL chunk length: %v", err)
-			}
-			if _, err = seeker.Seek(0, io.SeekEnd); err != nil {
-				return fmt.Errorf("failed to seek back to end of file after updating SVOL chunk: %v", err)
-			}
+		// Change the length of the SVOL chunk in the writer
+		if _, err = writer.Seek(startPos, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to seek back to SVOL chunk start position: %v", err)
 		}
-	}
-
-	// Write IEND chunk
-	iendChunk := iend.New()
-	if err = writeChunk(writer, &iendChunk.Chunk); err != nil {
-		return fmt.Errorf("failed to write IEND chunk: %v", err)
-	}
-
-	// Flush buffers if using encrypted/compressed writer
-	if encryptedWriter != nil {
-		log.Debug("Flushing encrypted writer buffers...")
-		if err := encryptedWriter.Close(); err != nil {
-			return fmt.Errorf("failed to close encrypted writer: %v", err)
+		if err = writeChunk(writer, &svolChunk.Chunk); err != nil {
+			return fmt.Errorf("failed to update SVOL chunk length: %v", err)
 		}
-	}
-	if closer, ok := writer.(io.Closer); ok {
-		if err := closer.Close(); err != nil {
-			return fmt.Errorf("failed to close writer: %v", err)
+		if _, err = writer.Seek(0, io.SeekEnd); err != nil {
+			return fmt.Errorf("failed to seek back to end of file after updating SVOL chunk: %v", err)
 		}
 	}
 	return nil
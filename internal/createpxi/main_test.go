@@ -0,0 +1,193 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package createpxi
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/PextraCloud/pxitool/internal/backup"
+	"github.com/PextraCloud/pxitool/internal/encryption"
+	"github.com/PextraCloud/pxitool/internal/readpxi"
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/conf"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/compressiontype"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/encryptiontype"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/instancetype"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumetype"
+)
+
+// Writes disk images of different sizes, returning the config of a VM with
+// them as block volumes, and the data of each volume.
+func writeTestDisks(t *testing.T) (*conf.InstanceConfigGeneric, map[string][]byte) {
+	t.Helper()
+	dir := t.TempDir()
+	large := make([]byte, 5*1024*1024+123) // Mostly zeroes, across many encrypted blocks
+	copy(large, "start of disk")
+	copy(large[len(large)-11:], "end of disk")
+	disks := map[string][]byte{
+		"vol-tiny":  []byte("x"),
+		"vol-block": bytes.Repeat([]byte("0123456789abcdef"), encryption.BlockSize/16), // Exactly one encrypted block
+		"vol-large": large,
+	}
+	config := &conf.InstanceConfigGeneric{}
+	config.Type = instancetype.QEMU
+	config.Name = "vm"
+	config.Metadata = conf.InstanceMetadata{Type: "qemu", Qemu: &conf.InstanceMetadataQemu{}}
+	for _, id := range []string{"vol-tiny", "vol-block", "vol-large"} {
+		path := filepath.Join(dir, id+".img")
+		if err := os.WriteFile(path, disks[id], 0644); err != nil {
+			t.Fatalf("Failed to write disk image: %v", err)
+		}
+		config.Volumes = append(config.Volumes, conf.InstanceVolume{ID: id, Type: volumetype.Block, Path: path})
+	}
+	return config, disks
+}
+
+func TestCreate_RoundTrip(t *testing.T) {
+	config, disks := writeTestDisks(t)
+
+	tests := []struct {
+		name      string
+		encrypted bool
+		parallel  bool
+		pipe      bool // Write to a pipe, which cannot be seeked
+	}{
+		{"plain", false, false, false},
+		{"encrypted", true, false, false},
+		{"encrypted parallel", true, true, false},
+		{"plain pipe", false, false, true},
+		{"encrypted pipe", true, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encryptionType := encryptiontype.None
+			if tt.encrypted {
+				encryptionType = encryptiontype.AES256GCM
+				t.Setenv(encryption.KeyEnv, "secret")
+			}
+			path := filepath.Join(t.TempDir(), "vm.pxi")
+			output, err := os.Create(path)
+			if err != nil {
+				t.Fatalf("Failed to create output file: %v", err)
+			}
+			defer output.Close()
+
+			w := output
+			done := make(chan error, 1)
+			if tt.pipe {
+				r, pw, err := os.Pipe()
+				if err != nil {
+					t.Fatalf("Failed to create pipe: %v", err)
+				}
+				go func() {
+					_, err := io.Copy(output, r)
+					done <- err
+				}()
+				w = pw
+			} else {
+				done <- nil
+			}
+
+			opts := Options{TmpDir: t.TempDir(), Parallel: tt.parallel}
+			err = Create(w, config, "", compressiontype.None, encryptionType, nil, opts)
+			if tt.pipe {
+				// Create only closes its outermost writer
+				w.Close()
+			}
+			if err != nil {
+				t.Fatalf("Create failed: %v", err)
+			}
+			if err := <-done; err != nil {
+				t.Fatalf("Failed to copy the image from the pipe: %v", err)
+			}
+
+			vr, err := readpxi.OpenVolumes(path)
+			if err != nil {
+				t.Fatalf("OpenVolumes failed: %v", err)
+			}
+			defer vr.Close()
+			for _, expected := range config.Volumes {
+				svolData, err := vr.Next()
+				if err != nil {
+					t.Fatalf("Next failed before volume %s: %v", expected.ID, err)
+				}
+				if svolData.VolumeID != expected.ID {
+					t.Fatalf("Expected volume %s, got %s", expected.ID, svolData.VolumeID)
+				}
+				disk, size, err := vr.Disk()
+				if err != nil {
+					t.Fatalf("Failed to open disk of volume %s: %v", expected.ID, err)
+				}
+				data, err := io.ReadAll(io.NewSectionReader(disk, 0, size))
+				if err != nil || !bytes.Equal(data, disks[expected.ID]) {
+					t.Errorf("Expected the %d bytes of volume %s, got %d bytes (%v)", len(disks[expected.ID]), expected.ID, len(data), err)
+				}
+			}
+			if _, err := vr.Next(); err != io.EOF {
+				t.Errorf("Expected io.EOF after the last volume, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSnapshotTime(t *testing.T) {
+	taken := time.Date(2025, 6, 1, 12, 30, 0, 0, time.FixedZone("CEST", 2*60*60))
+	if got := snapshotTime(&backup.SnapshotGroup{Time: taken, Complete: true}); got != "2025-06-01T10:30:00Z" {
+		t.Errorf("Expected the snapshot time in UTC, got %q", got)
+	}
+	// Volumes read as is were not captured at that time
+	if got := snapshotTime(&backup.SnapshotGroup{Time: taken}); got != "" {
+		t.Errorf("Expected no snapshot time for an incomplete group, got %q", got)
+	}
+}
+
+func TestAddBackingChains_SharedBase(t *testing.T) {
+	if _, err := exec.LookPath("qemu-img"); err != nil {
+		t.Skip("Skipping backing chain test: command 'qemu-img' not found")
+	}
+	dir := t.TempDir()
+	basePath := filepath.Join(dir, "base.qcow2")
+	if output, err := exec.Command("qemu-img", "create", "-f", "qcow2", basePath, "1M").CombinedOutput(); err != nil {
+		t.Fatalf("qemu-img create failed: %v: %s", err, output)
+	}
+	var volumes []*conf.InstanceVolume
+	for _, id := range []string{"vol-1", "vol-2"} {
+		path := filepath.Join(dir, id+".qcow2")
+		if output, err := exec.Command("qemu-img", "create", "-f", "qcow2", "-b", basePath, "-F", "qcow2", path).CombinedOutput(); err != nil {
+			t.Fatalf("qemu-img create failed: %v: %s", err, output)
+		}
+		volumes = append(volumes, &conf.InstanceVolume{ID: id, Type: volumetype.Directory, Path: path})
+	}
+
+	expanded, roles, err := addBackingChains(volumes)
+	if err != nil {
+		t.Fatalf("addBackingChains failed: %v", err)
+	}
+	// The base image is stored once, and both chains refer to it
+	if len(expanded) != 3 || expanded[1].ID != "vol-1-backing-1" || roles["vol-1-backing-1"] != chainBacking {
+		t.Fatalf("Expected the base image to be added once, got %d volumes", len(expanded))
+	}
+	for _, volume := range volumes {
+		if len(volume.BackingChain) != 1 || volume.BackingChain[0].ID != "vol-1-backing-1" {
+			t.Errorf("Expected volume %s to have the shared base image, got %+v", volume.ID, volume.BackingChain)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package createpxi
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/PextraCloud/pxitool/internal/backup"
+	"github.com/PextraCloud/pxitool/pkg/log"
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/conf"
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/svol"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumeformat"
+)
+
+// A volume captured into a spool file, to be copied into the image.
+type spooledVolume struct {
+	file   *os.File
+	length int64
+	format *volumeformat.VolumeFormat
+}
+
+// Captures a volume into an unlinked spool file in tmpDir.
+func spoolVolume(volume *conf.InstanceVolume, opts backup.Options, tmpDir string) (*spooledVolume, error) {
+	file, err := os.CreateTemp(tmpDir, "pxitool-spool-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool file: %v", err)
+	}
+	// The data stays reachable through the open file
+	if err := os.Remove(file.Name()); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to unlink spool file: %v", err)
+	}
+
+	bytesWritten, volumeFormat, err := backup.BackupVolume(volume.Path, volume.Type, file, opts)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to backup volume %s: %v", volume.Path, err)
+	}
+	if volumeFormat == nil {
+		file.Close()
+		return nil, fmt.Errorf("unknown volume format for volume %s", volume.Path)
+	}
+	return &spooledVolume{file: file, length: bytesWritten, format: volumeFormat}, nil
+}
+
+// Captures every volume at once, each into its own spool file in tmpDir,
+// then writes them to the image in order. The volumes are read from the
+// snapshots that snapshotVolumes took of all of them beforehand.
+func writeVolumesParallel(writer io.Writer, volumes []*conf.InstanceVolume, backupOptions map[string]backup.Options, tmpDir string) error {
+	spooled := make([]*spooledVolume, len(volumes))
+	errs := make([]error, len(volumes))
+	defer func() {
+		for _, s := range spooled {
+			if s != nil {
+				s.file.Close()
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i, volume := range volumes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			log.Debug("Capturing volume %d/%d: %s", i+1, len(volumes), volume.Path)
+			spooled[i], errs[i] = spoolVolume(volume, backupOptions[volume.ID], tmpDir)
+			if errs[i] == nil {
+				log.Info("Captured volume %s (%d bytes)", volume.ID, spooled[i].length)
+			}
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, volume := range volumes {
+		if err := writeSpooled(writer, volume, spooled[i]); err != nil {
+			return err
+		}
+		log.Debug("Volume %d/%d (%s) written to the image (%d bytes).", i+1, len(volumes), spooled[i].format, spooled[i].length)
+	}
+	return nil
+}
+
+// Captures the volumes one at a time, each into a spool file in tmpDir
+// that is copied into the image before the next volume is captured. The
+// length of each volume is known before its SVOL chunk is written, for
+// outputs that cannot be seeked, such as pipes or encrypted streams.
+func writeVolumesSpooled(writer io.Writer, volumes []*conf.InstanceVolume, backupOptions map[string]backup.Options, tmpDir string) error {
+	for i, volume := range volumes {
+		log.Debug("Capturing volume %d/%d: %s", i+1, len(volumes), volume.Path)
+		s, err := spoolVolume(volume, backupOptions[volume.ID], tmpDir)
+		if err != nil {
+			return err
+		}
+		err = writeSpooled(writer, volume, s)
+		s.file.Close()
+		if err != nil {
+			return err
+		}
+		log.Debug("Volume %d/%d (%s) written to the image (%d bytes).", i+1, len(volumes), s.format, s.length)
+	}
+	return nil
+}
+
+// Writes the SVOL chunk of a spooled volume, followed by its data.
+func writeSpooled(writer io.Writer, volume *conf.InstanceVolume, s *spooledVolume) error {
+	svolChunk := svol.New(volume.Type, volume.ID)
+	svol.IncrementLength(svolChunk, uint64(s.length))
+	svol.SetVolumeFormat(svolChunk, *s.format)
+	if err := writeChunk(writer, &svolChunk.Chunk); err != nil {
+		return fmt.Errorf("failed to write SVOL chunk for volume %s: %v", volume.Path, err)
+	}
+
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind spool file of volume %s: %v", volume.Path, err)
+	}
+	if _, err := io.CopyN(writer, s.file, s.length); err != nil {
+		return fmt.Errorf("failed to copy volume %s into the image: %v", volume.Path, err)
+	}
+	return nil
+}
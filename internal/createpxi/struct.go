@@ -0,0 +1,36 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package createpxi
+
+import (
+	"github.com/PextraCloud/pxitool/internal/rootfs"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumeformat"
+)
+
+// Options controls how volumes are captured into the image.
+type Options struct {
+	ParentSnapshots  map[string]string                    // Map of volume IDs to the snapshot an incremental backup is taken from
+	KeepSnapshots    bool                                 // Keep backup snapshots so they can be parents of later incremental backups
+	RootfsBtrfs      bool                                 // Capture the LXC rootfs as a btrfs subvolume instead of a tar archive
+	TmpDir           string                               // Directory for scratch files, the system default if empty
+	StreamImages     bool                                 // Stream disk image files as sparse raw data instead of converting them to qcow2
+	Formats          map[string]volumeformat.VolumeFormat // Map of volume IDs to the format their disk image is stored in
+	KeepChains       bool                                 // Store qcow2 volumes as is, with each image of their backing chain in its own SVOL
+	QMPSocket        string                               // QMP socket of the running VM, for live backups of its disk images
+	GuestAgentSocket string                               // Guest agent socket of the running VM, to freeze its filesystems during live backups
+	IDMap            rootfs.IDMap                         // ID map of an unprivileged LXC container, to store its rootfs with container IDs
+	Parallel         bool                                 // Capture all volumes at once, from snapshots taken together, into spool files in TmpDir
+}
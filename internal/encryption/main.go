@@ -16,23 +16,31 @@ limitations under the License.
 package encryption
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
 	"fmt"
+	"os"
 	"syscall"
 
 	"github.com/PextraCloud/pxitool/internal/utils"
 	"golang.org/x/crypto/argon2"
 )
 
+// Environment variable the encryption key is read from, instead of
+// prompting for it.
+const KeyEnv = "PXI_ENCRYPTION_KEY"
+
 func promptForKey() ([]byte, error) {
 	// Check environment variable first
-	if envKey, found := syscall.Getenv("PXI_ENCRYPTION_KEY"); found {
+	if envKey, found := syscall.Getenv(KeyEnv); found {
 		return []byte(envKey), nil
 	}
 
-	fmt.Print("Enter encryption key: ")
+	// Prompt on stderr, as stdout may carry data
+	fmt.Fprint(os.Stderr, "Enter encryption key: ")
 	password, err := utils.ReadPassword(syscall.Stdin)
-	fmt.Println()
+	fmt.Fprintln(os.Stderr)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read password: %v", err)
 	}
@@ -95,3 +103,30 @@ func GenerateNonce() ([NonceSize]byte, error) {
 	}
 	return nonce, nil
 }
+
+// Creates the AES-GCM cipher for a key, checking the key and nonce sizes.
+func newAEAD(key []byte, nonce []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("invalid key size: expected %d bytes, got %d", KeySize, len(key))
+	}
+	if len(nonce) != NonceSize {
+		return nil, fmt.Errorf("invalid nonce size: expected %d bytes, got %d", NonceSize, len(nonce))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Returns the nonce of a block, which holds the block counter in its last
+// 8 bytes to ensure uniqueness.
+func blockNonce(nonce []byte, counter uint64) []byte {
+	nonceWithCounter := make([]byte, NonceSize)
+	copy(nonceWithCounter, nonce)
+	for i := range 8 {
+		nonceWithCounter[NonceSize-1-i] = byte(counter >> (i * 8))
+	}
+	return nonceWithCounter
+}
@@ -16,28 +16,13 @@ limitations under the License.
 package encryption
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
 	"encoding/binary"
-	"fmt"
 	"io"
 )
 
 // Creates a reader that decrypts data from the underlying reader using AES-GCM
 func NewDecryptedReader(r io.Reader, key []byte, nonce []byte) (*DecryptedReader, error) {
-	if len(key) != KeySize {
-		return nil, fmt.Errorf("invalid key size: expected %d bytes, got %d", KeySize, len(key))
-	}
-	if len(nonce) != NonceSize {
-		return nil, fmt.Errorf("invalid nonce size: expected %d bytes, got %d", NonceSize, len(nonce))
-	}
-
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
-	}
-
-	aesgcm, err := cipher.NewGCM(block)
+	aesgcm, err := newAEAD(key, nonce)
 	if err != nil {
 		return nil, err
 	}
@@ -71,33 +56,70 @@ func (dr *DecryptedReader) Read(p []byte) (int, error) {
 	return n, nil
 }
 
+// Skip discards the next n bytes of plaintext. If the underlying reader is
+// an io.Seeker, whole blocks are seeked over without being decrypted.
+func (dr *DecryptedReader) Skip(n int64) error {
+	seeker, canSeek := dr.r.(io.Seeker)
+	for n > 0 {
+		if dr.pos < dr.end {
+			buffered := int(min(n, int64(dr.end-dr.pos)))
+			dr.pos += buffered
+			n -= int64(buffered)
+			continue
+		}
+
+		size, err := dr.readBlockSize()
+		if err != nil {
+			return err
+		}
+		if size == 0 {
+			return io.ErrUnexpectedEOF
+		}
+		plaintextSize := int64(size) - int64(dr.aesgcm.Overhead())
+		if canSeek && plaintextSize <= n {
+			if _, err := seeker.Seek(int64(size), io.SeekCurrent); err != nil {
+				return err
+			}
+			dr.counter++
+			n -= plaintextSize
+			continue
+		}
+		if err := dr.decryptBlock(size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // readNextBlock reads the next encrypted block and decrypts it
 func (dr *DecryptedReader) readNextBlock() error {
-	// Read the size of the next ciphertext block
-	lenBuf := make([]byte, 4)
-	if _, err := io.ReadFull(dr.r, lenBuf); err != nil {
+	size, err := dr.readBlockSize()
+	if err != nil {
 		return err
 	}
-
-	size := binary.BigEndian.Uint32(lenBuf)
 	if size == 0 {
 		return io.EOF
 	}
+	return dr.decryptBlock(size)
+}
+
+// Reads the size of the next ciphertext block
+func (dr *DecryptedReader) readBlockSize() (uint32, error) {
+	lenBuf := make([]byte, 4)
+	if _, err := io.ReadFull(dr.r, lenBuf); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(lenBuf), nil
+}
 
+func (dr *DecryptedReader) decryptBlock(size uint32) error {
 	// Read the ciphertext
 	ciphertext := make([]byte, size)
 	if _, err := io.ReadFull(dr.r, ciphertext); err != nil {
 		return err
 	}
 
-	// Create a nonce with a counter to ensure uniqueness
-	nonceWithCounter := make([]byte, NonceSize)
-	copy(nonceWithCounter, dr.nonce)
-
-	// Use the last 8 bytes for a counter
-	for i := range 8 {
-		nonceWithCounter[NonceSize-1-i] = byte(dr.counter >> (i * 8))
-	}
+	nonceWithCounter := blockNonce(dr.nonce, dr.counter)
 	dr.counter++
 
 	// Decrypt the ciphertext
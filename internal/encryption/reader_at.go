@@ -0,0 +1,117 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package encryption
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DecryptedReaderAt decrypts data at any offset of an encrypted stream. It
+// relies on every block but the last holding BlockSize bytes of plaintext,
+// as written by EncryptedWriter, so that each block is at a fixed offset.
+// It is safe for concurrent use.
+type DecryptedReaderAt struct {
+	r      io.ReaderAt
+	offset int64 // Offset of the encrypted stream in r
+	aesgcm cipher.AEAD
+	nonce  []byte
+
+	mu          sync.Mutex
+	cachedIndex int64 // Index of the last decrypted block, or -1
+	cached      []byte
+}
+
+// Creates a reader that decrypts the stream starting at offset in r.
+func NewDecryptedReaderAt(r io.ReaderAt, offset int64, key []byte, nonce []byte) (*DecryptedReaderAt, error) {
+	aesgcm, err := newAEAD(key, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return &DecryptedReaderAt{
+		r:           r,
+		offset:      offset,
+		aesgcm:      aesgcm,
+		nonce:       nonce,
+		cachedIndex: -1,
+	}, nil
+}
+
+// ReadAt implements io.ReaderAt for the plaintext of the stream.
+func (dr *DecryptedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		plaintext, err := dr.block(pos / BlockSize)
+		if err != nil {
+			return n, err
+		}
+		inBlock := int(pos % BlockSize)
+		if inBlock >= len(plaintext) {
+			return n, io.EOF
+		}
+		n += copy(p[n:], plaintext[inBlock:])
+	}
+	return n, nil
+}
+
+// Returns the plaintext of a block, or io.EOF past the end of the stream.
+func (dr *DecryptedReaderAt) block(index int64) ([]byte, error) {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	if index == dr.cachedIndex {
+		return dr.cached, nil
+	}
+
+	fullSize := int64(BlockSize + dr.aesgcm.Overhead())
+	blockOffset := dr.offset + index*(4+fullSize)
+	var lenBuf [4]byte
+	if _, err := dr.r.ReadAt(lenBuf[:], blockOffset); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	size := int64(binary.BigEndian.Uint32(lenBuf[:]))
+	if size == 0 {
+		return nil, io.EOF
+	}
+	if size > fullSize {
+		return nil, fmt.Errorf("encrypted block %d is too large: %d bytes", index, size)
+	}
+
+	ciphertext := make([]byte, size)
+	if _, err := dr.r.ReadAt(ciphertext, blockOffset+4); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	plaintext, err := dr.aesgcm.Open(nil, blockNonce(dr.nonce, uint64(index)), ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt block %d: %w", index, err)
+	}
+
+	dr.cachedIndex, dr.cached = index, plaintext
+	return plaintext, nil
+}
@@ -22,6 +22,7 @@ import (
 
 const (
 	NonceSize = 12
+	BlockSize = 16 * 1024 // Plaintext size of each encrypted block, except the last
 )
 
 type EncryptedWriter struct {
@@ -16,9 +16,6 @@ limitations under the License.
 package encryption
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"fmt"
 	"io"
 )
 
@@ -28,30 +25,17 @@ const (
 
 // Creates a writer that encrypts data using AES-256-GCM
 func NewWriter(w io.Writer, key []byte, nonce []byte) (*EncryptedWriter, error) {
-	if len(key) != KeySize {
-		return nil, fmt.Errorf("invalid key size: expected %d bytes, got %d", KeySize, len(key))
-	}
-	if len(nonce) != NonceSize {
-		return nil, fmt.Errorf("invalid nonce size: expected %d bytes, got %d", NonceSize, len(nonce))
-	}
-
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
-	}
-
-	aesgcm, err := cipher.NewGCM(block)
+	aesgcm, err := newAEAD(key, nonce)
 	if err != nil {
 		return nil, err
 	}
 
 	return &EncryptedWriter{
-		w:       w,
-		aesgcm:  aesgcm,
-		nonce:   nonce,
-		counter: 0,
-		// Buffer is 16KB
-		buf:      make([]byte, 16*1024),
+		w:        w,
+		aesgcm:   aesgcm,
+		nonce:    nonce,
+		counter:  0,
+		buf:      make([]byte, BlockSize),
 		blockPos: 0,
 	}, nil
 }
@@ -97,14 +81,7 @@ func (ew *EncryptedWriter) flushBuffer() error {
 		return nil
 	}
 
-	// Create a nonce with a counter to ensure uniqueness
-	nonceWithCounter := make([]byte, NonceSize)
-	copy(nonceWithCounter, ew.nonce)
-
-	// Use the last 8 bytes for a counter
-	for i := range 8 {
-		nonceWithCounter[NonceSize-1-i] = byte(ew.counter >> (i * 8))
-	}
+	nonceWithCounter := blockNonce(ew.nonce, ew.counter)
 	ew.counter++
 
 	// Encrypt the data
@@ -0,0 +1,222 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// FileInfo describes a file of the filesystem.
+type FileInfo struct {
+	Name     string // Path relative to the root of the filesystem, "." for the root
+	Mode     fs.FileMode
+	Uid      uint32
+	Gid      uint32
+	Size     int64
+	ModTime  time.Time
+	Linkname string // Target of a symlink
+}
+
+type dirEntry struct {
+	name  string
+	inode uint32
+}
+
+// Stat returns the file at name, such as "etc/hostname". Symlinks are not
+// followed.
+func (f *FS) Stat(name string) (*FileInfo, error) {
+	name = cleanPath(name)
+	ino, err := f.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return f.fileInfo(name, ino)
+}
+
+// ReadDir returns the files of the directory at name, sorted by name.
+func (f *FS) ReadDir(name string) ([]*FileInfo, error) {
+	name = cleanPath(name)
+	dir, err := f.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if !dir.isDir() {
+		return nil, fmt.Errorf("%s is not a directory", name)
+	}
+	entries, err := f.readDirEntries(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory %s: %w", name, err)
+	}
+
+	files := make([]*FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		ino, err := f.readInode(entry.inode)
+		if err != nil {
+			return nil, err
+		}
+		file, err := f.fileInfo(path.Join(name, entry.name), ino)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	slices.SortFunc(files, func(a, b *FileInfo) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return files, nil
+}
+
+func cleanPath(name string) string {
+	return path.Clean(strings.TrimLeft(name, "/"))
+}
+
+func (f *FS) fileInfo(name string, ino *inode) (*FileInfo, error) {
+	file := &FileInfo{
+		Name:    name,
+		Mode:    ino.fileMode(),
+		Uid:     ino.uid,
+		Gid:     ino.gid,
+		Size:    ino.size,
+		ModTime: ino.mtime,
+	}
+	if file.Mode&fs.ModeSymlink != 0 {
+		target, err := f.readlink(ino)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read symlink %s: %w", name, err)
+		}
+		file.Linkname = target
+	}
+	return file, nil
+}
+
+// Returns the inode at a cleaned path, without following symlinks.
+func (f *FS) lookup(name string) (*inode, error) {
+	ino, err := f.readInode(rootInode)
+	if err != nil {
+		return nil, err
+	}
+	if name == "." {
+		return ino, nil
+	}
+
+	walked := "."
+	for _, element := range strings.Split(name, "/") {
+		if !ino.isDir() {
+			return nil, fmt.Errorf("%s is not a directory", walked)
+		}
+		entries, err := f.readDirEntries(ino)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read directory %s: %w", walked, err)
+		}
+		walked = path.Join(walked, element)
+
+		index := slices.IndexFunc(entries, func(entry dirEntry) bool { return entry.name == element })
+		if index < 0 {
+			return nil, fmt.Errorf("%s: %w", walked, fs.ErrNotExist)
+		}
+		if ino, err = f.readInode(entries[index].inode); err != nil {
+			return nil, err
+		}
+	}
+	return ino, nil
+}
+
+// Reads the entries of a directory, other than "." and "..". Hashed
+// directories are read linearly, as their index blocks look like empty
+// directory blocks.
+func (f *FS) readDirEntries(dir *inode) ([]dirEntry, error) {
+	if dir.flags&flagEncrypt != 0 {
+		return nil, fmt.Errorf("directory is encrypted")
+	}
+	data, err := f.readData(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Inline directories start with the parent inode instead of entries
+	if dir.flags&flagInlineData != 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("inline directory is too short")
+		}
+		return f.parseDirBlock(data[4:])
+	}
+
+	var entries []dirEntry
+	for offset := int64(0); offset < int64(len(data)); offset += f.blockSize {
+		blockEntries, err := f.parseDirBlock(data[offset:min(offset+f.blockSize, int64(len(data)))])
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, blockEntries...)
+	}
+	return entries, nil
+}
+
+func (f *FS) parseDirBlock(block []byte) ([]dirEntry, error) {
+	var entries []dirEntry
+	for offset := 0; offset+8 <= len(block); {
+		number := binary.LittleEndian.Uint32(block[offset:])
+		recordLength := f.recordLength(binary.LittleEndian.Uint16(block[offset+4:]))
+		nameLength := int(block[offset+6])
+		if f.incompat&incompatFiletype == 0 {
+			nameLength = int(binary.LittleEndian.Uint16(block[offset+6:]))
+		}
+		if recordLength < 8 || offset+recordLength > len(block) || 8+nameLength > recordLength {
+			return nil, fmt.Errorf("invalid directory entry at offset %d", offset)
+		}
+
+		name := string(block[offset+8 : offset+8+nameLength])
+		if number != 0 && name != "." && name != ".." {
+			entries = append(entries, dirEntry{name: name, inode: number})
+		}
+		offset += recordLength
+	}
+	return entries, nil
+}
+
+// Decodes the record length of a directory entry, which needs more than
+// 16 bits in 64 KiB blocks.
+func (f *FS) recordLength(length uint16) int {
+	if f.blockSize < 65536 {
+		return int(length)
+	}
+	if length == 65535 || length == 0 {
+		return int(f.blockSize)
+	}
+	return int(length&65532) | int(length&3)<<16
+}
+
+// Returns the target of a symlink. Targets shorter than 60 bytes are
+// usually stored in the inode itself.
+func (f *FS) readlink(ino *inode) (string, error) {
+	if ino.flags&(flagExtents|flagInlineData) == 0 && ino.size >= 0 && ino.size < inlineSize {
+		return string(ino.block[:ino.size]), nil
+	}
+	if ino.flags&flagEncrypt != 0 {
+		return "", fmt.Errorf("symlink is encrypted")
+	}
+	data, err := f.readData(ino)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
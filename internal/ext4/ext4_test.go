@@ -0,0 +1,143 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ext4
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Builds a filesystem image from a directory tree with mkfs.ext4.
+func makeImage(t *testing.T, args ...string) *os.File {
+	t.Helper()
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("Skipping ext4 test: command 'mkfs.ext4' not found")
+	}
+
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "etc", "many"), 0755); err != nil {
+		t.Fatalf("Failed to create directories: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "etc", "hostname"), []byte("container\n"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if err := os.Symlink("hostname", filepath.Join(root, "etc", "short.link")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	longTarget := strings.Repeat("long/", 30) + "target"
+	if err := os.Symlink(longTarget, filepath.Join(root, "etc", "long.link")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	// Enough entries for a hashed directory spanning indirect blocks
+	for i := range 2000 {
+		if err := os.WriteFile(filepath.Join(root, "etc", "many", fmt.Sprintf("file-%04d", i)), nil, 0600); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+	mtime := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(root, "etc", "hostname"), mtime, mtime); err != nil {
+		t.Fatalf("Failed to set times: %v", err)
+	}
+
+	image := filepath.Join(t.TempDir(), "fs.img")
+	args = append(append([]string{"-q", "-F", "-L", "test", "-d", root}, args...), image, "32M")
+	if output, err := exec.Command("mkfs.ext4", args...).CombinedOutput(); err != nil {
+		t.Fatalf("mkfs.ext4 failed: %v\n%s", err, output)
+	}
+	file, err := os.Open(image)
+	if err != nil {
+		t.Fatalf("Failed to open image: %v", err)
+	}
+	t.Cleanup(func() { file.Close() })
+	return file
+}
+
+func TestFS(t *testing.T) {
+	testCases := []struct {
+		name string
+		args []string
+	}{
+		{"ext4", nil},
+		{"ext4 64bit", []string{"-O", "64bit,metadata_csum"}},
+		{"ext4 inline data", []string{"-O", "inline_data"}},
+		{"ext4 meta_bg", []string{"-O", "meta_bg,^resize_inode", "-b", "1024"}},
+		{"ext2 1k blocks", []string{"-t", "ext2", "-b", "1024"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := Open(makeImage(t, tc.args...))
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			if f.Label != "test" {
+				t.Errorf("Expected label test, got %q", f.Label)
+			}
+
+			files, err := f.ReadDir("/etc")
+			if err != nil {
+				t.Fatalf("ReadDir failed: %v", err)
+			}
+			var names []string
+			for _, file := range files {
+				names = append(names, file.Name)
+			}
+			expected := []string{"etc/hostname", "etc/long.link", "etc/many", "etc/short.link"}
+			if strings.Join(names, ",") != strings.Join(expected, ",") {
+				t.Errorf("Expected %v, got %v", expected, names)
+			}
+
+			hostname, err := f.Stat("etc/hostname")
+			if err != nil {
+				t.Fatalf("Stat failed: %v", err)
+			}
+			if hostname.Size != 10 || hostname.Mode != 0644 || !hostname.ModTime.Equal(time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)) {
+				t.Errorf("Unexpected file info for hostname: %+v", hostname)
+			}
+			if link, err := f.Stat("etc/short.link"); err != nil || link.Linkname != "hostname" || link.Mode&fs.ModeSymlink == 0 {
+				t.Errorf("Expected a symlink to hostname, got %+v (%v)", link, err)
+			}
+			if link, err := f.Stat("etc/long.link"); err != nil || !strings.HasSuffix(link.Linkname, "/target") || len(link.Linkname) != 156 {
+				t.Errorf("Expected a long symlink, got %+v (%v)", link, err)
+			}
+
+			many, err := f.ReadDir("etc/many")
+			if err != nil || len(many) != 2000 || many[1999].Name != "etc/many/file-1999" {
+				t.Errorf("Expected 2000 files in etc/many, got %d (%v)", len(many), err)
+			}
+
+			if _, err := f.Stat("etc/missing"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Expected a not found error, got %v", err)
+			}
+			if _, err := f.ReadDir("etc/hostname"); err == nil {
+				t.Error("Expected an error for listing a file")
+			}
+		})
+	}
+}
+
+func TestOpen_NotExt4(t *testing.T) {
+	if _, err := Open(strings.NewReader(strings.Repeat("\x00", 4096))); err == nil {
+		t.Error("Expected an error for a disk without a filesystem")
+	}
+}
@@ -0,0 +1,192 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Package ext4 lists the contents of ext2, ext3 and ext4 filesystems,
+// read-only and without mounting them.
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/PextraCloud/pxitool/pkg/log"
+)
+
+// https://docs.kernel.org/filesystems/ext4/index.html
+const (
+	superblockOffset = 1024
+	superblockSize   = 1024
+	magic            = 0xef53
+	rootInode        = 2
+
+	// Compatible features
+	compatSparseSuper2 = 0x200
+
+	// Read-only compatible features
+	roCompatSparseSuper = 0x1
+
+	// Incompatible features
+	incompatCompression = 0x1
+	incompatFiletype    = 0x2
+	incompatRecover     = 0x4
+	incompatJournalDev  = 0x8
+	incompatMetaBG      = 0x10
+	incompat64Bit       = 0x80
+	incompatDirData     = 0x1000
+	unsupportedIncompat = incompatCompression | incompatJournalDev | incompatDirData
+)
+
+// FS is a read-only ext2, ext3 or ext4 filesystem.
+type FS struct {
+	r              io.ReaderAt
+	blockSize      int64
+	blocksCount    uint64
+	firstDataBlock uint64
+	blocksPerGroup uint64
+	inodesPerGroup uint64
+	inodesCount    uint64
+	inodeSize      int64
+	descSize       int64
+	firstMetaBG    uint64
+	compat         uint32
+	roCompat       uint32
+	incompat       uint32
+	inodeTables    map[uint64]uint64 // First block of the inode table of each group read
+
+	// Label is the volume name of the filesystem.
+	Label string
+}
+
+// Open reads the superblock of the filesystem read from r.
+func Open(r io.ReaderAt) (*FS, error) {
+	sb := make([]byte, superblockSize)
+	if _, err := r.ReadAt(sb, superblockOffset); err != nil {
+		return nil, fmt.Errorf("failed to read ext4 superblock: %w", err)
+	}
+	if binary.LittleEndian.Uint16(sb[0x38:]) != magic {
+		return nil, fmt.Errorf("not an ext2, ext3 or ext4 filesystem")
+	}
+
+	logBlockSize := binary.LittleEndian.Uint32(sb[0x18:])
+	if logBlockSize > 6 {
+		return nil, fmt.Errorf("invalid ext4 block size %d", 1024<<logBlockSize)
+	}
+	f := &FS{
+		r:              r,
+		blockSize:      1024 << logBlockSize,
+		blocksCount:    uint64(binary.LittleEndian.Uint32(sb[0x4:])),
+		firstDataBlock: uint64(binary.LittleEndian.Uint32(sb[0x14:])),
+		blocksPerGroup: uint64(binary.LittleEndian.Uint32(sb[0x20:])),
+		inodesPerGroup: uint64(binary.LittleEndian.Uint32(sb[0x28:])),
+		inodesCount:    uint64(binary.LittleEndian.Uint32(sb[0x0:])),
+		inodeSize:      128,
+		descSize:       32,
+		compat:         binary.LittleEndian.Uint32(sb[0x5c:]),
+		incompat:       binary.LittleEndian.Uint32(sb[0x60:]),
+		roCompat:       binary.LittleEndian.Uint32(sb[0x64:]),
+		firstMetaBG:    uint64(binary.LittleEndian.Uint32(sb[0x104:])),
+		Label:          strings.TrimRight(string(sb[0x78:0x88]), "\x00"),
+		inodeTables:    make(map[uint64]uint64),
+	}
+	if unsupported := f.incompat & unsupportedIncompat; unsupported != 0 {
+		return nil, fmt.Errorf("ext4 filesystem has unsupported incompatible features: %#x", unsupported)
+	}
+	if f.incompat&incompatRecover != 0 {
+		log.Warn("ext4 journal needs recovery, recent changes may be missing")
+	}
+	if binary.LittleEndian.Uint32(sb[0x4c:]) >= 1 {
+		f.inodeSize = int64(binary.LittleEndian.Uint16(sb[0x58:]))
+	}
+	if f.incompat&incompat64Bit != 0 {
+		f.blocksCount |= uint64(binary.LittleEndian.Uint32(sb[0x150:])) << 32
+		f.descSize = int64(binary.LittleEndian.Uint16(sb[0xfe:]))
+	}
+	if f.inodeSize < 128 || f.inodeSize > f.blockSize || f.inodeSize&(f.inodeSize-1) != 0 {
+		return nil, fmt.Errorf("invalid ext4 inode size %d", f.inodeSize)
+	}
+	if f.descSize < 32 || f.descSize > f.blockSize {
+		return nil, fmt.Errorf("invalid ext4 group descriptor size %d", f.descSize)
+	}
+	if f.blocksPerGroup == 0 || f.inodesPerGroup == 0 {
+		return nil, fmt.Errorf("invalid ext4 group size")
+	}
+	return f, nil
+}
+
+// Reads a block of the filesystem.
+func (f *FS) readBlock(block uint64) ([]byte, error) {
+	if block >= f.blocksCount {
+		return nil, fmt.Errorf("block %d is beyond the end of the filesystem", block)
+	}
+	buf := make([]byte, f.blockSize)
+	if _, err := f.r.ReadAt(buf, int64(block)*f.blockSize); err != nil {
+		return nil, fmt.Errorf("failed to read block %d: %w", block, err)
+	}
+	return buf, nil
+}
+
+// Returns whether a block group holds a backup of the superblock and
+// group descriptors.
+func (f *FS) hasSuper(group uint64) bool {
+	if group <= 1 || f.roCompat&roCompatSparseSuper == 0 {
+		return true
+	}
+	if f.compat&compatSparseSuper2 != 0 {
+		return false
+	}
+	for _, base := range []uint64{3, 5, 7} {
+		n := base
+		for n < group {
+			n *= base
+		}
+		if n == group {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the first block of the inode table of a block group.
+func (f *FS) inodeTable(group uint64) (uint64, error) {
+	if table, found := f.inodeTables[group]; found {
+		return table, nil
+	}
+	descPerBlock := uint64(f.blockSize / f.descSize)
+	var block uint64
+	if f.incompat&incompatMetaBG != 0 && group/descPerBlock >= f.firstMetaBG {
+		// Each meta group keeps its descriptors in its first group
+		firstGroup := group / descPerBlock * descPerBlock
+		block = f.firstDataBlock + firstGroup*f.blocksPerGroup
+		if f.hasSuper(firstGroup) {
+			block++
+		}
+	} else {
+		block = f.firstDataBlock + 1 + group/descPerBlock
+	}
+
+	buf, err := f.readBlock(block)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read group descriptor %d: %w", group, err)
+	}
+	desc := buf[int64(group%descPerBlock)*f.descSize:]
+	table := uint64(binary.LittleEndian.Uint32(desc[0x8:]))
+	if f.descSize >= 64 {
+		table |= uint64(binary.LittleEndian.Uint32(desc[0x28:])) << 32
+	}
+	f.inodeTables[group] = table
+	return table, nil
+}
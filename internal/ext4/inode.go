@@ -0,0 +1,256 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"time"
+)
+
+const (
+	// Inode flags
+	flagEncrypt    = 0x800
+	flagExtents    = 0x80000
+	flagInlineData = 0x10000000
+
+	// File types of the inode mode
+	typeMask    = 0xf000
+	typeFIFO    = 0x1000
+	typeChar    = 0x2000
+	typeDir     = 0x4000
+	typeBlock   = 0x6000
+	typeRegular = 0x8000
+	typeSymlink = 0xa000
+	typeSocket  = 0xc000
+
+	inlineSize     = 60 // Size of the block map, extent tree root or inline data in an inode
+	extentMagic    = 0xf30a
+	maxExtentDepth = 5
+	maxDataSize    = 64 << 20 // Largest directory or symlink target read into memory
+)
+
+type inode struct {
+	number uint32
+	mode   uint16
+	uid    uint32
+	gid    uint32
+	size   int64
+	mtime  time.Time
+	flags  uint32
+	block  []byte // Block map, extent tree root or inline data
+}
+
+func (f *FS) readInode(number uint32) (*inode, error) {
+	if number == 0 || uint64(number) > f.inodesCount {
+		return nil, fmt.Errorf("invalid inode number %d", number)
+	}
+	group := uint64(number-1) / f.inodesPerGroup
+	index := uint64(number-1) % f.inodesPerGroup
+	table, err := f.inodeTable(group)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, f.inodeSize)
+	if _, err := f.r.ReadAt(buf, int64(table)*f.blockSize+int64(index)*f.inodeSize); err != nil {
+		return nil, fmt.Errorf("failed to read inode %d: %w", number, err)
+	}
+
+	ino := &inode{
+		number: number,
+		mode:   binary.LittleEndian.Uint16(buf[0x0:]),
+		uid:    uint32(binary.LittleEndian.Uint16(buf[0x2:])) | uint32(binary.LittleEndian.Uint16(buf[0x78:]))<<16,
+		gid:    uint32(binary.LittleEndian.Uint16(buf[0x18:])) | uint32(binary.LittleEndian.Uint16(buf[0x7a:]))<<16,
+		size:   int64(binary.LittleEndian.Uint32(buf[0x4:])) | int64(binary.LittleEndian.Uint32(buf[0x6c:]))<<32,
+		flags:  binary.LittleEndian.Uint32(buf[0x20:]),
+		block:  buf[0x28 : 0x28+inlineSize],
+	}
+
+	// Large inodes extend the timestamps with an epoch and nanoseconds
+	seconds := int64(int32(binary.LittleEndian.Uint32(buf[0x10:])))
+	var nanoseconds int64
+	if f.inodeSize > 128 && binary.LittleEndian.Uint16(buf[0x80:]) >= 12 {
+		extra := binary.LittleEndian.Uint32(buf[0x88:])
+		seconds += int64(extra&3) << 32
+		nanoseconds = int64(extra >> 2)
+	}
+	ino.mtime = time.Unix(seconds, nanoseconds)
+	return ino, nil
+}
+
+func (ino *inode) isDir() bool {
+	return ino.mode&typeMask == typeDir
+}
+
+// Returns the mode of an inode as an fs.FileMode.
+func (ino *inode) fileMode() fs.FileMode {
+	mode := fs.FileMode(ino.mode & 0o777)
+	if ino.mode&0o4000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if ino.mode&0o2000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if ino.mode&0o1000 != 0 {
+		mode |= fs.ModeSticky
+	}
+	switch ino.mode & typeMask {
+	case typeDir:
+		mode |= fs.ModeDir
+	case typeSymlink:
+		mode |= fs.ModeSymlink
+	case typeChar:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case typeBlock:
+		mode |= fs.ModeDevice
+	case typeFIFO:
+		mode |= fs.ModeNamedPipe
+	case typeSocket:
+		mode |= fs.ModeSocket
+	case typeRegular:
+	default:
+		mode |= fs.ModeIrregular
+	}
+	return mode
+}
+
+// Reads the whole contents of a small file, such as a directory or a
+// symlink target. Holes and uninitialized extents read as zeroes.
+func (f *FS) readData(ino *inode) ([]byte, error) {
+	if ino.size < 0 || ino.size > maxDataSize {
+		return nil, fmt.Errorf("inode %d is too large to read: %d bytes", ino.number, ino.size)
+	}
+	if ino.flags&flagInlineData != 0 {
+		if ino.size > inlineSize {
+			return nil, fmt.Errorf("inode %d has inline data beyond the inode, which is not supported", ino.number)
+		}
+		return ino.block[:ino.size], nil
+	}
+
+	data := make([]byte, ino.size)
+	count := uint64((ino.size + f.blockSize - 1) / f.blockSize)
+	readBlock := func(logical, physical uint64) error {
+		block, err := f.readBlock(physical)
+		if err != nil {
+			return err
+		}
+		copy(data[int64(logical)*f.blockSize:], block)
+		return nil
+	}
+
+	if ino.flags&flagExtents != 0 {
+		return data, f.walkExtents(ino.block, maxExtentDepth, count, readBlock)
+	}
+	return data, f.walkBlockMap(ino.block, count, readBlock)
+}
+
+// Calls fn for each initialized block of an extent tree node that is
+// among the first count blocks of the file.
+func (f *FS) walkExtents(node []byte, maxDepth int, count uint64, fn func(logical, physical uint64) error) error {
+	if len(node) < 12 || binary.LittleEndian.Uint16(node[0:]) != extentMagic {
+		return fmt.Errorf("invalid extent tree node")
+	}
+	entries := int(binary.LittleEndian.Uint16(node[2:]))
+	depth := int(binary.LittleEndian.Uint16(node[6:]))
+	if 12+entries*12 > len(node) || depth > maxDepth {
+		return fmt.Errorf("invalid extent tree node")
+	}
+
+	for i := range entries {
+		entry := node[12+i*12:]
+		if depth > 0 {
+			leaf := uint64(binary.LittleEndian.Uint32(entry[4:])) | uint64(binary.LittleEndian.Uint16(entry[8:]))<<32
+			child, err := f.readBlock(leaf)
+			if err != nil {
+				return err
+			}
+			if err := f.walkExtents(child, depth-1, count, fn); err != nil {
+				return err
+			}
+			continue
+		}
+
+		logical := uint64(binary.LittleEndian.Uint32(entry[0:]))
+		length := uint64(binary.LittleEndian.Uint16(entry[4:]))
+		if length > 32768 {
+			continue // Uninitialized extent, which reads as zeroes
+		}
+		start := uint64(binary.LittleEndian.Uint16(entry[6:]))<<32 | uint64(binary.LittleEndian.Uint32(entry[8:]))
+		for j := uint64(0); j < length && logical+j < count; j++ {
+			if err := fn(logical+j, start+j); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Calls fn for each mapped block among the first count blocks of a file
+// using the ext2 and ext3 block map: 12 direct blocks, then single, double
+// and triple indirect blocks.
+func (f *FS) walkBlockMap(blockMap []byte, count uint64, fn func(logical, physical uint64) error) error {
+	const direct = 12
+	for i := uint64(0); i < direct && i < count; i++ {
+		if physical := binary.LittleEndian.Uint32(blockMap[i*4:]); physical != 0 {
+			if err := fn(i, uint64(physical)); err != nil {
+				return err
+			}
+		}
+	}
+
+	perBlock := uint64(f.blockSize / 4)
+	logical, span := uint64(direct), perBlock
+	for level := 1; level <= 3 && logical < count; level++ {
+		if physical := binary.LittleEndian.Uint32(blockMap[(direct-1+level)*4:]); physical != 0 {
+			if err := f.walkIndirect(uint64(physical), level, logical, count, fn); err != nil {
+				return err
+			}
+		}
+		logical += span
+		span *= perBlock
+	}
+	return nil
+}
+
+// Walks an indirect block, whose first pointer maps the given logical block.
+func (f *FS) walkIndirect(block uint64, level int, logical uint64, count uint64, fn func(logical, physical uint64) error) error {
+	buf, err := f.readBlock(block)
+	if err != nil {
+		return err
+	}
+	perBlock := uint64(f.blockSize / 4)
+	span := uint64(1)
+	for range level - 1 {
+		span *= perBlock
+	}
+
+	for i := uint64(0); i < perBlock && logical+i*span < count; i++ {
+		physical := uint64(binary.LittleEndian.Uint32(buf[i*4:]))
+		if physical == 0 {
+			continue
+		}
+		if level == 1 {
+			err = fn(logical+i, physical)
+		} else {
+			err = f.walkIndirect(physical, level-1, logical+i*span, count, fn)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
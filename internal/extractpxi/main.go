@@ -0,0 +1,97 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Package extractpxi extracts single files from the LXC rootfs of a PXI file.
+package extractpxi
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/PextraCloud/pxitool/internal/readpxi"
+	"github.com/PextraCloud/pxitool/internal/rootfs"
+	"github.com/PextraCloud/pxitool/pkg/log"
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/svol"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/instancetype"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumetype"
+)
+
+// Reads volumes up to the rootfs, skipping the data of the others.
+func findRootfs(volumes *readpxi.VolumeReader) (*svol.Data, error) {
+	if volumes.IHDR.InstanceType != instancetype.LXC {
+		return nil, fmt.Errorf("image is a %s instance, files can only be extracted from LXC instances", volumes.IHDR.InstanceType)
+	}
+	for {
+		svolData, err := volumes.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("image has no rootfs volume")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if svolData.VolumeID != "rootfs" {
+			log.Debug("Skipping volume %s", svolData.VolumeID)
+			continue
+		}
+		if svolData.VolumeType != volumetype.LXC_ {
+			return nil, fmt.Errorf("rootfs is stored as a %s volume, files can only be extracted from tar archives", svolData.VolumeType)
+		}
+		return svolData, nil
+	}
+}
+
+// Extracts the rootfs paths matching any of the glob patterns, along with
+// everything below matching directories, into outputDir. It returns how
+// many entries were extracted.
+func Extract(inputFileName string, patterns []string, outputDir string) (int, error) {
+	match, err := rootfs.MatchPatterns(patterns)
+	if err != nil {
+		return 0, err
+	}
+
+	volumes, err := readpxi.OpenVolumes(inputFileName)
+	if err != nil {
+		return 0, err
+	}
+	defer volumes.Close()
+
+	svolData, err := findRootfs(volumes)
+	if err != nil {
+		return 0, err
+	}
+	count, err := rootfs.ExtractMatching(svolData.VolumeData, outputDir, match)
+	if err != nil {
+		return count, err
+	}
+	if count == 0 {
+		return 0, fmt.Errorf("no files in the rootfs match %q", patterns)
+	}
+	return count, nil
+}
+
+// Writes the contents of the regular file at name in the rootfs to w.
+func WriteFile(inputFileName string, name string, w io.Writer) error {
+	volumes, err := readpxi.OpenVolumes(inputFileName)
+	if err != nil {
+		return err
+	}
+	defer volumes.Close()
+
+	svolData, err := findRootfs(volumes)
+	if err != nil {
+		return err
+	}
+	return rootfs.WriteFile(svolData.VolumeData, name, w)
+}
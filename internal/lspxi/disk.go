@@ -0,0 +1,143 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lspxi
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/PextraCloud/pxitool/internal/ext4"
+	"github.com/PextraCloud/pxitool/internal/partition"
+	"github.com/PextraCloud/pxitool/internal/readpxi"
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/svol"
+)
+
+// Lists a disk image volume: its partition table, or the files at name in
+// the filesystem of the selected partition, or of the whole disk if it is
+// not partitioned.
+func listDisk(volumes *readpxi.VolumeReader, svolData *svol.Data, name string, opts Options, w io.Writer) error {
+	disk, size, err := volumes.Disk()
+	if err != nil {
+		return err
+	}
+
+	table, err := partition.Read(disk, size)
+	if err != nil {
+		return fmt.Errorf("failed to read partition table of volume %s: %w", svolData.VolumeID, err)
+	}
+
+	var fsReader io.ReaderAt
+	switch {
+	case opts.Partition != 0:
+		p, err := findPartition(table, opts.Partition)
+		if err != nil {
+			return err
+		}
+		fsReader = io.NewSectionReader(disk, p.Start, p.Size)
+	case table.Scheme == partition.None:
+		fsReader = io.NewSectionReader(disk, 0, size)
+	case name != ".":
+		return fmt.Errorf("volume %s is partitioned, select a partition with --partition", svolData.VolumeID)
+	default:
+		return writePartitions(w, disk, size, table)
+	}
+
+	filesystem, err := ext4.Open(fsReader)
+	if err != nil {
+		return err
+	}
+	return listFilesystem(filesystem, name, opts.Recursive, w)
+}
+
+func findPartition(table *partition.Table, number int) (partition.Partition, error) {
+	if table.Scheme == partition.None {
+		return partition.Partition{}, fmt.Errorf("volume has no partition table, omit --partition to list its filesystem")
+	}
+	for _, p := range table.Partitions {
+		if p.Number == number {
+			return p, nil
+		}
+	}
+	return partition.Partition{}, fmt.Errorf("partition %d was not found", number)
+}
+
+// Writes a partition table, with the filesystem found in each partition.
+func writePartitions(w io.Writer, disk io.ReaderAt, size int64, table *partition.Table) error {
+	fmt.Fprintf(w, "Partition table: %s, %d bytes\n", table.Scheme, size)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NUMBER\tSTART\tSIZE\tTYPE\tNAME\tFILESYSTEM")
+	for _, p := range table.Partitions {
+		filesystem := "-"
+		if fs, err := ext4.Open(io.NewSectionReader(disk, p.Start, p.Size)); err == nil {
+			filesystem = "ext4"
+			if fs.Label != "" {
+				filesystem += fmt.Sprintf(" (%s)", fs.Label)
+			}
+		}
+		name := p.Name
+		if name == "" {
+			name = "-"
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%s\t%s\t%s\n", p.Number, p.Start, p.Size, p.Type, name, filesystem)
+	}
+	return tw.Flush()
+}
+
+// Lists the file or directory at name in an ext2/3/4 filesystem.
+func listFilesystem(filesystem *ext4.FS, name string, recursive bool, w io.Writer) error {
+	file, err := filesystem.Stat(name)
+	if err != nil {
+		return err
+	}
+	if !file.Mode.IsDir() {
+		return writeEntries(w, []*entry{filesystemEntry(file)})
+	}
+
+	var entries []*entry
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		files, err := filesystem.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			entries = append(entries, filesystemEntry(file))
+			if recursive && file.Mode.IsDir() {
+				if err := walk(file.Name); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk(name); err != nil {
+		return err
+	}
+	return writeEntries(w, entries)
+}
+
+func filesystemEntry(file *ext4.FileInfo) *entry {
+	return &entry{
+		name:     file.Name,
+		mode:     file.Mode,
+		uid:      int64(file.Uid),
+		gid:      int64(file.Gid),
+		size:     file.Size,
+		modTime:  file.ModTime,
+		linkname: file.Linkname,
+	}
+}
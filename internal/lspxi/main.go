@@ -0,0 +1,231 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Package lspxi lists the volumes of a PXI file and the files inside them.
+package lspxi
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/PextraCloud/pxitool/internal/readpxi"
+	"github.com/PextraCloud/pxitool/internal/rootfs"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumeformat"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumetype"
+)
+
+type Options struct {
+	Partition int  // Partition of a disk volume to list, numbered from 1; 0 to list the partitions
+	Recursive bool // List the contents of subdirectories
+}
+
+// A file inside a volume.
+type entry struct {
+	name     string // Path relative to the root of the filesystem
+	mode     fs.FileMode
+	uid      int64
+	gid      int64
+	size     int64
+	modTime  time.Time
+	linkname string // Target of a symlink
+	hardLink string // Target of a hard link, for tar archives
+}
+
+// ListVolumes writes the volumes of a PXI file to w, without reading
+// their data.
+func ListVolumes(inputFileName string, w io.Writer) error {
+	volumes, err := readpxi.OpenVolumes(inputFileName)
+	if err != nil {
+		return err
+	}
+	defer volumes.Close()
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTYPE\tFORMAT\tSIZE")
+	for {
+		svolData, err := volumes.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\n", svolData.VolumeID, svolData.VolumeType, svolData.VolumeFormat, svolData.DataLength)
+	}
+	return tw.Flush()
+}
+
+// List writes the files at name, such as "etc" or "etc/hostname", in a
+// volume to w. LXC rootfs archives are listed directly; disk images are
+// listed as their partition table, or the ext2/3/4 filesystem of a
+// partition or of the whole disk.
+func List(inputFileName string, volumeID string, name string, opts Options, w io.Writer) error {
+	volumes, err := readpxi.OpenVolumes(inputFileName)
+	if err != nil {
+		return err
+	}
+	defer volumes.Close()
+
+	svolData, err := volumes.Find(volumeID)
+	if err != nil {
+		return err
+	}
+	name = cleanName(name)
+
+	switch {
+	case svolData.VolumeType == volumetype.LXC_ && svolData.VolumeFormat == volumeformat.Raw:
+		if opts.Partition != 0 {
+			return fmt.Errorf("volume %s is a rootfs archive, which has no partitions", volumeID)
+		}
+		return listArchive(svolData.VolumeData, name, opts.Recursive, w)
+	case svolData.VolumeFormat == volumeformat.Raw, svolData.VolumeFormat == volumeformat.SparseRaw, svolData.VolumeFormat == volumeformat.QCOW2:
+		return listDisk(volumes, svolData, name, opts, w)
+	default:
+		return fmt.Errorf("volume %s is stored as %s, which cannot be listed", volumeID, svolData.VolumeFormat)
+	}
+}
+
+// Returns a path relative to the root of a volume, "." for the root.
+func cleanName(name string) string {
+	return path.Clean(strings.TrimLeft(name, "/"))
+}
+
+// Lists the entries of a rootfs archive at name. The whole archive is
+// read, as entries may appear in any order.
+func listArchive(r io.Reader, name string, recursive bool, w io.Writer) error {
+	var self *entry
+	var children []*entry
+	err := rootfs.Walk(r, func(entryName string, hdr *tar.Header) error {
+		switch {
+		case entryName == name:
+			self = archiveEntry(entryName, hdr)
+		case name == "." || strings.HasPrefix(entryName, name+"/"):
+			if recursive || path.Dir(entryName) == name {
+				children = append(children, archiveEntry(entryName, hdr))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if self == nil && len(children) == 0 {
+		return fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	if self != nil && !self.mode.IsDir() {
+		children = []*entry{self}
+	}
+	return writeEntries(w, children)
+}
+
+func archiveEntry(name string, hdr *tar.Header) *entry {
+	e := &entry{
+		name:    name,
+		mode:    hdr.FileInfo().Mode(),
+		uid:     int64(hdr.Uid),
+		gid:     int64(hdr.Gid),
+		size:    hdr.Size,
+		modTime: hdr.ModTime,
+	}
+	switch hdr.Typeflag {
+	case tar.TypeSymlink:
+		e.linkname = hdr.Linkname
+	case tar.TypeLink:
+		e.hardLink = strings.TrimPrefix(path.Clean(hdr.Linkname), "./")
+	}
+	return e
+}
+
+// Writes entries in the style of "ls -l".
+func writeEntries(w io.Writer, entries []*entry) error {
+	ownerWidth, sizeWidth := 0, 0
+	for _, e := range entries {
+		ownerWidth = max(ownerWidth, len(formatOwner(e)))
+		sizeWidth = max(sizeWidth, len(strconv.FormatInt(e.size, 10)))
+	}
+
+	for _, e := range entries {
+		name := e.name
+		switch {
+		case e.linkname != "":
+			name += " -> " + e.linkname
+		case e.hardLink != "":
+			name += " link to " + e.hardLink
+		}
+		if _, err := fmt.Fprintf(w, "%s %-*s %*d %s %s\n", formatMode(e.mode), ownerWidth, formatOwner(e), sizeWidth, e.size, e.modTime.Local().Format("2006-01-02 15:04"), name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatOwner(e *entry) string {
+	return fmt.Sprintf("%d/%d", e.uid, e.gid)
+}
+
+// Formats a mode like "ls -l", such as "drwxr-xr-x".
+func formatMode(mode fs.FileMode) string {
+	var b strings.Builder
+	switch {
+	case mode.IsDir():
+		b.WriteByte('d')
+	case mode&fs.ModeSymlink != 0:
+		b.WriteByte('l')
+	case mode&fs.ModeCharDevice != 0:
+		b.WriteByte('c')
+	case mode&fs.ModeDevice != 0:
+		b.WriteByte('b')
+	case mode&fs.ModeNamedPipe != 0:
+		b.WriteByte('p')
+	case mode&fs.ModeSocket != 0:
+		b.WriteByte('s')
+	default:
+		b.WriteByte('-')
+	}
+
+	const rwx = "rwxrwxrwx"
+	special := [3]struct {
+		set    bool
+		letter byte
+	}{
+		{mode&fs.ModeSetuid != 0, 's'},
+		{mode&fs.ModeSetgid != 0, 's'},
+		{mode&fs.ModeSticky != 0, 't'},
+	}
+	for i := range 9 {
+		c := byte('-')
+		if mode&(1<<(8-i)) != 0 {
+			c = rwx[i]
+		}
+		// The execute bit of each class shows the special bit of that class
+		if i%3 == 2 && special[i/3].set {
+			if c == '-' {
+				c = special[i/3].letter - 'a' + 'A'
+			} else {
+				c = special[i/3].letter
+			}
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
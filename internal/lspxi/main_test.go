@@ -0,0 +1,91 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lspxi
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+func TestFormatMode(t *testing.T) {
+	testCases := map[fs.FileMode]string{
+		fs.ModeDir | 0755:                 "drwxr-xr-x",
+		0644:                              "-rw-r--r--",
+		fs.ModeSymlink | 0777:             "lrwxrwxrwx",
+		fs.ModeSetuid | 0755:              "-rwsr-xr-x",
+		fs.ModeSetgid | 0640:              "-rw-r-S---",
+		fs.ModeDir | fs.ModeSticky | 0777: "drwxrwxrwt",
+		fs.ModeDevice | fs.ModeCharDevice: "c---------",
+		fs.ModeNamedPipe | 0600:           "prw-------",
+	}
+	for mode, expected := range testCases {
+		if got := formatMode(mode); got != expected {
+			t.Errorf("formatMode(%v): expected %s, got %s", mode, expected, got)
+		}
+	}
+}
+
+func TestListArchive(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, hdr := range []*tar.Header{
+		{Name: "./", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "./etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "./etc/hostname", Typeflag: tar.TypeReg, Mode: 0644, Size: 0},
+		{Name: "./etc/hostname.hard", Typeflag: tar.TypeLink, Linkname: "./etc/hostname"},
+		{Name: "./etc/ssh/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "./etc/ssh/sshd_config", Typeflag: tar.TypeReg, Mode: 0600, Uid: 1000},
+		{Name: "./bin", Typeflag: tar.TypeSymlink, Linkname: "usr/bin"},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("Failed to write header: %v", err)
+		}
+	}
+	tw.Close()
+
+	testCases := []struct {
+		name      string
+		recursive bool
+		expected  []string
+	}{
+		{".", false, []string{"etc", "bin -> usr/bin"}},
+		{"/etc", false, []string{"etc/hostname", "etc/hostname.hard link to etc/hostname", "etc/ssh"}},
+		{"etc", true, []string{"etc/hostname", "etc/hostname.hard link to etc/hostname", "etc/ssh", "etc/ssh/sshd_config"}},
+		{"etc/ssh/sshd_config", false, []string{"etc/ssh/sshd_config"}},
+	}
+	for _, tc := range testCases {
+		var out bytes.Buffer
+		if err := listArchive(bytes.NewReader(archive.Bytes()), cleanName(tc.name), tc.recursive, &out); err != nil {
+			t.Fatalf("listArchive(%q) failed: %v", tc.name, err)
+		}
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if len(lines) != len(tc.expected) {
+			t.Fatalf("listArchive(%q): expected %d entries, got:\n%s", tc.name, len(tc.expected), out.String())
+		}
+		for i, line := range lines {
+			if !strings.HasSuffix(line, " "+tc.expected[i]) {
+				t.Errorf("listArchive(%q): expected entry %q, got %q", tc.name, tc.expected[i], line)
+			}
+		}
+	}
+
+	if err := listArchive(bytes.NewReader(archive.Bytes()), "missing", false, &bytes.Buffer{}); err == nil {
+		t.Error("Expected an error for a missing path")
+	}
+}
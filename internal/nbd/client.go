@@ -0,0 +1,224 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package nbd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Client is a read-only NBD client for a single export.
+type Client struct {
+	conn   net.Conn
+	size   int64
+	flags  uint16
+	handle uint64
+	mu     sync.Mutex
+}
+
+// Connects to the NBD server listening on a unix socket and selects an export.
+func Dial(socketPath string, exportName string) (*Client, error) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NBD server at %s: %w", socketPath, err)
+	}
+
+	client := &Client{conn: conn}
+	if err := client.handshake(exportName); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("NBD handshake failed: %w", err)
+	}
+	return client, nil
+}
+
+func (c *Client) handshake(exportName string) error {
+	var serverHello struct {
+		Magic       uint64
+		OptionMagic uint64
+		Flags       uint16
+	}
+	if err := binary.Read(c.conn, binary.BigEndian, &serverHello); err != nil {
+		return err
+	}
+	if serverHello.Magic != nbdMagic || serverHello.OptionMagic != optionMagic {
+		return fmt.Errorf("server does not support newstyle negotiation")
+	}
+	if serverHello.Flags&flagFixedNewstyle == 0 {
+		return fmt.Errorf("server does not support fixed newstyle negotiation")
+	}
+
+	clientFlags := flagClientFixedNewstyle
+	if serverHello.Flags&flagNoZeroes != 0 {
+		clientFlags |= flagClientNoZeroes
+	}
+	if err := binary.Write(c.conn, binary.BigEndian, clientFlags); err != nil {
+		return err
+	}
+
+	// NBD_OPT_GO: name length, name, and no information requests
+	data := make([]byte, 4+len(exportName)+2)
+	binary.BigEndian.PutUint32(data[0:4], uint32(len(exportName)))
+	copy(data[4:], exportName)
+	if err := writeOption(c.conn, optGo, data); err != nil {
+		return err
+	}
+
+	gotExportInfo := false
+	for {
+		replyType, replyData, err := readOptionReply(c.conn, optGo)
+		if err != nil {
+			return err
+		}
+		switch {
+		case replyType == repAck:
+			if !gotExportInfo {
+				return fmt.Errorf("server did not send export information")
+			}
+			return nil
+		case replyType == repInfo:
+			if len(replyData) >= 12 && binary.BigEndian.Uint16(replyData[0:2]) == infoExport {
+				c.size = int64(binary.BigEndian.Uint64(replyData[2:10]))
+				c.flags = binary.BigEndian.Uint16(replyData[10:12])
+				gotExportInfo = true
+			}
+		case replyType&repFlagErrorID != 0:
+			return fmt.Errorf("server refused export %q: error %#x: %s", exportName, replyType, replyData)
+		}
+	}
+}
+
+func writeOption(w io.Writer, option uint32, data []byte) error {
+	header := make([]byte, 16)
+	binary.BigEndian.PutUint64(header[0:8], optionMagic)
+	binary.BigEndian.PutUint32(header[8:12], option)
+	binary.BigEndian.PutUint32(header[12:16], uint32(len(data)))
+	if _, err := w.Write(append(header, data...)); err != nil {
+		return fmt.Errorf("failed to send option %d: %w", option, err)
+	}
+	return nil
+}
+
+func readOptionReply(r io.Reader, option uint32) (uint32, []byte, error) {
+	var header struct {
+		Magic     uint64
+		Option    uint32
+		ReplyType uint32
+		Length    uint32
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return 0, nil, fmt.Errorf("failed to read option reply: %w", err)
+	}
+	if header.Magic != replyMagic || header.Option != option {
+		return 0, nil, fmt.Errorf("invalid option reply")
+	}
+	if header.Length > 64*1024 {
+		return 0, nil, fmt.Errorf("option reply too long: %d bytes", header.Length)
+	}
+
+	data := make([]byte, header.Length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, fmt.Errorf("failed to read option reply data: %w", err)
+	}
+	return header.ReplyType, data, nil
+}
+
+// Size returns the size of the export in bytes.
+func (c *Client) Size() int64 {
+	return c.size
+}
+
+// ReadAt implements io.ReaderAt.
+func (c *Client) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset: %d", off)
+	}
+	if off >= c.size {
+		return 0, io.EOF
+	}
+
+	var err error
+	if remaining := c.size - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+		err = io.EOF
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	read := 0
+	for read < len(p) {
+		n := min(len(p)-read, maxRequestSize)
+		if rerr := c.read(p[read:read+n], off+int64(read)); rerr != nil {
+			return read, rerr
+		}
+		read += n
+	}
+	return read, err
+}
+
+// read sends a single read request and reads its simple reply
+func (c *Client) read(p []byte, off int64) error {
+	c.handle++
+	if err := c.sendRequest(cmdRead, uint64(off), uint32(len(p))); err != nil {
+		return err
+	}
+
+	var reply struct {
+		Magic  uint32
+		Error  uint32
+		Handle uint64
+	}
+	if err := binary.Read(c.conn, binary.BigEndian, &reply); err != nil {
+		return fmt.Errorf("failed to read NBD reply: %w", err)
+	}
+	if reply.Magic != simpleReplyMagic || reply.Handle != c.handle {
+		return fmt.Errorf("invalid NBD reply")
+	}
+	if reply.Error != 0 {
+		return fmt.Errorf("NBD read of %d bytes at offset %d failed: error %d", len(p), off, reply.Error)
+	}
+	if _, err := io.ReadFull(c.conn, p); err != nil {
+		return fmt.Errorf("failed to read NBD reply data: %w", err)
+	}
+	return nil
+}
+
+func (c *Client) sendRequest(command uint16, offset uint64, length uint32) error {
+	request := make([]byte, 28)
+	binary.BigEndian.PutUint32(request[0:4], requestMagic)
+	binary.BigEndian.PutUint16(request[4:6], 0)
+	binary.BigEndian.PutUint16(request[6:8], command)
+	binary.BigEndian.PutUint64(request[8:16], c.handle)
+	binary.BigEndian.PutUint64(request[16:24], offset)
+	binary.BigEndian.PutUint32(request[24:28], length)
+	if _, err := c.conn.Write(request); err != nil {
+		return fmt.Errorf("failed to send NBD request: %w", err)
+	}
+	return nil
+}
+
+// Close disconnects from the server.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.handle++
+	c.sendRequest(cmdDisc, 0, 0) // No reply is sent for disconnects
+	return c.conn.Close()
+}
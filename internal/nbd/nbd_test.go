@@ -0,0 +1,124 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package nbd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+// Serves disk on a unix socket for the duration of the test.
+func startServer(t *testing.T, disk []byte) string {
+	t.Helper()
+	socketPath := filepath.Join(t.TempDir(), "nbd.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- NewServer("vol-1", bytes.NewReader(disk), int64(len(disk))).Serve(listener)
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		if err := <-done; err != nil {
+			t.Errorf("Serve failed: %v", err)
+		}
+	})
+	return socketPath
+}
+
+func TestServer(t *testing.T) {
+	disk := make([]byte, 3*1024*1024+100)
+	for i := range disk {
+		disk[i] = byte(i * 7)
+	}
+	socketPath := startServer(t, disk)
+
+	for _, exportName := range []string{"vol-1", ""} {
+		client, err := Dial(socketPath, exportName)
+		if err != nil {
+			t.Fatalf("Dial(%q) failed: %v", exportName, err)
+		}
+		if client.Size() != int64(len(disk)) {
+			t.Errorf("Expected size %d, got %d", len(disk), client.Size())
+		}
+		if client.flags&transReadOnly == 0 {
+			t.Errorf("Expected a read-only export, got flags %#x", client.flags)
+		}
+
+		data, err := io.ReadAll(io.NewSectionReader(client, 0, client.Size()))
+		if err != nil || !bytes.Equal(data, disk) {
+			t.Errorf("Read data does not match the disk (%d bytes, %v)", len(data), err)
+		}
+		client.Close()
+	}
+}
+
+func TestServer_RefusesWrites(t *testing.T) {
+	socketPath := startServer(t, make([]byte, 4096))
+	client, err := Dial(socketPath, "vol-1")
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer client.Close()
+
+	readReply := func() (uint32, uint64) {
+		var reply struct {
+			Magic  uint32
+			Error  uint32
+			Handle uint64
+		}
+		if err := binary.Read(client.conn, binary.BigEndian, &reply); err != nil {
+			t.Fatalf("Failed to read reply: %v", err)
+		}
+		return reply.Error, reply.Handle
+	}
+
+	client.handle = 100
+	if err := client.sendRequest(cmdWrite, 0, 4); err != nil {
+		t.Fatalf("Failed to send write: %v", err)
+	}
+	client.conn.Write([]byte("data"))
+	if errno, handle := readReply(); errno != errPerm || handle != 100 {
+		t.Errorf("Expected EPERM for handle 100, got error %d for handle %d", errno, handle)
+	}
+
+	client.handle = 101
+	if err := client.sendRequest(cmdRead, 4000, 100); err != nil {
+		t.Fatalf("Failed to send read: %v", err)
+	}
+	if errno, handle := readReply(); errno != errInval || handle != 101 {
+		t.Errorf("Expected EINVAL for a read past the end, got error %d for handle %d", errno, handle)
+	}
+
+	// The connection is still usable
+	buf := make([]byte, 16)
+	if _, err := client.ReadAt(buf, 0); err != nil {
+		t.Errorf("Expected a read after refused requests to succeed: %v", err)
+	}
+}
+
+func TestServer_UnknownExport(t *testing.T) {
+	socketPath := startServer(t, make([]byte, 4096))
+	if _, err := Dial(socketPath, "other"); err == nil {
+		t.Error("Expected an error for an unknown export")
+	}
+}
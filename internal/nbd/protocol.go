@@ -0,0 +1,78 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package nbd
+
+// Constants of the NBD protocol, fixed newstyle negotiation only.
+// https://github.com/NetworkBlockDevice/nbd/blob/master/doc/proto.md
+const (
+	nbdMagic         uint64 = 0x4e42444d41474943 // "NBDMAGIC"
+	optionMagic      uint64 = 0x49484156454f5054 // "IHAVEOPT"
+	replyMagic       uint64 = 0x0003e889045565a9
+	requestMagic     uint32 = 0x25609513
+	simpleReplyMagic uint32 = 0x67446698
+
+	// Handshake flags
+	flagFixedNewstyle uint16 = 1 << 0
+	flagNoZeroes      uint16 = 1 << 1
+
+	// Client flags
+	flagClientFixedNewstyle uint32 = 1 << 0
+	flagClientNoZeroes      uint32 = 1 << 1
+
+	// Options
+	optExportName uint32 = 1
+	optAbort      uint32 = 2
+	optList       uint32 = 3
+	optInfo       uint32 = 6
+	optGo         uint32 = 7
+
+	// Option reply types
+	repAck         uint32 = 1
+	repServer      uint32 = 2
+	repInfo        uint32 = 3
+	repFlagErrorID uint32 = 1 << 31
+	repErrUnsup    uint32 = repFlagErrorID | 1
+	repErrInvalid  uint32 = repFlagErrorID | 3
+	repErrUnknown  uint32 = repFlagErrorID | 6
+
+	// Info types
+	infoExport    uint16 = 0
+	infoBlockSize uint16 = 3
+
+	// Transmission flags
+	transHasFlags     uint16 = 1 << 0
+	transReadOnly     uint16 = 1 << 1
+	transCanMultiConn uint16 = 1 << 8
+
+	// Commands
+	cmdRead        uint16 = 0
+	cmdWrite       uint16 = 1
+	cmdDisc        uint16 = 2
+	cmdFlush       uint16 = 3
+	cmdTrim        uint16 = 4
+	cmdWriteZeroes uint16 = 6
+
+	// Errors of simple replies
+	errPerm  uint32 = 1
+	errIO    uint32 = 5
+	errInval uint32 = 22
+
+	// Largest read request sent by the client, and served by the server
+	maxRequestSize = 32 * 1024 * 1024
+
+	// Largest option data accepted by the server
+	maxOptionSize = 64 * 1024
+)
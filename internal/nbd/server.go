@@ -0,0 +1,290 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package nbd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+
+	"github.com/PextraCloud/pxitool/pkg/log"
+)
+
+// Server serves a single read-only export over NBD, with fixed newstyle
+// negotiation and simple replies. Writes and trims are refused with EPERM.
+type Server struct {
+	name string
+	disk io.ReaderAt
+	size int64
+}
+
+// Creates a server for an export of the given size, read from disk. The
+// export can be selected by name or as the default export. disk must be
+// safe for concurrent use, as each connection is served concurrently.
+func NewServer(name string, disk io.ReaderAt, size int64) *Server {
+	return &Server{name: name, disk: disk, size: size}
+}
+
+// Serve accepts connections on l until it is closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("failed to accept NBD connection: %w", err)
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	log.Debug("NBD client connected")
+	transmit, err := s.negotiate(conn)
+	if err == nil && transmit {
+		err = s.transmit(conn)
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		log.Warn("NBD connection closed: %v", err)
+		return
+	}
+	log.Debug("NBD client disconnected")
+}
+
+func (s *Server) transmissionFlags() uint16 {
+	return transHasFlags | transReadOnly | transCanMultiConn
+}
+
+// Negotiates options until the client selects the export, which returns
+// true, or aborts.
+func (s *Server) negotiate(conn net.Conn) (bool, error) {
+	hello := make([]byte, 18)
+	binary.BigEndian.PutUint64(hello[0:8], nbdMagic)
+	binary.BigEndian.PutUint64(hello[8:16], optionMagic)
+	binary.BigEndian.PutUint16(hello[16:18], flagFixedNewstyle|flagNoZeroes)
+	if _, err := conn.Write(hello); err != nil {
+		return false, err
+	}
+
+	var clientFlags uint32
+	if err := binary.Read(conn, binary.BigEndian, &clientFlags); err != nil {
+		return false, err
+	}
+	if clientFlags&^(flagClientFixedNewstyle|flagClientNoZeroes) != 0 {
+		return false, fmt.Errorf("client sent unknown flags %#x", clientFlags)
+	}
+	noZeroes := clientFlags&flagClientNoZeroes != 0
+
+	for {
+		var header struct {
+			Magic  uint64
+			Option uint32
+			Length uint32
+		}
+		if err := binary.Read(conn, binary.BigEndian, &header); err != nil {
+			return false, err
+		}
+		if header.Magic != optionMagic {
+			return false, fmt.Errorf("invalid option magic %#x", header.Magic)
+		}
+		if header.Length > maxOptionSize {
+			return false, fmt.Errorf("option %d too long: %d bytes", header.Option, header.Length)
+		}
+		data := make([]byte, header.Length)
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return false, err
+		}
+
+		switch header.Option {
+		case optExportName:
+			// The old way of selecting an export, with no way to refuse it
+			if !s.isExport(string(data)) {
+				return false, fmt.Errorf("client requested unknown export %q", data)
+			}
+			reply := make([]byte, 10, 10+124)
+			binary.BigEndian.PutUint64(reply[0:8], uint64(s.size))
+			binary.BigEndian.PutUint16(reply[8:10], s.transmissionFlags())
+			if !noZeroes {
+				reply = append(reply, make([]byte, 124)...)
+			}
+			_, err := conn.Write(reply)
+			return err == nil, err
+		case optInfo, optGo:
+			selected, err := s.replyInfo(conn, header.Option, data)
+			if err != nil {
+				return false, err
+			}
+			if selected && header.Option == optGo {
+				return true, nil
+			}
+		case optAbort:
+			return false, writeOptionReply(conn, header.Option, repAck, nil)
+		case optList:
+			name := binary.BigEndian.AppendUint32(nil, uint32(len(s.name)))
+			if err := writeOptionReply(conn, header.Option, repServer, append(name, s.name...)); err != nil {
+				return false, err
+			}
+			if err := writeOptionReply(conn, header.Option, repAck, nil); err != nil {
+				return false, err
+			}
+		default:
+			if err := writeOptionReply(conn, header.Option, repErrUnsup, []byte("unsupported option")); err != nil {
+				return false, err
+			}
+		}
+	}
+}
+
+func (s *Server) isExport(name string) bool {
+	return name == s.name || name == ""
+}
+
+// Replies to NBD_OPT_INFO or NBD_OPT_GO, whose data is the export name
+// followed by the requested information types. It returns whether the
+// export was found.
+func (s *Server) replyInfo(conn net.Conn, option uint32, data []byte) (bool, error) {
+	if len(data) < 6 || uint32(len(data)) < 6+binary.BigEndian.Uint32(data[0:4]) {
+		return false, writeOptionReply(conn, option, repErrInvalid, []byte("malformed request"))
+	}
+	nameLength := binary.BigEndian.Uint32(data[0:4])
+	name := string(data[4 : 4+nameLength])
+	requests := data[4+nameLength:]
+	count := int(binary.BigEndian.Uint16(requests[0:2]))
+	if len(requests) != 2+count*2 {
+		return false, writeOptionReply(conn, option, repErrInvalid, []byte("malformed request"))
+	}
+	if !s.isExport(name) {
+		return false, writeOptionReply(conn, option, repErrUnknown, []byte("unknown export"))
+	}
+
+	export := make([]byte, 12)
+	binary.BigEndian.PutUint16(export[0:2], infoExport)
+	binary.BigEndian.PutUint64(export[2:10], uint64(s.size))
+	binary.BigEndian.PutUint16(export[10:12], s.transmissionFlags())
+	if err := writeOptionReply(conn, option, repInfo, export); err != nil {
+		return false, err
+	}
+
+	var infoTypes []uint16
+	for i := range count {
+		infoTypes = append(infoTypes, binary.BigEndian.Uint16(requests[2+i*2:]))
+	}
+	if slices.Contains(infoTypes, infoBlockSize) {
+		blockSize := make([]byte, 14)
+		binary.BigEndian.PutUint16(blockSize[0:2], infoBlockSize)
+		binary.BigEndian.PutUint32(blockSize[2:6], 1)                // Minimum
+		binary.BigEndian.PutUint32(blockSize[6:10], 4096)            // Preferred
+		binary.BigEndian.PutUint32(blockSize[10:14], maxRequestSize) // Maximum
+		if err := writeOptionReply(conn, option, repInfo, blockSize); err != nil {
+			return false, err
+		}
+	}
+	return true, writeOptionReply(conn, option, repAck, nil)
+}
+
+func writeOptionReply(w io.Writer, option uint32, replyType uint32, data []byte) error {
+	header := make([]byte, 20)
+	binary.BigEndian.PutUint64(header[0:8], replyMagic)
+	binary.BigEndian.PutUint32(header[8:12], option)
+	binary.BigEndian.PutUint32(header[12:16], replyType)
+	binary.BigEndian.PutUint32(header[16:20], uint32(len(data)))
+	if _, err := w.Write(append(header, data...)); err != nil {
+		return fmt.Errorf("failed to send reply to option %d: %w", option, err)
+	}
+	return nil
+}
+
+// Serves requests until the client disconnects.
+func (s *Server) transmit(conn net.Conn) error {
+	var request struct {
+		Magic  uint32
+		Flags  uint16
+		Type   uint16
+		Handle uint64
+		Offset uint64
+		Length uint32
+	}
+	for {
+		if err := binary.Read(conn, binary.BigEndian, &request); err != nil {
+			return err
+		}
+		if request.Magic != requestMagic {
+			return fmt.Errorf("invalid request magic %#x", request.Magic)
+		}
+
+		switch request.Type {
+		case cmdRead:
+			if request.Length > maxRequestSize || request.Offset > uint64(s.size) || uint64(request.Length) > uint64(s.size)-request.Offset {
+				if err := writeSimpleReply(conn, request.Handle, errInval, nil); err != nil {
+					return err
+				}
+				continue
+			}
+			data := make([]byte, request.Length)
+			if n, err := s.disk.ReadAt(data, int64(request.Offset)); n < len(data) {
+				log.Error("Failed to read %d bytes at offset %d: %v", len(data), request.Offset, err)
+				if err := writeSimpleReply(conn, request.Handle, errIO, nil); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := writeSimpleReply(conn, request.Handle, 0, data); err != nil {
+				return err
+			}
+		case cmdWrite:
+			// The data must still be read to stay in sync with the client
+			if request.Length > maxRequestSize {
+				return fmt.Errorf("write request too long: %d bytes", request.Length)
+			}
+			if _, err := io.CopyN(io.Discard, conn, int64(request.Length)); err != nil {
+				return err
+			}
+			if err := writeSimpleReply(conn, request.Handle, errPerm, nil); err != nil {
+				return err
+			}
+		case cmdTrim, cmdWriteZeroes:
+			if err := writeSimpleReply(conn, request.Handle, errPerm, nil); err != nil {
+				return err
+			}
+		case cmdFlush:
+			if err := writeSimpleReply(conn, request.Handle, 0, nil); err != nil {
+				return err
+			}
+		case cmdDisc:
+			return nil
+		default:
+			if err := writeSimpleReply(conn, request.Handle, errInval, nil); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func writeSimpleReply(w io.Writer, handle uint64, errno uint32, data []byte) error {
+	reply := make([]byte, 16, 16+len(data))
+	binary.BigEndian.PutUint32(reply[0:4], simpleReplyMagic)
+	binary.BigEndian.PutUint32(reply[4:8], errno)
+	binary.BigEndian.PutUint64(reply[8:16], handle)
+	if _, err := w.Write(append(reply, data...)); err != nil {
+		return fmt.Errorf("failed to send NBD reply: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package partition
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"unicode/utf16"
+
+	"github.com/PextraCloud/pxitool/pkg/log"
+)
+
+var gptSignature = []byte("EFI PART")
+
+const (
+	gptMinHeaderSize  = 92
+	gptMinEntrySize   = 128
+	gptMaxEntriesSize = 4 * 1024 * 1024 // The spec requires 16 KiB, which tools rarely exceed
+)
+
+var gptTypes = map[string]string{
+	"C12A7328-F81F-11D2-BA4B-00A0C93EC93B": "EFI System",
+	"21686148-6449-6E6F-744E-656564454649": "BIOS boot",
+	"0FC63DAF-8483-4772-8E79-3D69D8477DE4": "Linux filesystem",
+	"0657FD6D-A4AB-43C4-84E5-0933C84B4F4F": "Linux swap",
+	"E6D6D379-F507-44C2-A23C-238F2A3DF928": "Linux LVM",
+	"A19D880F-05FC-4D3B-A006-743F0F84911E": "Linux RAID",
+	"4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709": "Linux root (x86-64)",
+	"B921B045-1DF0-41C3-AF44-4C6F280D3FAE": "Linux root (ARM-64)",
+	"BC13C2FF-59E6-4262-A352-B275FD6F7172": "Linux extended boot",
+	"933AC7E1-2EB4-4F13-B844-0E14E2AEF915": "Linux home",
+	"EBD0A0A2-B9E5-4433-87C0-68B6B72699C7": "Microsoft basic data",
+	"E3C9E316-0B5C-4DB8-817D-F92DF00215AE": "Microsoft reserved",
+	"DE94BBA4-06D1-4D40-A16A-BFD50179D6AC": "Windows recovery environment",
+}
+
+type gptHeader struct {
+	entriesLBA uint64
+	numEntries uint32
+	entrySize  uint32
+	entriesCRC uint32
+}
+
+// Formats a GUID stored in the mixed-endian GPT layout.
+func formatGUID(b []byte) string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X", binary.LittleEndian.Uint32(b[0:4]), binary.LittleEndian.Uint16(b[4:6]), binary.LittleEndian.Uint16(b[6:8]), b[8:10], b[10:16])
+}
+
+// Reads the GPT of a disk with a protective MBR. Disks with 512 byte and
+// 4 KiB logical sectors are supported, and the backup header at the end of
+// the disk is used if the primary one is damaged.
+func readGPT(r io.ReaderAt, size int64) (*Table, error) {
+	for _, sectorSize := range []int64{512, 4096} {
+		primary, err := readGPTHeader(r, sectorSize, 1)
+		if err == errNoGPTHeader {
+			continue
+		}
+		if err == nil {
+			table, err := readGPTEntries(r, size, sectorSize, primary)
+			if err == nil {
+				return table, nil
+			}
+			log.Warn("Primary GPT entries are damaged, using the backup: %v", err)
+		} else {
+			log.Warn("Primary GPT header is damaged, using the backup: %v", err)
+		}
+
+		backup, err := readGPTHeader(r, sectorSize, size/sectorSize-1)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read backup GPT header: %w", err)
+		}
+		return readGPTEntries(r, size, sectorSize, backup)
+	}
+	return nil, fmt.Errorf("disk has a protective MBR, but no GPT header")
+}
+
+var errNoGPTHeader = errors.New("no GPT header")
+
+// Reads and verifies the GPT header at the given LBA.
+func readGPTHeader(r io.ReaderAt, sectorSize int64, lba int64) (*gptHeader, error) {
+	sector := make([]byte, sectorSize)
+	if _, err := r.ReadAt(sector, lba*sectorSize); err != nil {
+		return nil, fmt.Errorf("failed to read GPT header at LBA %d: %w", lba, err)
+	}
+	if !bytes.Equal(sector[:len(gptSignature)], gptSignature) {
+		return nil, errNoGPTHeader
+	}
+
+	headerSize := binary.LittleEndian.Uint32(sector[12:16])
+	if headerSize < gptMinHeaderSize || int64(headerSize) > sectorSize {
+		return nil, fmt.Errorf("invalid GPT header size %d", headerSize)
+	}
+	expectedCRC := binary.LittleEndian.Uint32(sector[16:20])
+	binary.LittleEndian.PutUint32(sector[16:20], 0)
+	if crc := crc32.ChecksumIEEE(sector[:headerSize]); crc != expectedCRC {
+		return nil, fmt.Errorf("GPT header checksum mismatch: expected %08x, got %08x", expectedCRC, crc)
+	}
+
+	header := &gptHeader{
+		entriesLBA: binary.LittleEndian.Uint64(sector[72:80]),
+		numEntries: binary.LittleEndian.Uint32(sector[80:84]),
+		entrySize:  binary.LittleEndian.Uint32(sector[84:88]),
+		entriesCRC: binary.LittleEndian.Uint32(sector[88:92]),
+	}
+	if header.entrySize < gptMinEntrySize || header.entrySize%8 != 0 {
+		return nil, fmt.Errorf("invalid GPT entry size %d", header.entrySize)
+	}
+	if uint64(header.numEntries)*uint64(header.entrySize) > gptMaxEntriesSize {
+		return nil, fmt.Errorf("GPT has too many entries: %d", header.numEntries)
+	}
+	return header, nil
+}
+
+// Reads and verifies the partition entries of a GPT.
+func readGPTEntries(r io.ReaderAt, size int64, sectorSize int64, header *gptHeader) (*Table, error) {
+	entries := make([]byte, header.numEntries*header.entrySize)
+	if header.entriesLBA > uint64(size/sectorSize) {
+		return nil, fmt.Errorf("GPT entries at LBA %d are beyond the end of the disk", header.entriesLBA)
+	}
+	if _, err := r.ReadAt(entries, int64(header.entriesLBA)*sectorSize); err != nil {
+		return nil, fmt.Errorf("failed to read GPT entries: %w", err)
+	}
+	if crc := crc32.ChecksumIEEE(entries); crc != header.entriesCRC {
+		return nil, fmt.Errorf("GPT entries checksum mismatch: expected %08x, got %08x", header.entriesCRC, crc)
+	}
+
+	table := &Table{Scheme: GPT, SectorSize: sectorSize}
+	for i := range int(header.numEntries) {
+		entry := entries[i*int(header.entrySize):]
+		if bytes.Equal(entry[:16], make([]byte, 16)) {
+			continue
+		}
+		firstLBA := binary.LittleEndian.Uint64(entry[32:40])
+		lastLBA := binary.LittleEndian.Uint64(entry[40:48])
+		if lastLBA < firstLBA || lastLBA >= uint64(size/sectorSize) {
+			return nil, fmt.Errorf("GPT partition %d has an invalid range: LBA %d to %d", i+1, firstLBA, lastLBA)
+		}
+
+		typeGUID := formatGUID(entry[:16])
+		typeName := typeGUID
+		if name, found := gptTypes[typeGUID]; found {
+			typeName = name
+		}
+		table.Partitions = append(table.Partitions, Partition{
+			Number: i + 1,
+			Start:  int64(firstLBA) * sectorSize,
+			Size:   int64(lastLBA-firstLBA+1) * sectorSize,
+			Type:   typeName,
+			Name:   decodeName(entry[56:128]),
+		})
+	}
+	return table, nil
+}
+
+// Decodes a NUL-terminated UTF-16LE partition name.
+func decodeName(b []byte) string {
+	units := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		unit := binary.LittleEndian.Uint16(b[i:])
+		if unit == 0 {
+			break
+		}
+		units = append(units, unit)
+	}
+	return string(utf16.Decode(units))
+}
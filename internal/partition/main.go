@@ -0,0 +1,84 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Package partition reads the MBR and GPT partition tables of disk images.
+package partition
+
+import (
+	"fmt"
+	"io"
+)
+
+// Scheme is the partitioning scheme of a disk.
+type Scheme string
+
+const (
+	None Scheme = "none" // The disk has no partition table
+	MBR  Scheme = "mbr"
+	GPT  Scheme = "gpt"
+)
+
+// Partition is a partition of a disk. Offsets and sizes are in bytes.
+type Partition struct {
+	Number int    // Numbered from 1; logical MBR partitions start at 5
+	Start  int64  // Offset of the partition on the disk
+	Size   int64  // Size of the partition
+	Type   string // Description of the partition type, such as "Linux filesystem"
+	Name   string // GPT partition name, if any
+}
+
+// Table is the partition table of a disk.
+type Table struct {
+	Scheme     Scheme
+	SectorSize int64
+	Partitions []Partition
+}
+
+const (
+	mbrSectorSize = 512
+	mbrSignature  = 0xaa55
+	maxPartitions = 256 // Upper bound on logical MBR partitions, against EBR loops
+)
+
+// Read reads the partition table of a disk of the given size. A disk with
+// no partition table gives a table with the None scheme and no partitions.
+func Read(r io.ReaderAt, size int64) (*Table, error) {
+	sector := make([]byte, mbrSectorSize)
+	if _, err := r.ReadAt(sector, 0); err != nil {
+		if err == io.EOF {
+			return &Table{Scheme: None, SectorSize: mbrSectorSize}, nil
+		}
+		return nil, fmt.Errorf("failed to read MBR: %w", err)
+	}
+	if !hasMBRSignature(sector) {
+		return &Table{Scheme: None, SectorSize: mbrSectorSize}, nil
+	}
+
+	entries := parseMBREntries(sector)
+	for _, entry := range entries {
+		if entry.typ == mbrTypeProtective {
+			return readGPT(r, size)
+		}
+	}
+	return readMBR(r, size, entries)
+}
+
+// Checks that a partition lies within the disk.
+func checkBounds(p Partition, size int64) error {
+	if p.Start < 0 || p.Size < 0 || p.Start > size || p.Size > size-p.Start {
+		return fmt.Errorf("partition %d (offset %d, %d bytes) extends beyond the end of the disk", p.Number, p.Start, p.Size)
+	}
+	return nil
+}
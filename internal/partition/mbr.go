@@ -0,0 +1,151 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package partition
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	mbrEntriesOffset  = 446
+	mbrEntrySize      = 16
+	mbrTypeProtective = 0xee
+)
+
+var mbrTypes = map[byte]string{
+	0x01: "FAT12",
+	0x04: "FAT16",
+	0x05: "Extended",
+	0x06: "FAT16",
+	0x07: "NTFS/exFAT",
+	0x0b: "W95 FAT32",
+	0x0c: "W95 FAT32 (LBA)",
+	0x0e: "W95 FAT16 (LBA)",
+	0x0f: "W95 extended (LBA)",
+	0x82: "Linux swap",
+	0x83: "Linux",
+	0x85: "Linux extended",
+	0x8e: "Linux LVM",
+	0xef: "EFI System",
+	0xfd: "Linux raid autodetect",
+}
+
+type mbrEntry struct {
+	typ    byte
+	start  uint32 // In sectors
+	length uint32 // In sectors
+}
+
+func hasMBRSignature(sector []byte) bool {
+	return binary.LittleEndian.Uint16(sector[510:512]) == mbrSignature
+}
+
+func parseMBREntries(sector []byte) []mbrEntry {
+	entries := make([]mbrEntry, 4)
+	for i := range entries {
+		entry := sector[mbrEntriesOffset+i*mbrEntrySize:]
+		entries[i] = mbrEntry{
+			typ:    entry[4],
+			start:  binary.LittleEndian.Uint32(entry[8:12]),
+			length: binary.LittleEndian.Uint32(entry[12:16]),
+		}
+	}
+	return entries
+}
+
+func isExtended(typ byte) bool {
+	return typ == 0x05 || typ == 0x0f || typ == 0x85
+}
+
+func mbrTypeName(typ byte) string {
+	if name, found := mbrTypes[typ]; found {
+		return fmt.Sprintf("%s (0x%02x)", name, typ)
+	}
+	return fmt.Sprintf("0x%02x", typ)
+}
+
+// Reads the primary partitions of an MBR, followed by the logical
+// partitions of its extended partition.
+func readMBR(r io.ReaderAt, size int64, entries []mbrEntry) (*Table, error) {
+	table := &Table{Scheme: MBR, SectorSize: mbrSectorSize}
+	var extended *mbrEntry
+	for i, entry := range entries {
+		if entry.typ == 0 || entry.length == 0 {
+			continue
+		}
+		p := Partition{
+			Number: i + 1,
+			Start:  int64(entry.start) * mbrSectorSize,
+			Size:   int64(entry.length) * mbrSectorSize,
+			Type:   mbrTypeName(entry.typ),
+		}
+		if err := checkBounds(p, size); err != nil {
+			return nil, err
+		}
+		table.Partitions = append(table.Partitions, p)
+		if isExtended(entry.typ) && extended == nil {
+			extended = &entries[i]
+		}
+	}
+
+	if extended != nil {
+		logical, err := readLogical(r, size, extended.start)
+		if err != nil {
+			return nil, err
+		}
+		table.Partitions = append(table.Partitions, logical...)
+	}
+	return table, nil
+}
+
+// Follows the chain of extended boot records of an extended partition.
+// Each holds a logical partition, relative to the EBR, and a link to the
+// next EBR, relative to the extended partition.
+func readLogical(r io.ReaderAt, size int64, extendedStart uint32) ([]Partition, error) {
+	var partitions []Partition
+	sector := make([]byte, mbrSectorSize)
+	ebr := int64(extendedStart)
+	for number := 5; number < 5+maxPartitions; number++ {
+		if _, err := r.ReadAt(sector, ebr*mbrSectorSize); err != nil {
+			return nil, fmt.Errorf("failed to read extended boot record at sector %d: %w", ebr, err)
+		}
+		if !hasMBRSignature(sector) {
+			return nil, fmt.Errorf("invalid extended boot record at sector %d", ebr)
+		}
+
+		entries := parseMBREntries(sector)
+		if entries[0].typ != 0 && entries[0].length != 0 {
+			p := Partition{
+				Number: number,
+				Start:  (ebr + int64(entries[0].start)) * mbrSectorSize,
+				Size:   int64(entries[0].length) * mbrSectorSize,
+				Type:   mbrTypeName(entries[0].typ),
+			}
+			if err := checkBounds(p, size); err != nil {
+				return nil, err
+			}
+			partitions = append(partitions, p)
+		}
+
+		if !isExtended(entries[1].typ) || entries[1].start == 0 {
+			return partitions, nil
+		}
+		ebr = int64(extendedStart) + int64(entries[1].start)
+	}
+	return nil, fmt.Errorf("extended partition has more than %d logical partitions", maxPartitions)
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package partition
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+	"unicode/utf16"
+)
+
+const testDiskSize = 8 * 1024 * 1024
+
+func putMBREntry(sector []byte, index int, typ byte, start, length uint32) {
+	entry := sector[mbrEntriesOffset+index*mbrEntrySize:]
+	entry[4] = typ
+	binary.LittleEndian.PutUint32(entry[8:], start)
+	binary.LittleEndian.PutUint32(entry[12:], length)
+	binary.LittleEndian.PutUint16(sector[510:], mbrSignature)
+}
+
+func TestRead_MBR(t *testing.T) {
+	disk := make([]byte, testDiskSize)
+	putMBREntry(disk, 0, 0x83, 2048, 4096)
+	putMBREntry(disk, 1, 0x05, 8192, 8192)
+	// Two logical partitions in the extended partition
+	putMBREntry(disk[8192*512:], 0, 0x82, 64, 1024)
+	putMBREntry(disk[8192*512:], 1, 0x05, 2048, 2048)
+	putMBREntry(disk[(8192+2048)*512:], 0, 0x83, 64, 1024)
+
+	table, err := Read(bytes.NewReader(disk), testDiskSize)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	expected := []Partition{
+		{Number: 1, Start: 2048 * 512, Size: 4096 * 512, Type: "Linux (0x83)"},
+		{Number: 2, Start: 8192 * 512, Size: 8192 * 512, Type: "Extended (0x05)"},
+		{Number: 5, Start: (8192 + 64) * 512, Size: 1024 * 512, Type: "Linux swap (0x82)"},
+		{Number: 6, Start: (8192 + 2048 + 64) * 512, Size: 1024 * 512, Type: "Linux (0x83)"},
+	}
+	if table.Scheme != MBR || len(table.Partitions) != len(expected) {
+		t.Fatalf("Expected %d MBR partitions, got %+v", len(expected), table)
+	}
+	for i, p := range table.Partitions {
+		if p != expected[i] {
+			t.Errorf("Expected partition %+v, got %+v", expected[i], p)
+		}
+	}
+}
+
+func TestRead_None(t *testing.T) {
+	table, err := Read(bytes.NewReader(make([]byte, 4096)), 4096)
+	if err != nil || table.Scheme != None || len(table.Partitions) != 0 {
+		t.Errorf("Expected no partition table, got %+v (%v)", table, err)
+	}
+}
+
+// Writes a GPT header and its entries at the given LBAs.
+func putGPT(disk []byte, headerLBA, entriesLBA uint64, entries []byte) {
+	header := disk[headerLBA*512 : headerLBA*512+512]
+	copy(header, gptSignature)
+	binary.LittleEndian.PutUint32(header[12:], gptMinHeaderSize)
+	binary.LittleEndian.PutUint64(header[72:], entriesLBA)
+	binary.LittleEndian.PutUint32(header[80:], uint32(len(entries)/gptMinEntrySize))
+	binary.LittleEndian.PutUint32(header[84:], gptMinEntrySize)
+	binary.LittleEndian.PutUint32(header[88:], crc32.ChecksumIEEE(entries))
+	binary.LittleEndian.PutUint32(header[16:], crc32.ChecksumIEEE(header[:gptMinHeaderSize]))
+	copy(disk[entriesLBA*512:], entries)
+}
+
+func makeGPTDisk() []byte {
+	entries := make([]byte, 128*gptMinEntrySize)
+	linuxFS := []byte{0xaf, 0x3d, 0xc6, 0x0f, 0x83, 0x84, 0x72, 0x47, 0x8e, 0x79, 0x3d, 0x69, 0xd8, 0x47, 0x7d, 0xe4}
+	copy(entries, linuxFS)
+	binary.LittleEndian.PutUint64(entries[32:], 2048)
+	binary.LittleEndian.PutUint64(entries[40:], 4095)
+	for i, unit := range utf16.Encode([]rune("root")) {
+		binary.LittleEndian.PutUint16(entries[56+i*2:], unit)
+	}
+	// The second entry is unused, and the third has an unknown type
+	third := entries[2*gptMinEntrySize:]
+	copy(third, bytes.Repeat([]byte{0x11}, 16))
+	binary.LittleEndian.PutUint64(third[32:], 4096)
+	binary.LittleEndian.PutUint64(third[40:], 8191)
+
+	disk := make([]byte, testDiskSize)
+	putMBREntry(disk, 0, mbrTypeProtective, 1, testDiskSize/512-1)
+	lastLBA := uint64(testDiskSize/512 - 1)
+	putGPT(disk, 1, 2, entries)
+	putGPT(disk, lastLBA, lastLBA-32, entries)
+	return disk
+}
+
+func TestRead_GPT(t *testing.T) {
+	expected := []Partition{
+		{Number: 1, Start: 2048 * 512, Size: 2048 * 512, Type: "Linux filesystem", Name: "root"},
+		{Number: 3, Start: 4096 * 512, Size: 4096 * 512, Type: "11111111-1111-1111-1111-111111111111"},
+	}
+
+	primary := makeGPTDisk()
+	backup := makeGPTDisk()
+	backup[512+20] ^= 0xff // Damage the primary header
+	for name, disk := range map[string][]byte{"primary": primary, "backup": backup} {
+		t.Run(name, func(t *testing.T) {
+			table, err := Read(bytes.NewReader(disk), testDiskSize)
+			if err != nil {
+				t.Fatalf("Read failed: %v", err)
+			}
+			if table.Scheme != GPT || len(table.Partitions) != len(expected) {
+				t.Fatalf("Expected %d GPT partitions, got %+v", len(expected), table)
+			}
+			for i, p := range table.Partitions {
+				if p != expected[i] {
+					t.Errorf("Expected partition %+v, got %+v", expected[i], p)
+				}
+			}
+		})
+	}
+}
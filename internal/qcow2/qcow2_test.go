@@ -0,0 +1,137 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+// Builds a version 3 image with 512 byte clusters: a data cluster, a
+// zeroed cluster, a compressed cluster and unallocated clusters.
+func makeImage(t *testing.T) ([]byte, []byte) {
+	t.Helper()
+	const clusterSize = 512
+	const virtualSize = 64 * clusterSize
+
+	expected := make([]byte, virtualSize)
+	copy(expected, "data cluster")
+	compressed := bytes.Repeat([]byte("z"), clusterSize)
+	copy(expected[2*clusterSize:], compressed)
+
+	image := make([]byte, 6*clusterSize)
+	copy(image, magic)
+	binary.BigEndian.PutUint32(image[4:], 3)
+	binary.BigEndian.PutUint32(image[20:], 9)
+	binary.BigEndian.PutUint64(image[24:], virtualSize)
+	binary.BigEndian.PutUint32(image[36:], 1)
+	binary.BigEndian.PutUint64(image[40:], 1*clusterSize) // L1 table
+	binary.BigEndian.PutUint32(image[100:], headerSize)
+
+	binary.BigEndian.PutUint64(image[1*clusterSize:], 2*clusterSize) // L2 table
+	l2 := image[2*clusterSize:]
+	binary.BigEndian.PutUint64(l2[0:], 3*clusterSize)
+	binary.BigEndian.PutUint64(l2[8:], 4*clusterSize|flagZero) // Stale data, which must read as zeroes
+	binary.BigEndian.PutUint64(l2[16:], flagCompressed|5*clusterSize)
+
+	copy(image[3*clusterSize:], "data cluster")
+	copy(image[4*clusterSize:], "stale")
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.BestCompression)
+	fw.Write(compressed)
+	fw.Close()
+	copy(image[5*clusterSize:], buf.Bytes())
+	return image, expected
+}
+
+func TestImage_ReadAt(t *testing.T) {
+	image, expected := makeImage(t)
+	img, err := Open(bytes.NewReader(image))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if img.Size() != int64(len(expected)) {
+		t.Fatalf("Expected size %d, got %d", len(expected), img.Size())
+	}
+
+	data, err := io.ReadAll(io.NewSectionReader(img, 0, img.Size()))
+	if err != nil {
+		t.Fatalf("Failed to read image: %v", err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Error("Virtual disk does not match the expected data")
+	}
+
+	// Reads spanning clusters and the end of the disk
+	buf := make([]byte, 100)
+	if n, err := img.ReadAt(buf, 2*512-50); err != nil || n != 100 || !bytes.Equal(buf, expected[2*512-50:2*512+50]) {
+		t.Errorf("Unexpected read across clusters: %d bytes (%v)", n, err)
+	}
+	if n, err := img.ReadAt(buf, img.Size()-10); err != io.EOF || n != 10 {
+		t.Errorf("Expected a short read at the end of the disk, got %d bytes (%v)", n, err)
+	}
+}
+
+func TestOpen_Invalid(t *testing.T) {
+	image, _ := makeImage(t)
+	testCases := map[string]func([]byte){
+		"magic":       func(b []byte) { b[0] = 0 },
+		"version":     func(b []byte) { binary.BigEndian.PutUint32(b[4:], 4) },
+		"encryption":  func(b []byte) { binary.BigEndian.PutUint32(b[32:], 1) },
+		"extended L2": func(b []byte) { binary.BigEndian.PutUint64(b[72:], featureExtendedL2) },
+		"L1 size":     func(b []byte) { binary.BigEndian.PutUint64(b[24:], 1<<30) },
+	}
+	for name, corrupt := range testCases {
+		t.Run(name, func(t *testing.T) {
+			corrupted := bytes.Clone(image)
+			corrupt(corrupted)
+			if _, err := Open(bytes.NewReader(corrupted)); err == nil {
+				t.Error("Expected an error, got nil")
+			}
+		})
+	}
+}
+
+func TestOpen_BackingFile(t *testing.T) {
+	image, expected := makeImage(t)
+	const backingFile = "base.qcow2"
+	binary.BigEndian.PutUint64(image[8:], 400)
+	binary.BigEndian.PutUint32(image[16:], uint32(len(backingFile)))
+	copy(image[400:], backingFile)
+
+	if _, err := Open(bytes.NewReader(image)); !errors.Is(err, ErrBackingFile) {
+		t.Fatalf("Expected ErrBackingFile, got %v", err)
+	}
+
+	img, err := OpenOverlay(bytes.NewReader(image))
+	if err != nil {
+		t.Fatalf("OpenOverlay failed: %v", err)
+	}
+	if img.BackingFile() != backingFile {
+		t.Errorf("Expected backing file %q, got %q", backingFile, img.BackingFile())
+	}
+	data, err := io.ReadAll(io.NewSectionReader(img, 0, img.Size()))
+	if err != nil {
+		t.Fatalf("Failed to read image: %v", err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Error("Virtual disk does not match the expected data")
+	}
+}
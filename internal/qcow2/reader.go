@@ -0,0 +1,295 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Package qcow2 reads the virtual disk of qcow2 images, without qemu-img.
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/PextraCloud/pxitool/pkg/log"
+)
+
+// https://gitlab.com/qemu-project/qemu/-/blob/master/docs/interop/qcow2.txt
+var magic = []byte{'Q', 'F', 'I', 0xfb}
+
+const (
+	headerSize     = 104 // Version 3 header, up to the header length field
+	minClusterBits = 9
+	maxClusterBits = 21
+
+	// Incompatible features
+	featureDirty        = 1 << 0
+	featureCorrupt      = 1 << 1
+	featureExternalData = 1 << 2
+	featureCompression  = 1 << 3
+	featureExtendedL2   = 1 << 4
+
+	// Table entries
+	offsetMask     = 0x00fffffffffffe00
+	flagCompressed = 1 << 62
+	flagZero       = 1 << 0
+
+	maxL2Cache = 64 // Cached L2 tables
+)
+
+// ErrBackingFile is returned by Open for an image that has a backing file,
+// since the clusters it provides are not read.
+var ErrBackingFile = errors.New("qcow2 image has a backing file")
+
+// Image is a qcow2 image, whose virtual disk is read with ReadAt. Clusters
+// that are not allocated read as zeroes, including those that a backing
+// file would provide. It is safe for concurrent use if the underlying
+// reader is.
+type Image struct {
+	r           io.ReaderAt
+	size        int64
+	clusterBits uint
+	l1          []uint64
+	zstd        bool   // Compressed clusters use zstd instead of deflate
+	backingFile string // Name of the backing file, whose data is not read
+
+	mu      sync.Mutex
+	l2Cache map[uint64][]uint64
+}
+
+// Open reads the header and L1 table of the qcow2 image read from r. Images
+// with a backing file are refused with ErrBackingFile, as reading them
+// would return zeroes for the data of the backing file.
+func Open(r io.ReaderAt) (*Image, error) {
+	img, err := open(r)
+	if err != nil {
+		return nil, err
+	}
+	if img.backingFile != "" {
+		return nil, fmt.Errorf("%w %s, whose data is not read", ErrBackingFile, img.backingFile)
+	}
+	return img, nil
+}
+
+// OpenOverlay is like Open, but also opens images with a backing file, for
+// callers that only need the clusters allocated in the image itself.
+func OpenOverlay(r io.ReaderAt) (*Image, error) {
+	img, err := open(r)
+	if err != nil {
+		return nil, err
+	}
+	if img.backingFile != "" {
+		log.Warn("qcow2 image has backing file %s, whose data is not read", img.backingFile)
+	}
+	return img, nil
+}
+
+func open(r io.ReaderAt) (*Image, error) {
+	header := make([]byte, headerSize)
+	if _, err := r.ReadAt(header[:72], 0); err != nil {
+		return nil, fmt.Errorf("failed to read qcow2 header: %w", err)
+	}
+	if !bytes.Equal(header[:4], magic) {
+		return nil, fmt.Errorf("invalid qcow2 magic")
+	}
+	version := binary.BigEndian.Uint32(header[4:8])
+	if version != 2 && version != 3 {
+		return nil, fmt.Errorf("unsupported qcow2 version %d", version)
+	}
+
+	img := &Image{
+		r:           r,
+		clusterBits: uint(binary.BigEndian.Uint32(header[20:24])),
+		l2Cache:     make(map[uint64][]uint64),
+	}
+	if img.clusterBits < minClusterBits || img.clusterBits > maxClusterBits {
+		return nil, fmt.Errorf("invalid qcow2 cluster bits %d", img.clusterBits)
+	}
+	size := binary.BigEndian.Uint64(header[24:32])
+	if size > 1<<62 {
+		return nil, fmt.Errorf("invalid qcow2 virtual size %d", size)
+	}
+	img.size = int64(size)
+	if method := binary.BigEndian.Uint32(header[32:36]); method != 0 {
+		return nil, fmt.Errorf("encrypted qcow2 images are not supported")
+	}
+
+	if version == 3 {
+		if _, err := r.ReadAt(header[72:], 72); err != nil {
+			return nil, fmt.Errorf("failed to read qcow2 header: %w", err)
+		}
+		incompatible := binary.BigEndian.Uint64(header[72:80])
+		if unknown := incompatible &^ (featureDirty | featureCorrupt | featureCompression); unknown != 0 {
+			return nil, fmt.Errorf("qcow2 image has unsupported incompatible features: %#x", unknown)
+		}
+		if incompatible&featureCorrupt != 0 {
+			log.Warn("qcow2 image is marked as corrupt")
+		}
+		if incompatible&featureCompression != 0 {
+			compressionType := []byte{0}
+			if _, err := r.ReadAt(compressionType, headerSize); err != nil {
+				return nil, fmt.Errorf("failed to read qcow2 compression type: %w", err)
+			}
+			img.zstd = compressionType[0] == 1
+		}
+	}
+
+	if backingOffset := binary.BigEndian.Uint64(header[8:16]); backingOffset != 0 {
+		name := make([]byte, min(binary.BigEndian.Uint32(header[16:20]), 1023))
+		if _, err := r.ReadAt(name, int64(backingOffset)); err != nil {
+			return nil, fmt.Errorf("failed to read qcow2 backing file name: %w", err)
+		}
+		img.backingFile = string(name)
+	}
+
+	// Each L1 entry covers the clusters of one L2 table
+	l2Bits := img.clusterBits - 3
+	l1Size := binary.BigEndian.Uint32(header[36:40])
+	if needed := (size + 1<<(img.clusterBits+l2Bits) - 1) >> (img.clusterBits + l2Bits); uint64(l1Size) < needed {
+		return nil, fmt.Errorf("qcow2 L1 table has %d entries, %d are needed", l1Size, needed)
+	}
+	var err error
+	if img.l1, err = img.readTable(binary.BigEndian.Uint64(header[40:48]), int(l1Size)); err != nil {
+		return nil, fmt.Errorf("failed to read qcow2 L1 table: %w", err)
+	}
+	return img, nil
+}
+
+// BackingFile returns the name of the backing file of an image opened with
+// OpenOverlay, or an empty string if it has none.
+func (img *Image) BackingFile() string {
+	return img.backingFile
+}
+
+// Size returns the size of the virtual disk.
+func (img *Image) Size() int64 {
+	return img.size
+}
+
+func (img *Image) readTable(offset uint64, entries int) ([]uint64, error) {
+	buf := make([]byte, entries*8)
+	if _, err := img.r.ReadAt(buf, int64(offset)); err != nil {
+		return nil, err
+	}
+	table := make([]uint64, entries)
+	for i := range table {
+		table[i] = binary.BigEndian.Uint64(buf[i*8:])
+	}
+	return table, nil
+}
+
+// Returns the L2 entry of a guest cluster, which is 0 if it is unallocated.
+func (img *Image) l2Entry(cluster uint64) (uint64, error) {
+	l2Bits := img.clusterBits - 3
+	l1Index := cluster >> l2Bits
+	if l1Index >= uint64(len(img.l1)) {
+		return 0, fmt.Errorf("cluster %d is beyond the L1 table", cluster)
+	}
+	l2Offset := img.l1[l1Index] & offsetMask
+	if l2Offset == 0 {
+		return 0, nil
+	}
+
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	l2, found := img.l2Cache[l2Offset]
+	if !found {
+		var err error
+		if l2, err = img.readTable(l2Offset, 1<<l2Bits); err != nil {
+			return 0, fmt.Errorf("failed to read L2 table at offset %d: %w", l2Offset, err)
+		}
+		if len(img.l2Cache) >= maxL2Cache {
+			clear(img.l2Cache)
+		}
+		img.l2Cache[l2Offset] = l2
+	}
+	return l2[cluster&(1<<l2Bits-1)], nil
+}
+
+// ReadAt implements io.ReaderAt for the virtual disk.
+func (img *Image) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= img.size {
+		return 0, io.EOF
+	}
+	var err error
+	if int64(len(p)) > img.size-off {
+		p = p[:img.size-off]
+		err = io.EOF
+	}
+
+	clusterSize := int64(1) << img.clusterBits
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		inCluster := pos & (clusterSize - 1)
+		chunk := p[n:min(len(p), n+int(clusterSize-inCluster))]
+		if readErr := img.readCluster(chunk, uint64(pos>>img.clusterBits), inCluster); readErr != nil {
+			return n, readErr
+		}
+		n += len(chunk)
+	}
+	return n, err
+}
+
+// Reads part of a guest cluster, starting at offset within it.
+func (img *Image) readCluster(p []byte, cluster uint64, offset int64) error {
+	entry, err := img.l2Entry(cluster)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case entry&flagCompressed != 0:
+		data, err := img.readCompressed(entry)
+		if err != nil {
+			return fmt.Errorf("failed to read compressed cluster %d: %w", cluster, err)
+		}
+		copy(p, data[offset:])
+	case entry&flagZero != 0 || entry&offsetMask == 0:
+		clear(p)
+	default:
+		if _, err := img.r.ReadAt(p, int64(entry&offsetMask)+offset); err != nil {
+			return fmt.Errorf("failed to read cluster %d: %w", cluster, err)
+		}
+	}
+	return nil
+}
+
+// Decompresses a cluster. The descriptor holds the host offset in its low
+// bits, followed by the number of additional 512 byte sectors used.
+func (img *Image) readCompressed(entry uint64) ([]byte, error) {
+	if img.zstd {
+		return nil, errors.New("zstd compressed clusters are not supported")
+	}
+	offsetBits := 62 - (img.clusterBits - 8)
+	hostOffset := int64(entry & (1<<offsetBits - 1))
+	sectors := int64((entry>>offsetBits)&(1<<(img.clusterBits-8)-1)) + 1
+	compressed := make([]byte, sectors*512-hostOffset&511)
+	n, err := img.r.ReadAt(compressed, hostOffset)
+	if err != nil && !(err == io.EOF && n > 0) {
+		return nil, err
+	}
+
+	data := make([]byte, 1<<img.clusterBits)
+	if _, err := io.ReadFull(flate.NewReader(bytes.NewReader(compressed[:n])), data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package qmp
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+type BlockInfo struct {
+	Device   string `json:"device"`
+	Inserted *struct {
+		File     string `json:"file"`
+		NodeName string `json:"node-name"`
+		Image    struct {
+			Filename string `json:"filename"`
+		} `json:"image"`
+	} `json:"inserted"`
+}
+
+type JobInfo struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Status string `json:"status"`
+	Error  string `json:"error"`
+}
+
+func (c *Client) QueryBlock() ([]BlockInfo, error) {
+	var blocks []BlockInfo
+	err := c.Execute("query-block", nil, &blocks)
+	return blocks, err
+}
+
+func (c *Client) QueryJobs() ([]JobInfo, error) {
+	var jobs []JobInfo
+	err := c.Execute("query-jobs", nil, &jobs)
+	return jobs, err
+}
+
+// Returns the name of the block node that has the image file open as its
+// active layer. Legacy device names are not accepted in its place, as
+// snapshots and commits address the node.
+func (c *Client) FindBlockNode(filePath string) (string, error) {
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return "", err
+	}
+	blocks, err := c.QueryBlock()
+	if err != nil {
+		return "", err
+	}
+
+	for _, block := range blocks {
+		if block.Inserted == nil {
+			continue
+		}
+		if block.Inserted.File != absPath && block.Inserted.Image.Filename != absPath {
+			continue
+		}
+		if block.Inserted.NodeName == "" {
+			return "", fmt.Errorf("block device %q of the VM has %s open without a node name", block.Device, absPath)
+		}
+		return block.Inserted.NodeName, nil
+	}
+	return "", fmt.Errorf("no block device of the VM has %s open", absPath)
+}
+
+// An external snapshot that redirects the writes to a block node into a
+// new qcow2 overlay.
+type Overlay struct {
+	Node         string // Node whose writes are redirected, the backing node of the overlay
+	File         string // Path of the overlay file
+	SnapshotNode string // Node name of the overlay, which becomes the root node
+}
+
+// Redirects writes to each node into a new qcow2 overlay, which QEMU
+// creates with the node's current image as its backing file. The overlays
+// are created in a single transaction: either every overlay is created at
+// the same point in time, or none is.
+func (c *Client) BlockdevSnapshotSyncGroup(overlays []Overlay) error {
+	actions := make([]map[string]any, 0, len(overlays))
+	for _, overlay := range overlays {
+		actions = append(actions, map[string]any{
+			"type": "blockdev-snapshot-sync",
+			"data": map[string]any{
+				"node-name":          overlay.Node,
+				"snapshot-file":      overlay.File,
+				"snapshot-node-name": overlay.SnapshotNode,
+				"format":             "qcow2",
+			},
+		})
+	}
+	return c.Execute("transaction", map[string]any{"actions": actions}, nil)
+}
+
+// Merges the active overlay at the root node top back into its backing
+// node base, and waits for the VM to use base again. Jobs that do not
+// finish within JobTimeout are cancelled.
+func (c *Client) BlockCommit(top string, base string, jobID string) error {
+	err := c.Execute("block-commit", map[string]any{
+		"job-id":       jobID,
+		"device":       top,
+		"base-node":    base,
+		"auto-dismiss": false,
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(c.JobTimeout)
+	completed := false
+	for {
+		if time.Now().After(deadline) {
+			if err := c.Execute("job-cancel", map[string]any{"id": jobID}, nil); err != nil {
+				return fmt.Errorf("block job %s timed out after %s, and could not be cancelled: %w", jobID, c.JobTimeout, err)
+			}
+			return fmt.Errorf("block job %s timed out after %s and was cancelled", jobID, c.JobTimeout)
+		}
+
+		jobs, err := c.QueryJobs()
+		if err != nil {
+			return err
+		}
+
+		var job *JobInfo
+		for i := range jobs {
+			if jobs[i].ID == jobID {
+				job = &jobs[i]
+				break
+			}
+		}
+		if job == nil {
+			return fmt.Errorf("block job %s disappeared", jobID)
+		}
+
+		switch job.Status {
+		case "ready":
+			// Active commits keep mirroring new writes until completed
+			if !completed {
+				if err := c.Execute("job-complete", map[string]any{"id": jobID}, nil); err != nil {
+					return err
+				}
+				completed = true
+			}
+		case "concluded":
+			if err := c.Execute("job-dismiss", map[string]any{"id": jobID}, nil); err != nil {
+				return err
+			}
+			if job.Error != "" {
+				return fmt.Errorf("block job %s failed: %s", jobID, job.Error)
+			}
+			return nil
+		}
+		time.Sleep(c.PollInterval)
+	}
+}
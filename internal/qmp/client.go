@@ -0,0 +1,149 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Package qmp is a minimal client for the QEMU Machine Protocol and the
+// QEMU guest agent protocol, which share the same JSON framing.
+package qmp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	DefaultTimeout      = 60 * time.Second // Freezing guest filesystems can take a while
+	DefaultPollInterval = 500 * time.Millisecond
+	DefaultJobTimeout   = 30 * time.Minute
+)
+
+type Client struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	encoder *json.Encoder
+
+	Timeout      time.Duration // Timeout for each command
+	PollInterval time.Duration // Interval for polling block jobs
+	JobTimeout   time.Duration // Timeout for a block job to finish, after which it is cancelled
+}
+
+type command struct {
+	Execute   string `json:"execute"`
+	Arguments any    `json:"arguments,omitempty"`
+}
+
+type response struct {
+	Return json.RawMessage `json:"return"`
+	Error  *Error          `json:"error"`
+	Event  string          `json:"event"`
+	QMP    json.RawMessage `json:"QMP"`
+}
+
+// An error returned by QEMU or the guest agent.
+type Error struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Class, e.Desc)
+}
+
+func newClient(socketPath string) (*Client, error) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", socketPath, err)
+	}
+	return &Client{
+		conn:         conn,
+		reader:       bufio.NewReader(conn),
+		encoder:      json.NewEncoder(conn),
+		Timeout:      DefaultTimeout,
+		PollInterval: DefaultPollInterval,
+		JobTimeout:   DefaultJobTimeout,
+	}, nil
+}
+
+// Connects to a QMP socket and enters command mode.
+func Dial(socketPath string) (*Client, error) {
+	client, err := newClient(socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	client.conn.SetReadDeadline(time.Now().Add(client.Timeout))
+	greeting, err := client.readResponse()
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to read QMP greeting: %w", err)
+	}
+	if greeting.QMP == nil {
+		client.Close()
+		return nil, fmt.Errorf("%s is not a QMP socket", socketPath)
+	}
+
+	if err := client.Execute("qmp_capabilities", nil, nil); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to negotiate QMP capabilities: %w", err)
+	}
+	return client, nil
+}
+
+// Runs a command and decodes its return value into result, if not nil.
+// Asynchronous events received in the meantime are discarded.
+func (c *Client) Execute(name string, arguments any, result any) error {
+	c.conn.SetDeadline(time.Now().Add(c.Timeout))
+	if err := c.encoder.Encode(command{Execute: name, Arguments: arguments}); err != nil {
+		return fmt.Errorf("failed to send %s: %w", name, err)
+	}
+
+	for {
+		resp, err := c.readResponse()
+		if err != nil {
+			return fmt.Errorf("failed to read %s response: %w", name, err)
+		}
+		if resp.Event != "" {
+			continue
+		}
+		if resp.Error != nil {
+			return fmt.Errorf("%s failed: %w", name, resp.Error)
+		}
+		if result == nil || resp.Return == nil {
+			return nil
+		}
+		if err := json.Unmarshal(resp.Return, result); err != nil {
+			return fmt.Errorf("failed to parse %s response: %w", name, err)
+		}
+		return nil
+	}
+}
+
+func (c *Client) readResponse() (*response, error) {
+	line, err := c.reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	var resp response
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return nil, fmt.Errorf("invalid message %q: %w", line, err)
+	}
+	return &resp, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
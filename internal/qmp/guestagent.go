@@ -0,0 +1,74 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package qmp
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"time"
+)
+
+// Connects to a QEMU guest agent socket. The agent keeps no session, so
+// replies left over from earlier clients are flushed with guest-sync.
+func DialGuestAgent(socketPath string) (*Client, error) {
+	client, err := newClient(socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.sync(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to sync with guest agent: %w", err)
+	}
+	return client, nil
+}
+
+func (c *Client) sync() error {
+	id := rand.Int64N(1 << 53) // Exactly representable as a JSON number
+	c.conn.SetDeadline(time.Now().Add(c.Timeout))
+	if err := c.encoder.Encode(command{Execute: "guest-sync", Arguments: map[string]any{"id": id}}); err != nil {
+		return err
+	}
+
+	want := strconv.FormatInt(id, 10)
+	for {
+		resp, err := c.readResponse()
+		if err != nil {
+			return err
+		}
+		if string(resp.Return) == want {
+			return nil
+		}
+	}
+}
+
+// Freezes the guest filesystems, returning how many were frozen.
+func (c *Client) FSFreeze() (int, error) {
+	var frozen int
+	if err := c.Execute("guest-fsfreeze-freeze", nil, &frozen); err != nil {
+		return 0, err
+	}
+	return frozen, nil
+}
+
+// Thaws the guest filesystems, returning how many were thawed.
+func (c *Client) FSThaw() (int, error) {
+	var thawed int
+	if err := c.Execute("guest-fsfreeze-thaw", nil, &thawed); err != nil {
+		return 0, err
+	}
+	return thawed, nil
+}
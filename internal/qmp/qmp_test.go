@@ -0,0 +1,183 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package qmp_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PextraCloud/pxitool/internal/qmp"
+	"github.com/PextraCloud/pxitool/internal/qmp/qmptest"
+)
+
+func TestExecute(t *testing.T) {
+	server := qmptest.NewServer(t, func(command string, arguments map[string]any) (any, error) {
+		switch command {
+		case "query-status":
+			return map[string]any{"status": "running"}, nil
+		default:
+			return nil, &qmp.Error{Class: "CommandNotFound", Desc: "The command " + command + " has not been found"}
+		}
+	})
+
+	client, err := qmp.Dial(server.SocketPath)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer client.Close()
+
+	var status struct {
+		Status string `json:"status"`
+	}
+	if err := client.Execute("query-status", nil, &status); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if status.Status != "running" {
+		t.Errorf("Expected status running, got %q", status.Status)
+	}
+
+	err = client.Execute("no-such-command", nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "CommandNotFound") {
+		t.Errorf("Expected a CommandNotFound error, got %v", err)
+	}
+
+	commands := server.Commands()
+	if len(commands) != 3 || commands[0] != "qmp_capabilities" {
+		t.Errorf("Unexpected commands: %v", commands)
+	}
+}
+
+func TestGuestAgentFreezeThaw(t *testing.T) {
+	server := qmptest.NewGuestAgentServer(t, func(command string, arguments map[string]any) (any, error) {
+		switch command {
+		case "guest-fsfreeze-freeze", "guest-fsfreeze-thaw":
+			return 2, nil
+		}
+		return nil, &qmp.Error{Class: "CommandNotFound", Desc: command}
+	})
+
+	agent, err := qmp.DialGuestAgent(server.SocketPath)
+	if err != nil {
+		t.Fatalf("DialGuestAgent failed: %v", err)
+	}
+	defer agent.Close()
+
+	if frozen, err := agent.FSFreeze(); err != nil || frozen != 2 {
+		t.Errorf("FSFreeze returned %d, %v", frozen, err)
+	}
+	if thawed, err := agent.FSThaw(); err != nil || thawed != 2 {
+		t.Errorf("FSThaw returned %d, %v", thawed, err)
+	}
+}
+
+func TestFindBlockNode(t *testing.T) {
+	server := qmptest.NewServer(t, func(command string, arguments map[string]any) (any, error) {
+		return []map[string]any{
+			{"device": "ide0-cd0"},
+			{"device": "drive-virtio0", "inserted": map[string]any{"file": "/images/a.qcow2", "node-name": "#block123", "image": map[string]any{"filename": "/images/a.qcow2"}}},
+			{"device": "", "inserted": map[string]any{"file": "json:{}", "node-name": "disk1", "image": map[string]any{"filename": "/images/b.qcow2"}}},
+			{"device": "drive-virtio2", "inserted": map[string]any{"file": "/images/legacy.qcow2", "image": map[string]any{"filename": "/images/legacy.qcow2"}}},
+		}, nil
+	})
+
+	client, err := qmp.Dial(server.SocketPath)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer client.Close()
+
+	for path, want := range map[string]string{"/images/a.qcow2": "#block123", "/images/b.qcow2": "disk1"} {
+		if node, err := client.FindBlockNode(path); err != nil || node != want {
+			t.Errorf("FindBlockNode(%s) = %q, %v, want %q", path, node, err, want)
+		}
+	}
+	if _, err := client.FindBlockNode("/images/c.qcow2"); err == nil {
+		t.Error("Expected an error for an image that is not open")
+	}
+	if _, err := client.FindBlockNode("/images/legacy.qcow2"); err == nil {
+		t.Error("Expected an error for an image without a node name, not its device name")
+	}
+}
+
+func TestBlockCommit(t *testing.T) {
+	for _, jobError := range []string{"", "Input/output error"} {
+		polls := 0
+		server := qmptest.NewServer(t, func(command string, arguments map[string]any) (any, error) {
+			switch command {
+			case "block-commit":
+				if arguments["device"] != "overlay1" || arguments["base-node"] != "disk1" {
+					return nil, &qmp.Error{Class: "GenericError", Desc: "Need a root block node"}
+				}
+			case "query-jobs":
+				polls++
+				status := "running"
+				if polls == 2 {
+					status = "ready"
+				} else if polls > 2 {
+					status = "concluded"
+				}
+				return []map[string]any{{"id": "commit", "type": "commit", "status": status, "error": jobError}}, nil
+			}
+			return map[string]any{}, nil
+		})
+
+		client, err := qmp.Dial(server.SocketPath)
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		client.PollInterval = time.Millisecond
+
+		err = client.BlockCommit("overlay1", "disk1", "commit")
+		client.Close()
+		if jobError == "" && err != nil {
+			t.Errorf("BlockCommit failed: %v", err)
+		}
+		if jobError != "" && (err == nil || !strings.Contains(err.Error(), jobError)) {
+			t.Errorf("Expected a job error, got %v", err)
+		}
+
+		want := "qmp_capabilities,block-commit,query-jobs,query-jobs,job-complete,query-jobs,job-dismiss"
+		if got := strings.Join(server.Commands(), ","); got != want {
+			t.Errorf("Unexpected commands: %s", got)
+		}
+	}
+}
+
+func TestBlockCommit_Timeout(t *testing.T) {
+	// The job never becomes ready
+	server := qmptest.NewServer(t, func(command string, arguments map[string]any) (any, error) {
+		if command == "query-jobs" {
+			return []map[string]any{{"id": "commit", "type": "commit", "status": "running"}}, nil
+		}
+		return map[string]any{}, nil
+	})
+
+	client, err := qmp.Dial(server.SocketPath)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer client.Close()
+	client.PollInterval = time.Millisecond
+	client.JobTimeout = 20 * time.Millisecond
+
+	if err := client.BlockCommit("overlay1", "disk1", "commit"); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+	if commands := server.Commands(); commands[len(commands)-1] != "job-cancel" {
+		t.Errorf("Expected the job to be cancelled, got %v", commands)
+	}
+}
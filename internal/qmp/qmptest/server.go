@@ -0,0 +1,134 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Package qmptest provides a fake QMP and guest agent server for tests.
+package qmptest
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/PextraCloud/pxitool/internal/qmp"
+)
+
+// Handles a command, returning its result or a *qmp.Error.
+type Handler func(command string, arguments map[string]any) (any, error)
+
+type Server struct {
+	SocketPath string
+
+	listener net.Listener
+	handler  Handler
+	greeting bool
+
+	mu       sync.Mutex
+	commands []string
+}
+
+// Starts a fake QMP server, which sends a greeting to each client.
+func NewServer(t testing.TB, handler Handler) *Server {
+	return newServer(t, handler, true)
+}
+
+// Starts a fake guest agent server, which answers guest-sync itself.
+func NewGuestAgentServer(t testing.TB, handler Handler) *Server {
+	return newServer(t, handler, false)
+}
+
+func newServer(t testing.TB, handler Handler, greeting bool) *Server {
+	// Unix socket paths are limited to about 100 bytes, too short for t.TempDir()
+	dir, err := os.MkdirTemp("", "qmptest-")
+	if err != nil {
+		t.Fatalf("Failed to create socket directory: %v", err)
+	}
+	socketPath := filepath.Join(dir, "qmp.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Failed to listen on %s: %v", socketPath, err)
+	}
+
+	s := &Server{SocketPath: socketPath, listener: listener, handler: handler, greeting: greeting}
+	t.Cleanup(func() {
+		listener.Close()
+		os.RemoveAll(dir)
+	})
+	go s.serve()
+	return s
+}
+
+// Returns the commands received so far, in order.
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	encoder := json.NewEncoder(conn)
+	if s.greeting {
+		encoder.Encode(map[string]any{"QMP": map[string]any{"version": map[string]any{}, "capabilities": []string{}}})
+	}
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var cmd struct {
+			Execute   string         `json:"execute"`
+			Arguments map[string]any `json:"arguments"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &cmd); err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, cmd.Execute)
+		s.mu.Unlock()
+
+		var result any = map[string]any{}
+		var err error
+		switch {
+		case cmd.Execute == "qmp_capabilities" && s.greeting:
+		case cmd.Execute == "guest-sync" && !s.greeting:
+			result = cmd.Arguments["id"]
+		default:
+			result, err = s.handler(cmd.Execute, cmd.Arguments)
+		}
+
+		// Events may arrive at any time, and clients must skip them
+		encoder.Encode(map[string]any{"event": "TEST_EVENT", "data": map[string]any{}})
+		if qmpErr, ok := err.(*qmp.Error); ok {
+			encoder.Encode(map[string]any{"error": qmpErr})
+		} else if err != nil {
+			encoder.Encode(map[string]any{"error": qmp.Error{Class: "GenericError", Desc: err.Error()}})
+		} else {
+			encoder.Encode(map[string]any{"return": result})
+		}
+	}
+}
@@ -16,14 +16,25 @@ limitations under the License.
 package readpxi
 
 import (
-	"bufio"
+	"fmt"
+	"io"
+	"os"
 
 	"github.com/PextraCloud/pxitool/internal/encryption"
 	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/encr"
 )
 
-func getDecryptedReader(buf *bufio.Reader, encrData *encr.Data) (*encryption.DecryptedReader, error) {
-	key, err := encryption.DeriveEncryptionKeyFromSalt(encrData.Salt)
+// Derives the key of an encrypted image. The key of an image read from
+// stdin cannot be prompted for, so it must be given in the environment.
+func deriveKey(salt []byte, fromStdin bool) ([]byte, error) {
+	if _, found := os.LookupEnv(encryption.KeyEnv); fromStdin && !found {
+		return nil, fmt.Errorf("the encryption key must be given in %s when the image is read from stdin", encryption.KeyEnv)
+	}
+	return encryption.DeriveEncryptionKeyFromSalt(salt)
+}
+
+func getDecryptedReader(buf io.Reader, encrData *encr.Data, fromStdin bool) (*encryption.DecryptedReader, error) {
+	key, err := deriveKey(encrData.Salt, fromStdin)
 	if err != nil {
 		return nil, err
 	}
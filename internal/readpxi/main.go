@@ -25,7 +25,13 @@ import (
 	"github.com/PextraCloud/pxitool/pkg/pxi/constants/encryptiontype"
 )
 
+// Path that reads a PXI file from stdin, such as from a pipe.
+const Stdin = "-"
+
 func openFile(path string) (io.Reader, error) {
+	if path == Stdin {
+		return os.Stdin, nil
+	}
 	file, err := os.Open(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open file %s: %w", path, err)
@@ -70,7 +76,7 @@ func ReadChunks(path string) (*PXIChunks, error) {
 		}
 		result.ENCR = encrData
 
-		decReader, err := getDecryptedReader(buf, encrData)
+		decReader, err := getDecryptedReader(buf, encrData, path == Stdin)
 		if err != nil {
 			return nil, fmt.Errorf("failed to get decrypted reader: %w", err)
 		}
@@ -144,6 +150,29 @@ func ReadChunksSkipEncrypted(path string) (*PXIChunks, error) {
 	return result, nil
 }
 
+// Reads the chunks of a PXI file like ReadChunks, but skips over the data
+// of its volumes instead of holding it in memory, as only their headers are
+// returned.
+func readChunksWithoutData(path string) (*PXIChunks, error) {
+	vr, err := OpenVolumes(path)
+	if err != nil {
+		return nil, err
+	}
+	defer vr.Close()
+
+	result := &PXIChunks{IHDR: vr.IHDR, ENCR: vr.ENCR, CONF: vr.CONF}
+	for {
+		svolData, err := vr.Next()
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		result.SVOL = append(result.SVOL, svolData)
+	}
+}
+
 // Reads a PXI file and returns information about it
 func GetInfo(path string, skipEncrypted bool) (*ReadPXIOutput, error) {
 	var chunks *PXIChunks
@@ -151,7 +180,7 @@ func GetInfo(path string, skipEncrypted bool) (*ReadPXIOutput, error) {
 	if skipEncrypted {
 		chunks, err = ReadChunksSkipEncrypted(path)
 	} else {
-		chunks, err = ReadChunks(path)
+		chunks, err = readChunksWithoutData(path)
 	}
 	if err != nil {
 		return nil, err
@@ -159,7 +188,7 @@ func GetInfo(path string, skipEncrypted bool) (*ReadPXIOutput, error) {
 
 	// If not absolute, convert to absolute path
 	absPath := path
-	if !filepath.IsAbs(path) {
+	if path != Stdin && !filepath.IsAbs(path) {
 		absPath, err = filepath.Abs(path)
 		if err != nil {
 			return nil, fmt.Errorf("failed to convert path to absolute: %w", err)
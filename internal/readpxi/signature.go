@@ -24,7 +24,7 @@ import (
 
 func verifySignature(reader io.Reader) error {
 	magic := make([]byte, signature.PXISignatureLength)
-	if _, err := reader.Read(magic); err != nil {
+	if _, err := io.ReadFull(reader, magic); err != nil {
 		return err
 	}
 	if err := signature.Verify(magic); err != nil {
@@ -49,5 +49,5 @@ type ReadPXIOutput struct {
 	Config          *conf.InstanceConfigGeneric     `json:"config,omitempty"` // nil if encrypted chunks are skipped
 	// List of volume IDs that are present in the PXI file as SVOL chunks
 	Volumes []ReadPXIOutputVolume `json:"volumes,omitempty"` // nil if encrypted chunks are skipped
-	Path    string                `json:"path"`              // Absolute path to the PXI file
+	Path    string                `json:"path"`              // Absolute path to the PXI file, or "-" for stdin
 }
@@ -0,0 +1,387 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package readpxi
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/PextraCloud/pxitool/internal/encryption"
+	"github.com/PextraCloud/pxitool/internal/qcow2"
+	"github.com/PextraCloud/pxitool/internal/sparse"
+	"github.com/PextraCloud/pxitool/pkg/log"
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunk"
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/conf"
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/encr"
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/ihdr"
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/svol"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/encryptiontype"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumeformat"
+)
+
+const (
+	// Buffer size of indexed volume data, a multiple of the encryption
+	// block size, so that concurrent readers decrypt few blocks twice
+	indexBufferSize = 64 * encryption.BlockSize
+)
+
+// VolumeReader reads the volumes of a PXI file one at a time. Unlike
+// ReadChunks, volume data is streamed from the file, and the data of
+// volumes that are not read is skipped over without being decrypted where
+// possible. A file that cannot be seeked, such as a pipe on stdin, is read
+// as a stream: skipped data is read and discarded, and volumes cannot be
+// read with random access.
+type VolumeReader struct {
+	IHDR *ihdr.Data
+	ENCR *encr.Data // Only if encryption indicated in IHDR
+	CONF *conf.Data
+
+	file        *os.File
+	stream      bool                          // The file cannot be seeked
+	stdin       bool                          // The file was read from stdin, so the key cannot be prompted for
+	reader      *countingReader               // Chunk stream after the IHDR and ENCR chunks
+	decrypted   *encryption.DecryptedReader   // Decrypts reader, if the file is encrypted
+	decryptedAt *encryption.DecryptedReaderAt // Decrypts the chunk stream at any offset
+	remaining   *io.LimitedReader             // Unread data of the current volume
+	current     *svol.Data                    // Volume last returned by Next
+	section     *io.SectionReader             // Data of the current volume
+	indexed     map[string]*io.SectionReader  // Data of the volumes read by Index, by volume ID
+}
+
+// Counts the bytes read from the chunk stream, which is its offset.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// Opens a PXI file, or stdin if path is Stdin, and reads its chunks up to
+// the first volume.
+func OpenVolumes(path string) (*VolumeReader, error) {
+	if path == Stdin {
+		return newVolumeReader(&VolumeReader{file: os.Stdin, stream: !isSeekable(os.Stdin), stdin: true})
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file %s: %w", path, err)
+	}
+	return newVolumeReader(&VolumeReader{file: file})
+}
+
+func newVolumeReader(vr *VolumeReader) (*VolumeReader, error) {
+	if err := vr.readHeader(); err != nil {
+		vr.file.Close()
+		return nil, err
+	}
+	return vr, nil
+}
+
+// Reports whether a file can be seeked, which pipes and sockets cannot.
+func isSeekable(file *os.File) bool {
+	_, err := file.Seek(0, io.SeekCurrent)
+	return err == nil
+}
+
+// Copies stdin into an unlinked file in tmpDir, so that it can be read
+// with random access, and returns it rewound.
+func spoolStdin(tmpDir string) (*os.File, error) {
+	file, err := os.CreateTemp(tmpDir, "pxitool-stdin-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool file: %w", err)
+	}
+	// The data stays reachable through the open file
+	if err := os.Remove(file.Name()); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to unlink spool file: %w", err)
+	}
+
+	log.Info("Copying the image from stdin to a temporary file in %s", filepath.Dir(file.Name()))
+	n, err := io.Copy(file, os.Stdin)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to copy the image from stdin: %w", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to rewind spool file: %w", err)
+	}
+	log.Debug("Copied %d bytes from stdin", n)
+	return file, nil
+}
+
+func (vr *VolumeReader) readHeader() error {
+	var err error
+	if err = verifySignature(vr.file); err != nil {
+		return fmt.Errorf("signature verification failed: %w", err)
+	}
+	// The file is read without buffering, so it can be seeked over
+	if vr.IHDR, err = readIHDR(vr.file); err != nil {
+		return fmt.Errorf("failed to read IHDR chunk: %w", err)
+	}
+
+	// The chunk stream starts at the current offset, after the IHDR and ENCR chunks
+	vr.reader = &countingReader{r: vr.file}
+	if vr.IHDR.EncryptionType != encryptiontype.None {
+		if vr.ENCR, err = readENCR(vr.file); err != nil {
+			return fmt.Errorf("failed to read ENCR chunk: %w", err)
+		}
+		key, err := deriveKey(vr.ENCR.Salt, vr.stdin)
+		if err != nil {
+			return fmt.Errorf("failed to derive encryption key: %w", err)
+		}
+		if vr.decrypted, err = encryption.NewDecryptedReader(vr.file, key, vr.ENCR.Nonce[:]); err != nil {
+			return fmt.Errorf("failed to get decrypted reader: %w", err)
+		}
+		vr.reader.r = vr.decrypted
+		if vr.stream {
+			return vr.readCONF()
+		}
+		streamOffset, err := vr.file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return fmt.Errorf("failed to get encrypted stream offset: %w", err)
+		}
+		if vr.decryptedAt, err = encryption.NewDecryptedReaderAt(vr.file, streamOffset, key, vr.ENCR.Nonce[:]); err != nil {
+			return fmt.Errorf("failed to get decrypted reader: %w", err)
+		}
+	} else if !vr.stream {
+		offset, err := vr.file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return fmt.Errorf("failed to get chunk stream offset: %w", err)
+		}
+		vr.reader.n = offset
+	}
+	return vr.readCONF()
+}
+
+func (vr *VolumeReader) readCONF() error {
+	var err error
+	if vr.CONF, err = readCONF(vr.reader); err != nil {
+		return fmt.Errorf("failed to read CONF chunk: %w", err)
+	}
+	return nil
+}
+
+// Next returns the next volume, whose VolumeData reads from the file until
+// Next is called again. It returns io.EOF after the last volume.
+func (vr *VolumeReader) Next() (*svol.Data, error) {
+	if vr.remaining != nil {
+		if err := vr.skip(vr.remaining.N); err != nil {
+			return nil, fmt.Errorf("failed to skip volume data: %w", err)
+		}
+		vr.remaining = nil
+	}
+
+	var length uint64
+	var chunkType [4]byte
+	if err := binary.Read(vr.reader, binary.BigEndian, &length); err != nil {
+		return nil, fmt.Errorf("failed to read chunk length: %w", err)
+	}
+	if _, err := io.ReadFull(vr.reader, chunkType[:]); err != nil {
+		return nil, fmt.Errorf("failed to read chunk type: %w", err)
+	}
+	if chunkType == chunk.ChunkTypeIEND {
+		log.Debug("Finished reading SVOL chunks")
+		return nil, io.EOF
+	}
+	if chunkType != chunk.ChunkTypeSVOL {
+		return nil, fmt.Errorf("expected SVOL or IEND chunk, got %s", chunkType)
+	}
+
+	// The SVOL header is followed by the (zero) CRC, then the volume data
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(vr.reader, header); err != nil {
+		return nil, fmt.Errorf("failed to read SVOL header: %w", err)
+	}
+	rest := make([]byte, int(header[2])+4+4) // Volume ID, reserved bytes and CRC
+	if _, err := io.ReadFull(vr.reader, rest); err != nil {
+		return nil, fmt.Errorf("failed to read SVOL header: %w", err)
+	}
+	header = append(header, rest...)
+	headerLength := uint64(len(header) - 4)
+	if length < headerLength {
+		return nil, fmt.Errorf("SVOL chunk length %d is shorter than its header", length)
+	}
+
+	svolData, err := svol.GetDataStruct(header)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing SVOL chunk: %w", err)
+	}
+	svolData.DataLength = length - headerLength
+	vr.remaining = &io.LimitedReader{R: vr.reader, N: int64(svolData.DataLength)}
+	svolData.VolumeData = bufio.NewReader(vr.remaining)
+	vr.current = svolData
+	if vr.stream {
+		vr.section = nil
+	} else if vr.decryptedAt != nil {
+		vr.section = io.NewSectionReader(vr.decryptedAt, vr.reader.n, int64(svolData.DataLength))
+	} else {
+		vr.section = io.NewSectionReader(vr.file, vr.reader.n, int64(svolData.DataLength))
+	}
+
+	log.Debug("Reading volume %s (%s, %d bytes)", svolData.VolumeID, svolData.VolumeFormat, svolData.DataLength)
+	return svolData, nil
+}
+
+// Find reads volumes up to the one with the given ID, skipping the data of
+// the others, and returns it as Next would.
+func (vr *VolumeReader) Find(volumeID string) (*svol.Data, error) {
+	for {
+		svolData, err := vr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("volume %s was not found in the image", volumeID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if svolData.VolumeID == volumeID {
+			return svolData, nil
+		}
+	}
+}
+
+// Section returns the data of the volume last returned by Next for random
+// access, decrypting it if needed. Reading it does not affect VolumeData,
+// and it stays valid after Next is called again. It is nil if the file is
+// read as a stream.
+func (vr *VolumeReader) Section() *io.SectionReader {
+	return vr.section
+}
+
+// Disk returns the virtual disk of the volume last returned by Next for
+// random access, along with its size. Sparse streams and qcow2 images are
+// decoded, without staging the volume anywhere. The disk is safe for
+// concurrent use.
+func (vr *VolumeReader) Disk() (io.ReaderAt, int64, error) {
+	if vr.current == nil {
+		return nil, 0, fmt.Errorf("no volume has been read")
+	}
+	if vr.stream {
+		return nil, 0, fmt.Errorf("volume %s cannot be read as a disk from a stream, such as stdin", vr.current.VolumeID)
+	}
+	return openDisk(vr.current, vr.section)
+}
+
+// DiskOf returns the virtual disk of a volume read by Index, like Disk.
+func (vr *VolumeReader) DiskOf(svolData *svol.Data) (io.ReaderAt, int64, error) {
+	section, found := vr.indexed[svolData.VolumeID]
+	if !found {
+		return nil, 0, fmt.Errorf("volume %s has not been indexed", svolData.VolumeID)
+	}
+	return openDisk(svolData, section)
+}
+
+func openDisk(svolData *svol.Data, section *io.SectionReader) (io.ReaderAt, int64, error) {
+	switch svolData.VolumeFormat {
+	case volumeformat.Raw:
+		return section, section.Size(), nil
+	case volumeformat.SparseRaw:
+		disk, err := sparse.NewReaderAt(section)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to index sparse volume %s: %w", svolData.VolumeID, err)
+		}
+		return disk, disk.Size(), nil
+	case volumeformat.QCOW2:
+		disk, err := qcow2.Open(section)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to open qcow2 volume %s: %w", svolData.VolumeID, err)
+		}
+		return disk, disk.Size(), nil
+	default:
+		return nil, 0, fmt.Errorf("volume %s is stored as %s, which cannot be read as a disk", svolData.VolumeID, svolData.VolumeFormat)
+	}
+}
+
+// Index reads the remaining volumes, skipping over their data, and returns
+// them with a VolumeData that reads from their section instead. Their data
+// can be read independently of each other, and concurrently, until the
+// VolumeReader is closed. Their disks can be opened with DiskOf.
+func (vr *VolumeReader) Index() ([]*svol.Data, error) {
+	if vr.stream {
+		return nil, fmt.Errorf("volumes cannot be indexed when reading a stream, such as stdin")
+	}
+	var volumes []*svol.Data
+	for {
+		svolData, err := vr.Next()
+		if err == io.EOF {
+			return volumes, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		svolData.VolumeData = bufio.NewReaderSize(vr.Section(), indexBufferSize)
+		volumes = append(volumes, svolData)
+		if vr.indexed == nil {
+			vr.indexed = make(map[string]*io.SectionReader)
+		}
+		vr.indexed[svolData.VolumeID] = vr.Section()
+	}
+}
+
+// IndexChunks reads a PXI file like ReadChunks, but the data of its
+// volumes is not read into memory: it is read from the file as the
+// VolumeData of each SVOL chunk is read, as returned by Index. The file is
+// closed by closing the returned VolumeReader. A stream on stdin is first
+// copied to an unlinked file in tmpDir, which must have room for the image.
+func IndexChunks(path string, tmpDir string) (*PXIChunks, *VolumeReader, error) {
+	var vr *VolumeReader
+	if path == Stdin && !isSeekable(os.Stdin) {
+		file, err := spoolStdin(tmpDir)
+		if err != nil {
+			return nil, nil, err
+		}
+		if vr, err = newVolumeReader(&VolumeReader{file: file, stdin: true}); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		var err error
+		if vr, err = OpenVolumes(path); err != nil {
+			return nil, nil, err
+		}
+	}
+	volumes, err := vr.Index()
+	if err != nil {
+		vr.Close()
+		return nil, nil, err
+	}
+	return &PXIChunks{IHDR: vr.IHDR, ENCR: vr.ENCR, CONF: vr.CONF, SVOL: volumes}, vr, nil
+}
+
+// Skips n bytes of the chunk stream, seeking over them where possible.
+func (vr *VolumeReader) skip(n int64) error {
+	if vr.stream {
+		_, err := io.CopyN(io.Discard, vr.reader, n)
+		return err
+	}
+	vr.reader.n += n
+	if vr.decrypted != nil {
+		return vr.decrypted.Skip(n)
+	}
+	_, err := vr.file.Seek(n, io.SeekCurrent)
+	return err
+}
+
+func (vr *VolumeReader) Close() error {
+	return closeFile(vr.file)
+}
@@ -0,0 +1,263 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package readpxi
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"testing/iotest"
+
+	"github.com/PextraCloud/pxitool/internal/encryption"
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/conf"
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/encr"
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/iend"
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/ihdr"
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/svol"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/compressiontype"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/encryptiontype"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/instancetype"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/pxiversion"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumeformat"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumetype"
+	"github.com/PextraCloud/pxitool/pkg/pxi/signature"
+)
+
+type testVolume struct {
+	id   string
+	data []byte
+}
+
+// Writes a PXI file holding the given volumes, with SVOL lengths known up
+// front so encrypted files are framed correctly.
+func writeTestPXI(t *testing.T, encrypted bool, volumes []testVolume) string {
+	t.Helper()
+	var buf bytes.Buffer
+	buf.Write(signature.PXISignature)
+
+	encryptionType := encryptiontype.None
+	if encrypted {
+		encryptionType = encryptiontype.AES256GCM
+	}
+	buf.Write(ihdr.New(pxiversion.V1, instancetype.LXC, compressiontype.None, encryptionType).Bytes())
+
+	var w io.Writer = &buf
+	var encryptedWriter *encryption.EncryptedWriter
+	if encrypted {
+		t.Setenv("PXI_ENCRYPTION_KEY", "secret")
+		key, salt, err := encryption.CreateEncryptionKey()
+		if err != nil {
+			t.Fatalf("Failed to create key: %v", err)
+		}
+		nonce, err := encryption.GenerateNonce()
+		if err != nil {
+			t.Fatalf("Failed to generate nonce: %v", err)
+		}
+		encrChunk, err := encr.New(nonce, make([]byte, 16), salt)
+		if err != nil {
+			t.Fatalf("Failed to create ENCR chunk: %v", err)
+		}
+		buf.Write(encrChunk.Bytes())
+		if encryptedWriter, err = encryption.NewWriter(&buf, key, nonce[:]); err != nil {
+			t.Fatalf("Failed to create encrypted writer: %v", err)
+		}
+		w = encryptedWriter
+	}
+
+	config := &conf.InstanceConfigGeneric{}
+	config.Type = instancetype.LXC
+	config.Name = "ct"
+	config.Metadata = conf.InstanceMetadata{Type: "lxc", Lxc: &conf.InstanceMetadataLxc{}}
+	confChunk, err := conf.New(config)
+	if err != nil {
+		t.Fatalf("Failed to create CONF chunk: %v", err)
+	}
+	w.Write(confChunk.Bytes())
+
+	for _, volume := range volumes {
+		svolChunk := svol.New(volumetype.LXC_, volume.id)
+		svol.IncrementLength(svolChunk, uint64(len(volume.data)))
+		svol.SetVolumeFormat(svolChunk, volumeformat.Raw)
+		w.Write(svolChunk.Bytes())
+		w.Write(volume.data)
+	}
+	w.Write(iend.New().Bytes())
+	if encryptedWriter != nil {
+		if err := encryptedWriter.Close(); err != nil {
+			t.Fatalf("Failed to close encrypted writer: %v", err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "test.pxi")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write PXI file: %v", err)
+	}
+	return path
+}
+
+func TestVolumeReader(t *testing.T) {
+	large := bytes.Repeat([]byte("0123456789abcdef"), 10000) // Spans several encrypted blocks
+	volumes := []testVolume{
+		{"vol-skipped", large},
+		{"vol-partial", large},
+		{"rootfs", []byte("rootfs data")},
+	}
+
+	for _, encrypted := range []bool{false, true} {
+		t.Run(map[bool]string{false: "plain", true: "encrypted"}[encrypted], func(t *testing.T) {
+			vr, err := OpenVolumes(writeTestPXI(t, encrypted, volumes))
+			if err != nil {
+				t.Fatalf("OpenVolumes failed: %v", err)
+			}
+			defer vr.Close()
+			if vr.CONF.Config.Name != "ct" {
+				t.Errorf("Expected config of instance ct, got %q", vr.CONF.Config.Name)
+			}
+			if (vr.ENCR != nil) != encrypted {
+				t.Errorf("Expected ENCR chunk: %v, got %v", encrypted, vr.ENCR != nil)
+			}
+
+			// The first volume is skipped without reading it, the second is partly read
+			for _, expected := range volumes[:2] {
+				svolData, err := vr.Next()
+				if err != nil {
+					t.Fatalf("Next failed: %v", err)
+				}
+				if svolData.VolumeID != expected.id || svolData.DataLength != uint64(len(expected.data)) {
+					t.Errorf("Expected volume %s of %d bytes, got %s of %d bytes", expected.id, len(expected.data), svolData.VolumeID, svolData.DataLength)
+				}
+				if expected.id == "vol-partial" {
+					head := make([]byte, 100)
+					if _, err := io.ReadFull(svolData.VolumeData, head); err != nil || !bytes.Equal(head, large[:100]) {
+						t.Errorf("Expected the start of the volume data, got %q (%v)", head, err)
+					}
+					// Random access across encrypted blocks
+					middle := make([]byte, 1000)
+					if _, err := vr.Section().ReadAt(middle, 50000); err != nil || !bytes.Equal(middle, large[50000:51000]) {
+						t.Errorf("Expected volume data at offset 50000, got %q (%v)", middle, err)
+					}
+				}
+			}
+
+			svolData, err := vr.Next()
+			if err != nil {
+				t.Fatalf("Next failed: %v", err)
+			}
+			if data, err := io.ReadAll(vr.Section()); err != nil || string(data) != "rootfs data" {
+				t.Errorf("Expected rootfs data from the section reader, got %q (%v)", data, err)
+			}
+			data, err := io.ReadAll(svolData.VolumeData)
+			if err != nil || string(data) != "rootfs data" {
+				t.Errorf("Expected rootfs data, got %q (%v)", data, err)
+			}
+
+			if _, err := vr.Next(); err != io.EOF {
+				t.Errorf("Expected io.EOF after the last volume, got %v", err)
+			}
+		})
+	}
+}
+
+func TestIndexChunks(t *testing.T) {
+	large := bytes.Repeat([]byte("0123456789abcdef"), 10000)
+	volumes := []testVolume{
+		{"vol-1", large},
+		{"vol-2", bytes.ToUpper(large)},
+		{"rootfs", []byte("rootfs data")},
+	}
+
+	for _, encrypted := range []bool{false, true} {
+		t.Run(map[bool]string{false: "plain", true: "encrypted"}[encrypted], func(t *testing.T) {
+			chunks, vr, err := IndexChunks(writeTestPXI(t, encrypted, volumes), "")
+			if err != nil {
+				t.Fatalf("IndexChunks failed: %v", err)
+			}
+			defer vr.Close()
+			if len(chunks.SVOL) != len(volumes) || chunks.CONF.Config.Name != "ct" {
+				t.Fatalf("Expected %d volumes of instance ct, got %d of %q", len(volumes), len(chunks.SVOL), chunks.CONF.Config.Name)
+			}
+
+			// Volumes are read concurrently, in small interleaved reads
+			var wg sync.WaitGroup
+			for i, expected := range volumes {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					data, err := io.ReadAll(iotest.OneByteReader(chunks.SVOL[i].VolumeData))
+					if err != nil || !bytes.Equal(data, expected.data) {
+						t.Errorf("Expected the data of volume %s, got %d bytes (%v)", expected.id, len(data), err)
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestVolumeReader_Stream(t *testing.T) {
+	large := bytes.Repeat([]byte("0123456789abcdef"), 10000)
+	volumes := []testVolume{
+		{"vol-skipped", large},
+		{"rootfs", []byte("rootfs data")},
+	}
+
+	for _, encrypted := range []bool{false, true} {
+		t.Run(map[bool]string{false: "plain", true: "encrypted"}[encrypted], func(t *testing.T) {
+			data, err := os.ReadFile(writeTestPXI(t, encrypted, volumes))
+			if err != nil {
+				t.Fatalf("Failed to read PXI file: %v", err)
+			}
+			// A pipe cannot be seeked, like stdin in a shell pipeline
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatalf("Failed to create pipe: %v", err)
+			}
+			go func() {
+				w.Write(data)
+				w.Close()
+			}()
+			if isSeekable(r) {
+				t.Fatal("Expected a pipe not to be seekable")
+			}
+
+			vr, err := newVolumeReader(&VolumeReader{file: r, stream: true, stdin: true})
+			if err != nil {
+				t.Fatalf("Failed to open stream: %v", err)
+			}
+			defer vr.Close()
+
+			svolData, err := vr.Find("rootfs")
+			if err != nil {
+				t.Fatalf("Find failed: %v", err)
+			}
+			if vr.Section() != nil {
+				t.Error("Expected no section when reading a stream")
+			}
+			if _, _, err := vr.Disk(); err == nil {
+				t.Error("Expected a stream not to be readable as a disk")
+			}
+			if data, err := io.ReadAll(svolData.VolumeData); err != nil || string(data) != "rootfs data" {
+				t.Errorf("Expected rootfs data, got %q (%v)", data, err)
+			}
+			if _, err := vr.Next(); err != io.EOF {
+				t.Errorf("Expected io.EOF after the last volume, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package restorepxi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/PextraCloud/pxitool/pkg/log"
+)
+
+// A btrfs send stream received into a staging directory next to its
+// target. Once promoted, the received read-only snapshot is moved next to
+// the target and a writable snapshot of it replaces the target. The
+// received snapshot is deleted when the restore finishes, unless it is
+// kept as the parent for later incremental streams.
+type stagedBtrfs struct {
+	target     string
+	stagingDir string
+	name       string // Name of the received snapshot
+	keep       bool   // Whether the received snapshot is kept once finished
+	replaced   bool   // Whether an existing target was moved to the staging directory
+}
+
+// Receives a btrfs send stream into a staging directory next to restorePath.
+// The received snapshot is kept if keep is set.
+func stageBtrfs(ctx context.Context, restorePath string, reader io.Reader, keep bool) (*stagedBtrfs, error) {
+	restorePath = filepath.Clean(restorePath)
+	parentDir := filepath.Dir(restorePath)
+
+	// Receive into an empty directory, as the stream decides the subvolume name
+	stagingDir, err := os.MkdirTemp(parentDir, ".pxitool-receive-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create staging directory in '%s': %w", parentDir, err)
+	}
+	s := &stagedBtrfs{target: restorePath, stagingDir: stagingDir, keep: keep}
+
+	log.Debug("Receiving btrfs stream into '%s'", stagingDir)
+	cmd := exec.CommandContext(ctx, "btrfs", "receive", stagingDir)
+	cmd.Stdin = reader
+
+	var errBuf bytes.Buffer
+	cmd.Stderr = &errBuf
+	if err := cmd.Run(); err != nil {
+		log.Error("stderr: %s", errBuf.String())
+		s.discard()
+		return nil, fmt.Errorf("failed to receive btrfs stream: %w", err)
+	}
+
+	entries, err := os.ReadDir(stagingDir)
+	if err != nil {
+		s.discard()
+		return nil, fmt.Errorf("failed to read staging directory '%s': %w", stagingDir, err)
+	}
+	if len(entries) != 1 {
+		s.discard()
+		return nil, fmt.Errorf("expected one received subvolume in '%s', found %d", stagingDir, len(entries))
+	}
+	s.name = entries[0].Name()
+
+	if _, err := os.Lstat(s.receivedPath()); err == nil {
+		s.discard()
+		return nil, fmt.Errorf("received snapshot '%s' already exists", s.receivedPath())
+	}
+	return s, nil
+}
+
+// Returns where the received snapshot is moved once promoted.
+func (s *stagedBtrfs) receivedPath() string {
+	return filepath.Join(filepath.Dir(s.target), s.name)
+}
+
+// Returns where an existing target is kept until the promotion finishes.
+func (s *stagedBtrfs) previousPath() string {
+	return filepath.Join(s.stagingDir, filepath.Base(s.target))
+}
+
+func deleteSubvolume(path string) error {
+	if output, err := exec.Command("btrfs", "subvolume", "delete", path).CombinedOutput(); err != nil {
+		log.Error("output: %s", output)
+		return fmt.Errorf("failed to delete subvolume '%s': %w", path, err)
+	}
+	return nil
+}
+
+func (s *stagedBtrfs) promote() error {
+	if err := os.Rename(filepath.Join(s.stagingDir, s.name), s.receivedPath()); err != nil {
+		return fmt.Errorf("failed to move received snapshot to '%s': %w", s.receivedPath(), err)
+	}
+	if _, err := os.Lstat(s.target); err == nil {
+		log.Debug("Moving existing subvolume '%s' aside", s.target)
+		if err := os.Rename(s.target, s.previousPath()); err != nil {
+			os.Rename(s.receivedPath(), filepath.Join(s.stagingDir, s.name))
+			return fmt.Errorf("failed to move existing subvolume '%s' aside: %w", s.target, err)
+		}
+		s.replaced = true
+	}
+
+	// Received snapshots are read-only, so restore a writable snapshot of it
+	if output, err := exec.Command("btrfs", "subvolume", "snapshot", s.receivedPath(), s.target).CombinedOutput(); err != nil {
+		log.Error("output: %s", output)
+		if s.replaced {
+			os.Rename(s.previousPath(), s.target)
+			s.replaced = false
+		}
+		os.Rename(s.receivedPath(), filepath.Join(s.stagingDir, s.name))
+		return fmt.Errorf("failed to create subvolume '%s': %w", s.target, err)
+	}
+	log.Debug("Restored btrfs subvolume to '%s' from received snapshot '%s'", s.target, s.receivedPath())
+	return nil
+}
+
+func (s *stagedBtrfs) revert() error {
+	if err := deleteSubvolume(s.target); err != nil {
+		return err
+	}
+	if s.replaced {
+		if err := os.Rename(s.previousPath(), s.target); err != nil {
+			return err
+		}
+		s.replaced = false
+	}
+	return os.Rename(s.receivedPath(), filepath.Join(s.stagingDir, s.name))
+}
+
+func (s *stagedBtrfs) finish() error {
+	if s.replaced {
+		log.Debug("Deleting previous subvolume '%s'", s.target)
+		if err := deleteSubvolume(s.previousPath()); err != nil {
+			return err
+		}
+		s.replaced = false
+	}
+	if s.keep {
+		log.Info("Kept received btrfs snapshot '%s' as the parent for incremental restores", s.receivedPath())
+	} else {
+		log.Debug("Deleting received snapshot '%s'", s.receivedPath())
+		if err := deleteSubvolume(s.receivedPath()); err != nil {
+			return err
+		}
+	}
+	return os.Remove(s.stagingDir)
+}
+
+func (s *stagedBtrfs) discard() error {
+	if s.name != "" {
+		if err := deleteSubvolume(filepath.Join(s.stagingDir, s.name)); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(s.stagingDir)
+}
+
+func (s *stagedBtrfs) String() string {
+	return fmt.Sprintf("btrfs subvolume '%s'", s.target)
+}
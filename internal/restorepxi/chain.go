@@ -0,0 +1,112 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package restorepxi
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"os/exec"
+	"path/filepath"
+	"slices"
+
+	"github.com/PextraCloud/pxitool/pkg/log"
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/conf"
+)
+
+// Adds the backing images of qcow2 volumes to the volume map, as they are
+// not listed in the config volumes themselves.
+func addBackingVolumes(volumeMap volumeMapType, svolMap svolMapType) error {
+	for _, volume := range volumeMap {
+		for _, image := range volume.BackingChain {
+			if _, found := svolMap[image.ID]; !found {
+				return fmt.Errorf("backing image '%s' of volume '%s' was not found in SVOL chunks", image.ID, volume.ID)
+			}
+			volumeMap[image.ID] = &conf.InstanceVolume{
+				ID:            image.ID,
+				Type:          volume.Type,
+				StoragePoolID: volume.StoragePoolID,
+			}
+		}
+	}
+	return nil
+}
+
+// Returns a copy of restorePaths with a path for every backing image of the
+// volumes being restored. Unless given, backing images are restored next to
+// their volume, under their original file name. An image shared by several
+// volumes is restored once, next to the first of them by volume ID.
+func getChainRestorePaths(restorePaths restorePathsType, volumeMap volumeMapType) (restorePathsType, error) {
+	paths := make(restorePathsType, len(restorePaths))
+	for volumeID, restorePath := range restorePaths {
+		paths[volumeID] = restorePath
+	}
+
+	for _, volumeID := range slices.Sorted(maps.Keys(restorePaths)) {
+		restorePath := restorePaths[volumeID]
+		volume, found := volumeMap[volumeID]
+		if !found {
+			continue
+		}
+		for _, image := range volume.BackingChain {
+			if _, found := paths[image.ID]; found {
+				continue
+			}
+			paths[image.ID] = filepath.Join(filepath.Dir(restorePath), image.File)
+			log.Debug("Restoring backing image '%s' of volume '%s' to path '%s'", image.ID, volumeID, paths[image.ID])
+		}
+	}
+
+	used := make(map[string]string, len(paths))
+	for volumeID, restorePath := range paths {
+		if otherID, found := used[filepath.Clean(restorePath)]; found {
+			return nil, fmt.Errorf("volumes '%s' and '%s' would both be restored to '%s'", otherID, volumeID, restorePath)
+		}
+		used[filepath.Clean(restorePath)] = volumeID
+	}
+	return paths, nil
+}
+
+// Points each restored image of a backing chain at the restore path of
+// its backing image, while the images are still at their write paths.
+// Only the header is rewritten, as the image data itself is unchanged.
+func relinkBackingChains(restorePaths restorePathsType, writePaths restorePathsType, volumeMap volumeMapType) error {
+	for volumeID := range restorePaths {
+		volume, found := volumeMap[volumeID]
+		if !found || len(volume.BackingChain) == 0 {
+			continue
+		}
+
+		imagePath := writePaths[volumeID]
+		for _, image := range volume.BackingChain {
+			backingPath, err := filepath.Abs(restorePaths[image.ID])
+			if err != nil {
+				return fmt.Errorf("failed to resolve path of backing image '%s': %w", image.ID, err)
+			}
+
+			log.Debug("Relinking '%s' to backing image '%s'", imagePath, backingPath)
+			cmd := exec.Command("qemu-img", "rebase", "-u", "-b", backingPath, "-F", image.Format, imagePath)
+			var errBuf bytes.Buffer
+			cmd.Stderr = &errBuf
+			if err := cmd.Run(); err != nil {
+				log.Error("stderr: %s", errBuf.String())
+				return fmt.Errorf("failed to relink '%s' to its backing image: %w", imagePath, err)
+			}
+			imagePath = writePaths[image.ID]
+		}
+	}
+	return nil
+}
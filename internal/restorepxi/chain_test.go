@@ -0,0 +1,83 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package restorepxi
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/conf"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumetype"
+)
+
+func TestGetChainRestorePaths(t *testing.T) {
+	base := conf.BackingImage{ID: "vol-1-backing-1", File: "base.qcow2", Format: "qcow2"}
+	tests := []struct {
+		name    string
+		chains  map[string][]conf.BackingImage
+		paths   restorePathsType
+		want    restorePathsType
+		wantErr string
+	}{
+		{
+			name:   "Shared base image",
+			chains: map[string][]conf.BackingImage{"vol-1": {base}, "vol-2": {base}},
+			paths:  restorePathsType{"vol-1": "/a/vol-1.qcow2", "vol-2": "/b/vol-2.qcow2"},
+			want:   restorePathsType{"vol-1": "/a/vol-1.qcow2", "vol-2": "/b/vol-2.qcow2", "vol-1-backing-1": "/a/base.qcow2"},
+		},
+		{
+			name:   "Given backing path",
+			chains: map[string][]conf.BackingImage{"vol-1": {base}, "vol-2": {base}},
+			paths:  restorePathsType{"vol-1": "/a/vol-1.qcow2", "vol-2": "/b/vol-2.qcow2", "vol-1-backing-1": "/c/base.qcow2"},
+			want:   restorePathsType{"vol-1": "/a/vol-1.qcow2", "vol-2": "/b/vol-2.qcow2", "vol-1-backing-1": "/c/base.qcow2"},
+		},
+		{
+			name: "Distinct images with one file name",
+			chains: map[string][]conf.BackingImage{
+				"vol-1": {base},
+				"vol-2": {{ID: "vol-2-backing-1", File: "base.qcow2", Format: "qcow2"}},
+			},
+			paths:   restorePathsType{"vol-1": "/a/vol-1.qcow2", "vol-2": "/a/vol-2.qcow2"},
+			wantErr: "would both be restored to '/a/base.qcow2'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			volumeMap := make(volumeMapType)
+			for volumeID, chain := range tt.chains {
+				volumeMap[volumeID] = &conf.InstanceVolume{ID: volumeID, Type: volumetype.Directory, BackingChain: chain}
+			}
+			paths, err := getChainRestorePaths(tt.paths, volumeMap)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getChainRestorePaths failed: %v", err)
+			}
+			if len(paths) != len(tt.want) {
+				t.Errorf("Expected %d paths, got %v", len(tt.want), paths)
+			}
+			for volumeID, path := range tt.want {
+				if paths[volumeID] != path {
+					t.Errorf("Expected '%s' to be restored to '%s', got '%s'", volumeID, path, paths[volumeID])
+				}
+			}
+		})
+	}
+}
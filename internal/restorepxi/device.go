@@ -0,0 +1,228 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package restorepxi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/PextraCloud/pxitool/pkg/log"
+)
+
+const (
+	stagingSuffix  = "-pxitool-restore"
+	previousSuffix = "-pxitool-previous"
+	// How long to wait for the device node of a new zvol
+	zvolDeviceTimeout = 30 * time.Second
+)
+
+// Runs an external tool, logging its stderr if it fails.
+func runTool(ctx context.Context, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	var errBuf bytes.Buffer
+	cmd.Stderr = &errBuf
+	if err := cmd.Run(); err != nil {
+		log.Error("stderr: %s", errBuf.String())
+		return fmt.Errorf("%s %s failed: %w", name, args[0], err)
+	}
+	return nil
+}
+
+// Returns a block device that a volume restored to devicePath is staged
+// on, for logical volumes and zvols, which are staged on a new volume of
+// the same size next to them. Other block devices cannot be staged, and
+// nil is returned for them.
+func newStagedDevice(ctx context.Context, devicePath string) (stagedDevice, error) {
+	if dataset, found := strings.CutPrefix(devicePath, "/dev/zvol/"); found {
+		s, err := newStagedZvol(ctx, dataset)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	// lvs fails for block devices that are not logical volumes
+	output, err := exec.CommandContext(ctx, "lvs", "--noheadings", "--nosuffix", "--units", "b", "-o", "vg_name,lv_name,lv_size,pool_lv", devicePath).Output()
+	if err != nil {
+		log.Debug("'%s' is not a logical volume, it is written in place: %v", devicePath, err)
+		return nil, nil
+	}
+	s, err := newStagedLV(ctx, strings.Fields(string(output)))
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// A block device that a volume is staged on.
+type stagedDevice interface {
+	stagedTarget
+	devicePath() string
+}
+
+// A logical volume staged on a new LV in the same volume group.
+type stagedLV struct {
+	vgName string
+	lvName string
+}
+
+// Creates an LV with the size of an existing LV, described by the
+// vg_name, lv_name, lv_size and pool_lv fields of lvs. Thin LVs are staged
+// in the same thin pool.
+func newStagedLV(ctx context.Context, fields []string) (*stagedLV, error) {
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("unexpected lvs output: %q", fields)
+	}
+	s := &stagedLV{vgName: fields[0], lvName: fields[1]}
+
+	args := []string{"--yes", "--name", s.lvName + stagingSuffix}
+	if len(fields) > 3 {
+		args = append(args, "--virtualsize", fields[2]+"b", "--thinpool", s.vgName+"/"+fields[3])
+	} else {
+		args = append(args, "--size", fields[2]+"b", s.vgName)
+	}
+	log.Debug("Creating staging LV '%s/%s'", s.vgName, s.lvName+stagingSuffix)
+	if err := runTool(ctx, "lvcreate", args...); err != nil {
+		return nil, fmt.Errorf("failed to create staging LV for '%s/%s': %w", s.vgName, s.lvName, err)
+	}
+	return s, nil
+}
+
+func (s *stagedLV) devicePath() string {
+	return fmt.Sprintf("/dev/%s/%s", s.vgName, s.lvName+stagingSuffix)
+}
+
+func (s *stagedLV) rename(from string, to string) error {
+	return runTool(context.Background(), "lvrename", s.vgName, from, to)
+}
+
+func (s *stagedLV) promote() error {
+	if err := s.rename(s.lvName, s.lvName+previousSuffix); err != nil {
+		return err
+	}
+	if err := s.rename(s.lvName+stagingSuffix, s.lvName); err != nil {
+		if revertErr := s.rename(s.lvName+previousSuffix, s.lvName); revertErr != nil {
+			log.Error("Failed to rename LV '%s/%s' back: %v", s.vgName, s.lvName+previousSuffix, revertErr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *stagedLV) revert() error {
+	if err := s.rename(s.lvName, s.lvName+stagingSuffix); err != nil {
+		return err
+	}
+	return s.rename(s.lvName+previousSuffix, s.lvName)
+}
+
+func (s *stagedLV) finish() error {
+	return runTool(context.Background(), "lvremove", "--yes", s.vgName+"/"+s.lvName+previousSuffix)
+}
+
+func (s *stagedLV) discard() error {
+	return runTool(context.Background(), "lvremove", "--yes", s.vgName+"/"+s.lvName+stagingSuffix)
+}
+
+func (s *stagedLV) String() string {
+	return fmt.Sprintf("LV '%s/%s'", s.vgName, s.lvName)
+}
+
+// A zvol staged on a new zvol next to it.
+type stagedZvol struct {
+	dataset string
+}
+
+// Creates a zvol with the size and block size of an existing one. It is
+// sparse if the existing zvol has no reservation.
+func newStagedZvol(ctx context.Context, dataset string) (*stagedZvol, error) {
+	output, err := exec.CommandContext(ctx, "zfs", "get", "-Hp", "-o", "value", "volsize,volblocksize,refreservation", dataset).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get properties of zvol '%s': %w", dataset, err)
+	}
+	fields := strings.Fields(string(output))
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("unexpected zfs get output: %q", output)
+	}
+	s := &stagedZvol{dataset: dataset}
+
+	args := []string{"create", "-V", fields[0], "-b", fields[1]}
+	if fields[2] == "0" || fields[2] == "none" {
+		args = append(args, "-s")
+	}
+	log.Debug("Creating staging zvol '%s'", dataset+stagingSuffix)
+	if err := runTool(ctx, "zfs", append(args, dataset+stagingSuffix)...); err != nil {
+		return nil, fmt.Errorf("failed to create staging zvol for '%s': %w", dataset, err)
+	}
+
+	// The device node is created asynchronously by udev
+	deadline := time.Now().Add(zvolDeviceTimeout)
+	for {
+		if _, err := os.Stat(s.devicePath()); err == nil {
+			return s, nil
+		}
+		if time.Now().After(deadline) || ctx.Err() != nil {
+			s.discard()
+			return nil, fmt.Errorf("device of staging zvol '%s' did not appear", dataset+stagingSuffix)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (s *stagedZvol) devicePath() string {
+	return filepath.Join("/dev/zvol", s.dataset+stagingSuffix)
+}
+
+func (s *stagedZvol) rename(from string, to string) error {
+	return runTool(context.Background(), "zfs", "rename", from, to)
+}
+
+func (s *stagedZvol) promote() error {
+	if err := s.rename(s.dataset, s.dataset+previousSuffix); err != nil {
+		return err
+	}
+	if err := s.rename(s.dataset+stagingSuffix, s.dataset); err != nil {
+		if revertErr := s.rename(s.dataset+previousSuffix, s.dataset); revertErr != nil {
+			log.Error("Failed to rename zvol '%s' back: %v", s.dataset+previousSuffix, revertErr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *stagedZvol) revert() error {
+	if err := s.rename(s.dataset, s.dataset+stagingSuffix); err != nil {
+		return err
+	}
+	return s.rename(s.dataset+previousSuffix, s.dataset)
+}
+
+func (s *stagedZvol) finish() error {
+	return runTool(context.Background(), "zfs", "destroy", "-r", s.dataset+previousSuffix)
+}
+
+func (s *stagedZvol) discard() error {
+	return runTool(context.Background(), "zfs", "destroy", "-r", s.dataset+stagingSuffix)
+}
+
+func (s *stagedZvol) String() string {
+	return fmt.Sprintf("zvol '%s'", s.dataset)
+}
@@ -0,0 +1,256 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package restorepxi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+
+	"github.com/PextraCloud/pxitool/internal/utils"
+	"github.com/PextraCloud/pxitool/pkg/log"
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/conf"
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/svol"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumeformat"
+)
+
+// Returns the format a stored volume is restored in by default, which is
+// a disk image format for sparse streams.
+func restoredFormat(format volumeformat.VolumeFormat) volumeformat.VolumeFormat {
+	if format == volumeformat.SparseRaw {
+		return volumeformat.Raw
+	}
+	return format
+}
+
+// Returns whether a volume is converted to another format while restored.
+func needsConversion(volumeID string, svolData *svol.Data, opts Options) bool {
+	format, found := opts.Formats[volumeID]
+	return found && svolData != nil && format != restoredFormat(svolData.VolumeFormat)
+}
+
+// Checks that each volume with a requested format can be converted to it,
+// before anything is written.
+func checkFormats(restorePaths restorePathsType, svolMap svolMapType, volumeMap volumeMapType, opts Options) error {
+	for volumeID, format := range opts.Formats {
+		restorePath, found := restorePaths[volumeID]
+		if !found {
+			return fmt.Errorf("format given for volume '%s', which is not being restored", volumeID)
+		}
+		svolData, found := svolMap[volumeID]
+		if !found {
+			return fmt.Errorf("no SVOL chunk found for volume ID '%s'", volumeID)
+		}
+		if !needsConversion(volumeID, svolData, opts) {
+			continue
+		}
+
+		if _, err := utils.QEMUImgDriver(svolData.VolumeFormat); err != nil {
+			return fmt.Errorf("volume '%s' cannot be converted: %w", volumeID, err)
+		}
+		if _, err := utils.QEMUImgDriver(format); err != nil {
+			return fmt.Errorf("volume '%s' cannot be converted: %w", volumeID, err)
+		}
+		if volume, found := volumeMap[volumeID]; found && len(volume.BackingChain) > 0 {
+			return fmt.Errorf("volume '%s' has a backing chain and cannot be converted", volumeID)
+		}
+		if format != volumeformat.Raw && utils.IsBlockDevice(restorePath) {
+			return fmt.Errorf("volume '%s' cannot be written to block device '%s' as %s, only as raw", volumeID, restorePath, format)
+		}
+	}
+	return nil
+}
+
+// Records the disk image format each volume is restored in, so the
+// written config matches the restored volumes.
+func recordFormats(config *conf.InstanceConfigGeneric, restorePaths restorePathsType, svolMap svolMapType, opts Options) {
+	// Do not modify the volumes of the parsed chunks
+	config.Volumes = slices.Clone(config.Volumes)
+	for i := range config.Volumes {
+		volume := &config.Volumes[i]
+		svolData, found := svolMap[volume.ID]
+		if _, restored := restorePaths[volume.ID]; !restored || !found {
+			continue
+		}
+		if _, err := utils.QEMUImgDriver(svolData.VolumeFormat); err != nil {
+			continue
+		}
+
+		format := restoredFormat(svolData.VolumeFormat)
+		if requested, found := opts.Formats[volume.ID]; found {
+			format = requested
+		}
+		volume.Format = &format
+	}
+}
+
+// Restores a disk image volume in another format. qcow2 images restored
+// as raw are decoded on the fly from the image. For other conversions,
+// qemu-img needs random access to the stored image, so it is staged in
+// opts.TmpDir first, then converted straight into the target file or block
+// device.
+func restoreConverted(ctx context.Context, restorePath string, svolData *svol.Data, format volumeformat.VolumeFormat, opts Options) error {
+	from := restoredFormat(svolData.VolumeFormat)
+	if from == volumeformat.QCOW2 && format == volumeformat.Raw && opts.Disks != nil {
+		return restoreDecoded(ctx, restorePath, svolData, opts.Disks)
+	}
+
+	fromDriver, err := utils.QEMUImgDriver(from)
+	if err != nil {
+		return err
+	}
+	toDriver, err := utils.QEMUImgDriver(format)
+	if err != nil {
+		return err
+	}
+
+	stagedPath, err := stageVolume(ctx, svolData, fromDriver, opts.TmpDir)
+	if stagedPath != "" {
+		defer os.Remove(stagedPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Debug("Converting %s volume to %s at '%s'", from, format, restorePath)
+	args := []string{"-f", fromDriver, "-O", toDriver}
+	if utils.IsBlockDevice(restorePath) {
+		if err := checkDeviceCapacity(stagedPath, fromDriver, restorePath); err != nil {
+			return err
+		}
+		// Write into the existing device instead of creating the target
+		args = append(args, "-n")
+	} else {
+		args = append(args, utils.QEMUImgCreateOptions(format)...)
+	}
+
+	return convertImage(ctx, append(args, stagedPath, restorePath)...)
+}
+
+// Runs qemu-img convert with args.
+func convertImage(ctx context.Context, args ...string) error {
+	cmd := exec.CommandContext(ctx, "qemu-img", append([]string{"convert"}, args...)...)
+	var errBuf bytes.Buffer
+	cmd.Stderr = &errBuf
+	if err := cmd.Run(); err != nil {
+		log.Error("stderr: %s", errBuf.String())
+		return fmt.Errorf("qemu-img convert failed: %w", err)
+	}
+	return nil
+}
+
+// Writes the virtual disk of a volume to the file or block device at
+// restorePath as raw data, reading it from the stored image without
+// staging it. Zeroed ranges are deallocated instead of written.
+func restoreDecoded(ctx context.Context, restorePath string, svolData *svol.Data, disks DiskOpener) error {
+	disk, size, err := disks.DiskOf(svolData)
+	if err != nil {
+		return err
+	}
+	file, isBlockDevice, err := openRestoreTarget(restorePath, nil)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	target := &fileTarget{File: file, isBlockDevice: isBlockDevice}
+
+	if isBlockDevice {
+		deviceSize, err := utils.GetBlockDeviceSize(file)
+		if err != nil {
+			return err
+		}
+		if deviceSize < size {
+			return fmt.Errorf("block device '%s' is too small: %d bytes, volume needs %d bytes", restorePath, deviceSize, size)
+		}
+	}
+
+	log.Debug("Decoding %s volume as raw to '%s'", svolData.VolumeFormat, restorePath)
+	if err := restoreRaw(target, &contextReader{ctx: ctx, r: io.NewSectionReader(disk, 0, size)}); err != nil {
+		return err
+	}
+	if isBlockDevice {
+		if err := file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync block device '%s': %w", restorePath, err)
+		}
+	}
+	return file.Close()
+}
+
+// Writes the stored volume to a temp file, returning its path.
+func stageVolume(ctx context.Context, svolData *svol.Data, driver string, tmpDir string) (string, error) {
+	if tmpDir == "" {
+		tmpDir = os.TempDir()
+	}
+	free, err := utils.GetFreeSpace(tmpDir)
+	if err != nil {
+		return "", err
+	}
+	if svolData.DataLength > free {
+		return "", fmt.Errorf("not enough space in %s to stage volume: %d bytes needed, %d bytes available", tmpDir, svolData.DataLength, free)
+	}
+
+	file, err := os.CreateTemp(tmpDir, "pxitool-restore-*."+driver)
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer file.Close()
+
+	reader := &contextReader{ctx: ctx, r: svolData.VolumeData}
+	if svolData.VolumeFormat == volumeformat.SparseRaw {
+		err = restoreSparse(&fileTarget{File: file}, reader)
+	} else {
+		_, err = io.Copy(file, reader)
+	}
+	if err != nil {
+		return file.Name(), fmt.Errorf("failed to stage volume: %w", err)
+	}
+	return file.Name(), nil
+}
+
+// Checks that a block device can hold the virtual disk of an image. The
+// device is opened exclusively, so that mounted devices are refused.
+func checkDeviceCapacity(imagePath string, driver string, devicePath string) error {
+	output, err := exec.Command("qemu-img", "info", "--output=json", "-f", driver, imagePath).Output()
+	if err != nil {
+		return fmt.Errorf("qemu-img info failed: %w", err)
+	}
+	var info struct {
+		VirtualSize int64 `json:"virtual-size"`
+	}
+	if err := json.Unmarshal(output, &info); err != nil {
+		return fmt.Errorf("failed to parse qemu-img info output: %w", err)
+	}
+
+	device, err := os.OpenFile(devicePath, os.O_RDONLY|os.O_EXCL, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open block device '%s' exclusively (is it mounted or in use?): %w", devicePath, err)
+	}
+	defer device.Close()
+
+	deviceSize, err := utils.GetBlockDeviceSize(device)
+	if err != nil {
+		return err
+	}
+	if deviceSize < info.VirtualSize {
+		return fmt.Errorf("block device '%s' is too small: %d bytes, volume needs %d bytes", devicePath, deviceSize, info.VirtualSize)
+	}
+	return nil
+}
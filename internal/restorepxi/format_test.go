@@ -0,0 +1,221 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package restorepxi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/PextraCloud/pxitool/internal/qcow2"
+	"github.com/PextraCloud/pxitool/internal/utils"
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/conf"
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/svol"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumeformat"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumetype"
+)
+
+// Returns a block device of the system, or "" if there is none.
+func findBlockDevice() string {
+	entries, _ := os.ReadDir("/dev")
+	for _, entry := range entries {
+		if path := filepath.Join("/dev", entry.Name()); utils.IsBlockDevice(path) {
+			return path
+		}
+	}
+	return ""
+}
+
+// qcow2Disks opens the qcow2 images of volumes held in memory.
+type qcow2Disks map[string][]byte
+
+func (d qcow2Disks) DiskOf(svolData *svol.Data) (io.ReaderAt, int64, error) {
+	img, err := qcow2.Open(bytes.NewReader(d[svolData.VolumeID]))
+	if err != nil {
+		return nil, 0, err
+	}
+	return img, img.Size(), nil
+}
+
+func TestCheckFormats(t *testing.T) {
+	dir := t.TempDir()
+	svolMap := svolMapType{
+		"vol-1":  {VolumeID: "vol-1", VolumeType: volumetype.Directory, VolumeFormat: volumeformat.SparseRaw},
+		"vol-2":  {VolumeID: "vol-2", VolumeType: volumetype.Directory, VolumeFormat: volumeformat.QCOW2},
+		"rootfs": {VolumeID: "rootfs", VolumeType: volumetype.LXC_, VolumeFormat: volumeformat.Raw},
+		"vol-3":  {VolumeID: "vol-3", VolumeType: volumetype.RBD, VolumeFormat: volumeformat.RBDDiff},
+	}
+	volumeMap := volumeMapType{
+		"vol-1": {ID: "vol-1"},
+		"vol-2": {ID: "vol-2", BackingChain: []conf.BackingImage{{ID: "vol-2-backing-1", File: "base.qcow2", Format: "qcow2"}}},
+		"vol-3": {ID: "vol-3"},
+	}
+	device := findBlockDevice()
+
+	tests := []struct {
+		name    string
+		volume  string
+		path    string
+		format  volumeformat.VolumeFormat
+		wantErr string // Empty if the format is valid
+	}{
+		{"Raw to qcow2", "vol-1", filepath.Join(dir, "vol-1.qcow2"), volumeformat.QCOW2, ""},
+		{"Unchanged format", "vol-1", filepath.Join(dir, "vol-1.img"), volumeformat.Raw, ""},
+		{"Volume not restored", "vol-9", "", volumeformat.Raw, "not being restored"},
+		{"Unknown volume", "vol-9", filepath.Join(dir, "vol-9.img"), volumeformat.Raw, "no SVOL chunk found"},
+		{"Backing chain", "vol-2", filepath.Join(dir, "vol-2.img"), volumeformat.Raw, "has a backing chain"},
+		{"Not a disk image", "vol-3", filepath.Join(dir, "vol-3.img"), volumeformat.QCOW2, "cannot be converted"},
+		{"Unknown target format", "vol-1", filepath.Join(dir, "vol-1.tar"), volumeformat.RBDDiff, "cannot be converted"},
+		{"Non-raw to block device", "vol-1", device, volumeformat.QCOW2, "only as raw"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.name == "Non-raw to block device" && device == "" {
+				t.Skip("Skipping block device check: no block device found")
+			}
+			restorePaths := restorePathsType{}
+			if tt.path != "" {
+				restorePaths[tt.volume] = tt.path
+			}
+			opts := Options{Formats: map[string]volumeformat.VolumeFormat{tt.volume: tt.format}}
+
+			err := checkFormats(restorePaths, svolMap, volumeMap, opts)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Expected the format to be valid, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected an error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestRecordFormats(t *testing.T) {
+	config := &conf.InstanceConfigGeneric{}
+	config.Volumes = []conf.InstanceVolume{
+		{ID: "vol-1"}, // Sparse stream, restored as raw
+		{ID: "vol-2"}, // qcow2, converted to vmdk
+		{ID: "vol-3"}, // RBD diff, which is not a disk image
+		{ID: "vol-4"}, // Not restored
+	}
+	svolMap := svolMapType{
+		"vol-1": {VolumeID: "vol-1", VolumeFormat: volumeformat.SparseRaw},
+		"vol-2": {VolumeID: "vol-2", VolumeFormat: volumeformat.QCOW2},
+		"vol-3": {VolumeID: "vol-3", VolumeFormat: volumeformat.RBDDiff},
+		"vol-4": {VolumeID: "vol-4", VolumeFormat: volumeformat.QCOW2},
+	}
+	restorePaths := restorePathsType{"vol-1": "/a", "vol-2": "/b", "vol-3": "/c"}
+	opts := Options{Formats: map[string]volumeformat.VolumeFormat{"vol-2": volumeformat.VMDK}}
+
+	original := config.Volumes
+	recordFormats(config, restorePaths, svolMap, opts)
+	expected := map[string]string{"vol-1": "raw", "vol-2": "vmdk"}
+	for _, volume := range config.Volumes {
+		got := ""
+		if volume.Format != nil {
+			got = volume.Format.String()
+		}
+		if got != expected[volume.ID] {
+			t.Errorf("Expected volume %s to be recorded as %q, got %q", volume.ID, expected[volume.ID], got)
+		}
+	}
+	if original[0].Format != nil {
+		t.Error("Expected the volumes of the parsed chunks not to be modified")
+	}
+}
+
+func TestRestoreConverted_QCOW2ToRaw(t *testing.T) {
+	if _, err := exec.LookPath("qemu-img"); err != nil {
+		t.Skip("Skipping conversion test: command 'qemu-img' not found")
+	}
+	dir := t.TempDir()
+	data := make([]byte, 8*1024*1024)
+	copy(data, "start of disk")
+	copy(data[6*1024*1024:], "hello pxitool")
+	rawPath := filepath.Join(dir, "source.raw")
+	if err := os.WriteFile(rawPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	qcow2Path := filepath.Join(dir, "source.qcow2")
+	if output, err := exec.Command("qemu-img", "convert", "-O", "qcow2", rawPath, qcow2Path).CombinedOutput(); err != nil {
+		t.Fatalf("qemu-img convert failed: %v: %s", err, output)
+	}
+	image, err := os.ReadFile(qcow2Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Decoded on the fly when the image can be read with random access,
+	// otherwise staged and converted with qemu-img
+	for _, disks := range []DiskOpener{qcow2Disks{"vol-1": image}, nil} {
+		name := map[bool]string{true: "decoded", false: "staged"}[disks != nil]
+		t.Run(name, func(t *testing.T) {
+			svolData := &svol.Data{VolumeID: "vol-1", VolumeFormat: volumeformat.QCOW2, DataLength: uint64(len(image)), VolumeData: bufio.NewReader(bytes.NewReader(image))}
+			restorePath := filepath.Join(t.TempDir(), "vol-1.img")
+			opts := Options{Disks: disks, TmpDir: t.TempDir()}
+			if err := restoreConverted(context.Background(), restorePath, svolData, volumeformat.Raw, opts); err != nil {
+				t.Fatalf("restoreConverted failed: %v", err)
+			}
+			restored, err := os.ReadFile(restorePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(restored, data) {
+				t.Errorf("Restored %d bytes do not match the %d bytes of the disk", len(restored), len(data))
+			}
+			if disks != nil && len(dirNames(t, opts.TmpDir)) != 0 {
+				t.Errorf("Expected nothing to be staged, got %v", dirNames(t, opts.TmpDir))
+			}
+		})
+	}
+}
+
+func TestCheckDeviceCapacity(t *testing.T) {
+	if _, err := exec.LookPath("qemu-img"); err != nil {
+		t.Skip("Skipping capacity test: command 'qemu-img' not found")
+	}
+	if _, err := exec.LookPath("losetup"); err != nil || os.Getuid() != 0 {
+		t.Skip("Skipping capacity test: must be run as root with losetup")
+	}
+	dir := t.TempDir()
+	imagePath := filepath.Join(dir, "image.qcow2")
+	if output, err := exec.Command("qemu-img", "create", "-f", "qcow2", imagePath, "8M").CombinedOutput(); err != nil {
+		t.Fatalf("qemu-img create failed: %v: %s", err, output)
+	}
+	backing := filepath.Join(dir, "device.img")
+	if err := os.WriteFile(backing, make([]byte, 4*1024*1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output, err := exec.Command("losetup", "-f", "--show", backing).Output()
+	if err != nil {
+		t.Fatalf("Failed to set up loop device: %v", err)
+	}
+	device := strings.TrimSpace(string(output))
+	defer exec.Command("losetup", "-d", device).Run()
+
+	if err := checkDeviceCapacity(imagePath, "qcow2", device); err == nil || !strings.Contains(err.Error(), "too small") {
+		t.Errorf("Expected a 4 MiB device to be too small for an 8 MiB disk, got %v", err)
+	}
+}
@@ -0,0 +1,330 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package restorepxi
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/PextraCloud/pxitool/internal/sparse"
+	"github.com/PextraCloud/pxitool/internal/utils"
+	"github.com/PextraCloud/pxitool/pkg/log"
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/svol"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumeformat"
+)
+
+const (
+	journalSuffix          = ".pxitool-journal"
+	resumableStagingSuffix = ".pxitool-restore"
+	resumeBlockSize        = 4 * 1024 * 1024 // Volumes are written and resumed in blocks of this size
+)
+
+// Bytes written between updates of the journal
+var journalInterval int64 = 256 * 1024 * 1024
+
+// DiskOpener opens the volumes of an image for random access, such as a
+// readpxi.VolumeReader that indexed them.
+type DiskOpener interface {
+	DiskOf(svolData *svol.Data) (io.ReaderAt, int64, error)
+}
+
+// journal records how much of each volume written block by block has
+// been restored, so that an interrupted restore can be resumed. It is kept
+// next to the config output until the restore succeeds.
+type journal struct {
+	path string
+	mu   sync.Mutex
+
+	Volumes map[string]*volumeJournal `json:"volumes"`
+}
+
+// The progress of a volume, which is only resumed if the volume and the
+// path it is written to still match.
+type volumeJournal struct {
+	Path       string                    `json:"path"` // File or block device the volume is written to
+	Format     volumeformat.VolumeFormat `json:"format"`
+	DataLength uint64                    `json:"data_length"` // Length of the stored volume
+	Size       int64                     `json:"size"`        // Size of the restored volume
+	Done       int64                     `json:"done"`        // Bytes written and synced, a multiple of the block size
+	Checksum   []byte                    `json:"checksum"`    // SHA-256 state after the first Done bytes
+}
+
+func journalPath(outputFileName string) string {
+	return outputFileName + journalSuffix
+}
+
+// Loads the journal of a previous restore to outputFileName, or starts a
+// new one if there is none.
+func loadJournal(outputFileName string) (*journal, error) {
+	j := &journal{path: journalPath(outputFileName), Volumes: make(map[string]*volumeJournal)}
+	data, err := os.ReadFile(j.path)
+	if os.IsNotExist(err) {
+		log.Info("No journal of an interrupted restore found at '%s', restoring from the start", j.path)
+		return j, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read restore journal: %w", err)
+	}
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, fmt.Errorf("failed to parse restore journal '%s': %w", j.path, err)
+	}
+	if j.Volumes == nil {
+		j.Volumes = make(map[string]*volumeJournal)
+	}
+	return j, nil
+}
+
+// Writes the journal, replacing the previous one atomically.
+func (j *journal) save() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal restore journal: %w", err)
+	}
+	file, err := os.CreateTemp(filepath.Dir(j.path), ".pxitool-journal-*")
+	if err != nil {
+		return fmt.Errorf("failed to write restore journal: %w", err)
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), j.path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("failed to write restore journal: %w", err)
+	}
+	return nil
+}
+
+// Removes the journal once the restore is complete or rolled back.
+func (j *journal) remove() {
+	if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+		log.Warn("Failed to remove restore journal '%s': %v", j.path, err)
+	}
+}
+
+// Reports whether any volume has been partly or fully written, so that
+// resuming saves work.
+func (j *journal) hasProgress() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, entry := range j.Volumes {
+		if entry.Done > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether path is written by a volume that has made progress.
+func (j *journal) keeps(path string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, entry := range j.Volumes {
+		if entry.Path == path && entry.Done > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the entry of a volume written to path, with the previous
+// progress if it matches, or starting from the beginning.
+func (j *journal) entry(volumeID string, path string, svolData *svol.Data, size int64) *volumeJournal {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	previous := j.Volumes[volumeID]
+	if previous != nil && previous.Path == path && previous.Format == svolData.VolumeFormat &&
+		previous.DataLength == svolData.DataLength && previous.Size == size {
+		return previous
+	}
+	if previous != nil {
+		log.Warn("Volume '%s' does not match its journal entry, restoring it from the start", volumeID)
+	}
+	entry := &volumeJournal{Path: path, Format: svolData.VolumeFormat, DataLength: svolData.DataLength, Size: size}
+	j.Volumes[volumeID] = entry
+	return entry
+}
+
+// Records that a volume is written again from the start.
+func (j *journal) restart(entry *volumeJournal) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entry.Done, entry.Checksum = 0, nil
+}
+
+// Records that the first done bytes of a volume are written and synced.
+func (j *journal) update(entry *volumeJournal, done int64, h hash.Hash) error {
+	state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	entry.Done, entry.Checksum = done, state
+	j.mu.Unlock()
+	return j.save()
+}
+
+// Reports whether a volume is written block by block, recording its
+// progress in the journal, which is only kept when resume is set. Only raw
+// data written to files and block devices as is can be resumed.
+func isResumable(volumeID string, svolData *svol.Data, opts Options) bool {
+	if opts.journal == nil || opts.Disks == nil || needsConversion(volumeID, svolData, opts) {
+		return false
+	}
+	return svolData.VolumeFormat == volumeformat.Raw || svolData.VolumeFormat == volumeformat.SparseRaw
+}
+
+// Returns the staging file of target for volumes that can be resumed,
+// which has a fixed name so that it is found again. Its data is kept if
+// resume is set.
+func newResumableStagedFile(target string, resume bool) (*stagedPath, error) {
+	flags := os.O_WRONLY | os.O_CREATE
+	if !resume {
+		flags |= os.O_TRUNC
+	}
+	return stageFile(target, func(dir string, base string) (*os.File, error) {
+		return os.OpenFile(filepath.Join(dir, "."+base+resumableStagingSuffix), flags, 0600)
+	})
+}
+
+// Checks that the first entry.Done bytes of file are those the journal
+// recorded, returning the hash to continue from.
+func validateWritten(file *os.File, entry *volumeJournal) (hash.Hash, error) {
+	expected := sha256.New()
+	if err := expected.(encoding.BinaryUnmarshaler).UnmarshalBinary(entry.Checksum); err != nil {
+		return nil, fmt.Errorf("invalid checksum state: %w", err)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(file, 0, entry.Done)); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(h.Sum(nil), expected.Sum(nil)) {
+		return nil, fmt.Errorf("the data written does not match its checksum")
+	}
+	return h, nil
+}
+
+// Opens the file or block device a volume is written to block by block,
+// without truncating it.
+func openResumableTarget(path string, size int64) (*fileTarget, error) {
+	if !utils.IsBlockDevice(path) {
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0640)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open file '%s': %w", path, err)
+		}
+		if err := file.Truncate(size); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to set size of '%s': %w", path, err)
+		}
+		return &fileTarget{File: file}, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_EXCL, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open block device '%s' exclusively (is it mounted or in use?): %w", path, err)
+	}
+	deviceSize, err := utils.GetBlockDeviceSize(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if deviceSize < size {
+		file.Close()
+		return nil, fmt.Errorf("block device '%s' is too small: %d bytes, volume needs %d bytes", path, deviceSize, size)
+	}
+	return &fileTarget{File: file, isBlockDevice: true}, nil
+}
+
+// Writes a volume to path block by block from its disk, recording its
+// progress in the journal. Data already written by an interrupted restore
+// is checked against the journal, and writing continues after it.
+func writeResumable(ctx context.Context, volumeID string, path string, svolData *svol.Data, opts Options) error {
+	disk, size, err := opts.Disks.DiskOf(svolData)
+	if err != nil {
+		return err
+	}
+	target, err := openResumableTarget(path, size)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	entry := opts.journal.entry(volumeID, path, svolData, size)
+	h := sha256.New()
+	if entry.Done > 0 {
+		if h, err = validateWritten(target.File, entry); err != nil {
+			log.Warn("Cannot resume volume '%s' at %d bytes, restoring it from the start: %v", volumeID, entry.Done, err)
+			h = sha256.New()
+			opts.journal.restart(entry)
+		} else {
+			log.Info("Resuming volume '%s' at %d of %d bytes", volumeID, entry.Done, size)
+		}
+	}
+
+	buf := make([]byte, resumeBlockSize)
+	synced := entry.Done
+	for offset := entry.Done; offset < size; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		block := buf[:min(int64(len(buf)), size-offset)]
+		if _, err := disk.ReadAt(block, offset); err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read volume '%s' at offset %d: %w", volumeID, offset, err)
+		}
+		if sparse.IsZero(block) {
+			err = target.Zero(offset, int64(len(block)))
+		} else {
+			_, err = target.WriteAt(block, offset)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write volume '%s' at offset %d: %w", volumeID, offset, err)
+		}
+		h.Write(block)
+		offset += int64(len(block))
+
+		if offset-synced >= journalInterval || offset == size {
+			if err := target.Sync(); err != nil {
+				return fmt.Errorf("failed to sync '%s': %w", path, err)
+			}
+			if err := opts.journal.update(entry, offset, h); err != nil {
+				return err
+			}
+			synced = offset
+		}
+	}
+
+	log.Debug("Restored %d bytes to '%s' block by block", size, path)
+	return target.Close()
+}
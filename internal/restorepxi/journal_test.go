@@ -0,0 +1,152 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package restorepxi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/PextraCloud/pxitool/internal/sparse"
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/svol"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumeformat"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumetype"
+)
+
+// Serves the data of every volume as its disk, recording the lowest
+// offset read, and calling interrupt once reading reaches interruptAt.
+type testDisks struct {
+	data        []byte
+	interruptAt int64
+	interrupt   func()
+
+	mu     sync.Mutex
+	lowest int64
+}
+
+func (d *testDisks) DiskOf(svolData *svol.Data) (io.ReaderAt, int64, error) {
+	return d, int64(len(d.data)), nil
+}
+
+func (d *testDisks) ReadAt(p []byte, off int64) (int, error) {
+	d.mu.Lock()
+	d.lowest = min(d.lowest, off)
+	d.mu.Unlock()
+	if d.interrupt != nil && off >= d.interruptAt {
+		d.interrupt()
+	}
+	return bytes.NewReader(d.data).ReadAt(p, off)
+}
+
+func TestRestore_Resume(t *testing.T) {
+	defer func(interval int64) { journalInterval = interval }(journalInterval)
+	journalInterval = resumeBlockSize
+
+	data := make([]byte, 3*resumeBlockSize+1000)
+	rand.New(rand.NewSource(1)).Read(data)
+	chunks := testChunks(&svol.Data{VolumeID: "vol-1", VolumeType: volumetype.Directory, VolumeFormat: volumeformat.Raw})
+	chunks.SVOL[0].DataLength = uint64(len(data))
+
+	for _, corrupt := range []bool{false, true} {
+		dir := t.TempDir()
+		restorePaths := restorePathsType{"vol-1": filepath.Join(dir, "vol-1.img")}
+		configOutput := filepath.Join(dir, "config.json")
+		staging := filepath.Join(dir, ".vol-1.img"+resumableStagingSuffix)
+
+		// Interrupted while the third block is read, which is still written
+		ctx, cancel := context.WithCancel(context.Background())
+		disks := &testDisks{data: data, interruptAt: 2 * resumeBlockSize, interrupt: cancel}
+		err := Restore(ctx, chunks, restorePaths, configOutput, Options{Disks: disks, Resume: true})
+		cancel()
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Expected the restore to be interrupted, got %v", err)
+		}
+		if _, err := os.Stat(journalPath(configOutput)); err != nil {
+			t.Fatalf("Expected the journal to be kept: %v", err)
+		}
+		if _, err := os.Stat(restorePaths["vol-1"]); !os.IsNotExist(err) {
+			t.Fatalf("Expected the target not to be written, got %v", err)
+		}
+
+		if corrupt {
+			if err := os.WriteFile(staging, []byte("corrupted"), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		disks = &testDisks{data: data, lowest: int64(len(data))}
+		if err := Restore(context.Background(), chunks, restorePaths, configOutput, Options{Disks: disks, Resume: true}); err != nil {
+			t.Fatalf("Resumed restore failed: %v", err)
+		}
+		restored, err := os.ReadFile(restorePaths["vol-1"])
+		if err != nil || !bytes.Equal(restored, data) {
+			t.Errorf("Expected the volume to be restored, got %d bytes (%v)", len(restored), err)
+		}
+		wantLowest := int64(3 * resumeBlockSize)
+		if corrupt {
+			wantLowest = 0
+		}
+		if disks.lowest != wantLowest {
+			t.Errorf("Expected reading to resume at %d (corrupt=%v), got %d", wantLowest, corrupt, disks.lowest)
+		}
+		if names := dirNames(t, dir); len(names) != 2 {
+			t.Errorf("Expected only the volume and config to be left, got %v", names)
+		}
+	}
+}
+
+func TestRestore_NotResumable(t *testing.T) {
+	// A sparse volume with a single extent, after a large hole
+	data := make([]byte, 4*resumeBlockSize)
+	copy(data[len(data)-5:], "extent")
+	var stream bytes.Buffer
+	sw, err := sparse.NewWriter(&stream, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	chunks := testChunks(&svol.Data{VolumeID: "vol-1", VolumeType: volumetype.Directory, VolumeFormat: volumeformat.SparseRaw})
+	chunks.SVOL[0].VolumeData = bufio.NewReader(bytes.NewReader(stream.Bytes()))
+	chunks.SVOL[0].DataLength = uint64(stream.Len())
+
+	// The volume is restored from its extents, without reading its disk
+	dir := t.TempDir()
+	restorePaths := restorePathsType{"vol-1": filepath.Join(dir, "vol-1.img")}
+	configOutput := filepath.Join(dir, "config.json")
+	disks := &testDisks{data: data, interrupt: func() { t.Error("Expected the disk of the volume not to be read") }}
+	if err := Restore(context.Background(), chunks, restorePaths, configOutput, Options{Disks: disks}); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	restored, err := os.ReadFile(restorePaths["vol-1"])
+	if err != nil || !bytes.Equal(restored, data) {
+		t.Errorf("Expected the volume to be restored, got %d bytes (%v)", len(restored), err)
+	}
+	if _, err := os.Stat(journalPath(configOutput)); !os.IsNotExist(err) {
+		t.Errorf("Expected no journal without resume, got %v", err)
+	}
+}
@@ -16,28 +16,27 @@ limitations under the License.
 package restorepxi
 
 import (
-	"bufio"
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"maps"
 	"os"
-	"os/exec"
+	"slices"
 
 	"github.com/PextraCloud/pxitool/internal/readpxi"
+	"github.com/PextraCloud/pxitool/internal/rootfs"
+	"github.com/PextraCloud/pxitool/internal/utils"
 	"github.com/PextraCloud/pxitool/pkg/log"
 	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/conf"
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/svol"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumeformat"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumetype"
 )
 
 type restorePathsType map[string]string
-type svolMapType map[string]*bufio.Reader
+type svolMapType map[string]*svol.Data
 type volumeMapType map[string]*conf.InstanceVolume
 
-type fileWritersStruct struct {
-	file *os.File
-	buf  *bufio.Writer
-}
-type fileWritersType map[string]fileWritersStruct
-
 func makeMaps(chunks *readpxi.PXIChunks) (svolMapType, volumeMapType, error) {
 	if chunks == nil {
 		return nil, nil, fmt.Errorf("chunks cannot be nil")
@@ -51,7 +50,7 @@ func makeMaps(chunks *readpxi.PXIChunks) (svolMapType, volumeMapType, error) {
 		if chunk.VolumeData == nil {
 			return nil, nil, fmt.Errorf("SVOL chunk VolumeData cannot be nil")
 		}
-		svolMap[chunk.VolumeID] = chunk.VolumeData
+		svolMap[chunk.VolumeID] = chunk
 	}
 
 	config := chunks.CONF.Config
@@ -67,27 +66,10 @@ func makeMaps(chunks *readpxi.PXIChunks) (svolMapType, volumeMapType, error) {
 		volumeMap[volume.ID] = &volume
 
 	}
-	return svolMap, volumeMap, nil
-}
-
-func getFileWriters(restorePaths restorePathsType) (fileWritersType, error) {
-	writers := make(fileWritersType)
-	for volumeID, restorePath := range restorePaths {
-		if volumeID == "rootfs" {
-			// Skip rootfs for now, as it requires special handling
-			continue
-		}
-
-		file, err := os.OpenFile(restorePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
-		if err != nil {
-			return nil, fmt.Errorf("failed to open file '%s': %w", restorePath, err)
-		}
-		writers[volumeID] = fileWritersStruct{
-			file: file,
-			buf:  bufio.NewWriter(file),
-		}
+	if err := addBackingVolumes(volumeMap, svolMap); err != nil {
+		return nil, nil, err
 	}
-	return writers, nil
+	return svolMap, volumeMap, nil
 }
 
 func writeConfig(outputFileName string, config *conf.InstanceConfigGeneric) error {
@@ -106,101 +88,322 @@ func writeConfig(outputFileName string, config *conf.InstanceConfigGeneric) erro
 	return err
 }
 
-func restoreLXC(restorePath string, reader *bufio.Reader) error {
-	dirMode := os.FileMode(0755) // Default directory mode
-	if dirInfo, err := os.Stat(restorePath); err == nil {
-		log.Debug("Removing existing rootfs path '%s'", restorePath)
-		dirMode = dirInfo.Mode()
-		if err := os.RemoveAll(restorePath); err != nil {
-			return fmt.Errorf("failed to remove existing rootfs path '%s': %w", restorePath, err)
-		}
-	}
+// The volumes of an image resolved to their restore paths, along with the
+// config recording them, before anything is written.
+type restoreJob struct {
+	config       conf.InstanceConfigGeneric
+	svolMap      svolMapType
+	volumeMap    volumeMapType
+	restorePaths restorePathsType
+}
 
-	log.Debug("Creating directory for rootfs at '%s'", restorePath)
-	if err := os.MkdirAll(restorePath, dirMode); err != nil {
-		return fmt.Errorf("failed to create directory '%s': %w", restorePath, err)
+// Resolves the restore path of every volume being restored and checks that
+// they can be restored as requested.
+func prepareRestore(chunks *readpxi.PXIChunks, restorePaths restorePathsType, opts Options) (*restoreJob, error) {
+	if chunks == nil {
+		return nil, fmt.Errorf("config cannot be nil")
 	}
 
-	log.Debug("Restoring rootfs to path '%s'", restorePath)
-	cmd := exec.Command("tar", "-x", "-C", restorePath)
-	cmd.Stdin = reader
+	svolMap, volumeMap, err := makeMaps(chunks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create maps from chunks: %w", err)
+	}
 
-	var errBuf bytes.Buffer
-	cmd.Stderr = &errBuf
-	if err := cmd.Run(); err != nil {
-		log.Error("stderr: %s", errBuf.String())
-		return fmt.Errorf("failed to untar rootfs: %w", err)
+	config := chunks.CONF.Config
+	var poolTargets poolTargetsType
+	if opts.Pools != nil {
+		if restorePaths, poolTargets, err = getPoolRestorePaths(restorePaths, &config, svolMap, volumeMap, opts.Pools); err != nil {
+			return nil, err
+		}
+	}
+	if len(restorePaths) == 0 {
+		return nil, fmt.Errorf("no volumes to restore")
+	}
+	if restorePaths, err = getChainRestorePaths(restorePaths, volumeMap); err != nil {
+		return nil, err
+	}
+	if err := checkFormats(restorePaths, svolMap, volumeMap, opts); err != nil {
+		return nil, err
+	}
+	if rootfsData, found := svolMap["rootfs"]; found && opts.IDMap != nil {
+		if _, restored := restorePaths["rootfs"]; restored && rootfsData.VolumeType == volumetype.Btrfs {
+			return nil, fmt.Errorf("an ID map cannot be applied to a btrfs rootfs")
+		}
 	}
 
-	log.Debug("Finished restoring rootfs to path '%s'", restorePath)
-	return nil
+	recordFormats(&config, restorePaths, svolMap, opts)
+	recordPools(&config, poolTargets)
+	return &restoreJob{
+		config:       config,
+		svolMap:      svolMap,
+		volumeMap:    volumeMap,
+		restorePaths: restorePaths,
+	}, nil
 }
 
-func Restore(chunks *readpxi.PXIChunks, restorePaths restorePathsType, outputFileName string) error {
-	if chunks == nil {
-		return fmt.Errorf("config cannot be nil")
+// Writes a volume to the file or block device at path, converting it if
+// requested.
+func writeVolume(ctx context.Context, volumeID string, path string, svolData *svol.Data, opts Options) error {
+	if needsConversion(volumeID, svolData, opts) {
+		if err := restoreConverted(ctx, path, svolData, opts.Formats[volumeID], opts); err != nil {
+			return fmt.Errorf("failed to restore volume '%s' as %s: %w", volumeID, opts.Formats[volumeID], err)
+		}
+		return nil
 	}
 
-	config := chunks.CONF.Config
-	log.Debug("Restoring Pextra Image with config: %+v", config)
-	if err := writeConfig(outputFileName, &config); err != nil {
-		return fmt.Errorf("failed to write config: %w", err)
+	file, isBlockDevice, err := openRestoreTarget(path, svolData)
+	if err != nil {
+		return err
 	}
+	defer file.Close()
 
-	svolMap, volumeMap, err := makeMaps(chunks)
+	target := &fileTarget{File: file, isBlockDevice: isBlockDevice}
+	reader := &contextReader{ctx: ctx, r: svolData.VolumeData}
+	if svolData.VolumeFormat == volumeformat.SparseRaw {
+		err = restoreSparse(target, reader)
+	} else {
+		err = restoreRaw(target, reader)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to create maps from chunks: %w", err)
+		return fmt.Errorf("failed to write volume '%s' to file: %w", volumeID, err)
+	}
+	if isBlockDevice {
+		if err := file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync block device for volume '%s': %w", volumeID, err)
+		}
 	}
+	return file.Close()
+}
 
-	fileWriters, err := getFileWriters(restorePaths)
-	if err != nil {
-		return fmt.Errorf("failed to get file writers: %w", err)
+// Restores a volume to a staging location next to restorePath, returning
+// it along with the path the volume was written to. Block devices that
+// cannot be staged are not written, and nil is returned for them. Volumes
+// written block by block are returned even if writing them fails.
+func stageRestore(ctx context.Context, volumeID string, restorePath string, svolData *svol.Data, volume *conf.InstanceVolume, opts Options) (stagedTarget, string, error) {
+	reader := &contextReader{ctx: ctx, r: svolData.VolumeData}
+
+	// Handle special case for LXC rootfs
+	if volumeID == "rootfs" && svolData.VolumeType != volumetype.Btrfs {
+		log.Debug("Restoring rootfs to path '%s'", restorePath)
+		stagingDir, err := rootfs.Stage(reader, restorePath, opts.IDMap)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to restore rootfs: %w", err)
+		}
+		return &stagedPath{target: restorePath, staging: stagingDir}, stagingDir, nil
+	}
+	if svolData.VolumeType == volumetype.Btrfs {
+		// Only a snapshot kept on the source can be the parent of later
+		// incremental streams
+		keep := opts.KeepReceived || (volume != nil && volume.Snapshot != "")
+		staged, err := stageBtrfs(ctx, restorePath, reader, keep)
+		if err != nil {
+			return nil, "", err
+		}
+		return staged, staged.stagingDir, nil
 	}
 
-	for volumeID, restorePath := range restorePaths {
-		reader, found := svolMap[volumeID]
-		if !found {
-			return fmt.Errorf("no SVOL chunk found for volume ID '%s'", volumeID)
+	if volume == nil {
+		return nil, "", fmt.Errorf("volume ID '%s' was not found in the config or was not backed up", volumeID)
+	}
+	if image, found := rbdImageSpec(restorePath); found {
+		if svolData.VolumeType != volumetype.RBD {
+			return nil, "", fmt.Errorf("volume '%s' is a %s volume and cannot be restored to an RBD image", volumeID, svolData.VolumeType)
 		}
+		staged, err := stageRBD(ctx, image, volume, svolData)
+		if err != nil {
+			return nil, "", err
+		}
+		return staged, image, nil
+	}
+	if svolData.VolumeFormat == volumeformat.RBDDiff {
+		return nil, "", fmt.Errorf("volume '%s' is an incremental RBD export and can only be restored to an RBD image", volumeID)
+	}
 
-		// Handle special case for LXC rootfs
-		if volumeID == "rootfs" {
-			if !found {
-				return fmt.Errorf("no SVOL chunk found for rootfs volume ID '%s'", volumeID)
-			}
-			if err := restoreLXC(restorePath, reader); err != nil {
-				return err
+	if utils.IsBlockDevice(restorePath) {
+		device, err := newStagedDevice(ctx, restorePath)
+		if err != nil {
+			log.Warn("Volume '%s' cannot be staged: %v", volumeID, err)
+			return nil, "", nil
+		}
+		if device == nil {
+			return nil, "", nil
+		}
+		if err := writeVolume(ctx, volumeID, device.devicePath(), svolData, opts); err != nil {
+			if discardErr := device.discard(); discardErr != nil {
+				log.Warn("Failed to discard %s: %v", device, discardErr)
 			}
-			continue
+			return nil, "", err
 		}
+		return device, device.devicePath(), nil
+	}
 
-		_, found = volumeMap[volumeID]
-		if !found {
-			return fmt.Errorf("volume ID '%s' was not found in the config or was not backed up", volumeID)
+	if isResumable(volumeID, svolData, opts) {
+		staged, err := newResumableStagedFile(restorePath, opts.Resume)
+		if err != nil {
+			return nil, "", err
+		}
+		// Returned even if writing fails, so it is kept to be resumed if
+		// the restore was interrupted
+		if err := writeResumable(ctx, volumeID, staged.staging, svolData, opts); err != nil {
+			return staged, "", err
 		}
+		return staged, staged.staging, nil
+	}
 
-		writer, found := fileWriters[volumeID]
-		if !found {
-			return fmt.Errorf("no writer found for volume ID '%s'", volumeID)
+	staged, err := newStagedFile(restorePath)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := writeVolume(ctx, volumeID, staged.staging, svolData, opts); err != nil {
+		staged.discard()
+		return nil, "", err
+	}
+	return staged, staged.staging, nil
+}
+
+// Restores the volumes of an image to their restore paths, and writes the
+// config recording them to outputFileName. Everything is staged next to
+// its target first, and only replaces the targets once every volume and
+// the config have been written, so a failed or interrupted restore leaves
+// them as they were. Block devices other than logical volumes and zvols
+// cannot be staged; they are written in place after everything else.
+func Restore(ctx context.Context, chunks *readpxi.PXIChunks, restorePaths restorePathsType, outputFileName string, opts Options) (err error) {
+	job, err := prepareRestore(chunks, restorePaths, opts)
+	if err != nil {
+		return err
+	}
+	config, svolMap, volumeMap, restorePaths := job.config, job.svolMap, job.volumeMap, job.restorePaths
+	log.Debug("Restoring Pextra Image with config: %+v", config)
+
+	progress := &progress{}
+	if opts.Disks != nil {
+		opts.Disks = progress.disks(opts.Disks)
+	}
+	// Volumes are only written block by block with a journal when the
+	// restore can be resumed, as other restores skip the holes of sparse
+	// volumes instead of reading them
+	if opts.Resume {
+		if opts.Disks == nil {
+			return fmt.Errorf("resuming a restore needs random access to the volumes")
+		}
+		if opts.journal, err = loadJournal(outputFileName); err != nil {
+			return err
 		}
+	}
 
-		_, err = reader.WriteTo(writer.buf)
-		if err != nil {
-			return fmt.Errorf("failed to write volume '%s' to file: %w", volumeID, err)
+	tx := &transaction{}
+	defer func() {
+		if err == nil {
+			return
+		}
+		// An interrupted restore keeps the volumes written so far, along
+		// with the journal of their progress
+		if opts.journal != nil && ctx.Err() != nil && opts.journal.hasProgress() {
+			tx.suspend(func(target stagedTarget) bool {
+				staged, ok := target.(*stagedPath)
+				return ok && opts.journal.keeps(staged.staging)
+			})
+			log.Warn("Restore interrupted, run it again with --resume to continue where it stopped")
+			return
+		}
+		tx.rollback()
+		if opts.journal != nil {
+			opts.journal.remove()
 		}
+	}()
 
-		if err = writer.buf.Flush(); err != nil {
-			return fmt.Errorf("failed to flush writer for volume '%s': %w", volumeID, err)
+	stagedConfig, err := newStagedFile(outputFileName)
+	if err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+	tx.add(stagedConfig)
+	if err := writeConfig(stagedConfig.staging, &config); err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+
+	volumeIDs := slices.Sorted(maps.Keys(restorePaths))
+	for _, volumeID := range volumeIDs {
+		if _, found := svolMap[volumeID]; !found {
+			return fmt.Errorf("no SVOL chunk found for volume ID '%s'", volumeID)
 		}
-		log.Debug("Finished restoring volume '%s' to path '%s'", volumeID, restorePath)
 	}
 
-	// Close all file writers
-	for _, writer := range fileWriters {
-		if err := writer.file.Close(); err != nil {
-			return fmt.Errorf("failed to close file writer: %w", err)
+	// Volumes are independent of each other, so they are staged
+	// concurrently. Every volume that was staged is added to the
+	// transaction, even if another failed, so it is discarded on rollback.
+	progressCtx, stopProgress := context.WithCancel(ctx)
+	defer stopProgress()
+	go progress.run(progressCtx)
+
+	stagedVolumes := make([]stagedTarget, len(volumeIDs))
+	stagedPaths := make([]string, len(volumeIDs))
+	err = runWorkers(ctx, opts.Jobs, len(volumeIDs), func(ctx context.Context, i int) error {
+		volumeID := volumeIDs[i]
+		svolData, vp := progress.track(svolMap[volumeID])
+		staged, writePath, err := stageRestore(ctx, volumeID, restorePaths[volumeID], svolData, volumeMap[volumeID], opts)
+		stagedVolumes[i] = staged
+		if err != nil {
+			return err
+		}
+		if staged == nil {
+			// Not read yet; written in place below
+			return nil
+		}
+		vp.done.Store(true)
+		stagedPaths[i] = writePath
+		log.Info("Staged volume '%s' for '%s'", volumeID, restorePaths[volumeID])
+		log.Debug("Staged volume '%s' at '%s'", volumeID, writePath)
+		return nil
+	})
+	writePaths := make(restorePathsType, len(restorePaths))
+	var inPlace []string
+	for i, volumeID := range volumeIDs {
+		if stagedVolumes[i] == nil {
+			inPlace = append(inPlace, volumeID)
+			continue
 		}
-		log.Debug("Closed file writer for volume '%s'", writer.file.Name())
+		tx.add(stagedVolumes[i])
+		writePaths[volumeID] = stagedPaths[i]
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, volumeID := range inPlace {
+		log.Warn("Writing volume '%s' to block device '%s' in place, which cannot be rolled back", volumeID, restorePaths[volumeID])
+	}
+	err = runWorkers(ctx, opts.Jobs, len(inPlace), func(ctx context.Context, i int) error {
+		volumeID := inPlace[i]
+		svolData, vp := progress.track(svolMap[volumeID])
+		write := writeVolume
+		if isResumable(volumeID, svolData, opts) {
+			write = writeResumable
+		}
+		if err := write(ctx, volumeID, restorePaths[volumeID], svolData, opts); err != nil {
+			return err
+		}
+		vp.done.Store(true)
+		log.Info("Restored volume '%s' to '%s'", volumeID, restorePaths[volumeID])
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, volumeID := range inPlace {
+		writePaths[volumeID] = restorePaths[volumeID]
+	}
+
+	if err := relinkBackingChains(restorePaths, writePaths, volumeMap); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := tx.commit(); err != nil {
+		return err
+	}
+	if opts.journal != nil {
+		opts.journal.remove()
 	}
 	return nil
 }
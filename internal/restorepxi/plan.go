@@ -0,0 +1,342 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package restorepxi
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/PextraCloud/pxitool/internal/readpxi"
+	"github.com/PextraCloud/pxitool/internal/utils"
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/svol"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumeformat"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumetype"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Bytes at the start of a block device checked for existing data
+	probeSize = 1024 * 1024
+)
+
+// What restoring a volume would do to its restore path.
+type PlanEntry struct {
+	VolumeID string   `json:"volume_id"`
+	Path     string   `json:"path"`
+	Target   string   `json:"target"`             // "file", "block device", "directory" or "rbd image"
+	Format   string   `json:"format"`             // Format the volume is written in
+	Size     int64    `json:"size"`               // Size of the restored volume in bytes
+	Action   string   `json:"action"`             // "create", "overwrite", "write" (to an empty device), "replace" (a directory) or "import"
+	Existing int64    `json:"existing,omitempty"` // Size of the file or device data that is overwritten
+	Problems []string `json:"problems,omitempty"` // Reasons the volume cannot be restored
+}
+
+// Plan describes what a restore would write and overwrite, without writing
+// anything.
+type Plan struct {
+	ConfigOutput       string      `json:"config_output"`
+	ConfigAction       string      `json:"config_action"` // "create" or "overwrite"
+	Volumes            []PlanEntry `json:"volumes"`
+	Problems           []string    `json:"problems,omitempty"` // Reasons the restore would fail, other than those of single volumes
+	ProblemsFound      bool        `json:"problems_found"`
+	BackingChainRelink bool        `json:"backing_chain_relink,omitempty"` // Whether restored qcow2 images are relinked to their backing images
+}
+
+// Free space needed on a filesystem that files are restored to.
+type filesystemUsage struct {
+	path   string
+	free   uint64
+	needed int64
+}
+type filesystemUsageMap map[uint64]*filesystemUsage
+
+// Returns the closest directory containing path that exists.
+func existingParent(path string) string {
+	dir := filepath.Dir(filepath.Clean(path))
+	for {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// Adds bytes needed on the filesystem that path is restored to.
+func (usage filesystemUsageMap) add(path string, needed int64) error {
+	dir := existingParent(path)
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("failed to get the filesystem of '%s'", dir)
+	}
+
+	fsUsage, found := usage[uint64(stat.Dev)]
+	if !found {
+		free, err := utils.GetFreeSpace(dir)
+		if err != nil {
+			return err
+		}
+		fsUsage = &filesystemUsage{path: dir, free: free}
+		usage[uint64(stat.Dev)] = fsUsage
+	}
+	fsUsage.needed += needed
+	return nil
+}
+
+func (entry *PlanEntry) addProblem(format string, args ...any) {
+	entry.Problems = append(entry.Problems, fmt.Sprintf(format, args...))
+}
+
+// Adds a problem unless the current user can write to path.
+func (entry *PlanEntry) checkWritable(path string) {
+	if err := unix.Access(path, unix.W_OK); err != nil {
+		entry.addProblem("'%s' is not writable: %v", path, err)
+	}
+}
+
+// Adds a problem unless an external tool is installed.
+func (entry *PlanEntry) checkTool(name string) {
+	if _, err := exec.LookPath(name); err != nil {
+		entry.addProblem("%s is needed but was not found", name)
+	}
+}
+
+// Plans writing a plain file, which is created or truncated. Its parent
+// directory is not created.
+func (entry *PlanEntry) planFile(usage filesystemUsageMap, needed int64) {
+	info, err := os.Stat(entry.Path)
+	switch {
+	case err == nil && !info.Mode().IsRegular():
+		entry.addProblem("'%s' exists and is not a regular file or block device", entry.Path)
+		return
+	case err == nil:
+		entry.Action = "overwrite"
+		entry.Existing = info.Size()
+		entry.checkWritable(entry.Path)
+		// The existing data is freed when the file is truncated
+		needed = max(needed-info.Size(), 0)
+	case errors.Is(err, fs.ErrNotExist):
+		entry.Action = "create"
+		dir := filepath.Dir(entry.Path)
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			entry.addProblem("directory '%s' does not exist", dir)
+			return
+		}
+		entry.checkWritable(dir)
+	default:
+		entry.addProblem("failed to stat '%s': %v", entry.Path, err)
+		return
+	}
+	if err := usage.add(entry.Path, needed); err != nil {
+		entry.addProblem("%v", err)
+	}
+}
+
+// Plans restoring into a directory, which replaces an existing one. The
+// volume is staged next to it first, so its parents must be writable.
+func (entry *PlanEntry) planDirectory(usage filesystemUsageMap, needed int64) {
+	info, err := os.Lstat(entry.Path)
+	switch {
+	case err == nil && !info.IsDir():
+		entry.addProblem("'%s' exists and is not a directory", entry.Path)
+		return
+	case err == nil:
+		entry.Action = "replace"
+	case errors.Is(err, fs.ErrNotExist):
+		entry.Action = "create"
+	default:
+		entry.addProblem("failed to stat '%s': %v", entry.Path, err)
+		return
+	}
+	entry.checkWritable(existingParent(entry.Path))
+	if err := usage.add(entry.Path, needed); err != nil {
+		entry.addProblem("%v", err)
+	}
+}
+
+// Plans writing to a block device, which must not be in use and must be
+// large enough for the volume. It is only opened for reading.
+func (entry *PlanEntry) planBlockDevice() {
+	file, err := os.OpenFile(entry.Path, os.O_RDONLY|os.O_EXCL, 0)
+	if err != nil {
+		entry.addProblem("block device '%s' cannot be opened exclusively (is it mounted or in use?): %v", entry.Path, err)
+		return
+	}
+	defer file.Close()
+	entry.checkWritable(entry.Path)
+
+	deviceSize, err := utils.GetBlockDeviceSize(file)
+	if err != nil {
+		entry.addProblem("%v", err)
+		return
+	}
+	if deviceSize < entry.Size {
+		entry.addProblem("block device '%s' is too small: %d bytes, volume needs %d bytes", entry.Path, deviceSize, entry.Size)
+	}
+
+	buf := make([]byte, min(deviceSize, probeSize))
+	if _, err := io.ReadFull(file, buf); err != nil {
+		entry.addProblem("failed to read block device '%s': %v", entry.Path, err)
+		return
+	}
+	if slices.ContainsFunc(buf, func(b byte) bool { return b != 0 }) {
+		entry.Action = "overwrite"
+		entry.Existing = deviceSize
+	} else {
+		entry.Action = "write"
+	}
+}
+
+// Plans restoring a volume to its restore path, mirroring the checks and
+// targets of Restore.
+func planVolume(volumeID string, restorePath string, svolData *svol.Data, opts Options, usage filesystemUsageMap) PlanEntry {
+	format := restoredFormat(svolData.VolumeFormat)
+	if requested, found := opts.Formats[volumeID]; found {
+		format = requested
+	}
+	entry := PlanEntry{
+		VolumeID: volumeID,
+		Path:     restorePath,
+		Format:   format.String(),
+	}
+	size, err := getRestoredSize(svolData)
+	if err != nil {
+		entry.addProblem("%v", err)
+	}
+	entry.Size = size
+
+	// Stored data is roughly what restored files take up, as sparse
+	// streams are restored sparse
+	needed := int64(svolData.DataLength)
+	switch {
+	case volumeID == "rootfs" || svolData.VolumeType == volumetype.Btrfs:
+		entry.Target = "directory"
+		entry.planDirectory(usage, needed)
+		if svolData.VolumeType == volumetype.Btrfs {
+			entry.checkTool("btrfs")
+		}
+	case isRBDTarget(svolData, restorePath):
+		entry.Target = "rbd image"
+		entry.Action = "import"
+		entry.checkTool("rbd")
+	case strings.HasPrefix(restorePath, rbdPathPrefix):
+		entry.Target = "rbd image"
+		entry.addProblem("volume is a %s volume and cannot be restored to an RBD image", svolData.VolumeType)
+	case svolData.VolumeFormat == volumeformat.RBDDiff:
+		entry.Target = "file"
+		entry.addProblem("volume is an incremental RBD export and can only be restored to an RBD image")
+	case utils.IsBlockDevice(restorePath):
+		entry.Target = "block device"
+		entry.planBlockDevice()
+	default:
+		entry.Target = "file"
+		entry.planFile(usage, needed)
+	}
+	if needsConversion(volumeID, svolData, opts) {
+		entry.checkTool("qemu-img")
+	}
+	return entry
+}
+
+// PlanRestore resolves and checks every restore path the way Restore does,
+// and returns what would be written, without writing anything.
+func PlanRestore(chunks *readpxi.PXIChunks, restorePaths restorePathsType, outputFileName string, opts Options) (*Plan, error) {
+	job, err := prepareRestore(chunks, restorePaths, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{ConfigOutput: outputFileName}
+	config := PlanEntry{Path: outputFileName}
+	config.planFile(filesystemUsageMap{}, 0)
+	plan.ConfigAction = config.Action
+	plan.Problems = append(plan.Problems, config.Problems...)
+
+	usage := make(filesystemUsageMap)
+	for _, volumeID := range slices.Sorted(maps.Keys(job.restorePaths)) {
+		entry := planVolume(volumeID, job.restorePaths[volumeID], job.svolMap[volumeID], opts, usage)
+		plan.Volumes = append(plan.Volumes, entry)
+		plan.ProblemsFound = plan.ProblemsFound || len(entry.Problems) > 0
+
+		if volume, found := job.volumeMap[volumeID]; found && len(volume.BackingChain) > 0 {
+			plan.BackingChainRelink = true
+		}
+	}
+	if plan.BackingChainRelink {
+		if _, err := exec.LookPath("qemu-img"); err != nil {
+			plan.Problems = append(plan.Problems, "qemu-img is needed to relink backing chains but was not found")
+		}
+	}
+	for _, fsUsage := range usage {
+		if fsUsage.needed > int64(fsUsage.free) {
+			plan.Problems = append(plan.Problems, fmt.Sprintf("about %d bytes are needed on the filesystem of '%s', which has %d bytes free", fsUsage.needed, fsUsage.path, fsUsage.free))
+		}
+	}
+	slices.Sort(plan.Problems)
+	plan.ProblemsFound = plan.ProblemsFound || len(plan.Problems) > 0
+	return plan, nil
+}
+
+// Write writes the plan to w as a table, followed by its problems.
+func (plan *Plan) Write(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VOLUME\tTARGET\tACTION\tFORMAT\tSIZE\tPATH")
+	for _, entry := range plan.Volumes {
+		action := entry.Action
+		if len(entry.Problems) > 0 {
+			action = "fail"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n", entry.VolumeID, entry.Target, action, entry.Format, entry.Size, entry.Path)
+	}
+	configAction := plan.ConfigAction
+	if configAction == "" {
+		configAction = "fail"
+	}
+	fmt.Fprintf(tw, "config\tfile\t%s\tjson\t-\t%s\n", configAction, plan.ConfigOutput)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	for _, entry := range plan.Volumes {
+		for _, problem := range entry.Problems {
+			fmt.Fprintf(w, "%s: %s\n", entry.VolumeID, problem)
+		}
+	}
+	for _, problem := range plan.Problems {
+		fmt.Fprintln(w, problem)
+	}
+	if plan.BackingChainRelink {
+		fmt.Fprintln(w, "Restored qcow2 images are relinked to their restored backing images.")
+	}
+	return nil
+}
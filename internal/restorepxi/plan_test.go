@@ -0,0 +1,135 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package restorepxi
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/PextraCloud/pxitool/internal/readpxi"
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/conf"
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/svol"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumeformat"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumetype"
+)
+
+func testChunks(volumes ...*svol.Data) *readpxi.PXIChunks {
+	chunks := &readpxi.PXIChunks{CONF: &conf.Data{}}
+	for _, volume := range volumes {
+		data := make([]byte, 1000)
+		volume.VolumeData = bufio.NewReader(bytes.NewReader(data))
+		volume.DataLength = uint64(len(data))
+		chunks.SVOL = append(chunks.SVOL, volume)
+		if volume.VolumeID != "rootfs" {
+			chunks.CONF.Config.Volumes = append(chunks.CONF.Config.Volumes, conf.InstanceVolume{ID: volume.VolumeID, Type: volume.VolumeType})
+		}
+	}
+	return chunks
+}
+
+func TestPlanRestore(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	existing := filepath.Join(dir, "existing.img")
+	if err := os.WriteFile(existing, make([]byte, 300), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rootfsDir := filepath.Join(dir, "rootfs")
+	if err := os.Mkdir(rootfsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	chunks := testChunks(
+		&svol.Data{VolumeID: "rootfs", VolumeType: volumetype.LXC_, VolumeFormat: volumeformat.Raw},
+		&svol.Data{VolumeID: "vol-1", VolumeType: volumetype.Directory, VolumeFormat: volumeformat.Raw},
+		&svol.Data{VolumeID: "vol-2", VolumeType: volumetype.Directory, VolumeFormat: volumeformat.Raw},
+		&svol.Data{VolumeID: "vol-3", VolumeType: volumetype.Directory, VolumeFormat: volumeformat.Raw},
+		&svol.Data{VolumeID: "vol-4", VolumeType: volumetype.RBD, VolumeFormat: volumeformat.RBDDiff},
+		&svol.Data{VolumeID: "vol-5", VolumeType: volumetype.RBD, VolumeFormat: volumeformat.Raw},
+		&svol.Data{VolumeID: "vol-6", VolumeType: volumetype.Directory, VolumeFormat: volumeformat.Raw},
+	)
+	restorePaths := restorePathsType{
+		"rootfs": rootfsDir,
+		"vol-1":  filepath.Join(dir, "new.img"),
+		"vol-2":  existing,
+		"vol-3":  filepath.Join(dir, "missing", "disk.img"),
+		"vol-4":  filepath.Join(dir, "diff.img"),
+		"vol-5":  "rbd-disk.img", // A plain relative path is a file
+		"vol-6":  "rbd:vms/vm-disk-6",
+	}
+	configOutput := filepath.Join(dir, "config.json")
+
+	plan, err := PlanRestore(chunks, restorePaths, configOutput, Options{})
+	if err != nil {
+		t.Fatalf("PlanRestore failed: %v", err)
+	}
+
+	tests := []struct {
+		volumeID string
+		target   string
+		action   string
+		existing int64
+		problem  string
+	}{
+		{"rootfs", "directory", "replace", 0, ""},
+		{"vol-1", "file", "create", 0, ""},
+		{"vol-2", "file", "overwrite", 300, ""},
+		{"vol-3", "file", "create", 0, "does not exist"},
+		{"vol-4", "file", "", 0, "can only be restored to an RBD image"},
+		{"vol-5", "file", "create", 0, ""},
+		{"vol-6", "rbd image", "", 0, "cannot be restored to an RBD image"},
+	}
+	if len(plan.Volumes) != len(tests) {
+		t.Fatalf("Expected %d volumes in the plan, got %d", len(tests), len(plan.Volumes))
+	}
+	for i, tt := range tests {
+		entry := plan.Volumes[i]
+		if entry.VolumeID != tt.volumeID || entry.Target != tt.target || entry.Action != tt.action || entry.Existing != tt.existing {
+			t.Errorf("Expected %s to %s a %s with %d existing bytes, got %+v", tt.volumeID, tt.action, tt.target, tt.existing, entry)
+		}
+		if tt.problem == "" && len(entry.Problems) > 0 {
+			t.Errorf("Expected no problems for %s, got %v", tt.volumeID, entry.Problems)
+		}
+		if tt.problem != "" && (len(entry.Problems) != 1 || !strings.Contains(entry.Problems[0], tt.problem)) {
+			t.Errorf("Expected a problem containing %q for %s, got %v", tt.problem, tt.volumeID, entry.Problems)
+		}
+	}
+	if plan.ConfigAction != "create" || !plan.ProblemsFound {
+		t.Errorf("Expected the config to be created and problems to be found, got %+v", plan)
+	}
+
+	// Nothing is written
+	for _, restorePath := range []string{restorePaths["vol-1"], configOutput} {
+		if _, err := os.Stat(restorePath); !os.IsNotExist(err) {
+			t.Errorf("Expected '%s' not to be created, got %v", restorePath, err)
+		}
+	}
+	if data, err := os.ReadFile(existing); err != nil || len(data) != 300 {
+		t.Errorf("Expected '%s' to be left alone, got %d bytes (%v)", existing, len(data), err)
+	}
+
+	var out bytes.Buffer
+	if err := plan.Write(&out); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "vol-3: directory") {
+		t.Errorf("Expected the written plan to list the problems of vol-3, got:\n%s", out.String())
+	}
+}
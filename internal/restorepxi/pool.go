@@ -0,0 +1,216 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package restorepxi
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+
+	"github.com/PextraCloud/pxitool/pkg/log"
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/conf"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumetype"
+)
+
+// A local storage pool that volumes are restored to when no restore path
+// is given for them.
+type Pool struct {
+	Backend volumetype.VolumeType `json:"backend"` // Type of volumes the pool holds, such as "directory", "lvm" or "rbd"
+	Path    string                `json:"path"`    // Base directory of the pool, or the pool name of an RBD pool
+}
+
+// PoolMap resolves the storage pools recorded in an image to local pools.
+type PoolMap struct {
+	Pools   map[string]Pool   // Local pools by ID
+	Mapping map[string]string // Map of pool IDs in the image to local pool IDs, pools that are not mapped keep their ID
+}
+
+// Reads the local pools from a JSON file of pool IDs to pools, such as
+// {"local": {"backend": "directory", "path": "/var/lib/pools/local"}}.
+func LoadPools(fileName string) (map[string]Pool, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pools file '%s': %w", fileName, err)
+	}
+
+	var pools map[string]Pool
+	if err := json.Unmarshal(data, &pools); err != nil {
+		return nil, fmt.Errorf("failed to parse pools file '%s': %w", fileName, err)
+	}
+	for poolID, pool := range pools {
+		switch {
+		case pool.Path == "":
+			return nil, fmt.Errorf("pool '%s' has no path", poolID)
+		case pool.Backend == volumetype.RBD && (filepath.IsAbs(pool.Path) || path.Base(pool.Path) != pool.Path):
+			return nil, fmt.Errorf("path of RBD pool '%s' must be an RBD pool name, got '%s'", poolID, pool.Path)
+		case pool.Backend != volumetype.RBD && !filepath.IsAbs(pool.Path):
+			return nil, fmt.Errorf("path of pool '%s' must be absolute, got '%s'", poolID, pool.Path)
+		}
+	}
+	return pools, nil
+}
+
+// Returns the ID and the local pool that a pool of the image maps to.
+func (pm *PoolMap) resolve(poolID string) (string, Pool, error) {
+	localID := poolID
+	if mapped, found := pm.Mapping[poolID]; found {
+		localID = mapped
+	}
+	pool, found := pm.Pools[localID]
+	if !found {
+		if localID != poolID {
+			return "", Pool{}, fmt.Errorf("storage pool '%s' is mapped to '%s', which is not a local pool", poolID, localID)
+		}
+		return "", Pool{}, fmt.Errorf("storage pool '%s' is not a local pool, map it to one", poolID)
+	}
+	return localID, pool, nil
+}
+
+// A volume restored to a local pool, recorded in the emitted config.
+type poolTarget struct {
+	PoolID string
+	Path   string
+}
+type poolTargetsType map[string]poolTarget
+
+// Returns the restore path of a volume in a pool, named after the last
+// element of its original path.
+func poolVolumePath(pool Pool, volume *conf.InstanceVolume) string {
+	name := volume.ID
+	if volume.Path != "" {
+		name = path.Base(filepath.ToSlash(volume.Path))
+	}
+	if pool.Backend == volumetype.RBD {
+		// An RBD image in the pool, imported with rbd
+		return rbdPathPrefix + pool.Path + "/" + name
+	}
+	return filepath.Join(pool.Path, name)
+}
+
+// Checks that the restore path of a volume in a pool that holds block
+// devices is an existing device. Logical volumes and LUNs are not created
+// on restore, and a missing path under /dev would otherwise be created as a
+// regular file in memory.
+func checkPoolDevice(poolID string, pool Pool, volumeID string, restorePath string) error {
+	switch pool.Backend {
+	case volumetype.LVM, volumetype.ISCSI, volumetype.Block:
+	default:
+		return nil
+	}
+	info, err := os.Stat(restorePath)
+	if err == nil && info.Mode()&os.ModeDevice != 0 && info.Mode()&os.ModeCharDevice == 0 {
+		return nil
+	}
+	return fmt.Errorf("volume '%s' would be restored to '%s' in %s pool '%s', which is not an existing block device: create it first, or give a restore path with --paths", volumeID, restorePath, pool.Backend, poolID)
+}
+
+// Returns the restore path of the LXC rootfs in a pool, a directory named
+// after the instance.
+func poolRootfsPath(pool Pool, config *conf.InstanceConfigGeneric) (string, error) {
+	switch pool.Backend {
+	case volumetype.RBD, volumetype.LVM, volumetype.ISCSI, volumetype.Block:
+		return "", fmt.Errorf("the rootfs cannot be restored to a %s pool", pool.Backend)
+	}
+	name := config.ID
+	if name == "" {
+		name = config.Name
+	}
+	if name == "" || name != filepath.Base(name) {
+		return "", fmt.Errorf("instance name '%s' cannot be used as a rootfs directory name", name)
+	}
+	return filepath.Join(pool.Path, name), nil
+}
+
+// Returns restore paths for every stored volume of the config, resolved
+// through the pool map, along with the local pools they are restored to.
+// Volumes given in restorePaths keep their path and pool.
+func getPoolRestorePaths(restorePaths restorePathsType, config *conf.InstanceConfigGeneric, svolMap svolMapType, volumeMap volumeMapType, pm *PoolMap) (restorePathsType, poolTargetsType, error) {
+	paths := make(restorePathsType, len(volumeMap))
+	for volumeID, restorePath := range restorePaths {
+		paths[volumeID] = restorePath
+	}
+	targets := make(poolTargetsType)
+	used := make(map[string]string) // Volume IDs by pool restore path
+
+	for _, volume := range config.Volumes {
+		if _, found := volumeMap[volume.ID]; !found {
+			continue
+		}
+		if _, found := paths[volume.ID]; found {
+			continue
+		}
+		poolID, pool, err := pm.resolve(volume.StoragePoolID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to restore volume '%s': %w", volume.ID, err)
+		}
+		if pool.Backend == volumetype.RBD && svolMap[volume.ID].VolumeType != volumetype.RBD {
+			return nil, nil, fmt.Errorf("volume '%s' is a %s volume and cannot be restored to RBD pool '%s'", volume.ID, svolMap[volume.ID].VolumeType, poolID)
+		}
+
+		restorePath := poolVolumePath(pool, &volume)
+		if otherID, found := used[restorePath]; found {
+			return nil, nil, fmt.Errorf("volumes '%s' and '%s' are both named '%s' in pool '%s', give one of them a restore path with --paths", otherID, volume.ID, path.Base(filepath.ToSlash(restorePath)), poolID)
+		}
+		used[restorePath] = volume.ID
+		if err := checkPoolDevice(poolID, pool, volume.ID, restorePath); err != nil {
+			return nil, nil, err
+		}
+		paths[volume.ID] = restorePath
+		targets[volume.ID] = poolTarget{PoolID: poolID, Path: restorePath}
+		log.Debug("Restoring volume '%s' to pool '%s' at '%s'", volume.ID, poolID, restorePath)
+	}
+
+	if _, found := svolMap["rootfs"]; found && config.Metadata.Lxc != nil {
+		if _, found := paths["rootfs"]; !found {
+			poolID, pool, err := pm.resolve(config.Metadata.Lxc.Rootfs.StoragePoolID)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to restore rootfs: %w", err)
+			}
+			restorePath, err := poolRootfsPath(pool, config)
+			if err != nil {
+				return nil, nil, err
+			}
+			paths["rootfs"] = restorePath
+			targets["rootfs"] = poolTarget{PoolID: poolID, Path: restorePath}
+			log.Debug("Restoring rootfs to pool '%s' at '%s'", poolID, restorePath)
+		}
+	}
+	return paths, targets, nil
+}
+
+// Records the pools and paths that volumes were restored to in the config.
+func recordPools(config *conf.InstanceConfigGeneric, targets poolTargetsType) {
+	// Do not modify the volumes of the parsed chunks
+	config.Volumes = slices.Clone(config.Volumes)
+	for i := range config.Volumes {
+		volume := &config.Volumes[i]
+		if target, found := targets[volume.ID]; found {
+			volume.StoragePoolID = target.PoolID
+			volume.Path = target.Path
+			if image, found := rbdImageSpec(target.Path); found {
+				volume.Path = image
+			}
+		}
+	}
+	if target, found := targets["rootfs"]; found {
+		lxc := *config.Metadata.Lxc
+		lxc.Rootfs.StoragePoolID = target.PoolID
+		config.Metadata.Lxc = &lxc
+	}
+}
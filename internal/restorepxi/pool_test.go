@@ -0,0 +1,169 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package restorepxi
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/conf"
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/svol"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumetype"
+)
+
+func TestLoadPools(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		wantErr string
+	}{
+		{"Valid", `{"local": {"backend": "directory", "path": "/srv/local"}, "ceph": {"backend": "rbd", "path": "vms"}}`, ""},
+		{"No path", `{"local": {"backend": "directory"}}`, "has no path"},
+		{"Relative path", `{"local": {"backend": "lvm", "path": "dev/vg0"}}`, "must be absolute"},
+		{"RBD path", `{"ceph": {"backend": "rbd", "path": "vms/images"}}`, "must be an RBD pool name"},
+		{"Unknown backend", `{"local": {"backend": "tape", "path": "/srv"}}`, "failed to parse"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileName := filepath.Join(t.TempDir(), "pools.json")
+			if err := os.WriteFile(fileName, []byte(tt.json), 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := LoadPools(fileName)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Expected an error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestGetPoolRestorePaths(t *testing.T) {
+	config := &conf.InstanceConfigGeneric{}
+	config.Name = "ct1"
+	config.Metadata.Lxc = &conf.InstanceMetadataLxc{}
+	config.Metadata.Lxc.Rootfs.StoragePoolID = "old-local"
+	config.Volumes = []conf.InstanceVolume{
+		{ID: "vol-1", Type: volumetype.Directory, StoragePoolID: "old-local", Path: "/old/pool/disk1.qcow2"},
+		{ID: "vol-2", Type: volumetype.RBD, StoragePoolID: "ceph", Path: "old-rbd/vm-disk-2"},
+		{ID: "vol-3", Type: volumetype.LVM, StoragePoolID: "old-local", Path: "/dev/vg0/explicit"},
+		{ID: "vol-4", Type: volumetype.Directory, StoragePoolID: "gone", Path: "/excluded.img"},
+	}
+	svolMap := svolMapType{
+		"rootfs": {VolumeID: "rootfs", VolumeType: volumetype.LXC_},
+		"vol-1":  {VolumeID: "vol-1", VolumeType: volumetype.Directory},
+		"vol-2":  {VolumeID: "vol-2", VolumeType: volumetype.RBD},
+		"vol-3":  {VolumeID: "vol-3", VolumeType: volumetype.LVM},
+	}
+	volumeMap := volumeMapType{}
+	for i := range config.Volumes[:3] {
+		volumeMap[config.Volumes[i].ID] = &config.Volumes[i]
+	}
+	pm := &PoolMap{
+		Pools: map[string]Pool{
+			"local": {Backend: volumetype.Directory, Path: "/srv/local"},
+			"ceph":  {Backend: volumetype.RBD, Path: "vms"},
+		},
+		Mapping: map[string]string{"old-local": "local"},
+	}
+
+	paths, targets, err := getPoolRestorePaths(restorePathsType{"vol-3": "/dev/vg1/lv"}, config, svolMap, volumeMap, pm)
+	if err != nil {
+		t.Fatalf("getPoolRestorePaths failed: %v", err)
+	}
+	wantPaths := restorePathsType{
+		"rootfs": "/srv/local/ct1",
+		"vol-1":  "/srv/local/disk1.qcow2",
+		"vol-2":  "rbd:vms/vm-disk-2",
+		"vol-3":  "/dev/vg1/lv",
+	}
+	if len(paths) != len(wantPaths) {
+		t.Errorf("Expected paths %v, got %v", wantPaths, paths)
+	}
+	for volumeID, want := range wantPaths {
+		if paths[volumeID] != want {
+			t.Errorf("Expected volume %s to be restored to %q, got %q", volumeID, want, paths[volumeID])
+		}
+	}
+	if _, found := targets["vol-3"]; found {
+		t.Error("Expected the explicit restore path of vol-3 to keep its pool")
+	}
+
+	recordPools(config, targets)
+	if v := config.Volumes[0]; v.StoragePoolID != "local" || v.Path != "/srv/local/disk1.qcow2" {
+		t.Errorf("Expected vol-1 to be recorded in pool local, got %s at %s", v.StoragePoolID, v.Path)
+	}
+	if v := config.Volumes[1]; v.StoragePoolID != "ceph" || v.Path != "vms/vm-disk-2" {
+		t.Errorf("Expected vol-2 to be recorded in pool ceph, got %s at %s", v.StoragePoolID, v.Path)
+	}
+	if v := config.Volumes[2]; v.StoragePoolID != "old-local" || v.Path != "/dev/vg0/explicit" {
+		t.Errorf("Expected vol-3 to be unchanged, got %s at %s", v.StoragePoolID, v.Path)
+	}
+	if config.Metadata.Lxc.Rootfs.StoragePoolID != "local" {
+		t.Errorf("Expected rootfs to be recorded in pool local, got %s", config.Metadata.Lxc.Rootfs.StoragePoolID)
+	}
+}
+
+func TestGetPoolRestorePaths_Errors(t *testing.T) {
+	blockDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(blockDir, "file"), nil, 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	pm := &PoolMap{
+		Pools: map[string]Pool{
+			"local": {Backend: volumetype.Directory, Path: "/srv/local"},
+			"ceph":  {Backend: volumetype.RBD, Path: "vms"},
+			"lvm":   {Backend: volumetype.LVM, Path: filepath.Join(blockDir, "vg0")},
+			"block": {Backend: volumetype.Block, Path: blockDir},
+		},
+		Mapping: map[string]string{"old": "missing"},
+	}
+	tests := []struct {
+		name    string
+		volume  conf.InstanceVolume
+		wantErr string
+	}{
+		{"Unknown pool", conf.InstanceVolume{ID: "vol-1", Type: volumetype.Directory, StoragePoolID: "other"}, "not a local pool, map it"},
+		{"Mapped to unknown pool", conf.InstanceVolume{ID: "vol-1", Type: volumetype.Directory, StoragePoolID: "old"}, "mapped to 'missing'"},
+		{"File volume to RBD", conf.InstanceVolume{ID: "vol-1", Type: volumetype.Directory, StoragePoolID: "ceph"}, "cannot be restored to RBD pool"},
+		{"Missing logical volume", conf.InstanceVolume{ID: "vol-1", Type: volumetype.LVM, StoragePoolID: "lvm", Path: "/dev/vg0/disk0"}, "not an existing block device"},
+		{"Regular file in block pool", conf.InstanceVolume{ID: "vol-1", Type: volumetype.Block, StoragePoolID: "block", Path: "/dev/file"}, "not an existing block device"},
+		{"Same name in pool", conf.InstanceVolume{ID: "vol-1", Type: volumetype.Directory, StoragePoolID: "local", Path: "/a/disk0"}, "both named 'disk0' in pool 'local'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &conf.InstanceConfigGeneric{}
+			config.Volumes = []conf.InstanceVolume{tt.volume}
+			svolMap := svolMapType{"vol-1": &svol.Data{VolumeID: "vol-1", VolumeType: tt.volume.Type}}
+			volumeMap := volumeMapType{"vol-1": &config.Volumes[0]}
+			if tt.volume.StoragePoolID == "local" {
+				// A second volume whose path has the same last element
+				config.Volumes = append(config.Volumes, conf.InstanceVolume{ID: "vol-2", Type: volumetype.Directory, StoragePoolID: "local", Path: "/b/disk0"})
+				svolMap["vol-2"] = &svol.Data{VolumeID: "vol-2", VolumeType: volumetype.Directory}
+				volumeMap = volumeMapType{"vol-1": &config.Volumes[0], "vol-2": &config.Volumes[1]}
+			}
+
+			_, _, err := getPoolRestorePaths(nil, config, svolMap, volumeMap, pm)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected an error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package restorepxi
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/PextraCloud/pxitool/pkg/log"
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/svol"
+)
+
+const (
+	// Interval between reports of the volumes being restored
+	progressInterval = 10 * time.Second
+)
+
+// How much of the stored data of a volume has been read.
+type volumeProgress struct {
+	volumeID string
+	total    int64
+	read     atomic.Int64
+	started  atomic.Bool
+	done     atomic.Bool
+}
+
+// progressReader counts the bytes read for a volume.
+type progressReader struct {
+	r  io.Reader
+	vp *volumeProgress
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	pr.vp.started.Store(true)
+	n, err := pr.r.Read(p)
+	pr.vp.read.Add(int64(n))
+	return n, err
+}
+
+// progress reports how much of each volume has been restored, at
+// intervals, while volumes are restored concurrently.
+type progress struct {
+	mu      sync.Mutex
+	volumes []*volumeProgress
+}
+
+// Returns a copy of svolData whose data is counted towards the progress
+// of the volume.
+func (p *progress) track(svolData *svol.Data) (*svol.Data, *volumeProgress) {
+	vp := &volumeProgress{volumeID: svolData.VolumeID, total: int64(svolData.DataLength)}
+	p.mu.Lock()
+	p.volumes = append(p.volumes, vp)
+	p.mu.Unlock()
+
+	tracked := *svolData
+	tracked.VolumeData = bufio.NewReader(&progressReader{r: svolData.VolumeData, vp: vp})
+	return &tracked, vp
+}
+
+// progressReaderAt records how far into a volume its disk has been read.
+type progressReaderAt struct {
+	r  io.ReaderAt
+	vp *volumeProgress
+}
+
+func (pr *progressReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	pr.vp.started.Store(true)
+	n, err := pr.r.ReadAt(p, off)
+	for end := off + int64(n); ; {
+		read := pr.vp.read.Load()
+		if end <= read || pr.vp.read.CompareAndSwap(read, end) {
+			break
+		}
+	}
+	return n, err
+}
+
+// progressDisks opens disks whose reads count towards the progress of
+// their volume.
+type progressDisks struct {
+	p     *progress
+	disks DiskOpener
+}
+
+func (pd *progressDisks) DiskOf(svolData *svol.Data) (io.ReaderAt, int64, error) {
+	disk, size, err := pd.disks.DiskOf(svolData)
+	if err != nil {
+		return nil, 0, err
+	}
+	pd.p.mu.Lock()
+	defer pd.p.mu.Unlock()
+	for i := len(pd.p.volumes) - 1; i >= 0; i-- {
+		if vp := pd.p.volumes[i]; vp.volumeID == svolData.VolumeID {
+			vp.total = size
+			return &progressReaderAt{r: disk, vp: vp}, size, nil
+		}
+	}
+	return disk, size, nil
+}
+
+// Returns an opener of disks whose reads are counted as progress.
+func (p *progress) disks(disks DiskOpener) DiskOpener {
+	return &progressDisks{p: p, disks: disks}
+}
+
+// Logs the progress of the volumes being restored.
+func (p *progress) report() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var parts []string
+	for _, vp := range p.volumes {
+		if !vp.started.Load() || vp.done.Load() {
+			continue
+		}
+		percent := 100
+		if vp.total > 0 {
+			percent = int(vp.read.Load() * 100 / vp.total)
+		}
+		parts = append(parts, fmt.Sprintf("%s %d%%", vp.volumeID, percent))
+	}
+	if len(parts) > 0 {
+		log.Info("Restoring %s", strings.Join(parts, ", "))
+	}
+}
+
+// Reports the progress at intervals until ctx is done.
+func (p *progress) run(ctx context.Context) {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.report()
+		}
+	}
+}
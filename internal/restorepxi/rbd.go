@@ -0,0 +1,214 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package restorepxi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/PextraCloud/pxitool/internal/sparse"
+	"github.com/PextraCloud/pxitool/pkg/log"
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/conf"
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/svol"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumeformat"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumetype"
+)
+
+// Prefix of restore paths that name an RBD image ([pool/]image) rather
+// than a local file.
+const rbdPathPrefix = "rbd:"
+
+// Returns the RBD image spec of a restore path, and whether it names one.
+func rbdImageSpec(restorePath string) (string, bool) {
+	return strings.CutPrefix(restorePath, rbdPathPrefix)
+}
+
+// RBD volumes are imported with rbd only when their restore path names an
+// RBD image, and are otherwise restored to a local file like any volume.
+func isRBDTarget(svolData *svol.Data, restorePath string) bool {
+	_, found := rbdImageSpec(restorePath)
+	return svolData.VolumeType == volumetype.RBD && found
+}
+
+// Returns a reader of the whole volume in a sparse stream.
+func expandSparse(reader io.Reader) (io.ReadCloser, error) {
+	sparseReader, err := sparse.NewReader(reader)
+	if err != nil {
+		return nil, err
+	}
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		_, err := sparse.Expand(pipeWriter, sparseReader)
+		pipeWriter.CloseWithError(err)
+	}()
+	return pipeReader, nil
+}
+
+func restoreRBD(ctx context.Context, restorePath string, volume *conf.InstanceVolume, svolData *svol.Data) error {
+	var cmd *exec.Cmd
+	var input io.Reader = &contextReader{ctx: ctx, r: svolData.VolumeData}
+	switch svolData.VolumeFormat {
+	case volumeformat.Raw:
+		log.Debug("Importing RBD volume '%s' to image '%s'", volume.ID, restorePath)
+		cmd = exec.CommandContext(ctx, "rbd", "import", "--no-progress", "-", restorePath)
+	case volumeformat.SparseRaw:
+		// rbd import leaves zeroed ranges of its input unallocated
+		log.Debug("Importing sparse RBD volume '%s' to image '%s'", volume.ID, restorePath)
+		cmd = exec.CommandContext(ctx, "rbd", "import", "--no-progress", "-", restorePath)
+		expanded, err := expandSparse(input)
+		if err != nil {
+			return err
+		}
+		// Unblocks the expanding goroutine if rbd exits early
+		defer expanded.Close()
+		input = expanded
+	case volumeformat.RBDDiff:
+		// import-diff requires the parent snapshot on the target, and creates the end snapshot
+		log.Debug("Applying incremental RBD volume '%s' (parent snapshot '%s') to image '%s'", volume.ID, volume.ParentSnapshot, restorePath)
+		cmd = exec.CommandContext(ctx, "rbd", "import-diff", "--no-progress", "-", restorePath)
+	default:
+		return fmt.Errorf("cannot import volume '%s' of format %s into an RBD image", volume.ID, svolData.VolumeFormat)
+	}
+	cmd.Stdin = input
+
+	var errBuf bytes.Buffer
+	cmd.Stderr = &errBuf
+	if err := cmd.Run(); err != nil {
+		log.Error("stderr: %s", errBuf.String())
+		return fmt.Errorf("failed to import volume '%s' into RBD image '%s': %w", volume.ID, restorePath, err)
+	}
+
+	// Recreate the backup snapshot so later incremental images can be applied on top
+	if svolData.VolumeFormat != volumeformat.RBDDiff && volume.Snapshot != "" {
+		snapshotSpec := fmt.Sprintf("%s@%s", restorePath, volume.Snapshot)
+		if err := exec.CommandContext(ctx, "rbd", "snap", "create", "--no-progress", snapshotSpec).Run(); err != nil {
+			return fmt.Errorf("failed to create RBD snapshot '%s': %w", snapshotSpec, err)
+		}
+	}
+
+	log.Debug("Finished restoring volume '%s' to RBD image '%s'", volume.ID, restorePath)
+	return nil
+}
+
+// Stages an RBD volume. Full images are imported under a staging name, as
+// rbd import refuses to overwrite images anyway. Incremental images are
+// applied to the existing image, after taking a snapshot to roll back to.
+func stageRBD(ctx context.Context, restorePath string, volume *conf.InstanceVolume, svolData *svol.Data) (stagedTarget, error) {
+	if svolData.VolumeFormat == volumeformat.RBDDiff {
+		s := &stagedRBDDiff{image: restorePath, snapshot: volume.Snapshot}
+		log.Debug("Creating RBD snapshot '%s' to roll back to", s.rollbackSnapshot())
+		if err := runTool(ctx, "rbd", "snap", "create", "--no-progress", s.rollbackSnapshot()); err != nil {
+			return nil, fmt.Errorf("failed to create RBD snapshot '%s': %w", s.rollbackSnapshot(), err)
+		}
+		if err := restoreRBD(ctx, restorePath, volume, svolData); err != nil {
+			if discardErr := s.discard(); discardErr != nil {
+				log.Warn("Failed to roll back RBD image '%s': %v", restorePath, discardErr)
+			}
+			return nil, err
+		}
+		s.applied = true
+		return s, nil
+	}
+
+	if err := exec.CommandContext(ctx, "rbd", "info", restorePath).Run(); err == nil {
+		return nil, fmt.Errorf("RBD image '%s' already exists", restorePath)
+	}
+	s := &stagedRBDImage{target: restorePath}
+	if err := restoreRBD(ctx, s.staging(), volume, svolData); err != nil {
+		// The import may have failed before creating the image
+		if discardErr := s.discard(); discardErr != nil {
+			log.Debug("Failed to remove staging RBD image '%s': %v", s.staging(), discardErr)
+		}
+		return nil, err
+	}
+	return s, nil
+}
+
+// An RBD image imported under a staging name.
+type stagedRBDImage struct {
+	target string
+}
+
+func (s *stagedRBDImage) staging() string {
+	return s.target + stagingSuffix
+}
+
+func (s *stagedRBDImage) promote() error {
+	return runTool(context.Background(), "rbd", "rename", s.staging(), s.target)
+}
+
+func (s *stagedRBDImage) revert() error {
+	return runTool(context.Background(), "rbd", "rename", s.target, s.staging())
+}
+
+func (s *stagedRBDImage) finish() error {
+	return nil
+}
+
+func (s *stagedRBDImage) discard() error {
+	if err := runTool(context.Background(), "rbd", "snap", "purge", "--no-progress", s.staging()); err != nil {
+		return err
+	}
+	return runTool(context.Background(), "rbd", "rm", "--no-progress", s.staging())
+}
+
+func (s *stagedRBDImage) String() string {
+	return fmt.Sprintf("RBD image '%s'", s.target)
+}
+
+// An incremental RBD image applied in place, which is rolled back to a
+// snapshot taken before it was applied when discarded.
+type stagedRBDDiff struct {
+	image    string
+	snapshot string // Snapshot created by import-diff
+	applied  bool   // Whether import-diff succeeded, and so created the snapshot
+}
+
+func (s *stagedRBDDiff) rollbackSnapshot() string {
+	return s.image + "@pxitool-restore"
+}
+
+func (s *stagedRBDDiff) promote() error {
+	return nil
+}
+
+func (s *stagedRBDDiff) revert() error {
+	return nil
+}
+
+func (s *stagedRBDDiff) finish() error {
+	return runTool(context.Background(), "rbd", "snap", "rm", "--no-progress", s.rollbackSnapshot())
+}
+
+func (s *stagedRBDDiff) discard() error {
+	if s.applied && s.snapshot != "" {
+		if err := runTool(context.Background(), "rbd", "snap", "rm", "--no-progress", fmt.Sprintf("%s@%s", s.image, s.snapshot)); err != nil {
+			return err
+		}
+	}
+	if err := runTool(context.Background(), "rbd", "snap", "rollback", "--no-progress", s.rollbackSnapshot()); err != nil {
+		return err
+	}
+	return runTool(context.Background(), "rbd", "snap", "rm", "--no-progress", s.rollbackSnapshot())
+}
+
+func (s *stagedRBDDiff) String() string {
+	return fmt.Sprintf("RBD image '%s'", s.image)
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package restorepxi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/PextraCloud/pxitool/internal/utils"
+	"github.com/PextraCloud/pxitool/pkg/log"
+)
+
+// A volume or file restored to a staging location, which only replaces
+// its target once everything being restored has been staged.
+type stagedTarget interface {
+	// Moves the staged data into place. An existing target is kept aside
+	// until finish or revert is called.
+	promote() error
+	// Undoes promote, moving the staged data back to its staging location.
+	revert() error
+	// Removes the previous target after every target has been promoted.
+	finish() error
+	// Removes the staged data, after revert if it was promoted.
+	discard() error
+	// Describes the target in log messages.
+	String() string
+}
+
+// transaction promotes every staged target, or none of them.
+type transaction struct {
+	staged []stagedTarget
+}
+
+func (tx *transaction) add(target stagedTarget) {
+	tx.staged = append(tx.staged, target)
+}
+
+// Promotes every staged target. If one cannot be promoted, those already
+// promoted are reverted and all staged data is discarded.
+func (tx *transaction) commit() error {
+	for i, target := range tx.staged {
+		log.Debug("Promoting %s", target)
+		if err := target.promote(); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				if revertErr := tx.staged[j].revert(); revertErr != nil {
+					log.Error("Failed to revert %s: %v", tx.staged[j], revertErr)
+				}
+			}
+			tx.rollback()
+			return fmt.Errorf("failed to promote %s: %w", target, err)
+		}
+	}
+
+	for _, target := range tx.staged {
+		if err := target.finish(); err != nil {
+			log.Warn("Failed to clean up after promoting %s: %v", target, err)
+		}
+	}
+	tx.staged = nil
+	return nil
+}
+
+// Discards all staged data that has not been promoted.
+func (tx *transaction) rollback() {
+	tx.suspend(nil)
+}
+
+// Discards the staged data that has not been promoted, except the staged
+// targets keep reports, which are left for a later restore to resume.
+func (tx *transaction) suspend(keep func(stagedTarget) bool) {
+	for i := len(tx.staged) - 1; i >= 0; i-- {
+		if keep != nil && keep(tx.staged[i]) {
+			log.Debug("Keeping %s to resume", tx.staged[i])
+			continue
+		}
+		log.Debug("Discarding %s", tx.staged[i])
+		if err := tx.staged[i].discard(); err != nil {
+			log.Warn("Failed to discard %s: %v", tx.staged[i], err)
+		}
+	}
+	tx.staged = nil
+}
+
+// A file or directory staged next to its target on the same filesystem.
+type stagedPath struct {
+	target   string
+	staging  string
+	replaced bool // Whether an existing target was swapped to the staging path
+}
+
+// Creates an empty staging file next to target, which must not be a
+// directory. Symlinks are followed, and the mode and owner of an existing
+// target are kept.
+func newStagedFile(target string) (*stagedPath, error) {
+	return stageFile(target, func(dir string, base string) (*os.File, error) {
+		return os.CreateTemp(dir, ".pxitool-restore-*")
+	})
+}
+
+// Creates the staging file of target with create, which is given the
+// directory and name of the resolved target.
+func stageFile(target string, create func(dir string, base string) (*os.File, error)) (*stagedPath, error) {
+	if resolved, err := filepath.EvalSymlinks(target); err == nil {
+		target = resolved
+	}
+	info, err := os.Stat(target)
+	if err == nil && info.IsDir() {
+		return nil, fmt.Errorf("'%s' is a directory", target)
+	}
+
+	file, err := create(filepath.Dir(target), filepath.Base(target))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create staging file for '%s': %w", target, err)
+	}
+	s := &stagedPath{target: target, staging: file.Name()}
+	mode := os.FileMode(0640)
+	if info != nil {
+		mode = info.Mode().Perm()
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			if err := file.Chown(int(stat.Uid), int(stat.Gid)); err != nil {
+				log.Debug("Failed to keep the owner of '%s': %v", target, err)
+			}
+		}
+	}
+	err = file.Chmod(mode)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		s.discard()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *stagedPath) promote() error {
+	if _, err := os.Lstat(s.target); os.IsNotExist(err) {
+		return os.Rename(s.staging, s.target)
+	}
+	if err := utils.SwapPaths(s.staging, s.target); err != nil {
+		return err
+	}
+	s.replaced = true
+	return nil
+}
+
+func (s *stagedPath) revert() error {
+	if s.replaced {
+		s.replaced = false
+		return utils.SwapPaths(s.staging, s.target)
+	}
+	return os.Rename(s.target, s.staging)
+}
+
+func (s *stagedPath) finish() error {
+	if s.replaced {
+		return os.RemoveAll(s.staging)
+	}
+	return nil
+}
+
+func (s *stagedPath) discard() error {
+	return os.RemoveAll(s.staging)
+}
+
+func (s *stagedPath) String() string {
+	return fmt.Sprintf("'%s' (staged at '%s')", s.target, s.staging)
+}
+
+// contextReader fails reads once its context is done, so that restores
+// stop when interrupted.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
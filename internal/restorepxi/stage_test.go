@@ -0,0 +1,136 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package restorepxi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/svol"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumeformat"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumetype"
+)
+
+// Returns the names in dir, to check that no staged data is left behind.
+func dirNames(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestRestore_Staged(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "vol-1.img")
+	if err := os.WriteFile(existing, []byte("old data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	configOutput := filepath.Join(dir, "config.json")
+
+	chunks := testChunks(
+		&svol.Data{VolumeID: "vol-1", VolumeType: volumetype.Directory, VolumeFormat: volumeformat.Raw},
+		&svol.Data{VolumeID: "vol-2", VolumeType: volumetype.Directory, VolumeFormat: volumeformat.Raw},
+	)
+	restorePaths := restorePathsType{
+		"vol-1": existing,
+		"vol-2": filepath.Join(dir, "vol-2.img"),
+	}
+	if err := Restore(context.Background(), chunks, restorePaths, configOutput, Options{}); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	for _, restorePath := range restorePaths {
+		data, err := os.ReadFile(restorePath)
+		if err != nil || !bytes.Equal(data, make([]byte, 1000)) {
+			t.Errorf("Expected '%s' to hold the volume, got %d bytes (%v)", restorePath, len(data), err)
+		}
+	}
+	if info, err := os.Stat(existing); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the mode of the replaced file to be kept, got %v (%v)", info.Mode(), err)
+	}
+	if _, err := os.Stat(configOutput); err != nil {
+		t.Errorf("Expected the config to be written: %v", err)
+	}
+	if names := dirNames(t, dir); len(names) != 3 {
+		t.Errorf("Expected only the restored files to be left, got %v", names)
+	}
+}
+
+func TestRestore_RollsBack(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "vol-1.img")
+	if err := os.WriteFile(existing, []byte("old data"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	rootfsDir := filepath.Join(dir, "rootfs")
+	if err := os.MkdirAll(filepath.Join(rootfsDir, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	configOutput := filepath.Join(dir, "config.json")
+
+	// The rootfs is not a valid archive, and is restored alongside the
+	// other volumes
+	chunks := testChunks(
+		&svol.Data{VolumeID: "vol-1", VolumeType: volumetype.Directory, VolumeFormat: volumeformat.Raw},
+		&svol.Data{VolumeID: "vol-2", VolumeType: volumetype.Directory, VolumeFormat: volumeformat.Raw},
+		&svol.Data{VolumeID: "rootfs", VolumeType: volumetype.LXC_, VolumeFormat: volumeformat.Raw},
+	)
+	chunks.SVOL[2].VolumeData.Reset(strings.NewReader("not a tar archive"))
+	restorePaths := restorePathsType{
+		"vol-1":  existing,
+		"vol-2":  filepath.Join(dir, "vol-2.img"),
+		"rootfs": rootfsDir,
+	}
+	if err := Restore(context.Background(), chunks, restorePaths, configOutput, Options{Jobs: 3}); err == nil {
+		t.Fatal("Expected Restore to fail")
+	}
+
+	if data, err := os.ReadFile(existing); err != nil || string(data) != "old data" {
+		t.Errorf("Expected '%s' to be left alone, got %q (%v)", existing, data, err)
+	}
+	if _, err := os.Stat(filepath.Join(rootfsDir, "etc")); err != nil {
+		t.Errorf("Expected the rootfs to be left alone: %v", err)
+	}
+	if names := dirNames(t, dir); len(names) != 2 {
+		t.Errorf("Expected nothing but the previous targets, got %v", names)
+	}
+}
+
+func TestRestore_Interrupted(t *testing.T) {
+	dir := t.TempDir()
+	chunks := testChunks(&svol.Data{VolumeID: "vol-1", VolumeType: volumetype.Directory, VolumeFormat: volumeformat.Raw})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := Restore(ctx, chunks, restorePathsType{"vol-1": filepath.Join(dir, "vol-1.img")}, filepath.Join(dir, "config.json"), Options{})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the restore to be canceled, got %v", err)
+	}
+	if names := dirNames(t, dir); len(names) != 0 {
+		t.Errorf("Expected nothing to be written, got %v", names)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package restorepxi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/PextraCloud/pxitool/internal/readpxi"
+	"github.com/PextraCloud/pxitool/internal/sparse"
+	"github.com/PextraCloud/pxitool/internal/utils"
+	"github.com/PextraCloud/pxitool/pkg/log"
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/svol"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumeformat"
+)
+
+// WriteVolume writes the data of a single volume to w, such as stdout, so
+// it can be piped into another tool. Disk images are decoded to the raw
+// data of the disk: sparse streams and qcow2 images as they are read, with
+// their unallocated ranges written as zeroes, and other formats by
+// converting them with qemu-img in tmpDir. qcow2 images with a backing
+// file are refused. Other volumes, such as the rootfs tar archive, btrfs
+// send streams or RBD diffs, are written as stored, to be read by the tool
+// that made them. It returns the number of bytes written.
+func WriteVolume(ctx context.Context, inputFileName string, volumeID string, tmpDir string, w io.Writer) (int64, error) {
+	volumes, err := readpxi.OpenVolumes(inputFileName)
+	if err != nil {
+		return 0, err
+	}
+	defer volumes.Close()
+
+	svolData, err := volumes.Find(volumeID)
+	if err != nil {
+		return 0, err
+	}
+	log.Debug("Writing volume '%s' (%s %s)", volumeID, svolData.VolumeType, svolData.VolumeFormat)
+	return copyVolume(ctx, w, svolData, volumes.Disk, tmpDir)
+}
+
+// Copies the data of a volume to w, decoding disk images. Stored data is
+// read sequentially where possible; disk only opens qcow2 images.
+func copyVolume(ctx context.Context, w io.Writer, svolData *svol.Data, disk func() (io.ReaderAt, int64, error), tmpDir string) (int64, error) {
+	reader := &contextReader{ctx: ctx, r: svolData.VolumeData}
+	switch svolData.VolumeFormat {
+	case volumeformat.SparseRaw:
+		sparseReader, err := sparse.NewReader(reader)
+		if err != nil {
+			return 0, err
+		}
+		return sparse.Expand(w, sparseReader)
+	case volumeformat.QCOW2:
+		diskReader, size, err := disk()
+		if err != nil {
+			return 0, err
+		}
+		return io.Copy(w, &contextReader{ctx: ctx, r: io.NewSectionReader(diskReader, 0, size)})
+	case volumeformat.VMDK, volumeformat.VHD, volumeformat.VHDX:
+		return copyConverted(ctx, w, svolData, tmpDir)
+	default:
+		return io.Copy(w, reader)
+	}
+}
+
+// Copies the raw data of a disk image that cannot be decoded as it is read
+// to w. qemu-img needs random access to the image, so it is staged in
+// tmpDir and converted to a raw file there, which is then copied.
+func copyConverted(ctx context.Context, w io.Writer, svolData *svol.Data, tmpDir string) (int64, error) {
+	driver, err := utils.QEMUImgDriver(svolData.VolumeFormat)
+	if err != nil {
+		return 0, err
+	}
+	stagedPath, err := stageVolume(ctx, svolData, driver, tmpDir)
+	if stagedPath != "" {
+		defer os.Remove(stagedPath)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	rawFile, err := os.CreateTemp(filepath.Dir(stagedPath), "pxitool-restore-*.raw")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(rawFile.Name())
+	defer rawFile.Close()
+
+	log.Debug("Converting %s volume to raw in '%s'", svolData.VolumeFormat, rawFile.Name())
+	if err := convertImage(ctx, "-f", driver, "-O", "raw", stagedPath, rawFile.Name()); err != nil {
+		return 0, err
+	}
+	return io.Copy(w, &contextReader{ctx: ctx, r: rawFile})
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package restorepxi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/PextraCloud/pxitool/internal/qcow2"
+	"github.com/PextraCloud/pxitool/internal/sparse"
+	"github.com/PextraCloud/pxitool/internal/utils"
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/svol"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumeformat"
+)
+
+func TestCopyVolume(t *testing.T) {
+	// A disk with data around a zeroed range
+	data := make([]byte, 3*1024*1024)
+	copy(data, "start")
+	copy(data[len(data)-3:], "end")
+
+	var stream bytes.Buffer
+	sw, err := sparse.NewWriter(&stream, int64(len(data)))
+	if err != nil {
+		t.Fatalf("Failed to create sparse writer: %v", err)
+	}
+	if _, err := sw.Write(data); err != nil {
+		t.Fatalf("Failed to write sparse stream: %v", err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatalf("Failed to close sparse writer: %v", err)
+	}
+
+	noDisk := func() (io.ReaderAt, int64, error) {
+		t.Fatal("Expected the disk not to be opened")
+		return nil, 0, nil
+	}
+	tests := []struct {
+		name   string
+		format volumeformat.VolumeFormat
+		stored []byte
+	}{
+		{"raw", volumeformat.Raw, data},
+		{"sparse", volumeformat.SparseRaw, stream.Bytes()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svolData := &svol.Data{VolumeID: "vol-1", VolumeFormat: tt.format, VolumeData: bufio.NewReader(bytes.NewReader(tt.stored))}
+			var out bytes.Buffer
+			n, err := copyVolume(context.Background(), &out, svolData, noDisk, t.TempDir())
+			if err != nil {
+				t.Fatalf("copyVolume failed: %v", err)
+			}
+			if n != int64(len(data)) || !bytes.Equal(out.Bytes(), data) {
+				t.Errorf("Expected the %d bytes of the disk, got %d", len(data), n)
+			}
+		})
+	}
+}
+
+func TestCopyVolume_Converted(t *testing.T) {
+	if _, err := exec.LookPath("qemu-img"); err != nil {
+		t.Skip("Skipping conversion test: command 'qemu-img' not found")
+	}
+	dir := t.TempDir()
+	data := make([]byte, 4*1024*1024)
+	copy(data, "start of disk")
+	copy(data[3*1024*1024:], "hello pxitool")
+	rawPath := filepath.Join(dir, "source.raw")
+	if err := os.WriteFile(rawPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []volumeformat.VolumeFormat{volumeformat.VMDK, volumeformat.VHD, volumeformat.VHDX} {
+		t.Run(format.String(), func(t *testing.T) {
+			driver, err := utils.QEMUImgDriver(format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			imagePath := filepath.Join(dir, "source."+driver)
+			if output, err := exec.Command("qemu-img", "convert", "-f", "raw", "-O", driver, rawPath, imagePath).CombinedOutput(); err != nil {
+				t.Fatalf("qemu-img convert failed: %v: %s", err, output)
+			}
+			image, err := os.ReadFile(imagePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			svolData := &svol.Data{VolumeID: "vol-1", VolumeFormat: format, DataLength: uint64(len(image)), VolumeData: bufio.NewReader(bytes.NewReader(image))}
+			tmpDir := t.TempDir()
+			var out bytes.Buffer
+			if _, err := copyVolume(context.Background(), &out, svolData, nil, tmpDir); err != nil {
+				t.Fatalf("copyVolume failed: %v", err)
+			}
+			// VHD images may round the disk up to their geometry
+			if out.Len() < len(data) || !bytes.Equal(out.Bytes()[:len(data)], data) {
+				t.Errorf("Expected the %d bytes of the disk, got %d", len(data), out.Len())
+			}
+			if len(dirNames(t, tmpDir)) != 0 {
+				t.Errorf("Expected staged files to be removed, got %v", dirNames(t, tmpDir))
+			}
+		})
+	}
+}
+
+func TestCopyVolume_BackingFile(t *testing.T) {
+	// A qcow2 header with a backing file and an empty L1 table
+	const backingFile = "base.qcow2"
+	image := make([]byte, 1024)
+	copy(image, "QFI\xfb")
+	binary.BigEndian.PutUint32(image[4:], 3)
+	binary.BigEndian.PutUint64(image[8:], 200)
+	binary.BigEndian.PutUint32(image[16:], uint32(len(backingFile)))
+	binary.BigEndian.PutUint32(image[20:], 9)
+	binary.BigEndian.PutUint64(image[24:], 512)
+	binary.BigEndian.PutUint32(image[36:], 1)
+	binary.BigEndian.PutUint64(image[40:], 512)
+	binary.BigEndian.PutUint32(image[100:], 104)
+	copy(image[200:], backingFile)
+
+	disk := func() (io.ReaderAt, int64, error) {
+		img, err := qcow2.Open(bytes.NewReader(image))
+		if err != nil {
+			return nil, 0, err
+		}
+		return img, img.Size(), nil
+	}
+	svolData := &svol.Data{VolumeID: "vol-1", VolumeFormat: volumeformat.QCOW2, VolumeData: bufio.NewReader(bytes.NewReader(image))}
+	var out bytes.Buffer
+	if _, err := copyVolume(context.Background(), &out, svolData, disk, t.TempDir()); !errors.Is(err, qcow2.ErrBackingFile) {
+		t.Errorf("Expected ErrBackingFile, got %v", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("Expected nothing to be written, got %d bytes", out.Len())
+	}
+}
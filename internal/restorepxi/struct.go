@@ -0,0 +1,35 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package restorepxi
+
+import (
+	"github.com/PextraCloud/pxitool/internal/rootfs"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumeformat"
+)
+
+// Options controls how volumes are written to their restore paths.
+type Options struct {
+	Formats      map[string]volumeformat.VolumeFormat // Map of volume IDs to the disk image format they are restored in
+	TmpDir       string                               // Directory for staging volumes that are converted, the system default if empty
+	IDMap        rootfs.IDMap                         // ID map of an unprivileged LXC container, to shift the owners of its rootfs to
+	Pools        *PoolMap                             // Local pools to restore every volume without a restore path to, if set
+	Jobs         int                                  // Number of volumes restored at once, at least 1
+	Resume       bool                                 // Record progress in a journal, resuming the volumes of an interrupted restore recorded in it
+	Disks        DiskOpener                           // Random access to the volumes, to write them block by block so they can be resumed
+	KeepReceived bool                                 // Keep the received snapshots of all btrfs volumes, not only of those captured from a retained snapshot
+
+	journal *journal // Progress of the volumes written block by block, set by Restore
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package restorepxi
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/PextraCloud/pxitool/internal/sparse"
+	"github.com/PextraCloud/pxitool/internal/utils"
+	"github.com/PextraCloud/pxitool/pkg/log"
+	"github.com/PextraCloud/pxitool/pkg/pxi/chunks/svol"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumeformat"
+)
+
+const (
+	zeroBufferSize = 1024 * 1024
+)
+
+// Returns the number of bytes a volume takes up once restored.
+func getRestoredSize(svolData *svol.Data) (int64, error) {
+	if svolData.VolumeFormat == volumeformat.SparseRaw {
+		return sparse.PeekSize(svolData.VolumeData)
+	}
+	return int64(svolData.DataLength), nil
+}
+
+// Opens the file or block device a volume is restored to. Block devices
+// are never created or truncated, are opened exclusively so that mounted
+// or otherwise claimed devices are refused, and must be large enough for
+// the volume.
+func openRestoreTarget(restorePath string, svolData *svol.Data) (*os.File, bool, error) {
+	if !utils.IsBlockDevice(restorePath) {
+		file, err := os.OpenFile(restorePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to open file '%s': %w", restorePath, err)
+		}
+		return file, false, nil
+	}
+
+	file, err := os.OpenFile(restorePath, os.O_WRONLY|os.O_EXCL, 0)
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to open block device '%s' exclusively (is it mounted or in use?): %w", restorePath, err)
+	}
+
+	deviceSize, err := utils.GetBlockDeviceSize(file)
+	if err != nil {
+		file.Close()
+		return nil, true, err
+	}
+	if svolData != nil {
+		requiredSize, err := getRestoredSize(svolData)
+		if err != nil {
+			file.Close()
+			return nil, true, err
+		}
+		if deviceSize < requiredSize {
+			file.Close()
+			return nil, true, fmt.Errorf("block device '%s' is too small: %d bytes, volume needs %d bytes", restorePath, deviceSize, requiredSize)
+		}
+	}
+
+	log.Debug("Opened block device '%s' (%d bytes)", restorePath, deviceSize)
+	return file, true, nil
+}
+
+// fileTarget writes sparse streams to a restored file or block device.
+type fileTarget struct {
+	*os.File
+	isBlockDevice bool
+}
+
+// Zero implements sparse.Target. Ranges are deallocated where possible,
+// so thin-provisioned devices and sparse files stay thin, and otherwise
+// overwritten with zeroes.
+func (t *fileTarget) Zero(offset, length int64) error {
+	var err error
+	if t.isBlockDevice {
+		err = utils.ZeroBlockDeviceRange(t.File, offset, length)
+	} else {
+		err = utils.PunchHole(t.File, offset, length)
+	}
+	if err == nil {
+		return nil
+	}
+	log.Debug("Writing zeroes to '%s' at offset %d: %v", t.Name(), offset, err)
+
+	buf := make([]byte, min(length, zeroBufferSize))
+	for length > 0 {
+		n := min(length, int64(len(buf)))
+		if _, err := t.WriteAt(buf[:n], offset); err != nil {
+			return err
+		}
+		offset += n
+		length -= n
+	}
+	return nil
+}
+
+// Restores a sparse stream to the target, keeping regular files sparse.
+func restoreSparse(target *fileTarget, reader io.Reader) error {
+	sparseReader, err := sparse.NewReader(reader)
+	if err != nil {
+		return err
+	}
+	written, err := sparse.Copy(target, sparseReader)
+	if err != nil {
+		return err
+	}
+	if !target.isBlockDevice {
+		if err := target.Truncate(sparseReader.Size()); err != nil {
+			return fmt.Errorf("failed to set size of '%s': %w", target.Name(), err)
+		}
+	}
+
+	log.Debug("Restored %d of %d bytes from sparse stream to '%s'", written, sparseReader.Size(), target.Name())
+	return nil
+}
+
+// Restores raw data to the target, deallocating zeroed blocks instead of
+// writing them.
+func restoreRaw(target *fileTarget, reader io.Reader) error {
+	size, err := sparse.CopyRaw(target, reader)
+	if err != nil {
+		return err
+	}
+	if !target.isBlockDevice {
+		if err := target.Truncate(size); err != nil {
+			return fmt.Errorf("failed to set size of '%s': %w", target.Name(), err)
+		}
+	}
+
+	log.Debug("Restored %d bytes to '%s'", size, target.Name())
+	return nil
+}
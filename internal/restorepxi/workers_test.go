@@ -0,0 +1,70 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package restorepxi
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunWorkers(t *testing.T) {
+	var running, maxRunning, ran atomic.Int32
+	err := runWorkers(context.Background(), 3, 10, func(ctx context.Context, i int) error {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			m := maxRunning.Load()
+			if n <= m || maxRunning.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		ran.Add(1)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("runWorkers failed: %v", err)
+	}
+	if ran.Load() != 10 {
+		t.Errorf("Expected 10 tasks to run, got %d", ran.Load())
+	}
+	if maxRunning.Load() > 3 {
+		t.Errorf("Expected at most 3 tasks at once, got %d", maxRunning.Load())
+	}
+}
+
+func TestRunWorkers_FirstError(t *testing.T) {
+	errFailed := errors.New("failed")
+	var started atomic.Int32
+	err := runWorkers(context.Background(), 2, 100, func(ctx context.Context, i int) error {
+		started.Add(1)
+		if i == 0 {
+			return errFailed
+		}
+		// The others wait until they are canceled
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if !errors.Is(err, errFailed) {
+		t.Errorf("Expected the first error to be returned, got %v", err)
+	}
+	if started.Load() > 3 {
+		t.Errorf("Expected the remaining tasks not to start, %d started", started.Load())
+	}
+}
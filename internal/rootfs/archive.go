@@ -0,0 +1,161 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Package rootfs archives and extracts container root filesystems.
+package rootfs
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/PextraCloud/pxitool/pkg/log"
+)
+
+// Prefix of PAX records holding extended attributes, as used by GNU tar
+// and libarchive. POSIX ACLs, file capabilities and SELinux labels are all
+// extended attributes.
+const xattrRecordPrefix = "SCHILY.xattr."
+
+type archiver struct {
+	tw    *tar.Writer
+	w     io.Writer
+	links map[fileID]string // First archived name of each multiply-linked file
+	idMap IDMap             // Maps host IDs back to container IDs
+}
+
+// Archive writes the directory tree at root to w as a PAX tar archive.
+// Entries are in lexical order, with numeric owners and without access
+// times, so the same tree always produces the same archive. Files with
+// holes are stored as PAX 1.0 sparse files, and sockets are skipped. The
+// owners, POSIX ACLs and file capabilities of an unprivileged container's
+// rootfs are mapped back to container IDs with idMap, which may be nil.
+func Archive(root string, w io.Writer, idMap IDMap) error {
+	info, err := os.Lstat(root)
+	if err != nil {
+		return fmt.Errorf("failed to stat rootfs: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("rootfs %s is not a directory", root)
+	}
+
+	a := &archiver{tw: tar.NewWriter(w), w: w, links: make(map[fileID]string), idMap: idMap}
+	err = filepath.WalkDir(root, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return err
+		}
+		// Names are relative to the rootfs, like those of "tar -C root ."
+		name := "."
+		if rel != "." {
+			name = "./" + filepath.ToSlash(rel)
+		}
+		return a.add(filePath, name)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to archive rootfs: %w", err)
+	}
+	return a.tw.Close()
+}
+
+func (a *archiver) add(filePath string, name string) error {
+	info, err := os.Lstat(filePath)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket != 0 {
+		log.Debug("Skipping socket %s", filePath)
+		return nil
+	}
+
+	var linkTarget string
+	if info.Mode()&os.ModeSymlink != 0 {
+		if linkTarget, err = os.Readlink(filePath); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, linkTarget)
+	if err != nil {
+		return fmt.Errorf("failed to create header for %s: %w", filePath, err)
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	hdr.Format = tar.FormatPAX
+	hdr.Uname, hdr.Gname = "", ""
+	hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+
+	xattrs, err := listXattrs(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to read extended attributes of %s: %w", filePath, err)
+	}
+	if len(xattrs) > 0 {
+		hdr.PAXRecords = make(map[string]string, len(xattrs))
+		for key, value := range xattrs {
+			hdr.PAXRecords[xattrRecordPrefix+key] = value
+		}
+	}
+	if err := a.idMap.shiftHeader(hdr, false); err != nil {
+		return fmt.Errorf("failed to map owners of %s: %w", filePath, err)
+	}
+
+	if !info.Mode().IsRegular() {
+		return a.tw.WriteHeader(hdr)
+	}
+
+	// Later names of a multiply-linked file are stored as hard links
+	if id, linked := getFileID(info); linked {
+		if first, found := a.links[id]; found {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			hdr.Size = 0
+			return a.tw.WriteHeader(hdr)
+		}
+		a.links[id] = hdr.Name
+	}
+	return a.addFile(filePath, hdr)
+}
+
+func (a *archiver) addFile(filePath string, hdr *tar.Header) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	extents, err := getDataExtents(file, hdr.Size)
+	if err != nil {
+		return fmt.Errorf("failed to find data of %s: %w", filePath, err)
+	}
+	if isSparse(extents, hdr.Size) {
+		return a.addSparseFile(file, hdr, extents)
+	}
+
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(a.tw, file, hdr.Size); err != nil {
+		return fmt.Errorf("failed to archive %s: %w", filePath, err)
+	}
+	return nil
+}
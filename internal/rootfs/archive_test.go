@@ -0,0 +1,183 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package rootfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// Builds a small rootfs with each kind of entry the archiver handles.
+func makeTestRootfs(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+
+	mustDo := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("Failed to set up rootfs: %v", err)
+		}
+	}
+	mustDo(os.MkdirAll(filepath.Join(root, "etc"), 0755))
+	mustDo(os.WriteFile(filepath.Join(root, "etc", "hostname"), []byte("container\n"), 0644))
+	mustDo(os.Symlink("hostname", filepath.Join(root, "etc", "hostname.link")))
+	mustDo(os.Link(filepath.Join(root, "etc", "hostname"), filepath.Join(root, "etc", "hostname.hard")))
+	mustDo(unix.Mkfifo(filepath.Join(root, "fifo"), 0600))
+
+	// A 64 MiB file with data only at its start and end
+	sparseFile, err := os.Create(filepath.Join(root, "sparse.img"))
+	mustDo(err)
+	_, err = sparseFile.WriteAt([]byte("head"), 0)
+	mustDo(err)
+	_, err = sparseFile.WriteAt([]byte("tail"), 64*1024*1024-4)
+	mustDo(err)
+	mustDo(sparseFile.Close())
+	return root
+}
+
+func readArchive(t *testing.T, archive []byte) (map[string]*tar.Header, map[string][]byte) {
+	t.Helper()
+	headers := make(map[string]*tar.Header)
+	contents := make(map[string][]byte)
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read archive: %v", err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", hdr.Name, err)
+		}
+		headers[hdr.Name] = hdr
+		contents[hdr.Name] = data
+	}
+	return headers, contents
+}
+
+func TestArchive(t *testing.T) {
+	root := makeTestRootfs(t)
+
+	var buf bytes.Buffer
+	if err := Archive(root, &buf, nil); err != nil {
+		t.Fatalf("Archive failed: %v", err)
+	}
+	headers, contents := readArchive(t, buf.Bytes())
+
+	for _, name := range []string{"./", "./etc/", "./etc/hostname", "./etc/hostname.link", "./fifo", "./sparse.img"} {
+		if _, found := headers[name]; !found {
+			t.Errorf("Expected %s in archive", name)
+		}
+	}
+	if hdr := headers["./etc/hostname.link"]; hdr != nil && (hdr.Typeflag != tar.TypeSymlink || hdr.Linkname != "hostname") {
+		t.Errorf("Expected a symlink to hostname, got %+v", hdr)
+	}
+	if hdr := headers["./fifo"]; hdr != nil && hdr.Typeflag != tar.TypeFifo {
+		t.Errorf("Expected a fifo, got type %c", hdr.Typeflag)
+	}
+	if hdr := headers["./etc/hostname"]; hdr != nil && (hdr.Uname != "" || !hdr.AccessTime.IsZero()) {
+		t.Errorf("Expected numeric owners and no access times, got %+v", hdr)
+	}
+
+	if data := contents["./sparse.img"]; len(data) != 64*1024*1024 || string(data[:4]) != "head" || string(data[len(data)-4:]) != "tail" {
+		t.Errorf("Sparse file was not restored correctly (%d bytes)", len(data))
+	}
+
+	if runtime.GOOS == "linux" {
+		if hdr := headers["./etc/hostname.hard"]; hdr == nil || hdr.Typeflag != tar.TypeLink || hdr.Linkname != "./etc/hostname" {
+			t.Errorf("Expected a hard link to ./etc/hostname, got %+v", hdr)
+		}
+		if buf.Len() > 1024*1024 {
+			t.Errorf("Expected holes to be left out, but archive is %d bytes", buf.Len())
+		}
+	}
+}
+
+func TestArchive_Deterministic(t *testing.T) {
+	root := makeTestRootfs(t)
+
+	var first, second bytes.Buffer
+	if err := Archive(root, &first, nil); err != nil {
+		t.Fatalf("Archive failed: %v", err)
+	}
+	if err := Archive(root, &second, nil); err != nil {
+		t.Fatalf("Archive failed: %v", err)
+	}
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Error("Expected archives of the same tree to be identical")
+	}
+}
+
+func TestArchive_Xattrs(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Extended attributes are only archived on Linux")
+	}
+	root := t.TempDir()
+	filePath := filepath.Join(root, "ping")
+	if err := os.WriteFile(filePath, nil, 0755); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	if err := unix.Lsetxattr(filePath, "user.pxitool", []byte("value"), 0); err != nil {
+		t.Skipf("Filesystem does not support user extended attributes: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := Archive(root, &buf, nil); err != nil {
+		t.Fatalf("Archive failed: %v", err)
+	}
+	headers, _ := readArchive(t, buf.Bytes())
+	if hdr := headers["./ping"]; hdr == nil || hdr.PAXRecords[xattrRecordPrefix+"user.pxitool"] != "value" {
+		t.Errorf("Expected the extended attribute to be archived, got %+v", hdr)
+	}
+}
+
+func TestArchive_GNUTarCompatible(t *testing.T) {
+	if _, err := exec.LookPath("tar"); err != nil {
+		t.Skip("Skipping test: command 'tar' not found")
+	}
+	root := makeTestRootfs(t)
+
+	var buf bytes.Buffer
+	if err := Archive(root, &buf, nil); err != nil {
+		t.Fatalf("Archive failed: %v", err)
+	}
+
+	extractDir := t.TempDir()
+	cmd := exec.Command("tar", "-x", "-C", extractDir)
+	cmd.Stdin = &buf
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("tar failed to extract archive: %v\n%s", err, output)
+	}
+
+	data, err := os.ReadFile(filepath.Join(extractDir, "sparse.img"))
+	if err != nil {
+		t.Fatalf("Failed to read extracted sparse file: %v", err)
+	}
+	if len(data) != 64*1024*1024 || string(data[:4]) != "head" || string(data[len(data)-4:]) != "tail" {
+		t.Errorf("Sparse file was not extracted correctly (%d bytes)", len(data))
+	}
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package rootfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/PextraCloud/pxitool/internal/utils"
+	"github.com/PextraCloud/pxitool/pkg/log"
+)
+
+// Extract extracts the tar archive read from r to the directory target,
+// replacing the directory if it exists. The archive is extracted into a
+// staging directory next to target, which is only swapped in once the
+// whole archive has been extracted, so a failed restore leaves target as
+// it was.
+//
+// All writes are confined to the staging directory. Entries with absolute
+// or ".." names, entries below a symlink, and hard links to absolute or
+// escaping names are rejected. Symlinks are never followed during the
+// extraction; relative symlinks that escape the rootfs are rejected, while
+// absolute ones are kept, as they resolve inside the container.
+//
+// With an idMap, owners, POSIX ACLs and file capabilities are shifted to
+// the host IDs of an unprivileged container, which needs root.
+func Extract(r io.Reader, target string, idMap IDMap) error {
+	stagingDir, err := Stage(r, target, idMap)
+	if err != nil {
+		return err
+	}
+	replaced, err := promote(stagingDir, target)
+	if err != nil {
+		os.RemoveAll(stagingDir)
+		return err
+	}
+	if replaced {
+		// The old rootfs ends up at the staging path, and is removed from there
+		log.Debug("Removing previous rootfs from '%s'", stagingDir)
+		if err := os.RemoveAll(stagingDir); err != nil {
+			log.Warn("Failed to remove previous rootfs at '%s': %v", stagingDir, err)
+		}
+	}
+	return nil
+}
+
+// Stage extracts the tar archive read from r into a new staging directory
+// next to target, as Extract does, and returns its path. The staging
+// directory is removed if the extraction fails.
+func Stage(r io.Reader, target string, idMap IDMap) (string, error) {
+	target = filepath.Clean(target)
+	parentDir := filepath.Dir(target)
+	if err := os.MkdirAll(parentDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory '%s': %w", parentDir, err)
+	}
+
+	info, err := os.Lstat(target)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("failed to stat '%s': %w", target, err)
+	}
+	if err == nil && !info.IsDir() {
+		return "", fmt.Errorf("'%s' exists and is not a directory", target)
+	}
+
+	stagingDir, err := os.MkdirTemp(parentDir, ".pxitool-restore-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create staging directory in '%s': %w", parentDir, err)
+	}
+	log.Debug("Extracting rootfs into staging directory '%s'", stagingDir)
+	if _, err := extractEntries(r, stagingDir, idMap, nil); err != nil {
+		os.RemoveAll(stagingDir)
+		return "", err
+	}
+	return stagingDir, nil
+}
+
+// Moves a staging directory to target. An existing target is swapped with
+// it, atomically where the filesystem supports it, and ends up at the
+// staging path; promote reports whether it did.
+func promote(stagingDir string, target string) (bool, error) {
+	target = filepath.Clean(target)
+	if _, err := os.Lstat(target); errors.Is(err, fs.ErrNotExist) {
+		if err := os.Rename(stagingDir, target); err != nil {
+			return false, fmt.Errorf("failed to move rootfs to '%s': %w", target, err)
+		}
+		return false, nil
+	}
+	if err := utils.SwapPaths(stagingDir, target); err != nil {
+		return false, fmt.Errorf("failed to replace rootfs '%s': %w", target, err)
+	}
+	return true, nil
+}
+
+// Returns the name of an archive entry relative to the extraction root,
+// which is "." for the root itself. Absolute names and names with ".."
+// elements are rejected.
+func entryPath(name string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("entry has an empty name")
+	}
+	if path.IsAbs(name) {
+		return "", fmt.Errorf("entry %q has an absolute name", name)
+	}
+	for _, element := range strings.Split(name, "/") {
+		if element == ".." {
+			return "", fmt.Errorf("entry %q has a '..' element", name)
+		}
+	}
+	return path.Clean(name), nil
+}
+
+// Checks that a relative symlink at name stays inside the extraction root.
+func checkSymlink(name string, linkTarget string) error {
+	if linkTarget == "" {
+		return fmt.Errorf("symlink %q has an empty target", name)
+	}
+	if path.IsAbs(linkTarget) {
+		return nil
+	}
+	resolved := path.Join(path.Dir(name), linkTarget)
+	if resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return fmt.Errorf("symlink %q points outside the rootfs to %q", name, linkTarget)
+	}
+	return nil
+}
@@ -0,0 +1,384 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package rootfs
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/PextraCloud/pxitool/internal/sparse"
+	"github.com/PextraCloud/pxitool/pkg/log"
+	"golang.org/x/sys/unix"
+)
+
+// Regular files of at least this size are written without their zeroed
+// blocks, which leaves holes where the archived file had them.
+const sparseMinSize = 1024 * 1024
+
+// Resolution flags for paths inside the extraction root: no ".." above the
+// root, and no symlinks at all, so every write lands in a real directory of
+// the tree being extracted.
+const resolveFlags = unix.RESOLVE_BENEATH | unix.RESOLVE_NO_SYMLINKS | unix.RESOLVE_NO_MAGICLINKS
+
+type extractor struct {
+	root  int           // O_PATH descriptor of the extraction root
+	chown bool          // Whether archived owners are applied
+	idMap IDMap         // Maps container IDs to host IDs
+	match MatchFunc     // Selects the entries to extract, all if nil
+	count int           // Number of extracted entries
+	dirs  []*tar.Header // Directories, whose metadata is applied last
+}
+
+// Extracts the entries selected by match into dir, and returns how many
+// were extracted.
+func extractEntries(r io.Reader, dir string, idMap IDMap, match MatchFunc) (int, error) {
+	chown := os.Geteuid() == 0
+	if idMap != nil && !chown {
+		return 0, fmt.Errorf("shifting owners with an ID map requires root")
+	}
+
+	root, err := unix.Open(dir, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open '%s': %w", dir, err)
+	}
+	defer unix.Close(root)
+
+	e := &extractor{root: root, chown: chown, idMap: idMap, match: match}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return e.count, fmt.Errorf("failed to read rootfs archive: %w", err)
+		}
+		if err := e.extract(tr, hdr); err != nil {
+			return e.count, fmt.Errorf("failed to extract %s: %w", hdr.Name, err)
+		}
+	}
+
+	// Children change the modification time of their directory, and may
+	// not be writable once its mode is set, so directories are done last
+	for _, hdr := range slices.Backward(e.dirs) {
+		name, _ := entryPath(hdr.Name)
+		if err := e.withParent(name, func(parent int, base string) error {
+			// Skip directories that a later entry replaced
+			var stat unix.Stat_t
+			if err := unix.Fstatat(parent, base, &stat, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+				return err
+			}
+			if stat.Mode&unix.S_IFMT != unix.S_IFDIR {
+				return nil
+			}
+			return e.setMetadata(parent, base, hdr)
+		}); err != nil {
+			return e.count, fmt.Errorf("failed to set metadata of %s: %w", hdr.Name, err)
+		}
+	}
+	return e.count, nil
+}
+
+func (e *extractor) extract(tr *tar.Reader, hdr *tar.Header) error {
+	name, err := entryPath(hdr.Name)
+	if err != nil {
+		return err
+	}
+	if e.match != nil && !e.match(name) {
+		return nil
+	}
+	if hdr.Typeflag == tar.TypeLink && e.match != nil {
+		// The data of a hard link is archived with its target, which was
+		// passed over if it is not extracted
+		if linkName, err := entryPath(hdr.Linkname); err == nil && !e.match(linkName) {
+			log.Warn("Skipping %s, a hard link to %s, which is not extracted", hdr.Name, hdr.Linkname)
+			return nil
+		}
+	}
+	if err := e.idMap.shiftHeader(hdr, true); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeXGlobalHeader {
+		e.count++
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		err = e.withParent(name, func(parent int, base string) error {
+			return e.makeDir(parent, base)
+		})
+		if err == nil {
+			e.dirs = append(e.dirs, hdr)
+		}
+		return err
+	case tar.TypeReg:
+		return e.withParent(name, func(parent int, base string) error {
+			return e.writeFile(parent, base, hdr, tr)
+		})
+	case tar.TypeSymlink:
+		if err := checkSymlink(name, hdr.Linkname); err != nil {
+			return err
+		}
+		return e.withParent(name, func(parent int, base string) error {
+			if err := e.remove(parent, base); err != nil {
+				return err
+			}
+			if err := unix.Symlinkat(hdr.Linkname, parent, base); err != nil {
+				return err
+			}
+			return e.setMetadata(parent, base, hdr)
+		})
+	case tar.TypeLink:
+		linkName, err := entryPath(hdr.Linkname)
+		if err != nil {
+			return fmt.Errorf("hard link target: %w", err)
+		}
+		if linkName == "." {
+			return fmt.Errorf("hard link to the rootfs directory")
+		}
+		return e.withParent(linkName, func(linkParent int, linkBase string) error {
+			return e.withParent(name, func(parent int, base string) error {
+				if err := e.remove(parent, base); err != nil {
+					return err
+				}
+				return unix.Linkat(linkParent, linkBase, parent, base, 0)
+			})
+		})
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		return e.withParent(name, func(parent int, base string) error {
+			if err := e.remove(parent, base); err != nil {
+				return err
+			}
+			if err := e.makeNode(parent, base, hdr); err != nil {
+				return err
+			}
+			return e.setMetadata(parent, base, hdr)
+		})
+	case tar.TypeXGlobalHeader:
+		return nil
+	default:
+		log.Warn("Skipping %s, which has unsupported type %c", hdr.Name, hdr.Typeflag)
+		return nil
+	}
+}
+
+// Calls fn with a descriptor of the parent directory of name, creating
+// missing parents like tar does, and the final element of name.
+func (e *extractor) withParent(name string, fn func(parent int, base string) error) error {
+	dir, base := path.Split(name)
+	if dir == "" {
+		dir = "."
+	}
+	parent, err := e.openDir(dir)
+	if errors.Is(err, unix.ENOENT) {
+		if err := e.makeDirAll(dir); err != nil {
+			return err
+		}
+		parent, err = e.openDir(dir)
+	}
+	if err != nil {
+		return err
+	}
+	defer unix.Close(parent)
+	return fn(parent, base)
+}
+
+// Opens a directory below the extraction root, without following symlinks.
+func (e *extractor) openDir(dir string) (int, error) {
+	fd, err := unix.Openat2(e.root, dir, &unix.OpenHow{
+		Flags:   unix.O_PATH | unix.O_DIRECTORY | unix.O_CLOEXEC,
+		Resolve: resolveFlags,
+	})
+	if errors.Is(err, unix.ENOSYS) {
+		return e.walkDir(dir) // Kernels before 5.6
+	}
+	if errors.Is(err, unix.ELOOP) || errors.Is(err, unix.EXDEV) {
+		return -1, fmt.Errorf("'%s' is not a directory inside the rootfs: %w", dir, err)
+	}
+	return fd, err
+}
+
+// Opens a directory below the extraction root one element at a time, which
+// matches openat2 with resolveFlags for names accepted by entryPath.
+func (e *extractor) walkDir(dir string) (int, error) {
+	fd, err := unix.Dup(e.root)
+	if err != nil {
+		return -1, err
+	}
+	for _, element := range strings.Split(dir, "/") {
+		if element == "." || element == "" {
+			continue
+		}
+		next, err := unix.Openat(fd, element, unix.O_PATH|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		unix.Close(fd)
+		if err != nil {
+			if errors.Is(err, unix.ENOTDIR) || errors.Is(err, unix.ELOOP) {
+				return -1, fmt.Errorf("'%s' is not a directory inside the rootfs: %w", dir, err)
+			}
+			return -1, err
+		}
+		fd = next
+	}
+	return fd, nil
+}
+
+func (e *extractor) makeDirAll(dir string) error {
+	if dir == "." {
+		return nil
+	}
+	return e.withParent(strings.TrimSuffix(dir, "/"), func(parent int, base string) error {
+		err := unix.Mkdirat(parent, base, 0755)
+		if errors.Is(err, unix.EEXIST) {
+			return nil
+		}
+		return err
+	})
+}
+
+func (e *extractor) makeDir(parent int, base string) error {
+	if base == "" || base == "." {
+		return nil // The extraction root
+	}
+	// Directories stay writable until their metadata is applied
+	err := unix.Mkdirat(parent, base, 0700)
+	if errors.Is(err, unix.EEXIST) {
+		var stat unix.Stat_t
+		if err := unix.Fstatat(parent, base, &stat, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return err
+		}
+		if stat.Mode&unix.S_IFMT == unix.S_IFDIR {
+			return nil
+		}
+		if err := e.remove(parent, base); err != nil {
+			return err
+		}
+		err = unix.Mkdirat(parent, base, 0700)
+	}
+	return err
+}
+
+// Removes an existing entry that a later entry of the archive replaces.
+// Directories are only removed if they are empty.
+func (e *extractor) remove(parent int, base string) error {
+	err := unix.Unlinkat(parent, base, 0)
+	if errors.Is(err, unix.EISDIR) {
+		err = unix.Unlinkat(parent, base, unix.AT_REMOVEDIR)
+	}
+	if errors.Is(err, unix.ENOENT) {
+		return nil
+	}
+	return err
+}
+
+func (e *extractor) makeNode(parent int, base string, hdr *tar.Header) error {
+	if hdr.Typeflag == tar.TypeFifo {
+		return unix.Mkfifoat(parent, base, 0600)
+	}
+	mode := uint32(unix.S_IFCHR)
+	if hdr.Typeflag == tar.TypeBlock {
+		mode = unix.S_IFBLK
+	}
+	dev := unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+	return unix.Mknodat(parent, base, mode|0600, int(dev))
+}
+
+// Writes a regular file. Zeroed blocks of large files are left as holes.
+func (e *extractor) writeFile(parent int, base string, hdr *tar.Header, r io.Reader) error {
+	if err := e.remove(parent, base); err != nil {
+		return err
+	}
+	fd, err := unix.Openat(parent, base, unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0600)
+	if err != nil {
+		return err
+	}
+	file := os.NewFile(uintptr(fd), hdr.Name)
+	defer file.Close()
+
+	if hdr.Size >= sparseMinSize {
+		if _, err := sparse.CopyRaw(holeTarget{file}, r); err != nil {
+			return err
+		}
+		if err := file.Truncate(hdr.Size); err != nil {
+			return err
+		}
+	} else if _, err := io.Copy(file, r); err != nil {
+		return err
+	}
+	if err := e.setMetadata(parent, base, hdr); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// A new file, whose unwritten ranges are holes that read as zeroes.
+type holeTarget struct {
+	*os.File
+}
+
+func (holeTarget) Zero(offset, length int64) error {
+	return nil
+}
+
+// Applies the owner, mode, extended attributes and modification time of
+// an entry. The owner goes first, as changing it clears file capabilities.
+func (e *extractor) setMetadata(parent int, base string, hdr *tar.Header) error {
+	if base == "" {
+		base = "."
+	}
+	if e.chown {
+		if err := unix.Fchownat(parent, base, hdr.Uid, hdr.Gid, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return fmt.Errorf("failed to change owner: %w", err)
+		}
+	}
+	// Symlinks have no mode of their own, and fchmodat follows them
+	if hdr.Typeflag != tar.TypeSymlink {
+		var stat unix.Stat_t
+		if err := unix.Fstatat(parent, base, &stat, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return err
+		}
+		if stat.Mode&unix.S_IFMT == unix.S_IFLNK {
+			return fmt.Errorf("entry was replaced by a symlink")
+		}
+		if err := unix.Fchmodat(parent, base, uint32(hdr.Mode&07777), 0); err != nil {
+			return fmt.Errorf("failed to change mode: %w", err)
+		}
+	}
+
+	// The *xattr calls only take paths, so the parent is reached through
+	// its descriptor, and the final element is not followed
+	procPath := fmt.Sprintf("/proc/self/fd/%d/%s", parent, base)
+	for key, value := range hdr.PAXRecords {
+		name, found := strings.CutPrefix(key, xattrRecordPrefix)
+		if !found {
+			continue
+		}
+		if err := unix.Lsetxattr(procPath, name, []byte(value), 0); err != nil {
+			log.Warn("Failed to set extended attribute %s of %s: %v", name, hdr.Name, err)
+		}
+	}
+
+	mtime := unix.NsecToTimespec(hdr.ModTime.UnixNano())
+	if err := unix.UtimesNanoAt(parent, base, []unix.Timespec{mtime, mtime}, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return fmt.Errorf("failed to change modification time: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package rootfs
+
+import (
+	"fmt"
+	"io"
+)
+
+// Confined extraction relies on openat2 and the *at syscalls of Linux.
+func extractEntries(r io.Reader, dir string, idMap IDMap, match MatchFunc) (int, error) {
+	return 0, fmt.Errorf("extracting a rootfs is only supported on Linux")
+}
@@ -0,0 +1,227 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package rootfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+func skipUnlessLinux(t *testing.T) {
+	t.Helper()
+	if runtime.GOOS != "linux" {
+		t.Skip("Extracting a rootfs is only supported on Linux")
+	}
+}
+
+// Builds an archive from headers, with "data" as the content of regular files.
+func makeArchive(t *testing.T, headers ...*tar.Header) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range headers {
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = 4
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("Failed to write header: %v", err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte("data")); err != nil {
+				t.Fatalf("Failed to write data: %v", err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Failed to close archive: %v", err)
+	}
+	return &buf
+}
+
+func TestExtract(t *testing.T) {
+	skipUnlessLinux(t)
+	root := makeTestRootfs(t)
+	if err := os.Chmod(filepath.Join(root, "etc"), 0750); err != nil {
+		t.Fatalf("Failed to change mode: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := Archive(root, &buf, nil); err != nil {
+		t.Fatalf("Archive failed: %v", err)
+	}
+	target := filepath.Join(t.TempDir(), "rootfs")
+	if err := Extract(&buf, target, nil); err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+
+	if data, err := os.ReadFile(filepath.Join(target, "etc", "hostname")); err != nil || string(data) != "container\n" {
+		t.Errorf("Expected hostname to be restored, got %q (%v)", data, err)
+	}
+	if link, err := os.Readlink(filepath.Join(target, "etc", "hostname.link")); err != nil || link != "hostname" {
+		t.Errorf("Expected a symlink to hostname, got %q (%v)", link, err)
+	}
+	if info, err := os.Lstat(filepath.Join(target, "etc")); err != nil || info.Mode().Perm() != 0750 {
+		t.Errorf("Expected directory mode 0750, got %v (%v)", info.Mode(), err)
+	}
+	if info, err := os.Lstat(filepath.Join(target, "fifo")); err != nil || info.Mode()&os.ModeNamedPipe == 0 {
+		t.Errorf("Expected a fifo, got %v (%v)", info.Mode(), err)
+	}
+
+	hostname, _ := os.Stat(filepath.Join(target, "etc", "hostname"))
+	hardLink, err := os.Stat(filepath.Join(target, "etc", "hostname.hard"))
+	if err != nil || !os.SameFile(hostname, hardLink) {
+		t.Errorf("Expected hostname.hard to be a hard link of hostname (%v)", err)
+	}
+
+	sparsePath := filepath.Join(target, "sparse.img")
+	data, err := os.ReadFile(sparsePath)
+	if err != nil || len(data) != 64*1024*1024 || string(data[:4]) != "head" || string(data[len(data)-4:]) != "tail" {
+		t.Fatalf("Sparse file was not restored correctly (%d bytes, %v)", len(data), err)
+	}
+	info, _ := os.Stat(sparsePath)
+	if blocks := info.Sys().(*syscall.Stat_t).Blocks; blocks*512 > 1024*1024 {
+		t.Errorf("Expected sparse file to keep its holes, but %d blocks are allocated", blocks)
+	}
+}
+
+func TestExtract_ReplacesTarget(t *testing.T) {
+	skipUnlessLinux(t)
+	parentDir := t.TempDir()
+	target := filepath.Join(parentDir, "rootfs")
+	if err := os.MkdirAll(filepath.Join(target, "old"), 0755); err != nil {
+		t.Fatalf("Failed to create target: %v", err)
+	}
+
+	archive := makeArchive(t,
+		&tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "./new", Typeflag: tar.TypeReg},
+	)
+	if err := Extract(archive, target, nil); err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(target, "new")); err != nil {
+		t.Errorf("Expected the extracted file in the target: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(target, "old")); !os.IsNotExist(err) {
+		t.Errorf("Expected the previous contents to be gone, got %v", err)
+	}
+	if entries, _ := os.ReadDir(parentDir); len(entries) != 1 {
+		t.Errorf("Expected only the target in its parent directory, got %d entries", len(entries))
+	}
+}
+
+func TestExtract_RejectsEscapes(t *testing.T) {
+	skipUnlessLinux(t)
+	testCases := []struct {
+		name    string
+		headers []*tar.Header
+	}{
+		{"parent entry", []*tar.Header{{Name: "../escaped", Typeflag: tar.TypeReg}}},
+		{"nested parent entry", []*tar.Header{{Name: "./etc/../../escaped", Typeflag: tar.TypeReg}}},
+		{"absolute entry", []*tar.Header{{Name: "/escaped", Typeflag: tar.TypeReg}}},
+		{"escaping symlink", []*tar.Header{{Name: "./etc/link", Typeflag: tar.TypeSymlink, Linkname: "../../escaped"}}},
+		{"absolute hard link", []*tar.Header{{Name: "./passwd", Typeflag: tar.TypeLink, Linkname: "/etc/passwd"}}},
+		{"escaping hard link", []*tar.Header{{Name: "./passwd", Typeflag: tar.TypeLink, Linkname: "../escaped"}}},
+		{"entry below symlink", []*tar.Header{
+			{Name: "./link", Typeflag: tar.TypeSymlink, Linkname: "/tmp"},
+			{Name: "./link/escaped", Typeflag: tar.TypeReg},
+		}},
+		{"entry below relative symlink", []*tar.Header{
+			{Name: "./dir/", Typeflag: tar.TypeDir},
+			{Name: "./link", Typeflag: tar.TypeSymlink, Linkname: "dir"},
+			{Name: "./link/escaped", Typeflag: tar.TypeReg},
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			parentDir := t.TempDir()
+			target := filepath.Join(parentDir, "rootfs")
+			if err := os.MkdirAll(target, 0755); err != nil {
+				t.Fatalf("Failed to create target: %v", err)
+			}
+			if err := os.WriteFile(filepath.Join(target, "kept"), nil, 0644); err != nil {
+				t.Fatalf("Failed to create file: %v", err)
+			}
+
+			if err := Extract(makeArchive(t, tc.headers...), target, nil); err == nil {
+				t.Fatal("Expected an error, got nil")
+			}
+
+			if _, err := os.Stat(filepath.Join(target, "kept")); err != nil {
+				t.Errorf("Expected the target to be left as it was: %v", err)
+			}
+			if entries, _ := os.ReadDir(parentDir); len(entries) != 1 {
+				t.Errorf("Expected only the target in its parent directory, got %d entries", len(entries))
+			}
+			if _, err := os.Lstat(filepath.Join(parentDir, "escaped")); !os.IsNotExist(err) {
+				t.Errorf("Expected nothing to be written outside the target, got %v", err)
+			}
+		})
+	}
+}
+
+func TestExtract_AbsoluteSymlink(t *testing.T) {
+	skipUnlessLinux(t)
+	target := filepath.Join(t.TempDir(), "rootfs")
+
+	archive := makeArchive(t,
+		&tar.Header{Name: "./etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "./etc/localtime", Typeflag: tar.TypeSymlink, Linkname: "/usr/share/zoneinfo/UTC"},
+	)
+	if err := Extract(archive, target, nil); err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+	if link, err := os.Readlink(filepath.Join(target, "etc", "localtime")); err != nil || link != "/usr/share/zoneinfo/UTC" {
+		t.Errorf("Expected the absolute symlink to be kept, got %q (%v)", link, err)
+	}
+}
+
+func TestEntryPath(t *testing.T) {
+	testCases := []struct {
+		name     string
+		expected string
+		wantErr  bool
+	}{
+		{"./", ".", false},
+		{"./etc/hostname", "etc/hostname", false},
+		{"usr/bin/", "usr/bin", false},
+		{"", "", true},
+		{"/etc/passwd", "", true},
+		{"../etc", "", true},
+		{"./a/../b", "", true},
+	}
+
+	for _, tc := range testCases {
+		got, err := entryPath(tc.name)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("entryPath(%q): expected error %v, got %v", tc.name, tc.wantErr, err)
+			continue
+		}
+		if got != tc.expected {
+			t.Errorf("entryPath(%q): expected %q, got %q", tc.name, tc.expected, got)
+		}
+	}
+}
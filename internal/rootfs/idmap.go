@@ -0,0 +1,250 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package rootfs
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// IDMapping maps a range of container IDs to host IDs, like an lxc.idmap
+// entry.
+type IDMapping struct {
+	Type      byte // 'u' for user IDs, 'g' for group IDs, or 'b' for both
+	Container uint32
+	Host      uint32
+	Count     uint32
+}
+
+// IDMap maps the user and group IDs of a container to host IDs. Archives
+// always hold container IDs: they are shifted to host IDs on extraction,
+// and back to container IDs when archiving. A nil IDMap maps each ID to
+// itself.
+type IDMap []IDMapping
+
+// ParseIDMap parses LXC-style ID mappings, such as "u 0 100000 65536" or
+// "lxc.idmap = g 0 100000 65536". Both user and group IDs must be mapped.
+func ParseIDMap(specs []string) (IDMap, error) {
+	var idMap IDMap
+	for _, spec := range specs {
+		fields := strings.Fields(spec)
+		if len(fields) == 6 && fields[0] == "lxc.idmap" && fields[1] == "=" {
+			fields = fields[2:]
+		}
+		if len(fields) != 4 || len(fields[0]) != 1 || !strings.Contains("ugb", fields[0]) {
+			return nil, fmt.Errorf("invalid ID mapping %q, expected '<u|g|b> <container ID> <host ID> <count>'", spec)
+		}
+
+		var values [3]uint32
+		for i, field := range fields[1:] {
+			value, err := strconv.ParseUint(field, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ID mapping %q: %w", spec, err)
+			}
+			values[i] = uint32(value)
+		}
+		mapping := IDMapping{Type: fields[0][0], Container: values[0], Host: values[1], Count: values[2]}
+		if mapping.Count == 0 {
+			return nil, fmt.Errorf("invalid ID mapping %q: count must not be zero", spec)
+		}
+		if uint64(mapping.Container)+uint64(mapping.Count) > 1<<32 || uint64(mapping.Host)+uint64(mapping.Count) > 1<<32 {
+			return nil, fmt.Errorf("invalid ID mapping %q: range exceeds the largest ID", spec)
+		}
+		for _, other := range idMap {
+			if !sharesType(mapping, other) {
+				continue
+			}
+			if overlaps(mapping.Container, other.Container, mapping.Count, other.Count) || overlaps(mapping.Host, other.Host, mapping.Count, other.Count) {
+				return nil, fmt.Errorf("ID mapping %q overlaps another mapping", spec)
+			}
+		}
+		idMap = append(idMap, mapping)
+	}
+
+	if len(idMap) > 0 {
+		for _, kind := range []byte{'u', 'g'} {
+			if !idMap.has(kind) {
+				return nil, fmt.Errorf("ID map has no %s ID mappings", kindName(kind))
+			}
+		}
+	}
+	return idMap, nil
+}
+
+func sharesType(a IDMapping, b IDMapping) bool {
+	return a.Type == b.Type || a.Type == 'b' || b.Type == 'b'
+}
+
+func overlaps(a uint32, b uint32, aCount uint32, bCount uint32) bool {
+	return uint64(a) < uint64(b)+uint64(bCount) && uint64(b) < uint64(a)+uint64(aCount)
+}
+
+func kindName(kind byte) string {
+	if kind == 'u' {
+		return "user"
+	}
+	return "group"
+}
+
+func (m IDMap) has(kind byte) bool {
+	for _, mapping := range m {
+		if mapping.Type == kind || mapping.Type == 'b' {
+			return true
+		}
+	}
+	return false
+}
+
+// Maps a user ('u') or group ('g') ID to the host, or back to the container.
+func (m IDMap) mapID(kind byte, id int, toHost bool) (int, error) {
+	if m == nil {
+		return id, nil
+	}
+	for _, mapping := range m {
+		if mapping.Type != kind && mapping.Type != 'b' {
+			continue
+		}
+		from, to := mapping.Container, mapping.Host
+		if !toHost {
+			from, to = to, from
+		}
+		if id >= int(from) && int64(id) < int64(from)+int64(mapping.Count) {
+			return int(to) + id - int(from), nil
+		}
+	}
+
+	side := "container"
+	if !toHost {
+		side = "host"
+	}
+	return 0, fmt.Errorf("%s %s ID %d is not in the ID map", side, kindName(kind), id)
+}
+
+const (
+	aclAccessXattr  = "system.posix_acl_access"
+	aclDefaultXattr = "system.posix_acl_default"
+	capabilityXattr = "security.capability"
+
+	aclVersion   = 2
+	aclUser      = 0x02
+	aclGroup     = 0x08
+	aclEntrySize = 8
+
+	capRevisionMask = 0xff000000
+	capRevision2    = 0x02000000
+	capRevision3    = 0x03000000
+	capSize2        = 20
+	capSize3        = 24
+)
+
+// Maps the owner of an entry, and the IDs held in its POSIX ACLs and file
+// capabilities, to the host or back to the container.
+func (m IDMap) shiftHeader(hdr *tar.Header, toHost bool) error {
+	if m == nil {
+		return nil
+	}
+	var err error
+	if hdr.Uid, err = m.mapID('u', hdr.Uid, toHost); err != nil {
+		return err
+	}
+	if hdr.Gid, err = m.mapID('g', hdr.Gid, toHost); err != nil {
+		return err
+	}
+
+	for key, value := range hdr.PAXRecords {
+		switch strings.TrimPrefix(key, xattrRecordPrefix) {
+		case aclAccessXattr, aclDefaultXattr:
+			value, err = m.shiftACL(value, toHost)
+		case capabilityXattr:
+			value, err = m.shiftCapability(value, toHost)
+		default:
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to map %s: %w", strings.TrimPrefix(key, xattrRecordPrefix), err)
+		}
+		hdr.PAXRecords[key] = value
+	}
+	return nil
+}
+
+// Maps the named user and group entries of a POSIX ACL, stored as a
+// little-endian version followed by (tag, permissions, ID) entries.
+func (m IDMap) shiftACL(value string, toHost bool) (string, error) {
+	acl := []byte(value)
+	if len(acl) < 4 || (len(acl)-4)%aclEntrySize != 0 || binary.LittleEndian.Uint32(acl) != aclVersion {
+		return "", fmt.Errorf("unsupported ACL of %d bytes", len(acl))
+	}
+	for entry := acl[4:]; len(entry) > 0; entry = entry[aclEntrySize:] {
+		var kind byte
+		switch binary.LittleEndian.Uint16(entry) {
+		case aclUser:
+			kind = 'u'
+		case aclGroup:
+			kind = 'g'
+		default:
+			continue // Owner, group owner, mask and other entries hold no ID
+		}
+		id, err := m.mapID(kind, int(binary.LittleEndian.Uint32(entry[4:])), toHost)
+		if err != nil {
+			return "", err
+		}
+		binary.LittleEndian.PutUint32(entry[4:], uint32(id))
+	}
+	return string(acl), nil
+}
+
+// Maps the root ID of file capabilities. Revision 2 capabilities apply to
+// the host root, so capabilities of a container's root are stored as
+// revision 3 with the host ID of the container's root. They are stored as
+// revision 2 again in archives, which hold container IDs.
+func (m IDMap) shiftCapability(value string, toHost bool) (string, error) {
+	capData := []byte(value)
+	if len(capData) < 4 {
+		return "", fmt.Errorf("unsupported capabilities of %d bytes", len(capData))
+	}
+	magic := binary.LittleEndian.Uint32(capData)
+	flags := magic &^ capRevisionMask
+
+	var rootID int
+	switch {
+	case magic&capRevisionMask == capRevision2 && len(capData) == capSize2:
+		rootID = 0
+	case magic&capRevisionMask == capRevision3 && len(capData) == capSize3:
+		rootID = int(binary.LittleEndian.Uint32(capData[capSize2:]))
+	default:
+		return value, nil // Revision 1 capabilities hold no root ID
+	}
+
+	rootID, err := m.mapID('u', rootID, toHost)
+	if err != nil {
+		return "", err
+	}
+	if rootID == 0 {
+		shifted := make([]byte, capSize2)
+		copy(shifted, capData)
+		binary.LittleEndian.PutUint32(shifted, capRevision2|flags)
+		return string(shifted), nil
+	}
+	shifted := make([]byte, capSize3)
+	copy(shifted, capData[:capSize2])
+	binary.LittleEndian.PutUint32(shifted, capRevision3|flags)
+	binary.LittleEndian.PutUint32(shifted[capSize2:], uint32(rootID))
+	return string(shifted), nil
+}
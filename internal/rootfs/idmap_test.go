@@ -0,0 +1,168 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package rootfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+var testIDMap = IDMap{
+	{Type: 'u', Container: 0, Host: 100000, Count: 65536},
+	{Type: 'g', Container: 0, Host: 200000, Count: 65536},
+}
+
+func TestParseIDMap(t *testing.T) {
+	idMap, err := ParseIDMap([]string{"u 0 100000 65536", "lxc.idmap = g 0 200000 65536"})
+	if err != nil {
+		t.Fatalf("ParseIDMap failed: %v", err)
+	}
+	if len(idMap) != 2 || idMap[0] != testIDMap[0] || idMap[1] != testIDMap[1] {
+		t.Errorf("Expected %+v, got %+v", testIDMap, idMap)
+	}
+
+	if idMap, err := ParseIDMap(nil); err != nil || idMap != nil {
+		t.Errorf("Expected a nil map for no mappings, got %+v (%v)", idMap, err)
+	}
+
+	for _, specs := range [][]string{
+		{"u 0 100000"},
+		{"x 0 100000 65536", "g 0 100000 65536"},
+		{"u 0 100000 0", "g 0 100000 65536"},
+		{"u 0 100000 -1", "g 0 100000 65536"},
+		{"u 0 4294967295 2", "g 0 100000 65536"},
+		{"u 0 100000 65536"},
+		{"b 0 100000 65536", "u 1000 300000 1"},
+		{"u 0 100000 65536", "u 65536 100000 1", "g 0 100000 65536"},
+	} {
+		if _, err := ParseIDMap(specs); err == nil {
+			t.Errorf("Expected an error for %q", specs)
+		}
+	}
+}
+
+func TestIDMap_MapID(t *testing.T) {
+	if id, err := testIDMap.mapID('u', 1000, true); err != nil || id != 101000 {
+		t.Errorf("Expected user 1000 to map to 101000, got %d (%v)", id, err)
+	}
+	if id, err := testIDMap.mapID('g', 200005, false); err != nil || id != 5 {
+		t.Errorf("Expected host group 200005 to map back to 5, got %d (%v)", id, err)
+	}
+	if _, err := testIDMap.mapID('u', 65536, true); err == nil {
+		t.Error("Expected an error for an unmapped ID")
+	}
+	if id, err := IDMap(nil).mapID('u', 42, true); err != nil || id != 42 {
+		t.Errorf("Expected a nil map to keep IDs, got %d (%v)", id, err)
+	}
+}
+
+func makeACL(entries ...[3]uint32) string {
+	acl := binary.LittleEndian.AppendUint32(nil, aclVersion)
+	for _, entry := range entries {
+		acl = binary.LittleEndian.AppendUint16(acl, uint16(entry[0]))
+		acl = binary.LittleEndian.AppendUint16(acl, uint16(entry[1]))
+		acl = binary.LittleEndian.AppendUint32(acl, entry[2])
+	}
+	return string(acl)
+}
+
+func TestIDMap_ShiftACL(t *testing.T) {
+	const userObj, other, undefinedID = 0x01, 0x20, 0xffffffff
+	acl := makeACL([3]uint32{userObj, 6, undefinedID}, [3]uint32{aclUser, 4, 1000}, [3]uint32{aclGroup, 4, 50}, [3]uint32{other, 0, undefinedID})
+	expected := makeACL([3]uint32{userObj, 6, undefinedID}, [3]uint32{aclUser, 4, 101000}, [3]uint32{aclGroup, 4, 200050}, [3]uint32{other, 0, undefinedID})
+
+	shifted, err := testIDMap.shiftACL(acl, true)
+	if err != nil || shifted != expected {
+		t.Fatalf("Expected shifted ACL %x, got %x (%v)", expected, shifted, err)
+	}
+	if unshifted, err := testIDMap.shiftACL(shifted, false); err != nil || unshifted != acl {
+		t.Errorf("Expected the ACL to map back to %x, got %x (%v)", acl, unshifted, err)
+	}
+	if _, err := testIDMap.shiftACL("bad", true); err == nil {
+		t.Error("Expected an error for a malformed ACL")
+	}
+}
+
+func TestIDMap_ShiftCapability(t *testing.T) {
+	// cap_net_raw, effective
+	v2 := binary.LittleEndian.AppendUint32(nil, capRevision2|1)
+	v2 = binary.LittleEndian.AppendUint32(v2, 1<<13)
+	v2 = append(v2, make([]byte, capSize2-len(v2))...)
+
+	shifted, err := testIDMap.shiftCapability(string(v2), true)
+	if err != nil || len(shifted) != capSize3 {
+		t.Fatalf("Expected revision 3 capabilities, got %x (%v)", shifted, err)
+	}
+	if magic := binary.LittleEndian.Uint32([]byte(shifted)); magic != capRevision3|1 {
+		t.Errorf("Expected magic %#x, got %#x", capRevision3|1, magic)
+	}
+	if rootID := binary.LittleEndian.Uint32([]byte(shifted[capSize2:])); rootID != 100000 {
+		t.Errorf("Expected root ID 100000, got %d", rootID)
+	}
+	if shifted[4:capSize2] != string(v2[4:]) {
+		t.Error("Expected the capability sets to be kept")
+	}
+
+	if unshifted, err := testIDMap.shiftCapability(shifted, false); err != nil || unshifted != string(v2) {
+		t.Errorf("Expected the capabilities to map back to %x, got %x (%v)", v2, unshifted, err)
+	}
+}
+
+func TestExtract_IDMap(t *testing.T) {
+	skipUnlessLinux(t)
+	if os.Geteuid() != 0 {
+		t.Skip("Shifting owners requires root")
+	}
+	target := filepath.Join(t.TempDir(), "rootfs")
+
+	archive := makeArchive(t,
+		&tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "./file", Typeflag: tar.TypeReg, Uid: 1000, Gid: 50},
+	)
+	if err := Extract(archive, target, testIDMap); err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+
+	for name, expected := range map[string][2]uint32{".": {100000, 200000}, "file": {101000, 200050}} {
+		info, err := os.Lstat(filepath.Join(target, name))
+		if err != nil {
+			t.Fatalf("Failed to stat %s: %v", name, err)
+		}
+		stat := info.Sys().(*syscall.Stat_t)
+		if stat.Uid != expected[0] || stat.Gid != expected[1] {
+			t.Errorf("Expected %s to be owned by %d:%d, got %d:%d", name, expected[0], expected[1], stat.Uid, stat.Gid)
+		}
+	}
+
+	// Archiving with the same map gives back the container IDs
+	var buf bytes.Buffer
+	if err := Archive(target, &buf, testIDMap); err != nil {
+		t.Fatalf("Archive failed: %v", err)
+	}
+	headers, _ := readArchive(t, buf.Bytes())
+	if hdr := headers["./file"]; hdr == nil || hdr.Uid != 1000 || hdr.Gid != 50 {
+		t.Errorf("Expected ./file to be archived as 1000:50, got %+v", hdr)
+	}
+
+	if err := Extract(makeArchive(t, &tar.Header{Name: "./file", Typeflag: tar.TypeReg, Uid: 70000}), target, testIDMap); err == nil {
+		t.Error("Expected an error for an owner outside the ID map")
+	}
+}
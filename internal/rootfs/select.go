@@ -0,0 +1,126 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package rootfs
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/PextraCloud/pxitool/pkg/log"
+)
+
+// MatchFunc reports whether a path of the rootfs, such as "etc/hostname",
+// is selected.
+type MatchFunc func(name string) bool
+
+// MatchPatterns returns a MatchFunc selecting the paths that match any of
+// the glob patterns, along with everything below matching directories.
+// Patterns are relative to the rootfs, and a leading "/" is ignored.
+func MatchPatterns(patterns []string) (MatchFunc, error) {
+	cleaned := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		pattern = path.Clean(strings.TrimLeft(pattern, "/"))
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		cleaned = append(cleaned, pattern)
+	}
+
+	return func(name string) bool {
+		for candidate := name; candidate != "."; candidate = path.Dir(candidate) {
+			for _, pattern := range cleaned {
+				if matched, _ := path.Match(pattern, candidate); matched {
+					return true
+				}
+			}
+		}
+		return false
+	}, nil
+}
+
+// ExtractMatching extracts the entries of the tar archive read from r that
+// match into dir, which is created if needed, and returns how many were
+// extracted. Existing files are replaced, and the confinement rules of
+// Extract apply. Hard links to entries that do not match are skipped with
+// a warning, as their data is archived with the entry they link to.
+func ExtractMatching(r io.Reader, dir string, match MatchFunc) (int, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, fmt.Errorf("failed to create directory '%s': %w", dir, err)
+	}
+	return extractEntries(r, dir, nil, match)
+}
+
+// WriteFile writes the contents of the regular file at name, such as
+// "etc/hostname", in the tar archive read from r to w. Reading stops once
+// the file is found.
+func WriteFile(r io.Reader, name string, w io.Writer) error {
+	name = path.Clean(strings.TrimLeft(name, "/"))
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("%s was not found in the rootfs", name)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read rootfs archive: %w", err)
+		}
+		if entryName, err := entryPath(hdr.Name); err != nil || entryName != name {
+			continue
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			if _, err := io.Copy(w, tr); err != nil {
+				return fmt.Errorf("failed to write %s: %w", name, err)
+			}
+			return nil
+		case tar.TypeSymlink:
+			return fmt.Errorf("%s is a symlink to %s", name, hdr.Linkname)
+		case tar.TypeLink:
+			return fmt.Errorf("%s is a hard link to %s, which must be given instead", name, strings.TrimPrefix(hdr.Linkname, "./"))
+		default:
+			return fmt.Errorf("%s is not a regular file", name)
+		}
+	}
+}
+
+// Walk calls fn with the path relative to the rootfs, such as
+// "etc/hostname", and the header of each entry of the tar archive read
+// from r. Entries with invalid names are skipped.
+func Walk(r io.Reader, fn func(name string, hdr *tar.Header) error) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read rootfs archive: %w", err)
+		}
+		name, err := entryPath(hdr.Name)
+		if err != nil {
+			log.Warn("Skipping entry: %v", err)
+			continue
+		}
+		if err := fn(name, hdr); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package rootfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatchPatterns(t *testing.T) {
+	match, err := MatchPatterns([]string{"/etc/host*", "var/log"})
+	if err != nil {
+		t.Fatalf("MatchPatterns failed: %v", err)
+	}
+	for name, expected := range map[string]bool{
+		"etc/hostname":     true,
+		"etc/hosts":        true,
+		"etc/passwd":       false,
+		"etc":              false,
+		"var/log":          true,
+		"var/log/messages": true,
+		"var/lib":          false,
+	} {
+		if match(name) != expected {
+			t.Errorf("match(%q): expected %v", name, expected)
+		}
+	}
+
+	if _, err := MatchPatterns([]string{"etc/["}); err == nil {
+		t.Error("Expected an error for an invalid pattern")
+	}
+}
+
+func TestExtractMatching(t *testing.T) {
+	skipUnlessLinux(t)
+	dir := filepath.Join(t.TempDir(), "out")
+	archive := makeArchive(t,
+		&tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "./etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "./etc/hostname", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "./etc/passwd", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "./etc/hostname.hard", Typeflag: tar.TypeLink, Linkname: "./etc/hostname"},
+		&tar.Header{Name: "./etc/passwd.hard", Typeflag: tar.TypeLink, Linkname: "./etc/passwd"},
+	)
+	match, _ := MatchPatterns([]string{"etc/hostname*", "etc/passwd.hard"})
+
+	// The hard link to passwd is skipped, as passwd itself is not extracted
+	count, err := ExtractMatching(archive, dir, match)
+	if err != nil || count != 2 {
+		t.Fatalf("Expected 2 extracted entries, got %d (%v)", count, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "etc", "hostname.hard")); err != nil || string(data) != "data" {
+		t.Errorf("Expected the hard link to hostname to be extracted, got %q (%v)", data, err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "etc", "passwd.hard")); !os.IsNotExist(err) {
+		t.Errorf("Expected the hard link to passwd to be skipped, got %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "etc", "hostname")); err != nil || string(data) != "data" {
+		t.Errorf("Expected hostname to be extracted, got %q (%v)", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "etc", "passwd")); !os.IsNotExist(err) {
+		t.Errorf("Expected passwd to be left out, got %v", err)
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	headers := func() []*tar.Header {
+		return []*tar.Header{
+			{Name: "./etc/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "./etc/hostname", Typeflag: tar.TypeReg},
+			{Name: "./etc/hostname.link", Typeflag: tar.TypeSymlink, Linkname: "hostname"},
+			{Name: "./etc/hostname.hard", Typeflag: tar.TypeLink, Linkname: "./etc/hostname"},
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := WriteFile(makeArchive(t, headers()...), "/etc/hostname", &buf); err != nil || buf.String() != "data" {
+		t.Errorf("Expected the file contents, got %q (%v)", buf.String(), err)
+	}
+	for _, name := range []string{"etc", "etc/hostname.link", "etc/hostname.hard", "etc/missing"} {
+		if err := WriteFile(makeArchive(t, headers()...), name, &bytes.Buffer{}); err == nil {
+			t.Errorf("Expected an error for %s", name)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package rootfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// A PAX 1.0 sparse file, as written by GNU tar and read by archive/tar, is
+// a regular file entry whose data is a block-padded map of its data extents
+// ("count\noffset\nlength\n...") followed by the extents. Its PAX records
+// hold the real name and size. archive/tar cannot write these, so their
+// headers are encoded here.
+
+const (
+	blockSize       = 512
+	maxOctalSize    = 1<<33 - 1 // Largest value of an 11 digit octal field
+	maxOctalID      = 1<<21 - 1 // Largest value of a 7 digit octal field
+	sparseMapPrefix = "GNUSparseFile.0"
+)
+
+type extent struct {
+	offset int64
+	length int64
+}
+
+// Returns whether a file has holes worth storing as a sparse file.
+func isSparse(extents []extent, size int64) bool {
+	var dataSize int64
+	for _, e := range extents {
+		dataSize += e.length
+	}
+	return size-dataSize >= blockSize
+}
+
+func (a *archiver) addSparseFile(file io.ReaderAt, hdr *tar.Header, extents []extent) error {
+	// GNU tar ends the map of files with a trailing hole with an empty extent
+	if len(extents) == 0 || extents[len(extents)-1].offset+extents[len(extents)-1].length < hdr.Size {
+		extents = append(extents, extent{offset: hdr.Size})
+	}
+
+	// The data map is written as the start of the entry data
+	var sparseMap bytes.Buffer
+	fmt.Fprintf(&sparseMap, "%d\n", len(extents))
+	dataSize := int64(0)
+	for _, e := range extents {
+		fmt.Fprintf(&sparseMap, "%d\n%d\n", e.offset, e.length)
+		dataSize += e.length
+	}
+	sparseMap.Write(make([]byte, padding(int64(sparseMap.Len()))))
+	entrySize := int64(sparseMap.Len()) + dataSize
+
+	records := map[string]string{
+		"GNU.sparse.major":    "1",
+		"GNU.sparse.minor":    "0",
+		"GNU.sparse.name":     hdr.Name,
+		"GNU.sparse.realsize": strconv.FormatInt(hdr.Size, 10),
+		"mtime":               formatPAXTime(hdr.ModTime.Unix(), hdr.ModTime.Nanosecond()),
+	}
+	for key, value := range hdr.PAXRecords {
+		records[key] = value
+	}
+	if entrySize > maxOctalSize {
+		records["size"] = strconv.FormatInt(entrySize, 10)
+	}
+	if hdr.Uid > maxOctalID {
+		records["uid"] = strconv.Itoa(hdr.Uid)
+	}
+	if hdr.Gid > maxOctalID {
+		records["gid"] = strconv.Itoa(hdr.Gid)
+	}
+
+	// Pad the previous entry, then write the headers directly
+	if err := a.tw.Flush(); err != nil {
+		return err
+	}
+	dir, base := path.Split(hdr.Name)
+	entryName := path.Join(dir, sparseMapPrefix, base)
+
+	paxData := encodePAXRecords(records)
+	paxHeader := rawHeader{name: path.Join(dir, "PaxHeaders.0", base), typeflag: tar.TypeXHeader, mode: 0644, size: int64(len(paxData))}
+	fileHeader := rawHeader{name: entryName, typeflag: tar.TypeReg, mode: hdr.Mode, uid: hdr.Uid, gid: hdr.Gid, size: entrySize, mtime: hdr.ModTime.Unix()}
+	if err := writeBlocks(a.w, paxHeader.encode(), paxData); err != nil {
+		return err
+	}
+	if err := writeBlocks(a.w, fileHeader.encode(), sparseMap.Bytes()); err != nil {
+		return err
+	}
+
+	for _, e := range extents {
+		if _, err := io.Copy(a.w, io.NewSectionReader(file, e.offset, e.length)); err != nil {
+			return fmt.Errorf("failed to archive %s: %w", hdr.Name, err)
+		}
+	}
+	_, err := a.w.Write(make([]byte, padding(dataSize)))
+	return err
+}
+
+func padding(size int64) int64 {
+	return -size & (blockSize - 1)
+}
+
+func writeBlocks(w io.Writer, chunks ...[]byte) error {
+	for _, chunk := range chunks {
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+		if _, err := w.Write(make([]byte, padding(int64(len(chunk))))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatPAXTime(sec int64, nsec int) string {
+	if nsec == 0 {
+		return strconv.FormatInt(sec, 10)
+	}
+	return strings.TrimRight(fmt.Sprintf("%d.%09d", sec, nsec), "0")
+}
+
+// Encodes PAX records in sorted order. The length of each record includes
+// the length field itself.
+func encodePAXRecords(records map[string]string) []byte {
+	var buf bytes.Buffer
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		record := " " + key + "=" + records[key] + "\n"
+		size := len(record)
+		for size < len(strconv.Itoa(size))+len(record) {
+			size = len(strconv.Itoa(size)) + len(record)
+		}
+		buf.WriteString(strconv.Itoa(size) + record)
+	}
+	return buf.Bytes()
+}
+
+// A ustar header, with values too large for it given in PAX records.
+type rawHeader struct {
+	name     string
+	typeflag byte
+	mode     int64
+	uid, gid int
+	size     int64
+	mtime    int64
+}
+
+func (h rawHeader) encode() []byte {
+	block := make([]byte, blockSize)
+	copy(block[0:100], h.name) // Truncated names are overridden by PAX records
+	formatOctal(block[100:108], h.mode&07777)
+	formatOctal(block[108:116], int64(min(h.uid, maxOctalID)))
+	formatOctal(block[116:124], int64(min(h.gid, maxOctalID)))
+	formatOctal(block[124:136], min(h.size, maxOctalSize))
+	formatOctal(block[136:148], max(h.mtime, 0))
+	block[156] = h.typeflag
+	copy(block[257:265], "ustar\x0000")
+
+	// The checksum is computed with its own field set to spaces
+	copy(block[148:156], "        ")
+	var checksum int64
+	for _, b := range block {
+		checksum += int64(b)
+	}
+	copy(block[148:156], fmt.Sprintf("%06o\x00 ", checksum))
+	return block
+}
+
+func formatOctal(field []byte, value int64) {
+	s := strconv.FormatInt(value, 8)
+	copy(field, strings.Repeat("0", len(field)-1-len(s))+s)
+}
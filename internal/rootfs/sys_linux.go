@@ -0,0 +1,111 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package rootfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Identifies a file across its hard links.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// Returns the identity of a file, and whether it has multiple links.
+func getFileID(info os.FileInfo) (fileID, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(stat.Dev), ino: stat.Ino}, stat.Nlink > 1
+}
+
+// Returns the extended attributes of a file, without following symlinks.
+func listXattrs(filePath string) (map[string]string, error) {
+	size, err := unix.Llistxattr(filePath, nil)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(filePath, buf); err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string]string)
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		value, err := getXattr(filePath, string(name))
+		if err != nil {
+			return nil, err
+		}
+		xattrs[string(name)] = value
+	}
+	return xattrs, nil
+}
+
+func getXattr(filePath string, name string) (string, error) {
+	size, err := unix.Lgetxattr(filePath, name, nil)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Lgetxattr(filePath, name, buf); err != nil {
+		return "", err
+	}
+	return string(buf[:size]), nil
+}
+
+// Returns the ranges of a file that hold data, using SEEK_DATA and
+// SEEK_HOLE. Filesystems without hole support report a single range.
+func getDataExtents(file *os.File, size int64) ([]extent, error) {
+	fd := int(file.Fd())
+	var extents []extent
+	for offset := int64(0); offset < size; {
+		start, err := unix.Seek(fd, offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			break // Only a hole remains
+		}
+		if err != nil {
+			return []extent{{0, size}}, nil
+		}
+		end, err := unix.Seek(fd, start, unix.SEEK_HOLE)
+		if err != nil {
+			return []extent{{0, size}}, nil
+		}
+		end = min(end, size)
+		extents = append(extents, extent{offset: start, length: end - start})
+		offset = end
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return extents, nil
+}
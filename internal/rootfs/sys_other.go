@@ -0,0 +1,41 @@
+//go:build !linux
+
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package rootfs
+
+import "os"
+
+type fileID struct{}
+
+// Hard links are only detected on Linux, and archived as separate files
+// elsewhere.
+func getFileID(info os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
+
+// Extended attributes are only archived on Linux.
+func listXattrs(filePath string) (map[string]string, error) {
+	return nil, nil
+}
+
+// Holes are only detected on Linux.
+func getDataExtents(file *os.File, size int64) ([]extent, error) {
+	if size == 0 {
+		return nil, nil
+	}
+	return []extent{{0, size}}, nil
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Package servepxi serves the volumes of a PXI file over NBD.
+package servepxi
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/PextraCloud/pxitool/internal/nbd"
+	"github.com/PextraCloud/pxitool/internal/readpxi"
+	"github.com/PextraCloud/pxitool/pkg/log"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumetype"
+)
+
+// Serves the disk of a volume read-only over NBD on a unix socket at
+// socketPath, until ctx is done. The volume is read from the image as
+// clients request it, so it can be attached immediately.
+func ServeNBD(ctx context.Context, inputFileName string, volumeID string, socketPath string) error {
+	volumes, err := readpxi.OpenVolumes(inputFileName)
+	if err != nil {
+		return err
+	}
+	defer volumes.Close()
+
+	svolData, err := volumes.Find(volumeID)
+	if err != nil {
+		return err
+	}
+	if svolData.VolumeType == volumetype.LXC_ {
+		return fmt.Errorf("volume %s is a rootfs archive, only disk volumes can be served", volumeID)
+	}
+	disk, size, err := volumes.Disk()
+	if err != nil {
+		return err
+	}
+
+	// The socket file is removed when the listener is closed
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", socketPath, err)
+	}
+	defer listener.Close()
+	stop := context.AfterFunc(ctx, func() {
+		listener.Close()
+	})
+	defer stop()
+
+	log.Info("Serving volume %s (%d bytes) read-only at nbd+unix:///%s?socket=%s", volumeID, size, volumeID, socketPath)
+	if err := nbd.NewServer(volumeID, disk, size).Serve(listener); err != nil {
+		return err
+	}
+	log.Info("Stopped serving volume %s", volumeID)
+	return nil
+}
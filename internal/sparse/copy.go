@@ -0,0 +1,119 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package sparse
+
+import (
+	"fmt"
+	"io"
+)
+
+// Expand writes the whole volume of src to dst, with zeroes between the
+// extents. It is for consumers that cannot seek, such as "rbd import",
+// and returns the number of bytes written.
+func Expand(dst io.Writer, src *Reader) (int64, error) {
+	var pos int64
+	for {
+		extent, err := src.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return pos, err
+		}
+
+		if err := writeZeroes(dst, extent.Offset-pos); err != nil {
+			return pos, err
+		}
+		n, err := io.Copy(dst, src)
+		pos = extent.Offset + n
+		if err != nil {
+			return pos, fmt.Errorf("failed to write extent at offset %d: %w", extent.Offset, err)
+		}
+	}
+
+	if err := writeZeroes(dst, src.size-pos); err != nil {
+		return pos, err
+	}
+	return src.size, nil
+}
+
+func writeZeroes(w io.Writer, length int64) error {
+	for length > 0 {
+		n := min(length, int64(len(zeroBlock)))
+		if _, err := w.Write(zeroBlock[:n]); err != nil {
+			return fmt.Errorf("failed to write zeroes: %w", err)
+		}
+		length -= n
+	}
+	return nil
+}
+
+// CopyRaw writes raw volume data from src to dst, zeroing the ranges of
+// zeroed blocks instead of writing them. It returns the size of the volume.
+func CopyRaw(dst Target, src io.Reader) (int64, error) {
+	buf := make([]byte, maxExtentSize)
+	var pos int64
+	zeroStart := int64(-1) // Start of the pending zeroed range, if any
+	for {
+		n, readErr := io.ReadFull(src, buf)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return pos, readErr
+		}
+
+		for off := 0; off < n; {
+			// Find the run of blocks that are all zeroed, or all not
+			end := min(off+blockSize, n)
+			zero := IsZero(buf[off:end])
+			for end < n {
+				next := min(end+blockSize, n)
+				if IsZero(buf[end:next]) != zero {
+					break
+				}
+				end = next
+			}
+
+			runStart := pos + int64(off)
+			if zero {
+				if zeroStart < 0 {
+					zeroStart = runStart
+				}
+			} else {
+				if zeroStart >= 0 {
+					if err := dst.Zero(zeroStart, runStart-zeroStart); err != nil {
+						return pos, fmt.Errorf("failed to zero range at offset %d: %w", zeroStart, err)
+					}
+					zeroStart = -1
+				}
+				if _, err := dst.WriteAt(buf[off:end], runStart); err != nil {
+					return pos, fmt.Errorf("failed to write data at offset %d: %w", runStart, err)
+				}
+			}
+			off = end
+		}
+
+		pos += int64(n)
+		if readErr != nil {
+			break
+		}
+	}
+
+	if zeroStart >= 0 {
+		if err := dst.Zero(zeroStart, pos-zeroStart); err != nil {
+			return pos, fmt.Errorf("failed to zero range at offset %d: %w", zeroStart, err)
+		}
+	}
+	return pos, nil
+}
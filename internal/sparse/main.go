@@ -0,0 +1,89 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package sparse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// A sparse stream stores the non-zero extents of a volume:
+//
+//	"PXSP" | size (uint64)
+//	offset (uint64) | length (uint64) | data[length]   (repeated)
+//	size (uint64) | 0 (uint64)                         (terminator)
+//
+// Integers are big-endian, and extents are in increasing offset order.
+// Ranges not covered by an extent read as zeroes.
+var Signature = []byte{0x50, 0x58, 0x53, 0x50} // "PXSP"
+
+const (
+	HeaderSize       = 12              // Signature and size
+	extentHeaderSize = 16              // Offset and length
+	blockSize        = 4096            // Granularity of zero detection
+	maxExtentSize    = 4 * 1024 * 1024 // Extents are flushed once they reach this size
+)
+
+var zeroBlock = make([]byte, blockSize)
+
+// IsZero reports whether p holds only zeroes.
+func IsZero(p []byte) bool {
+	for len(p) > 0 {
+		n := min(len(p), blockSize)
+		if !bytes.Equal(p[:n], zeroBlock[:n]) {
+			return false
+		}
+		p = p[n:]
+	}
+	return true
+}
+
+// Extent is a range of a volume that holds data.
+type Extent struct {
+	Offset int64
+	Length int64
+}
+
+// Parses a sparse stream header, returning the size of the volume.
+func parseHeader(header []byte) (int64, error) {
+	if len(header) < HeaderSize || !bytes.Equal(header[:4], Signature) {
+		return 0, fmt.Errorf("invalid sparse stream signature")
+	}
+	size := binary.BigEndian.Uint64(header[4:HeaderSize])
+	if size > 1<<63-1 {
+		return 0, fmt.Errorf("invalid sparse stream size: %d", size)
+	}
+	return int64(size), nil
+}
+
+// Checks that an extent follows the previous one, which ended at end, and
+// lies within a volume of the given size.
+func checkExtent(offset, length, end, size int64) error {
+	if offset < end || length < 0 || offset > size-length {
+		return fmt.Errorf("invalid extent at offset %d with length %d", offset, length)
+	}
+	return nil
+}
+
+func writeExtentHeader(w io.Writer, offset, length int64) error {
+	var header [extentHeaderSize]byte
+	binary.BigEndian.PutUint64(header[0:8], uint64(offset))
+	binary.BigEndian.PutUint64(header[8:16], uint64(length))
+	_, err := w.Write(header[:])
+	return err
+}
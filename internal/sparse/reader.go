@@ -0,0 +1,153 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package sparse
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Reader decodes a sparse stream extent by extent.
+type Reader struct {
+	r         io.Reader
+	size      int64
+	end       int64 // End offset of the previous extent
+	remaining int64 // Unread data of the current extent
+	done      bool
+}
+
+// Reads the stream header and returns a reader positioned before the first extent.
+func NewReader(r io.Reader) (*Reader, error) {
+	header := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed to read sparse stream header: %w", err)
+	}
+	size, err := parseHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{r: r, size: size}, nil
+}
+
+// Returns the size of the volume in a sparse stream, without consuming it.
+func PeekSize(br *bufio.Reader) (int64, error) {
+	header, err := br.Peek(HeaderSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read sparse stream header: %w", err)
+	}
+	return parseHeader(header)
+}
+
+// Size returns the size of the volume.
+func (sr *Reader) Size() int64 {
+	return sr.size
+}
+
+// Next skips any unread data and advances to the next extent. It returns
+// io.EOF after the last extent.
+func (sr *Reader) Next() (Extent, error) {
+	if sr.done {
+		return Extent{}, io.EOF
+	}
+	if sr.remaining > 0 {
+		if _, err := io.CopyN(io.Discard, sr.r, sr.remaining); err != nil {
+			return Extent{}, fmt.Errorf("failed to skip extent data: %w", err)
+		}
+		sr.remaining = 0
+	}
+
+	var header [extentHeaderSize]byte
+	if _, err := io.ReadFull(sr.r, header[:]); err != nil {
+		return Extent{}, fmt.Errorf("failed to read extent header: %w", io.ErrUnexpectedEOF)
+	}
+	offset := int64(binary.BigEndian.Uint64(header[0:8]))
+	length := int64(binary.BigEndian.Uint64(header[8:16]))
+
+	if length == 0 {
+		if offset != sr.size {
+			return Extent{}, fmt.Errorf("invalid sparse stream terminator at offset %d, expected %d", offset, sr.size)
+		}
+		sr.done = true
+		return Extent{}, io.EOF
+	}
+	if err := checkExtent(offset, length, sr.end, sr.size); err != nil {
+		return Extent{}, err
+	}
+
+	sr.end = offset + length
+	sr.remaining = length
+	return Extent{Offset: offset, Length: length}, nil
+}
+
+// Read reads data of the current extent, returning io.EOF at its end.
+func (sr *Reader) Read(p []byte) (int, error) {
+	if sr.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > sr.remaining {
+		p = p[:sr.remaining]
+	}
+	n, err := sr.r.Read(p)
+	sr.remaining -= int64(n)
+	if err == io.EOF && sr.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Target receives the decoded data of a sparse stream.
+type Target interface {
+	io.WriterAt
+	// Zero makes the given range read as zeroes.
+	Zero(offset, length int64) error
+}
+
+// Copy writes each extent of src to dst at its offset, and zeroes the
+// ranges between them. It returns the number of data bytes written.
+func Copy(dst Target, src *Reader) (int64, error) {
+	var written, pos int64
+	buf := make([]byte, 1024*1024)
+	for {
+		extent, err := src.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return written, err
+		}
+
+		if extent.Offset > pos {
+			if err := dst.Zero(pos, extent.Offset-pos); err != nil {
+				return written, fmt.Errorf("failed to zero range at offset %d: %w", pos, err)
+			}
+		}
+		n, err := io.CopyBuffer(io.NewOffsetWriter(dst, extent.Offset), src, buf)
+		written += n
+		if err != nil {
+			return written, fmt.Errorf("failed to write extent at offset %d: %w", extent.Offset, err)
+		}
+		pos = extent.Offset + extent.Length
+	}
+
+	if src.size > pos {
+		if err := dst.Zero(pos, src.size-pos); err != nil {
+			return written, fmt.Errorf("failed to zero range at offset %d: %w", pos, err)
+		}
+	}
+	return written, nil
+}
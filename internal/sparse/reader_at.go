@@ -0,0 +1,128 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package sparse
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// ReaderAt reads the volume of a sparse stream at any offset, using an
+// index of its extents. It is safe for concurrent use if the underlying
+// reader is.
+type ReaderAt struct {
+	r       io.ReaderAt
+	size    int64
+	extents []indexedExtent
+}
+
+type indexedExtent struct {
+	Extent
+	data int64 // Offset of the extent data in the stream
+}
+
+// Indexes the extents of the sparse stream read from r. Only the headers
+// of the extents are read.
+func NewReaderAt(r io.ReaderAt) (*ReaderAt, error) {
+	header := make([]byte, HeaderSize)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, fmt.Errorf("failed to read sparse stream header: %w", err)
+	}
+	size, err := parseHeader(header)
+	if err != nil {
+		return nil, err
+	}
+
+	ra := &ReaderAt{r: r, size: size}
+	pos, end := int64(HeaderSize), int64(0)
+	var extentHeader [extentHeaderSize]byte
+	for {
+		if _, err := r.ReadAt(extentHeader[:], pos); err != nil {
+			return nil, fmt.Errorf("failed to read extent header: %w", io.ErrUnexpectedEOF)
+		}
+		offset := int64(binary.BigEndian.Uint64(extentHeader[0:8]))
+		length := int64(binary.BigEndian.Uint64(extentHeader[8:16]))
+		if length == 0 {
+			if offset != size {
+				return nil, fmt.Errorf("invalid sparse stream terminator at offset %d, expected %d", offset, size)
+			}
+			return ra, nil
+		}
+		if err := checkExtent(offset, length, end, size); err != nil {
+			return nil, err
+		}
+
+		pos += extentHeaderSize
+		ra.extents = append(ra.extents, indexedExtent{Extent: Extent{Offset: offset, Length: length}, data: pos})
+		pos += length
+		end = offset + length
+	}
+}
+
+// Size returns the size of the volume.
+func (ra *ReaderAt) Size() int64 {
+	return ra.size
+}
+
+// ReadAt implements io.ReaderAt for the volume. Ranges between extents
+// read as zeroes.
+func (ra *ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= ra.size {
+		return 0, io.EOF
+	}
+	var err error
+	if int64(len(p)) > ra.size-off {
+		p = p[:ra.size-off]
+		err = io.EOF
+	}
+
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		// The first extent ending after pos
+		i := sort.Search(len(ra.extents), func(i int) bool {
+			return ra.extents[i].Offset+ra.extents[i].Length > pos
+		})
+
+		if i == len(ra.extents) || ra.extents[i].Offset > pos {
+			gapEnd := ra.size
+			if i < len(ra.extents) {
+				gapEnd = ra.extents[i].Offset
+			}
+			chunk := p[n:min(int64(len(p)), int64(n)+gapEnd-pos)]
+			clear(chunk)
+			n += len(chunk)
+			continue
+		}
+
+		e := ra.extents[i]
+		chunk := p[n:min(int64(len(p)), int64(n)+e.Offset+e.Length-pos)]
+		if _, readErr := ra.r.ReadAt(chunk, e.data+pos-e.Offset); readErr != nil {
+			if readErr == io.EOF {
+				readErr = io.ErrUnexpectedEOF
+			}
+			return n, fmt.Errorf("failed to read extent at offset %d: %w", e.Offset, readErr)
+		}
+		n += len(chunk)
+	}
+	return n, err
+}
@@ -0,0 +1,250 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package sparse
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// memoryTarget is a Target backed by a byte slice.
+type memoryTarget struct {
+	data   []byte
+	zeroed int64
+}
+
+func (m *memoryTarget) WriteAt(p []byte, off int64) (int, error) {
+	return copy(m.data[off:], p), nil
+}
+
+func (m *memoryTarget) Zero(offset, length int64) error {
+	clear(m.data[offset : offset+length])
+	m.zeroed += length
+	return nil
+}
+
+func TestSparseRoundTrip(t *testing.T) {
+	volume := make([]byte, 3*1024*1024+100)
+	copy(volume[10:], "start of volume")
+	copy(volume[blockSize*5+7:], "unaligned data")
+	copy(volume[2*1024*1024:], bytes.Repeat([]byte{0xAB}, 3*blockSize))
+	copy(volume[len(volume)-4:], "tail")
+
+	var stream bytes.Buffer
+	writer, err := NewWriter(&stream, int64(len(volume)))
+	if err != nil {
+		t.Fatalf("NewWriter failed: %v", err)
+	}
+	// Write in uneven pieces to exercise block splitting
+	for rest := volume; len(rest) > 0; {
+		n := min(len(rest), 12345)
+		if _, err := writer.Write(rest[:n]); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		rest = rest[n:]
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	if stream.Len() > 8*blockSize {
+		t.Errorf("expected zeroed blocks to be left out, but stream is %d bytes", stream.Len())
+	}
+
+	reader, err := NewReader(&stream)
+	if err != nil {
+		t.Fatalf("NewReader failed: %v", err)
+	}
+	if reader.Size() != int64(len(volume)) {
+		t.Errorf("expected size %d, got %d", len(volume), reader.Size())
+	}
+
+	target := &memoryTarget{data: bytes.Repeat([]byte{0xFF}, len(volume))}
+	written, err := Copy(target, reader)
+	if err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+	if written+target.zeroed != int64(len(volume)) {
+		t.Errorf("expected %d bytes to be written or zeroed, got %d written and %d zeroed", len(volume), written, target.zeroed)
+	}
+	if !bytes.Equal(target.data, volume) {
+		t.Error("restored volume does not match original volume")
+	}
+}
+
+func testVolume() []byte {
+	volume := make([]byte, 9*1024*1024+100)
+	copy(volume[10:], "start of volume")
+	copy(volume[blockSize*5+7:], "unaligned data")
+	copy(volume[4*1024*1024-blockSize:], bytes.Repeat([]byte{0xAB}, 3*blockSize)) // Spans a read buffer
+	copy(volume[len(volume)-4:], "tail")
+	return volume
+}
+
+func TestExpand(t *testing.T) {
+	volume := testVolume()
+
+	var stream bytes.Buffer
+	writer, err := NewWriter(&stream, int64(len(volume)))
+	if err != nil {
+		t.Fatalf("NewWriter failed: %v", err)
+	}
+	if _, err := writer.Write(volume); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	reader, err := NewReader(&stream)
+	if err != nil {
+		t.Fatalf("NewReader failed: %v", err)
+	}
+	var expanded bytes.Buffer
+	n, err := Expand(&expanded, reader)
+	if err != nil {
+		t.Fatalf("Expand failed: %v", err)
+	}
+	if n != int64(len(volume)) || !bytes.Equal(expanded.Bytes(), volume) {
+		t.Errorf("expanded volume does not match original volume (%d bytes)", n)
+	}
+}
+
+func TestReaderAt(t *testing.T) {
+	volume := testVolume()
+
+	var stream bytes.Buffer
+	writer, err := NewWriter(&stream, int64(len(volume)))
+	if err != nil {
+		t.Fatalf("NewWriter failed: %v", err)
+	}
+	if _, err := writer.Write(volume); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	ra, err := NewReaderAt(bytes.NewReader(stream.Bytes()))
+	if err != nil {
+		t.Fatalf("NewReaderAt failed: %v", err)
+	}
+	if ra.Size() != int64(len(volume)) {
+		t.Errorf("expected size %d, got %d", len(volume), ra.Size())
+	}
+	read, err := io.ReadAll(io.NewSectionReader(ra, 0, ra.Size()))
+	if err != nil || !bytes.Equal(read, volume) {
+		t.Fatalf("read volume does not match original volume (%d bytes, %v)", len(read), err)
+	}
+
+	// Reads starting in a gap and ending in an extent, and the reverse
+	for _, off := range []int64{blockSize*5 - 100, 4*1024*1024 - blockSize - 10, 4*1024*1024 + 2*blockSize - 10} {
+		buf := make([]byte, 200)
+		if n, err := ra.ReadAt(buf, off); err != nil || n != len(buf) || !bytes.Equal(buf, volume[off:off+200]) {
+			t.Errorf("unexpected read at offset %d: %d bytes (%v)", off, n, err)
+		}
+	}
+	if n, err := ra.ReadAt(make([]byte, 10), int64(len(volume))-4); err != io.EOF || n != 4 {
+		t.Errorf("expected a short read at the end of the volume, got %d bytes (%v)", n, err)
+	}
+
+	if _, err := NewReaderAt(bytes.NewReader(stream.Bytes()[:stream.Len()-1])); err == nil {
+		t.Error("expected an error for a truncated stream")
+	}
+}
+
+func TestCopyRaw(t *testing.T) {
+	volume := testVolume()
+
+	target := &memoryTarget{data: bytes.Repeat([]byte{0xFF}, len(volume))}
+	size, err := CopyRaw(target, bytes.NewReader(volume))
+	if err != nil {
+		t.Fatalf("CopyRaw failed: %v", err)
+	}
+	if size != int64(len(volume)) {
+		t.Errorf("expected size %d, got %d", len(volume), size)
+	}
+	if !bytes.Equal(target.data, volume) {
+		t.Error("copied volume does not match original volume")
+	}
+	if target.zeroed < int64(len(volume))-8*blockSize {
+		t.Errorf("expected zeroed blocks to be zeroed instead of written, only %d bytes zeroed", target.zeroed)
+	}
+}
+
+func TestSparseWriter_Failures(t *testing.T) {
+	t.Run("write beyond size", func(t *testing.T) {
+		writer, err := NewWriter(io.Discard, 4)
+		if err != nil {
+			t.Fatalf("NewWriter failed: %v", err)
+		}
+		if _, err := writer.Write([]byte("too long")); err == nil {
+			t.Error("expected an error for a write beyond the volume size, but got nil")
+		}
+	})
+	t.Run("short volume", func(t *testing.T) {
+		writer, err := NewWriter(io.Discard, 8)
+		if err != nil {
+			t.Fatalf("NewWriter failed: %v", err)
+		}
+		if _, err := writer.Write([]byte("1234")); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err := writer.Close(); err == nil || !strings.Contains(err.Error(), "expected 8") {
+			t.Errorf("expected an error about the volume size, but got: %v", err)
+		}
+	})
+}
+
+func TestSparseReader_Failures(t *testing.T) {
+	// encode builds a stream from (offset, length) pairs, with zeroed extent data
+	encode := func(size int64, records ...int64) *bytes.Buffer {
+		var buf bytes.Buffer
+		if _, err := NewWriter(&buf, size); err != nil {
+			t.Fatalf("NewWriter failed: %v", err)
+		}
+		for i := 0; i < len(records); i += 2 {
+			writeExtentHeader(&buf, records[i], records[i+1])
+			buf.Write(make([]byte, records[i+1]))
+		}
+		return &buf
+	}
+
+	testCases := []struct {
+		name   string
+		stream *bytes.Buffer
+	}{
+		{"invalid signature", bytes.NewBufferString("NOPE00000000")},
+		{"extent beyond size", encode(16, 10, 10)},
+		{"overlapping extents", encode(32, 0, 8, 4, 8, 32, 0)},
+		{"bad terminator", encode(32, 0, 8, 16, 0)},
+		{"truncated stream", encode(32, 0, 8)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			reader, err := NewReader(tc.stream)
+			if err == nil {
+				_, err = Copy(&memoryTarget{data: make([]byte, reader.Size())}, reader)
+			}
+			if err == nil {
+				t.Error("expected an error for an invalid stream, but got nil")
+			}
+		})
+	}
+}
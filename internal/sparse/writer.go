@@ -0,0 +1,117 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package sparse
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Writer encodes sequentially written volume data as a sparse stream,
+// leaving out zeroed blocks.
+type Writer struct {
+	w           io.Writer
+	size        int64
+	offset      int64  // Volume offset of the next written byte
+	extentStart int64  // Volume offset of the pending extent
+	extent      []byte // Pending extent data
+}
+
+// Creates a writer for a volume of the given size, and writes the stream header.
+func NewWriter(w io.Writer, size int64) (*Writer, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("invalid volume size: %d", size)
+	}
+
+	header := make([]byte, HeaderSize)
+	copy(header, Signature)
+	binary.BigEndian.PutUint64(header[4:], uint64(size))
+	if _, err := w.Write(header); err != nil {
+		return nil, fmt.Errorf("failed to write sparse stream header: %w", err)
+	}
+
+	return &Writer{
+		w:      w,
+		size:   size,
+		extent: make([]byte, 0, maxExtentSize),
+	}, nil
+}
+
+// Write consumes the next len(p) bytes of the volume.
+func (sw *Writer) Write(p []byte) (int, error) {
+	if sw.offset+int64(len(p)) > sw.size {
+		return 0, fmt.Errorf("write of %d bytes at offset %d exceeds volume size %d", len(p), sw.offset, sw.size)
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// Split on block boundaries of the volume
+		n := min(len(p), blockSize-int(sw.offset%blockSize))
+		block := p[:n]
+
+		if IsZero(block) {
+			if err := sw.flush(); err != nil {
+				return written, err
+			}
+		} else {
+			if len(sw.extent) == 0 {
+				sw.extentStart = sw.offset
+			}
+			sw.extent = append(sw.extent, block...)
+			if len(sw.extent) >= maxExtentSize {
+				if err := sw.flush(); err != nil {
+					return written, err
+				}
+			}
+		}
+
+		sw.offset += int64(n)
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// flush writes the pending extent, if any
+func (sw *Writer) flush() error {
+	if len(sw.extent) == 0 {
+		return nil
+	}
+	if err := writeExtentHeader(sw.w, sw.extentStart, int64(len(sw.extent))); err != nil {
+		return fmt.Errorf("failed to write extent header: %w", err)
+	}
+	if _, err := sw.w.Write(sw.extent); err != nil {
+		return fmt.Errorf("failed to write extent data: %w", err)
+	}
+	sw.extent = sw.extent[:0]
+	return nil
+}
+
+// Close writes the pending extent and the stream terminator. The whole
+// volume must have been written.
+func (sw *Writer) Close() error {
+	if err := sw.flush(); err != nil {
+		return err
+	}
+	if sw.offset != sw.size {
+		return fmt.Errorf("volume ended after %d bytes, expected %d", sw.offset, sw.size)
+	}
+	if err := writeExtentHeader(sw.w, sw.size, 0); err != nil {
+		return fmt.Errorf("failed to write sparse stream terminator: %w", err)
+	}
+	return nil
+}
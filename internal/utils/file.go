@@ -19,6 +19,8 @@ import (
 	"fmt"
 	"os"
 	"strings"
+
+	"golang.org/x/sys/unix"
 )
 
 func promptOverwrite(fileName string) bool {
@@ -56,3 +58,37 @@ func GetOutputFileHandle(name string, force bool) (*os.File, error) {
 	}
 	return file, nil
 }
+
+// Returns the number of bytes available to unprivileged users on the
+// filesystem containing path.
+func GetFreeSpace(path string) (uint64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return 0, fmt.Errorf("failed to get free space of %s: %w", path, err)
+	}
+	return uint64(stat.Bsize) * stat.Bavail, nil
+}
+
+// Swaps two existing paths on the same filesystem, atomically where the
+// filesystem supports it and otherwise using three renames. Swapping them
+// again undoes the swap.
+func SwapPaths(a string, b string) error {
+	if err := ExchangePaths(a, b); err == nil {
+		return nil
+	}
+
+	aside := a + ".swap"
+	if err := os.Rename(b, aside); err != nil {
+		return fmt.Errorf("failed to move '%s' aside: %w", b, err)
+	}
+	if err := os.Rename(a, b); err != nil {
+		if restoreErr := os.Rename(aside, b); restoreErr != nil {
+			return fmt.Errorf("failed to move '%s' back from '%s': %v", b, aside, restoreErr)
+		}
+		return fmt.Errorf("failed to move '%s' to '%s': %w", a, b, err)
+	}
+	if err := os.Rename(aside, a); err != nil {
+		return fmt.Errorf("failed to move '%s' to '%s': %w", aside, a, err)
+	}
+	return nil
+}
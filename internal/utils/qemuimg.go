@@ -0,0 +1,53 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"fmt"
+
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumeformat"
+)
+
+// Returns the qemu-img driver name of an image format.
+func QEMUImgDriver(format volumeformat.VolumeFormat) (string, error) {
+	switch format {
+	case volumeformat.Raw, volumeformat.SparseRaw:
+		return "raw", nil
+	case volumeformat.QCOW2:
+		return "qcow2", nil
+	case volumeformat.VMDK:
+		return "vmdk", nil
+	case volumeformat.VHD:
+		return "vpc", nil
+	case volumeformat.VHDX:
+		return "vhdx", nil
+	default:
+		return "", fmt.Errorf("volume format %s is not a disk image format", format)
+	}
+}
+
+// Returns the qemu-img creation options used when writing an image format,
+// chosen for exchanging images with other hypervisors.
+func QEMUImgCreateOptions(format volumeformat.VolumeFormat) []string {
+	switch format {
+	case volumeformat.VMDK:
+		return []string{"-o", "subformat=streamOptimized"}
+	case volumeformat.VHD:
+		return []string{"-o", "subformat=dynamic"}
+	default:
+		return nil
+	}
+}
@@ -17,18 +17,19 @@ package utils
 
 import "github.com/PextraCloud/pxitool/pkg/pxi/chunks/conf"
 
-// Extracts volume paths from the configuration, excluding specified IDs.
-func GetVolumePathsFromConfig(config *conf.InstanceConfigGeneric, excluded []string) []string {
+// Extracts volumes from the configuration, excluding specified IDs.
+// The returned pointers refer to the entries in config.Volumes.
+func GetVolumesFromConfig(config *conf.InstanceConfigGeneric, excluded []string) []*conf.InstanceVolume {
 	excludedSet := make(map[string]struct{}, len(excluded))
 	for _, id := range excluded {
 		excludedSet[id] = struct{}{}
 	}
 
-	var paths []string
-	for _, v := range config.Volumes {
-		if _, found := excludedSet[v.ID]; !found {
-			paths = append(paths, v.Path)
+	var volumes []*conf.InstanceVolume
+	for i := range config.Volumes {
+		if _, found := excludedSet[config.Volumes[i].ID]; !found {
+			volumes = append(volumes, &config.Volumes[i])
 		}
 	}
-	return paths
+	return volumes
 }
@@ -0,0 +1,44 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Zeroes a range of a block device with the BLKZEROOUT ioctl, which lets
+// thin-provisioned devices deallocate it instead of writing zeroes.
+func ZeroBlockDeviceRange(file *os.File, offset, length int64) error {
+	zeroRange := [2]uint64{uint64(offset), uint64(length)}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, file.Fd(), unix.BLKZEROOUT, uintptr(unsafe.Pointer(&zeroRange)))
+	if errno != 0 {
+		return fmt.Errorf("failed to zero range of block device %s: %w", file.Name(), errno)
+	}
+	return nil
+}
+
+// Deallocates a range of a regular file, which then reads as zeroes.
+func PunchHole(file *os.File, offset, length int64) error {
+	err := unix.Fallocate(int(file.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, offset, length)
+	if err != nil {
+		return fmt.Errorf("failed to punch hole in %s: %w", file.Name(), err)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+//go:build !linux
+
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"errors"
+	"os"
+)
+
+// Zeroes a range of a block device. Only supported on Linux.
+func ZeroBlockDeviceRange(file *os.File, offset, length int64) error {
+	return errors.ErrUnsupported
+}
+
+// Deallocates a range of a regular file. Only ranges past the end of the
+// file, which already read as zeroes, are supported on this platform.
+func PunchHole(file *os.File, offset, length int64) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if offset >= info.Size() {
+		return nil
+	}
+	return errors.ErrUnsupported
+}
@@ -108,9 +108,18 @@ func ParseChunk(r io.Reader) (*Chunk, error) {
 	if _, err := io.ReadFull(r, chunkData); err != nil {
 		return nil, err
 	}
-	if err := binary.Read(r, binary.BigEndian, &crc); err != nil {
+	var crcBytes [4]byte
+	if _, err := io.ReadFull(r, crcBytes[:]); err != nil {
 		return nil, err
 	}
+	crc = binary.BigEndian.Uint32(crcBytes[:])
+	if chunkType == ChunkTypeSVOL {
+		// The CRC of an SVOL chunk, set by CRC32 in svol.New, is written
+		// after the SVOL header and before the volume data, and is not
+		// counted in its length. The bytes read here for the CRC are the
+		// last bytes of the volume data.
+		chunkData = append(chunkData, crcBytes[:]...)
+	}
 
 	c := &Chunk{
 		ChunkType: chunkType,
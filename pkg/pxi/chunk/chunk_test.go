@@ -0,0 +1,106 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package chunk
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/PextraCloud/pxitool/pkg/pxi/signature"
+)
+
+func TestParseChunk(t *testing.T) {
+	c := &Chunk{ChunkType: ChunkTypeCONF, Data: []byte(`{"name":"vm"}`)}
+	c.Length = uint64(len(c.Data))
+	c.CRC32()
+	encoded := c.Bytes()
+
+	parsed, err := ParseChunk(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("ParseChunk failed: %v", err)
+	}
+	if parsed.ChunkType != c.ChunkType || parsed.Length != c.Length || !bytes.Equal(parsed.Data, c.Data) || parsed.CRC != c.CRC {
+		t.Errorf("Expected %+v, got %+v", c, parsed)
+	}
+
+	corrupted := bytes.Clone(encoded)
+	corrupted[len(corrupted)-1] ^= 0xff
+	if _, err := ParseChunk(bytes.NewReader(corrupted)); err == nil {
+		t.Error("Expected a CRC mismatch for a corrupted CRC, got nil")
+	}
+	corrupted = bytes.Clone(encoded)
+	corrupted[12] ^= 0xff
+	if _, err := ParseChunk(bytes.NewReader(corrupted)); err == nil {
+		t.Error("Expected a CRC mismatch for corrupted data, got nil")
+	}
+}
+
+func TestParseChunk_SVOL(t *testing.T) {
+	// An SVOL chunk is written as its header, its CRC, then the volume
+	// data, with a length that counts the header and data
+	header := []byte{0, 0, 5, 'v', 'o', 'l', '-', '1', 0, 0, 0, 0}
+	volumeData := []byte("volume data ending in abcd")
+	c := &Chunk{ChunkType: ChunkTypeSVOL, Length: uint64(len(header) + len(volumeData)), Data: header}
+	c.CRC32()
+	encoded := append(c.Bytes(), volumeData...)
+
+	parsed, err := ParseChunk(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("ParseChunk failed: %v", err)
+	}
+	expected := append(append(bytes.Clone(header), 0, 0, 0, 0), volumeData...)
+	if !bytes.Equal(parsed.Data, expected) {
+		t.Errorf("Expected the header, CRC and all of the volume data, got %q", parsed.Data)
+	}
+}
+
+func TestParseChunk_BaselineImage(t *testing.T) {
+	// Written by pxitool before SVOL chunks were parsed whole, from a 64-byte
+	// volume that ends in "abcd"
+	file, err := os.Open("testdata/baseline.pxi")
+	if err != nil {
+		t.Fatalf("Failed to open image: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.Seek(int64(signature.PXISignatureLength), io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	var svolChunk *Chunk
+	for {
+		c, err := ParseChunk(file)
+		if err != nil {
+			t.Fatalf("ParseChunk failed: %v", err)
+		}
+		if c.ChunkType == ChunkTypeSVOL {
+			svolChunk = c
+		}
+		if c.ChunkType == ChunkTypeIEND {
+			break
+		}
+	}
+	if svolChunk == nil {
+		t.Fatal("Expected an SVOL chunk in the image")
+	}
+	if uint64(len(svolChunk.Data)) != svolChunk.Length+4 {
+		t.Errorf("Expected %d bytes of SVOL data with the CRC, got %d", svolChunk.Length+4, len(svolChunk.Data))
+	}
+	if !bytes.HasSuffix(svolChunk.Data, []byte("abcd")) {
+		t.Errorf("Expected the volume data to end in %q, got %q", "abcd", svolChunk.Data[max(0, len(svolChunk.Data)-4):])
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"fmt"
 
 	"github.com/PextraCloud/pxitool/pkg/pxi/constants/instancetype"
+	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumeformat"
 	"github.com/PextraCloud/pxitool/pkg/pxi/constants/volumetype"
 )
 
@@ -60,12 +61,28 @@ type InstanceMetadata struct {
 	Qemu   *InstanceMetadataQemu   `json:"qemu,omitempty"`
 }
 
+// A backing image of a qcow2 volume, stored in its own SVOL chunk
+type BackingImage struct {
+	ID     string `json:"id"`     // Volume ID of the SVOL chunk
+	File   string `json:"file"`   // Original file name
+	Format string `json:"format"` // Image format, as reported by qemu-img
+}
+
 type InstanceVolume struct {
 	ID            string                `json:"id"`
 	Type          volumetype.VolumeType `json:"type"`
 	StoragePoolID string                `json:"storage_pool_id"`
 	Path          string                `json:"path"`
 	Size          uint64                `json:"size,omitempty"` // Optional size in bytes
+	// Set by pxitool when the volume was captured from a retained snapshot
+	Snapshot string `json:"snapshot,omitempty"`
+	// Set by pxitool when the volume only holds changes since this snapshot
+	ParentSnapshot string `json:"parent_snapshot,omitempty"`
+	// Set by pxitool when the backing chain was kept, ordered from the
+	// volume's own backing image down to the base image
+	BackingChain []BackingImage `json:"backing_chain,omitempty"`
+	// Set by pxitool when restoring a disk image, to the format it was restored in
+	Format *volumeformat.VolumeFormat `json:"format,omitempty"`
 }
 
 type InstanceConfig struct {
@@ -85,6 +102,9 @@ type InstanceConfig struct {
 	Autostart bool             `json:"autostart,omitempty"`
 	BootOrder int8             `json:"boot_order,omitempty"`
 	Creation  string           `json:"creation,omitempty"`
+	// Set by pxitool to when the snapshots of all volumes were taken
+	// together, in RFC 3339 format
+	SnapshotTime string `json:"snapshot_time,omitempty"`
 }
 type InstanceConfigGeneric struct {
 	InstanceConfig `json:",inline"`
@@ -32,6 +32,7 @@ type Data struct {
 	VolumeID       string
 	Reserved       [4]byte // Reserved for future use, must be zeroed
 	VolumeData     *bufio.Reader
+	DataLength     uint64 // Length of VolumeData in bytes
 }
 
 type SVOL struct {
@@ -92,7 +93,10 @@ func GetDataStruct(data []byte) (*Data, error) {
 	}
 
 	// 1 byte volume type, 1 byte volume format, 1 byte volume ID length, volumeIdLen bytes for volume ID, 4 reserved bytes, 4 bytes CRC32 (zeroed in this case)
-	offset := 1 + 1 + 1 + volumeIdLen + 4 + 4
+	offset := 1 + 1 + 1 + int(volumeIdLen) + 4 + 4
+	if len(data) < offset {
+		return nil, fmt.Errorf("data too short for SVOL chunk: %d bytes", len(data))
+	}
 	return &Data{
 		VolumeType:     volumetype.VolumeType(volumeType),
 		VolumeFormat:   volumeformat.VolumeFormat(volumeFormat),
@@ -100,6 +104,7 @@ func GetDataStruct(data []byte) (*Data, error) {
 		VolumeID:       volumeId,
 		Reserved:       reserved,
 		VolumeData:     bufio.NewReader(bytes.NewReader(data[offset:])),
+		DataLength:     uint64(len(data) - offset),
 	}, nil
 }
 
@@ -23,6 +23,11 @@ const (
 	Raw VolumeFormat = iota
 	QCOW2
 	VMDK
+	RBDDiff     // Ceph "rbd export-diff" stream
+	BtrfsStream // "btrfs send" stream
+	SparseRaw   // Raw data with zeroed ranges left out
+	VHD         // Microsoft Virtual Hard Disk
+	VHDX        // Microsoft Hyper-V Virtual Hard Disk v2
 )
 
 func (v VolumeFormat) String() string {
@@ -33,6 +38,16 @@ func (v VolumeFormat) String() string {
 		return "qcow2"
 	case VMDK:
 		return "vmdk"
+	case RBDDiff:
+		return "rbd diff"
+	case BtrfsStream:
+		return "btrfs stream"
+	case SparseRaw:
+		return "sparse raw"
+	case VHD:
+		return "vhd"
+	case VHDX:
+		return "vhdx"
 	default:
 		panic(fmt.Sprintf("unknown volume format: %d", v))
 	}
@@ -50,6 +65,16 @@ func (v *VolumeFormat) UnmarshalText(text []byte) error {
 		*v = QCOW2
 	case "vmdk":
 		*v = VMDK
+	case "rbd diff":
+		*v = RBDDiff
+	case "btrfs stream":
+		*v = BtrfsStream
+	case "sparse raw":
+		*v = SparseRaw
+	case "vhd":
+		*v = VHD
+	case "vhdx":
+		*v = VHDX
 	default:
 		return fmt.Errorf("unknown volume format: %q", s)
 	}
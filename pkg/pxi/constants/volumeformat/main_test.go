@@ -27,6 +27,11 @@ func TestVolumeFormat_String(t *testing.T) {
 		{Raw, "raw"},
 		{QCOW2, "qcow2"},
 		{VMDK, "vmdk"},
+		{RBDDiff, "rbd diff"},
+		{BtrfsStream, "btrfs stream"},
+		{SparseRaw, "sparse raw"},
+		{VHD, "vhd"},
+		{VHDX, "vhdx"},
 	}
 
 	for _, tc := range testCases {
@@ -52,6 +57,11 @@ func TestVolumeFormat_MarshalText(t *testing.T) {
 		{Raw, "raw"},
 		{QCOW2, "qcow2"},
 		{VMDK, "vmdk"},
+		{RBDDiff, "rbd diff"},
+		{BtrfsStream, "btrfs stream"},
+		{SparseRaw, "sparse raw"},
+		{VHD, "vhd"},
+		{VHDX, "vhdx"},
 	}
 
 	for _, tc := range testCases {
@@ -73,6 +83,11 @@ func TestVolumeFormat_UnmarshalText(t *testing.T) {
 		{"raw", Raw},
 		{"qcow2", QCOW2},
 		{"vmdk", VMDK},
+		{"rbd diff", RBDDiff},
+		{"btrfs stream", BtrfsStream},
+		{"sparse raw", SparseRaw},
+		{"vhd", VHD},
+		{"vhdx", VHDX},
 	}
 
 	for _, tc := range testCases {
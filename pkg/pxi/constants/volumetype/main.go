@@ -27,6 +27,8 @@ const (
 	RBD
 	ZFS
 	LXC_
+	Btrfs
+	Block
 )
 
 func (v VolumeType) String() string {
@@ -45,6 +47,10 @@ func (v VolumeType) String() string {
 		return "zfs"
 	case LXC_:
 		return "lxc rootfs"
+	case Btrfs:
+		return "btrfs"
+	case Block:
+		return "block"
 	default:
 		panic(fmt.Sprintf("unknown volume type: %d", v))
 	}
@@ -70,6 +76,10 @@ func (v *VolumeType) UnmarshalText(text []byte) error {
 		*v = ZFS
 	case "lxc rootfs":
 		*v = LXC_
+	case "btrfs":
+		*v = Btrfs
+	case "block":
+		*v = Block
 	default:
 		return fmt.Errorf("unknown volume type: %q", s)
 	}
@@ -31,6 +31,8 @@ func TestVolumeType_String(t *testing.T) {
 		{RBD, "rbd"},
 		{ZFS, "zfs"},
 		{LXC_, "lxc rootfs"},
+		{Btrfs, "btrfs"},
+		{Block, "block"},
 	}
 
 	for _, tc := range testCases {
@@ -60,6 +62,8 @@ func TestVolumeType_MarshalText(t *testing.T) {
 		{RBD, "rbd"},
 		{ZFS, "zfs"},
 		{LXC_, "lxc rootfs"},
+		{Btrfs, "btrfs"},
+		{Block, "block"},
 	}
 
 	for _, tc := range testCases {
@@ -86,6 +90,8 @@ func TestVolumeType_UnmarshalText(t *testing.T) {
 		{"rbd", RBD},
 		{"zfs", ZFS},
 		{"lxc rootfs", LXC_},
+		{"btrfs", Btrfs},
+		{"block", Block},
 	}
 
 	for _, tc := range testCases {